@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// increment posts to a counter endpoint of key and prints the new value
+func increment(key, endpoint, by string, ttl int64) {
+	query := url.Values{}
+	query.Set("by", by)
+	if ttl > 0 {
+		query.Set("ttl", strconv.FormatInt(ttl, 10))
+	}
+
+	resp, err := http.Post(keyURL(key)+"/"+endpoint+"?"+query.Encode(), "text/plain", nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+		os.Exit(1)
+	}
+	fmt.Println(string(body))
+}
+
+// counterCommands returns the commands incrementing and decrementing
+// counters
+func counterCommands() []*cobra.Command {
+	var (
+		by      string
+		isFloat bool
+		ttl     int64
+	)
+	incrCmd := &cobra.Command{
+		Use:   "incr <key>",
+		Short: "Atomically add to the number stored under a key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			endpoint := "incr"
+			if isFloat {
+				endpoint = "incrbyfloat"
+			}
+			increment(args[0], endpoint, by, ttl)
+		},
+	}
+	incrCmd.Flags().StringVar(&by, "by", "1", "amount to add")
+	incrCmd.Flags().BoolVar(&isFloat, "float", false, "treat the value as a floating point number")
+	incrCmd.Flags().Int64Var(&ttl, "ttl", 0, "time-to-live in seconds if the key is created")
+
+	decrCmd := &cobra.Command{
+		Use:   "decr <key>",
+		Short: "Atomically subtract from the integer stored under a key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			increment(args[0], "decr", by, ttl)
+		},
+	}
+	decrCmd.Flags().StringVar(&by, "by", "1", "amount to subtract")
+	decrCmd.Flags().Int64Var(&ttl, "ttl", 0, "time-to-live in seconds if the key is created")
+
+	return []*cobra.Command{incrCmd, decrCmd}
+}
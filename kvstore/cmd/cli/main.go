@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,9 +18,68 @@ import (
 
 var (
 	serverAddr string
+	namespace  string
 	ttl        int
 )
 
+// keyspaceURL returns the URL the key-value endpoints of the selected
+// namespace are under
+func keyspaceURL() string {
+	if namespace == "" {
+		return serverAddr + "/v1"
+	}
+	return fmt.Sprintf("%s/v1/ns/%s", serverAddr, url.PathEscape(namespace))
+}
+
+// keyURL returns the URL of a key, escaping every byte that is not safe in
+// a single path segment so keys may contain slashes or binary data
+func keyURL(key string) string {
+	return fmt.Sprintf("%s/kv/%s", keyspaceURL(), url.PathEscape(key))
+}
+
+// batchOp is an operation of a batch request
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// batchResult is the outcome of one operation of a batch
+type batchResult struct {
+	Key   string `json:"key"`
+	Found bool   `json:"found"`
+	Value []byte `json:"value"`
+	Error string `json:"error"`
+}
+
+// postBatch sends a batch of operations and returns their results
+func postBatch(ops []batchOp) ([]batchResult, error) {
+	b, err := json.Marshal(map[string]interface{}{"ops": ops})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/batch", keyspaceURL()), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s (HTTP %d)", string(body), resp.StatusCode)
+	}
+
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+	return response.Results, nil
+}
+
 func main() {
 	// Create root command
 	rootCmd := &cobra.Command{
@@ -30,22 +91,40 @@ the KVStore distributed key-value store.`,
 
 	// Add global flags
 	rootCmd.PersistentFlags().StringVar(&serverAddr, "server", "http://localhost:8080", "server address")
+	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "", "namespace to operate on (default namespace if empty)")
 
 	// Get command
+	var revision uint64
+	var showMetadata bool
+	var byteRange string
 	getCmd := &cobra.Command{
 		Use:   "get <key>",
 		Short: "Get a value by key",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			key := args[0]
-			resp, err := http.Get(fmt.Sprintf("%s/v1/kv/%s", serverAddr, key))
+			u := keyURL(key)
+			if revision > 0 {
+				u = fmt.Sprintf("%s?revision=%d", u, revision)
+			}
+
+			req, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				fmt.Printf("Error creating request: %v\n", err)
+				os.Exit(1)
+			}
+			if byteRange != "" {
+				req.Header.Set("Range", "bytes="+byteRange)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
 			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 				body, _ := io.ReadAll(resp.Body)
 				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
 				os.Exit(1)
@@ -57,11 +136,36 @@ the KVStore distributed key-value store.`,
 				os.Exit(1)
 			}
 
+			if showMetadata {
+				fmt.Printf("Content-Type: %s\n", resp.Header.Get("Content-Type"))
+				for _, name := range []string{"X-Revision", "X-Created", "Last-Modified", "Content-Range"} {
+					if v := resp.Header.Get(name); v != "" {
+						fmt.Printf("%s: %s\n", name, v)
+					}
+				}
+				var names []string
+				for name := range resp.Header {
+					if strings.HasPrefix(name, "X-Kv-Meta-") {
+						names = append(names, name)
+					}
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					fmt.Printf("%s: %s\n", strings.ToLower(strings.TrimPrefix(name, "X-Kv-Meta-")), resp.Header.Get(name))
+				}
+				fmt.Println()
+			}
 			fmt.Println(string(body))
 		},
 	}
 
+	getCmd.Flags().Uint64Var(&revision, "revision", 0, "read the value the key had at this revision")
+	getCmd.Flags().BoolVar(&showMetadata, "metadata", false, "print the content type, timestamps and user metadata before the value")
+	getCmd.Flags().StringVar(&byteRange, "range", "", "read only the bytes first-last of the value, as in 0-99, 100- or -10")
+
 	// Set command
+	var contentType string
+	var meta map[string]string
 	setCmd := &cobra.Command{
 		Use:   "set <key> <value>",
 		Short: "Set a key-value pair",
@@ -70,16 +174,22 @@ the KVStore distributed key-value store.`,
 			key := args[0]
 			value := args[1]
 
-			url := fmt.Sprintf("%s/v1/kv/%s", serverAddr, key)
+			u := keyURL(key)
 			if ttl > 0 {
-				url = fmt.Sprintf("%s?ttl=%d", url, ttl)
+				u = fmt.Sprintf("%s?ttl=%d", u, ttl)
 			}
 
-			req, err := http.NewRequest("PUT", url, bytes.NewBufferString(value))
+			req, err := http.NewRequest("PUT", u, bytes.NewBufferString(value))
 			if err != nil {
 				fmt.Printf("Error creating request: %v\n", err)
 				os.Exit(1)
 			}
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			for name, v := range meta {
+				req.Header.Set("X-KV-Meta-"+name, v)
+			}
 
 			resp, err := http.DefaultClient.Do(req)
 			if err != nil {
@@ -98,6 +208,8 @@ the KVStore distributed key-value store.`,
 		},
 	}
 	setCmd.Flags().IntVar(&ttl, "ttl", 0, "time-to-live in seconds (0 means no expiration)")
+	setCmd.Flags().StringVar(&contentType, "content-type", "", "content type of the value")
+	setCmd.Flags().StringToStringVar(&meta, "meta", nil, "user metadata as name=value pairs")
 
 	// Delete command
 	deleteCmd := &cobra.Command{
@@ -107,7 +219,7 @@ the KVStore distributed key-value store.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			key := args[0]
 
-			req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/v1/kv/%s", serverAddr, key), nil)
+			req, err := http.NewRequest("DELETE", keyURL(key), nil)
 			if err != nil {
 				fmt.Printf("Error creating request: %v\n", err)
 				os.Exit(1)
@@ -130,13 +242,306 @@ the KVStore distributed key-value store.`,
 		},
 	}
 
+	// Mset command
+	msetCmd := &cobra.Command{
+		Use:   "mset <key> <value> [<key> <value>...]",
+		Short: "Set several key-value pairs in one request",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 || len(args)%2 != 0 {
+				return fmt.Errorf("requires pairs of keys and values")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var ops []batchOp
+			for i := 0; i < len(args); i += 2 {
+				ops = append(ops, batchOp{Op: "set", Key: args[i], Value: []byte(args[i+1]), TTL: int64(ttl)})
+			}
+
+			results, err := postBatch(ops)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			failed := false
+			for _, res := range results {
+				if res.Error != "" {
+					fmt.Printf("Error setting %s: %s\n", res.Key, res.Error)
+					failed = true
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+			fmt.Println("OK")
+		},
+	}
+	msetCmd.Flags().IntVar(&ttl, "ttl", 0, "time-to-live in seconds (0 means no expiration)")
+
+	// Mget command
+	mgetCmd := &cobra.Command{
+		Use:   "mget <key>...",
+		Short: "Get the values of several keys in one request",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ops []batchOp
+			for _, key := range args {
+				ops = append(ops, batchOp{Op: "get", Key: key})
+			}
+
+			results, err := postBatch(ops)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			for _, res := range results {
+				switch {
+				case res.Error != "":
+					fmt.Printf("%s: error: %s\n", res.Key, res.Error)
+				case !res.Found:
+					fmt.Printf("%s: (nil)\n", res.Key)
+				default:
+					fmt.Printf("%s: %s\n", res.Key, string(res.Value))
+				}
+			}
+		},
+	}
+
 	// Keys command
+	var prefix, match, delimiter string
+	var limit int
 	keysCmd := &cobra.Command{
 		Use:   "keys",
-		Short: "List all keys",
+		Short: "List keys",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			resp, err := http.Get(fmt.Sprintf("%s/v1/kv", serverAddr))
+			query := url.Values{}
+			query.Set("prefix", prefix)
+			query.Set("match", match)
+			query.Set("delimiter", delimiter)
+
+			printed := 0
+			for {
+				if limit > 0 {
+					query.Set("limit", strconv.Itoa(limit-printed))
+				}
+
+				resp, err := http.Get(fmt.Sprintf("%s/kv?%s", keyspaceURL(), query.Encode()))
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+					os.Exit(1)
+				}
+
+				var result struct {
+					Keys           []string `json:"keys"`
+					CommonPrefixes []string `json:"common_prefixes"`
+					NextCursor     string   `json:"next_cursor"`
+					Truncated      bool     `json:"truncated"`
+				}
+				err = json.NewDecoder(resp.Body).Decode(&result)
+				resp.Body.Close()
+				if err != nil {
+					fmt.Printf("Error parsing response: %v\n", err)
+					os.Exit(1)
+				}
+
+				// Common prefixes are listed the way directories are
+				for _, p := range result.CommonPrefixes {
+					fmt.Println(p)
+				}
+				for _, key := range result.Keys {
+					fmt.Println(key)
+				}
+				printed += len(result.CommonPrefixes) + len(result.Keys)
+
+				if !result.Truncated || (limit > 0 && printed >= limit) {
+					break
+				}
+				query.Set("cursor", result.NextCursor)
+			}
+
+			if printed == 0 {
+				fmt.Println("No keys found")
+			}
+		},
+	}
+	keysCmd.Flags().StringVar(&prefix, "prefix", "", "only list keys starting with this prefix")
+	keysCmd.Flags().StringVar(&match, "match", "", "only list keys matching this glob pattern")
+	keysCmd.Flags().StringVar(&delimiter, "delimiter", "", "group keys sharing a prefix up to this delimiter")
+	keysCmd.Flags().IntVar(&limit, "limit", 0, "maximum number of entries to list (0 lists all)")
+
+	// History command
+	historyCmd := &cobra.Command{
+		Use:   "history <key>",
+		Short: "Show the retained versions of a key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := http.Get(keyURL(args[0]) + "/history")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
+			}
+
+			var history struct {
+				Versions []struct {
+					Revision uint64 `json:"revision"`
+					Value    []byte `json:"value"`
+					Deleted  bool   `json:"deleted"`
+					Time     int64  `json:"time"`
+				} `json:"versions"`
+				Trimmed bool `json:"trimmed"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+				fmt.Printf("Error parsing response: %v\n", err)
+				os.Exit(1)
+			}
+
+			if history.Trimmed {
+				fmt.Println("(older versions discarded)")
+			}
+			for _, v := range history.Versions {
+				written := "-"
+				if v.Time > 0 {
+					written = time.Unix(0, v.Time).UTC().Format(time.RFC3339)
+				}
+				if v.Deleted {
+					fmt.Printf("%d\t%s\t(deleted)\n", v.Revision, written)
+				} else {
+					fmt.Printf("%d\t%s\t%s\n", v.Revision, written, string(v.Value))
+				}
+			}
+		},
+	}
+
+	// Compact command
+	compactCmd := &cobra.Command{
+		Use:   "compact <revision>",
+		Short: "Discard the versions replaced before a revision",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rev, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Printf("Error: invalid revision %q\n", args[0])
+				os.Exit(1)
+			}
+
+			body, _ := json.Marshal(map[string]uint64{"revision": rev})
+			resp, err := http.Post(fmt.Sprintf("%s/v1/compact", serverAddr), "application/json", bytes.NewReader(body))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
+			}
+
+			fmt.Println("OK")
+		},
+	}
+
+	// Scrub command
+	var lastReport bool
+	scrubCmd := &cobra.Command{
+		Use:   "scrub",
+		Short: "Verify stored records and repair corrupt ones from peers",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var resp *http.Response
+			var err error
+			if lastReport {
+				resp, err = http.Get(fmt.Sprintf("%s/v1/admin/scrub", serverAddr))
+			} else {
+				resp, err = http.Post(fmt.Sprintf("%s/v1/admin/scrub", serverAddr), "application/json", nil)
+			}
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
+			}
+
+			var report struct {
+				Started  time.Time     `json:"started"`
+				Duration time.Duration `json:"duration"`
+				Checked  int           `json:"checked"`
+				Issues   []struct {
+					Key         string `json:"key"`
+					Location    string `json:"location"`
+					Error       string `json:"error"`
+					Repaired    bool   `json:"repaired"`
+					RepairError string `json:"repair_error"`
+				} `json:"issues"`
+				Repaired int    `json:"repaired"`
+				Error    string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				fmt.Printf("Error parsing response: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Started: %s\n", report.Started.UTC().Format(time.RFC3339))
+			fmt.Printf("Duration: %s\n", report.Duration)
+			fmt.Printf("Checked: %d\n", report.Checked)
+			fmt.Printf("Corrupt: %d\n", len(report.Issues))
+			fmt.Printf("Repaired: %d\n", report.Repaired)
+			for _, issue := range report.Issues {
+				status := "repaired"
+				if !issue.Repaired {
+					status = "not repaired"
+					if issue.RepairError != "" {
+						status += ": " + issue.RepairError
+					}
+				}
+				fmt.Printf("%q\t%s\t%s (%s)\n", issue.Key, issue.Location, issue.Error, status)
+			}
+			if report.Error != "" {
+				fmt.Printf("Error: %s\n", report.Error)
+				os.Exit(1)
+			}
+			if report.Repaired < len(report.Issues) {
+				os.Exit(2)
+			}
+		},
+	}
+	scrubCmd.Flags().BoolVar(&lastReport, "last", false, "show the report of the last scrub instead of running one")
+
+	// Namespace commands
+	nsCmd := &cobra.Command{
+		Use:   "ns",
+		Short: "Manage namespaces",
+	}
+
+	nsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List namespaces",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := http.Get(fmt.Sprintf("%s/v1/ns", serverAddr))
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
@@ -150,23 +555,153 @@ the KVStore distributed key-value store.`,
 			}
 
 			var result struct {
-				Keys []string `json:"keys"`
+				Namespaces []struct {
+					Name       string `json:"name"`
+					DefaultTTL int64  `json:"default_ttl"`
+				} `json:"namespaces"`
 			}
 			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 				fmt.Printf("Error parsing response: %v\n", err)
 				os.Exit(1)
 			}
 
-			if len(result.Keys) == 0 {
-				fmt.Println("No keys found")
-				return
+			for _, ns := range result.Namespaces {
+				if ns.DefaultTTL > 0 {
+					fmt.Printf("%s\tdefault TTL %ds\n", ns.Name, ns.DefaultTTL)
+				} else {
+					fmt.Println(ns.Name)
+				}
+			}
+		},
+	}
+
+	nsInfoCmd := &cobra.Command{
+		Use:   "info <name>",
+		Short: "Show the settings and usage of a namespace",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := http.Get(fmt.Sprintf("%s/v1/ns/%s", serverAddr, url.PathEscape(args[0])))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
 			}
 
-			for _, key := range result.Keys {
-				fmt.Println(key)
+			var info struct {
+				Name         string `json:"name"`
+				DefaultTTL   int64  `json:"default_ttl"`
+				MaxKeys      int64  `json:"max_keys"`
+				MaxBytes     int64  `json:"max_bytes"`
+				MaxValueSize int64  `json:"max_value_size"`
+				Usage        struct {
+					Keys  int64 `json:"keys"`
+					Bytes int64 `json:"bytes"`
+				} `json:"usage"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+				fmt.Printf("Error parsing response: %v\n", err)
+				os.Exit(1)
+			}
+
+			// quota formats usage against a limit, 0 meaning none
+			quota := func(used, limit int64) string {
+				if limit == 0 {
+					return fmt.Sprintf("%d (no limit)", used)
+				}
+				return fmt.Sprintf("%d / %d", used, limit)
+			}
+			fmt.Printf("Name: %s\n", info.Name)
+			fmt.Printf("Default TTL: %ds\n", info.DefaultTTL)
+			fmt.Printf("Keys: %s\n", quota(info.Usage.Keys, info.MaxKeys))
+			fmt.Printf("Bytes: %s\n", quota(info.Usage.Bytes, info.MaxBytes))
+			if info.MaxValueSize > 0 {
+				fmt.Printf("Max value size: %d\n", info.MaxValueSize)
+			}
+		},
+	}
+
+	var defaultTTL int
+	var maxKeys, maxBytes, maxValueSize int64
+	nsCreateCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a namespace, or change the settings of an existing one",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, _ := json.Marshal(map[string]int64{
+				"default_ttl":    int64(defaultTTL),
+				"max_keys":       maxKeys,
+				"max_bytes":      maxBytes,
+				"max_value_size": maxValueSize,
+			})
+			req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/ns/%s", serverAddr, url.PathEscape(args[0])), bytes.NewReader(body))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
+			}
+
+			fmt.Println("OK")
+		},
+	}
+	nsCreateCmd.Flags().IntVar(&defaultTTL, "default-ttl", 0, "TTL in seconds of keys written without one (0 means none)")
+	nsCreateCmd.Flags().Int64Var(&maxKeys, "max-keys", 0, "Maximum number of keys (0 means no limit)")
+	nsCreateCmd.Flags().Int64Var(&maxBytes, "max-bytes", 0, "Maximum total size of keys and values in bytes (0 means no limit)")
+	nsCreateCmd.Flags().Int64Var(&maxValueSize, "max-value-size", 0, "Maximum size of a single value in bytes (0 means no limit)")
+
+	nsDropCmd := &cobra.Command{
+		Use:   "drop <name>",
+		Short: "Delete a namespace and all of its keys",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/v1/ns/%s", serverAddr, url.PathEscape(args[0])), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+				os.Exit(1)
+			}
+
+			var result struct {
+				Deleted int `json:"deleted"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				fmt.Printf("Error parsing response: %v\n", err)
+				os.Exit(1)
 			}
+			fmt.Printf("Dropped %s (%d keys deleted)\n", args[0], result.Deleted)
 		},
 	}
+	nsCmd.AddCommand(nsListCmd, nsInfoCmd, nsCreateCmd, nsDropCmd)
 
 	// Status command
 	statusCmd := &cobra.Command{
@@ -204,7 +739,11 @@ the KVStore distributed key-value store.`,
 	}
 
 	// Add commands to root
-	rootCmd.AddCommand(getCmd, setCmd, deleteCmd, keysCmd, statusCmd)
+	rootCmd.AddCommand(getCmd, setCmd, deleteCmd, msetCmd, mgetCmd, keysCmd, historyCmd, compactCmd, scrubCmd, nsCmd, statusCmd)
+	rootCmd.AddCommand(structureCommands()...)
+	rootCmd.AddCommand(counterCommands()...)
+	rootCmd.AddCommand(rangeCommands()...)
+	rootCmd.AddCommand(uploadCommand())
 
 	// Execute
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// writeRange posts data to the append or setrange endpoint of key and
+// prints the new length of the value
+func writeRange(key, endpoint string, query url.Values, data string) {
+	resp, err := http.Post(keyURL(key)+"/"+endpoint+"?"+query.Encode(), "application/octet-stream", strings.NewReader(data))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: %s (HTTP %d)\n", string(body), resp.StatusCode)
+		os.Exit(1)
+	}
+	fmt.Printf("(length %s)\n", string(body))
+}
+
+// rangeCommands returns the commands appending to and overwriting parts of
+// values
+func rangeCommands() []*cobra.Command {
+	var ttl int64
+	appendCmd := &cobra.Command{
+		Use:   "append <key> <value>",
+		Short: "Atomically add to the end of the value of a key",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			query := url.Values{}
+			if ttl > 0 {
+				query.Set("ttl", strconv.FormatInt(ttl, 10))
+			}
+			writeRange(args[0], "append", query, args[1])
+		},
+	}
+	appendCmd.Flags().Int64Var(&ttl, "ttl", 0, "time-to-live in seconds if the key is created")
+
+	setRangeCmd := &cobra.Command{
+		Use:   "setrange <key> <offset> <value>",
+		Short: "Atomically overwrite the value of a key starting at a byte offset",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, err := strconv.ParseUint(args[1], 10, 63); err != nil {
+				fmt.Printf("Error: invalid offset %q\n", args[1])
+				os.Exit(1)
+			}
+			writeRange(args[0], "setrange", url.Values{"offset": {args[1]}}, args[2])
+		},
+	}
+
+	return []*cobra.Command{appendCmd, setRangeCmd}
+}
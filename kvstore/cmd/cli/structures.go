@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// structURL returns the URL of a data structure of the given kind, "list",
+// "hash", "set" or "zset"
+func structURL(kind, key string) string {
+	return fmt.Sprintf("%s/%s/%s", keyspaceURL(), kind, url.PathEscape(key))
+}
+
+// callStruct sends a data structure request with an optional JSON body and
+// decodes the JSON response into out. It exits on failure.
+func callStruct(method, u string, query url.Values, body, out interface{}) {
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		fmt.Printf("Error creating request: %v\n", err)
+		os.Exit(1)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Error: %s (HTTP %d)\n", string(b), resp.StatusCode)
+		os.Exit(1)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		fmt.Printf("Error parsing response: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parsePairs parses name value arguments, exiting if there is an odd
+// number of them
+func parsePairs(args []string) [][2]string {
+	if len(args)%2 != 0 {
+		fmt.Println("Error: arguments must come in pairs")
+		os.Exit(1)
+	}
+	pairs := make([][2]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, [2]string{args[i], args[i+1]})
+	}
+	return pairs
+}
+
+// count is the response of writes that report how many elements changed
+type count struct {
+	Length  int `json:"length"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// structureCommands returns the commands for lists, hashes, sets and
+// sorted sets
+func structureCommands() []*cobra.Command {
+	// List commands
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Manage lists",
+	}
+
+	var left bool
+	listPushCmd := &cobra.Command{
+		Use:   "push <key> <value>...",
+		Short: "Append values to a list, or prepend them with --left",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var result count
+			callStruct("POST", structURL("list", args[0])+"/push", sideQuery(left),
+				map[string][]string{"values": args[1:]}, &result)
+			fmt.Printf("(length %d)\n", result.Length)
+		},
+	}
+	listPushCmd.Flags().BoolVar(&left, "left", false, "push to the head of the list")
+
+	var popCount int
+	listPopCmd := &cobra.Command{
+		Use:   "pop <key>",
+		Short: "Remove and print values from the tail of a list, or its head with --left",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			query := sideQuery(left)
+			query.Set("count", strconv.Itoa(popCount))
+			var result struct {
+				Values []string `json:"values"`
+			}
+			callStruct("POST", structURL("list", args[0])+"/pop", query, nil, &result)
+			for _, v := range result.Values {
+				fmt.Println(v)
+			}
+		},
+	}
+	listPopCmd.Flags().BoolVar(&left, "left", false, "pop from the head of the list")
+	listPopCmd.Flags().IntVar(&popCount, "count", 1, "number of values to pop")
+
+	var start, stop int
+	listRangeCmd := &cobra.Command{
+		Use:   "range <key>",
+		Short: "Print the values of a list between two indexes",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			query := url.Values{}
+			query.Set("start", strconv.Itoa(start))
+			query.Set("stop", strconv.Itoa(stop))
+			var result struct {
+				Values []string `json:"values"`
+			}
+			callStruct("GET", structURL("list", args[0]), query, nil, &result)
+			for _, v := range result.Values {
+				fmt.Println(v)
+			}
+		},
+	}
+	listRangeCmd.Flags().IntVar(&start, "start", 0, "first index, negative counts from the end")
+	listRangeCmd.Flags().IntVar(&stop, "stop", -1, "last index, negative counts from the end")
+	listCmd.AddCommand(listPushCmd, listPopCmd, listRangeCmd)
+
+	// Hash commands
+	hashCmd := &cobra.Command{
+		Use:   "hash",
+		Short: "Manage hashes",
+	}
+
+	hashSetCmd := &cobra.Command{
+		Use:   "set <key> <field> <value> [<field> <value>]...",
+		Short: "Set fields of a hash",
+		Args:  cobra.MinimumNArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			fields := make(map[string]string)
+			for _, pair := range parsePairs(args[1:]) {
+				fields[pair[0]] = pair[1]
+			}
+			var result count
+			callStruct("PUT", structURL("hash", args[0]), nil, map[string]interface{}{"fields": fields}, &result)
+			fmt.Printf("(%d added)\n", result.Added)
+		},
+	}
+
+	hashGetCmd := &cobra.Command{
+		Use:   "get <key> [<field>]...",
+		Short: "Print the fields of a hash, or only the given ones",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var query url.Values
+			if len(args) > 1 {
+				query = url.Values{"field": args[1:]}
+			}
+			var result struct {
+				Fields map[string]string `json:"fields"`
+			}
+			callStruct("GET", structURL("hash", args[0]), query, nil, &result)
+			fields := make([]string, 0, len(result.Fields))
+			for field := range result.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				fmt.Printf("%s\t%s\n", field, result.Fields[field])
+			}
+		},
+	}
+
+	hashDelCmd := &cobra.Command{
+		Use:   "del <key> <field>...",
+		Short: "Delete fields of a hash",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var result count
+			callStruct("DELETE", structURL("hash", args[0]), url.Values{"field": args[1:]}, nil, &result)
+			fmt.Printf("(%d removed)\n", result.Removed)
+		},
+	}
+	hashCmd.AddCommand(hashSetCmd, hashGetCmd, hashDelCmd)
+
+	// Set commands, named sets to keep set for plain values
+	setsCmd := &cobra.Command{
+		Use:   "sets",
+		Short: "Manage sets",
+	}
+
+	setsAddCmd := &cobra.Command{
+		Use:   "add <key> <member>...",
+		Short: "Add members to a set",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var result count
+			callStruct("POST", structURL("set", args[0]), nil, map[string][]string{"members": args[1:]}, &result)
+			fmt.Printf("(%d added)\n", result.Added)
+		},
+	}
+
+	setsRemCmd := &cobra.Command{
+		Use:   "rem <key> <member>...",
+		Short: "Remove members from a set",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var result count
+			callStruct("DELETE", structURL("set", args[0]), url.Values{"member": args[1:]}, nil, &result)
+			fmt.Printf("(%d removed)\n", result.Removed)
+		},
+	}
+
+	var members struct {
+		Members []string `json:"members"`
+	}
+	setsMembersCmd := &cobra.Command{
+		Use:   "members <key>",
+		Short: "Print the members of a set",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			callStruct("GET", structURL("set", args[0]), nil, nil, &members)
+			for _, member := range members.Members {
+				fmt.Println(member)
+			}
+		},
+	}
+
+	setsInterCmd := &cobra.Command{
+		Use:   "inter <key>...",
+		Short: "Print the members common to every set",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			callStruct("GET", keyspaceURL()+"/sets/intersect", url.Values{"key": args}, nil, &members)
+			for _, member := range members.Members {
+				fmt.Println(member)
+			}
+		},
+	}
+	setsCmd.AddCommand(setsAddCmd, setsRemCmd, setsMembersCmd, setsInterCmd)
+
+	// Sorted set commands
+	zsetCmd := &cobra.Command{
+		Use:   "zset",
+		Short: "Manage sorted sets",
+	}
+
+	zsetAddCmd := &cobra.Command{
+		Use:   "add <key> <score> <member> [<score> <member>]...",
+		Short: "Add members to a sorted set, or update their scores",
+		Args:  cobra.MinimumNArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			scores := make(map[string]float64)
+			for _, pair := range parsePairs(args[1:]) {
+				score, err := strconv.ParseFloat(pair[0], 64)
+				if err != nil {
+					fmt.Printf("Error: invalid score %q\n", pair[0])
+					os.Exit(1)
+				}
+				scores[pair[1]] = score
+			}
+			var result count
+			callStruct("POST", structURL("zset", args[0]), nil, map[string]interface{}{"members": scores}, &result)
+			fmt.Printf("(%d added)\n", result.Added)
+		},
+	}
+
+	zsetRemCmd := &cobra.Command{
+		Use:   "rem <key> <member>...",
+		Short: "Remove members from a sorted set",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var result count
+			callStruct("DELETE", structURL("zset", args[0]), url.Values{"member": args[1:]}, nil, &result)
+			fmt.Printf("(%d removed)\n", result.Removed)
+		},
+	}
+
+	var min, max string
+	var zmembers struct {
+		Members []struct {
+			Member string  `json:"member"`
+			Score  float64 `json:"score"`
+			Rank   int     `json:"rank"`
+		} `json:"members"`
+	}
+	zsetRangeCmd := &cobra.Command{
+		Use:   "range <key>",
+		Short: "Print the members of a sorted set with a score between --min and --max",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			query := url.Values{}
+			query.Set("min", min)
+			query.Set("max", max)
+			callStruct("GET", structURL("zset", args[0]), query, nil, &zmembers)
+			for _, m := range zmembers.Members {
+				fmt.Printf("%d\t%g\t%s\n", m.Rank, m.Score, m.Member)
+			}
+		},
+	}
+	zsetRangeCmd.Flags().StringVar(&min, "min", "-inf", "lowest score")
+	zsetRangeCmd.Flags().StringVar(&max, "max", "+inf", "highest score")
+
+	zsetRankCmd := &cobra.Command{
+		Use:   "rank <key> <member>",
+		Short: "Print the rank and score of a member of a sorted set",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			callStruct("GET", structURL("zset", args[0]), url.Values{"member": {args[1]}}, nil, &zmembers)
+			for _, m := range zmembers.Members {
+				fmt.Printf("%d\t%g\n", m.Rank, m.Score)
+			}
+		},
+	}
+	zsetCmd.AddCommand(zsetAddCmd, zsetRemCmd, zsetRangeCmd, zsetRankCmd)
+
+	return []*cobra.Command{listCmd, hashCmd, setsCmd, zsetCmd}
+}
+
+// sideQuery returns the query selecting the head of a list if left is set
+func sideQuery(left bool) url.Values {
+	query := url.Values{}
+	if left {
+		query.Set("side", "left")
+	}
+	return query
+}
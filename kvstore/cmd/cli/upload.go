@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// uploadRequest sends a request to a multipart upload endpoint and decodes
+// the JSON response into out, if it is not nil
+func uploadRequest(method, target, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s (HTTP %d)", bytes.TrimSpace(msg), resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// uploadFile writes the contents of file to key as a multipart upload of
+// parts of partSize bytes. The upload is aborted if a part fails.
+func uploadFile(key string, file io.Reader, partSize int64, contentType string, ttl int64) (int64, error) {
+	query := url.Values{"key": {key}}
+	if ttl > 0 {
+		query.Set("ttl", strconv.FormatInt(ttl, 10))
+	}
+	var upload struct {
+		ID string `json:"upload_id"`
+	}
+	if err := uploadRequest("POST", keyspaceURL()+"/uploads?"+query.Encode(), contentType, nil, &upload); err != nil {
+		return 0, fmt.Errorf("initiate upload: %w", err)
+	}
+	uploadURL := keyspaceURL() + "/uploads/" + url.PathEscape(upload.ID)
+
+	buf := make([]byte, partSize)
+	for part := 1; ; part++ {
+		n, err := io.ReadFull(file, buf)
+		if err == io.EOF && part > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			uploadRequest("DELETE", uploadURL, "", nil, nil)
+			return 0, err
+		}
+		if err := uploadRequest("PUT", fmt.Sprintf("%s/parts/%d", uploadURL, part), "application/octet-stream", bytes.NewReader(buf[:n]), nil); err != nil {
+			uploadRequest("DELETE", uploadURL, "", nil, nil)
+			return 0, fmt.Errorf("upload part %d: %w", part, err)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	var result struct {
+		Size int64 `json:"size"`
+	}
+	if err := uploadRequest("POST", uploadURL+"/complete", "", nil, &result); err != nil {
+		uploadRequest("DELETE", uploadURL, "", nil, nil)
+		return 0, fmt.Errorf("complete upload: %w", err)
+	}
+	return result.Size, nil
+}
+
+// uploadCommand returns the command writing a file as a multipart upload
+func uploadCommand() *cobra.Command {
+	var partSize int64
+	var contentType string
+	var ttl int64
+	uploadCmd := &cobra.Command{
+		Use:   "upload <key> <file>",
+		Short: "Write the contents of a file to a key as a multipart upload",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if partSize <= 0 {
+				fmt.Println("Error: --part-size must be positive")
+				os.Exit(1)
+			}
+			file, err := os.Open(args[1])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer file.Close()
+
+			size, err := uploadFile(args[0], file, partSize, contentType, ttl)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("OK (%d bytes)\n", size)
+		},
+	}
+	uploadCmd.Flags().Int64Var(&partSize, "part-size", 8<<20, "size of each uploaded part in bytes")
+	uploadCmd.Flags().StringVar(&contentType, "content-type", "", "content type of the value")
+	uploadCmd.Flags().Int64Var(&ttl, "ttl", 0, "time-to-live in seconds")
+	return uploadCmd
+}
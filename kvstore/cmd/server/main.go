@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,14 +21,27 @@ import (
 )
 
 var (
-	cfgFile     string
-	nodeID      string
-	httpAddr    string
-	raftAddr    string
-	joinAddr    string
-	dataDir     string
-	bootstrap   bool
-	storageType string
+	cfgFile         string
+	nodeID          string
+	httpAddr        string
+	raftAddr        string
+	joinAddr        string
+	dataDir         string
+	bootstrap       bool
+	storageType     string
+	syncMode        string
+	maxMemory       string
+	evictPolicy     string
+	memoryShards    int
+	historyVersions int
+	historyAge      time.Duration
+	compression     string
+	compressMin     string
+	maxEntrySize    string
+	keyringFile     string
+	scrubInterval   time.Duration
+	scrubPeers      string
+	peerSecret      string
 )
 
 func main() {
@@ -48,7 +63,20 @@ Built with Go, it offers a robust solution for distributed storage with strong c
 	rootCmd.Flags().StringVar(&joinAddr, "join", "", "leader address to join")
 	rootCmd.Flags().StringVar(&dataDir, "data-dir", "./data", "data directory")
 	rootCmd.Flags().BoolVar(&bootstrap, "bootstrap", false, "bootstrap a new cluster")
-	rootCmd.Flags().StringVar(&storageType, "storage", "memory", "storage type (memory or disk)")
+	rootCmd.Flags().StringVar(&storageType, "storage", "memory", "storage type (memory, disk, log or lsm)")
+	rootCmd.Flags().StringVar(&syncMode, "sync-mode", "always", "disk storage durability (always, batched or none)")
+	rootCmd.Flags().StringVar(&maxMemory, "max-memory", "0", "memory storage budget, e.g. 512mb (0 means unlimited)")
+	rootCmd.Flags().IntVar(&memoryShards, "memory-shards", 1, "number of independently locked shards of the memory storage")
+	rootCmd.Flags().StringVar(&keyringFile, "keyring", "", "keyring file to encrypt data at rest with (empty means no encryption)")
+	rootCmd.Flags().StringVar(&compression, "compression", "none", "value compression codec (none, flate or gzip)")
+	rootCmd.Flags().StringVar(&compressMin, "compression-threshold", "1kb", "smallest value that is compressed")
+	rootCmd.Flags().StringVar(&maxEntrySize, "max-entry-size", "16mb", "largest value written in a single request, larger ones need a multipart upload (0 means unlimited)")
+	rootCmd.Flags().IntVar(&historyVersions, "history-versions", 0, "prior versions kept per key, e.g. 10 (0 means no limit, history is off if --history-age is also 0)")
+	rootCmd.Flags().DurationVar(&historyAge, "history-age", 0, "how long a replaced version is kept (0 means no limit)")
+	rootCmd.Flags().DurationVar(&scrubInterval, "scrub-interval", 24*time.Hour, "time between background checks of stored records (0 disables them)")
+	rootCmd.Flags().StringVar(&scrubPeers, "scrub-peers", "", "comma-separated HTTP addresses of peers to repair corrupt records from (requires --peer-secret)")
+	rootCmd.Flags().StringVar(&peerSecret, "peer-secret", "", "secret shared by the nodes of the cluster to read each other's records (empty disables peer reads)")
+	rootCmd.Flags().StringVar(&evictPolicy, "eviction-policy", "noeviction", "eviction policy when the memory budget is reached (noeviction, allkeys-lru, allkeys-lfu or volatile-ttl)")
 
 	// Execute
 	if err := rootCmd.Execute(); err != nil {
@@ -97,6 +125,45 @@ func initConfig() {
 	if viper.GetString("storage") != "" {
 		storageType = viper.GetString("storage")
 	}
+	if viper.GetString("sync-mode") != "" {
+		syncMode = viper.GetString("sync-mode")
+	}
+	if viper.GetString("max-memory") != "" {
+		maxMemory = viper.GetString("max-memory")
+	}
+	if viper.GetString("eviction-policy") != "" {
+		evictPolicy = viper.GetString("eviction-policy")
+	}
+	if viper.GetInt("memory-shards") > 0 {
+		memoryShards = viper.GetInt("memory-shards")
+	}
+	if viper.GetString("keyring") != "" {
+		keyringFile = viper.GetString("keyring")
+	}
+	if viper.GetString("compression") != "" {
+		compression = viper.GetString("compression")
+	}
+	if viper.GetString("compression-threshold") != "" {
+		compressMin = viper.GetString("compression-threshold")
+	}
+	if viper.GetString("max-entry-size") != "" {
+		maxEntrySize = viper.GetString("max-entry-size")
+	}
+	if viper.IsSet("scrub-interval") {
+		scrubInterval = viper.GetDuration("scrub-interval")
+	}
+	if viper.GetString("scrub-peers") != "" {
+		scrubPeers = viper.GetString("scrub-peers")
+	}
+	if viper.GetString("peer-secret") != "" {
+		peerSecret = viper.GetString("peer-secret")
+	}
+	if viper.IsSet("history-versions") {
+		historyVersions = viper.GetInt("history-versions")
+	}
+	if viper.GetDuration("history-age") > 0 {
+		historyAge = viper.GetDuration("history-age")
+	}
 }
 
 func runServer(cmd *cobra.Command, args []string) {
@@ -127,21 +194,207 @@ func runServer(cmd *cobra.Command, args []string) {
 
 	// Create storage
 	var store storage.Storage
-	if storageType == "disk" {
-		store, err = storage.NewDiskStorage(kvDir)
+	switch storageType {
+	case "disk":
+		opts := storage.DefaultDiskStorageOptions()
+		opts.SyncMode, err = storage.ParseSyncMode(syncMode)
+		if err != nil {
+			logger.Fatal("invalid sync mode", zap.Error(err))
+		}
+
+		diskStore, err := storage.NewDiskStorageWithOptions(kvDir, opts)
 		if err != nil {
 			logger.Fatal("failed to create disk storage", zap.Error(err))
 		}
-	} else {
-		store = storage.NewMemoryStorage()
+
+		report := diskStore.RecoveryReport()
+		logger.Info("loaded disk storage",
+			zap.Int("keys", report.Loaded),
+			zap.Int("expired", report.Expired),
+			zap.Int("temp_files_removed", report.TempFilesRemoved))
+		for _, name := range report.Quarantined {
+			logger.Warn("quarantined corrupt file", zap.String("file", name))
+		}
+		store = diskStore
+	case "log":
+		store, err = storage.NewLogStorage(filepath.Join(dataDir, "log"), storage.DefaultLogStorageOptions())
+		if err != nil {
+			logger.Fatal("failed to create log storage", zap.Error(err))
+		}
+	case "lsm":
+		store, err = storage.NewLSMStorage(filepath.Join(dataDir, "lsm"), storage.DefaultLSMStorageOptions())
+		if err != nil {
+			logger.Fatal("failed to create LSM storage", zap.Error(err))
+		}
+	default:
+		opts := storage.MemoryStorageOptions{OnEvict: metricsCollector.AddKeysEvicted}
+		opts.MaxMemory, err = parseByteSize(maxMemory)
+		if err != nil {
+			logger.Fatal("invalid memory limit", zap.Error(err))
+		}
+		opts.EvictionPolicy, err = storage.ParseEvictionPolicy(evictPolicy)
+		if err != nil {
+			logger.Fatal("invalid eviction policy", zap.Error(err))
+		}
+
+		var memStore interface {
+			storage.Storage
+			UsedMemory() int64
+		}
+		if memoryShards > 1 {
+			memStore = storage.NewShardedMemoryStorageWithOptions(memoryShards, opts)
+		} else {
+			memStore = storage.NewMemoryStorageWithOptions(opts)
+		}
+		if opts.MaxMemory > 0 {
+			metricsCollector.RegisterMemoryUsage(memStore.UsedMemory, opts.MaxMemory)
+			logger.Info("memory limit enabled",
+				zap.Int64("max_memory", opts.MaxMemory),
+				zap.String("eviction_policy", opts.EvictionPolicy.String()))
+		}
+		store = memStore
+	}
+
+	backend := store
+
+	// Encrypt values, the Raft log and snapshots at rest. Values of the
+	// memory storage never reach the disk and are left alone.
+	var keyring *storage.Keyring
+	var encrypted *storage.EncryptedStorage
+	if keyringFile != "" {
+		keyring, err = storage.LoadKeyring(keyringFile)
+		if err != nil {
+			logger.Fatal("failed to load keyring", zap.Error(err))
+		}
+		if storageType == "disk" || storageType == "log" || storageType == "lsm" {
+			encrypted = storage.NewEncryptedStorage(store, keyring)
+			store = encrypted
+		}
+		logger.Info("encryption at rest enabled", zap.Uint32("active_key", keyring.ActiveID()))
+	}
+
+	// Compress values above the threshold. The store is wrapped even with
+	// compression off so that values compressed earlier, or by a leader
+	// configured differently, still read back.
+	compressOpts := storage.CompressionOptions{OnCompress: metricsCollector.ObserveCompression}
+	compressOpts.Codec, err = storage.ParseCodec(compression)
+	if err != nil {
+		logger.Fatal("invalid compression codec", zap.Error(err))
+	}
+	threshold, err := parseByteSize(compressMin)
+	if err != nil {
+		logger.Fatal("invalid compression threshold", zap.Error(err))
+	}
+	compressOpts.Threshold = int(threshold)
+	store = storage.NewCompressedStorageWithOptions(store, compressOpts)
+
+	// Values larger than a log entry may carry are written as multipart
+	// uploads
+	entryLimit, err := parseByteSize(maxEntrySize)
+	if err != nil {
+		logger.Fatal("invalid max entry size", zap.Error(err))
+	}
+	if entryLimit == 0 {
+		entryLimit = -1
 	}
 
-	// Create Raft node
-	node, err := raft.NewNode(nodeID, raftDir, raftAddr, store, logger)
+	// Create Raft node. Every node must keep the same history, retention
+	// is part of the replicated state.
+	node, err := raft.NewNodeWithOptions(nodeID, raftDir, raftAddr, store, logger, raft.NodeOptions{
+		History:      raft.HistoryOptions{MaxVersions: historyVersions, MaxAge: historyAge},
+		Compressor:   storage.NewCompressor(compressOpts),
+		Keyring:      keyring,
+		MaxEntrySize: entryLimit,
+	})
 	if err != nil {
 		logger.Fatal("failed to create Raft node", zap.Error(err))
 	}
 
+	// Expose what every namespace holds against its quotas
+	metricsCollector.RegisterNamespaceUsage(func() []metrics.NamespaceUsage {
+		var usages []metrics.NamespaceUsage
+		for name, config := range node.Namespaces() {
+			usage, err := node.NamespaceUsage(name)
+			if err != nil {
+				continue
+			}
+			usages = append(usages, metrics.NamespaceUsage{
+				Name:     name,
+				Keys:     usage.Keys,
+				Bytes:    usage.Bytes,
+				MaxKeys:  config.MaxKeys,
+				MaxBytes: config.MaxBytes,
+			})
+		}
+		return usages
+	})
+
+	// Reclaim expired keys in the background where the backend supports it.
+	// Only the leader looks for expired keys and removes them through Raft.
+	var expirer *storage.Expirer
+	if target, ok := backend.(storage.ActiveExpirer); ok {
+		opts := storage.DefaultExpiryOptions()
+		opts.Enabled = node.IsLeader
+		expirer = storage.NewExpirer(target, opts, func(keys []string) (int, error) {
+			n, err := node.Expire(keys)
+			if err != nil {
+				logger.Warn("failed to expire keys", zap.Int("keys", len(keys)), zap.Error(err))
+			}
+			metricsCollector.AddKeysExpired(n)
+			return n, err
+		})
+		expirer.Start()
+	}
+
+	// Age out versions of keys that are not written again. Only the leader
+	// proposes it, every replica prunes at the replicated time.
+	stopPruning := make(chan struct{})
+	if historyAge > 0 {
+		go func() {
+			ticker := time.NewTicker(historyPruneInterval(historyAge))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopPruning:
+					return
+				case <-ticker.C:
+					if !node.IsLeader() {
+						continue
+					}
+					if err := node.PruneHistory(); err != nil {
+						logger.Warn("failed to prune history", zap.Error(err))
+					}
+				}
+			}
+		}()
+	}
+
+	// Verify stored records against their checksums and repair corrupt
+	// ones from peers. Repairs are written by the state machine, between
+	// applied entries, through the outermost store wrapper so they are
+	// compressed and encrypted like any other write.
+	var scrubber *storage.Scrubber
+	if target, ok := backend.(storage.Verifier); ok {
+		opts := storage.ScrubOptions{
+			Interval: scrubInterval,
+			OnReport: func(report storage.ScrubReport) {
+				metricsCollector.ObserveScrub(report.Checked, len(report.Issues), report.Repaired)
+				logScrubReport(logger, report)
+			},
+		}
+		if scrubPeers != "" {
+			if peerSecret == "" {
+				logger.Fatal("--scrub-peers requires --peer-secret")
+			}
+			client := &http.Client{Timeout: 10 * time.Second}
+			opts.Repair = api.PeerRepair(strings.Split(scrubPeers, ","), peerSecret, node, client)
+		}
+		scrubber = storage.NewScrubber(target, opts)
+		if scrubInterval > 0 {
+			scrubber.Start()
+		}
+	}
+
 	// Bootstrap or join the cluster
 	if bootstrap {
 		logger.Info("bootstrapping cluster", zap.String("node_id", nodeID))
@@ -157,6 +410,12 @@ func runServer(cmd *cobra.Command, args []string) {
 
 	// Create API server
 	server := api.NewServer(node, httpAddr, metricsCollector, logger)
+	if scrubber != nil {
+		server.SetScrubber(scrubber)
+	}
+	if peerSecret != "" {
+		server.EnablePeerRecords(peerSecret)
+	}
 
 	// Start API server in a goroutine
 	go func() {
@@ -171,6 +430,17 @@ func runServer(cmd *cobra.Command, args []string) {
 		zap.String("raft_addr", raftAddr),
 		zap.String("storage", storageType))
 
+	// Reload the keyring on SIGHUP and re-encrypt data under retired keys
+	if keyring != nil {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				rotateKeys(keyring, encrypted, node, logger)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -178,7 +448,103 @@ func runServer(cmd *cobra.Command, args []string) {
 
 	// Gracefully shutdown
 	logger.Info("shutting down server")
+	if expirer != nil {
+		expirer.Stop()
+	}
+	if scrubber != nil {
+		scrubber.Stop()
+	}
+	close(stopPruning)
 	if err := node.Close(); err != nil {
 		logger.Error("failed to close node", zap.Error(err))
 	}
-}
\ No newline at end of file
+}
+
+// historyPruneInterval returns how often versions older than maxAge are
+// pruned, a tenth of the age within a second and a minute
+func historyPruneInterval(maxAge time.Duration) time.Duration {
+	interval := maxAge / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+// rotateKeys rereads the keyring and re-encrypts the store and the Raft log
+// with its active key
+func rotateKeys(keyring *storage.Keyring, encrypted *storage.EncryptedStorage, node *raft.Node, logger *zap.Logger) {
+	if err := keyring.Reload(); err != nil {
+		logger.Error("failed to reload keyring", zap.Error(err))
+		return
+	}
+	logger.Info("reloaded keyring", zap.Uint32("active_key", keyring.ActiveID()))
+
+	if encrypted != nil {
+		n, err := encrypted.Reencrypt()
+		if err != nil {
+			logger.Error("failed to re-encrypt values", zap.Int("rewritten", n), zap.Error(err))
+			return
+		}
+		logger.Info("re-encrypted values", zap.Int("rewritten", n))
+	}
+
+	n, err := node.Reencrypt()
+	if err != nil {
+		logger.Error("failed to re-encrypt Raft log", zap.Int("rewritten", n), zap.Error(err))
+		return
+	}
+	logger.Info("re-encrypted Raft log", zap.Int("rewritten", n))
+}
+
+// logScrubReport logs the outcome of a scrub and every corrupt record it found
+func logScrubReport(logger *zap.Logger, report storage.ScrubReport) {
+	for _, issue := range report.Issues {
+		logger.Warn("corrupt record found",
+			zap.String("key", issue.Key),
+			zap.String("location", issue.Location),
+			zap.String("error", issue.Error),
+			zap.Bool("repaired", issue.Repaired),
+			zap.String("repair_error", issue.RepairError))
+	}
+	if report.Error != "" {
+		logger.Error("scrub failed", zap.Int("checked", report.Checked), zap.String("error", report.Error))
+		return
+	}
+	logger.Info("scrub finished",
+		zap.Int("checked", report.Checked),
+		zap.Int("corrupt", len(report.Issues)),
+		zap.Int("repaired", report.Repaired),
+		zap.Duration("duration", report.Duration))
+}
+
+// parseByteSize parses a size such as "512mb", "2GB" or "1048576"
+func parseByteSize(size string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(size))
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"gb", 1 << 30},
+		{"mb", 1 << 20},
+		{"kb", 1 << 10},
+		{"b", 1},
+	}
+
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			factor = u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"go.uber.org/zap"
+)
+
+// maxBatchOps bounds the number of operations in one batch request
+const maxBatchOps = 10000
+
+// batchRequest is the body of POST /v1/batch
+type batchRequest struct {
+	Ops []txnOp `json:"ops"`
+}
+
+// batchResponse is the body returned for a batch
+type batchResponse struct {
+	Results []raft.BatchResult `json:"results"`
+}
+
+// handleBatch handles POST requests applying a batch of gets, sets and
+// deletes. Writes are replicated as a single log entry.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Ops) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("batch exceeds %d operations", maxBatchOps), http.StatusBadRequest)
+		return
+	}
+
+	results, err := s.keyspace(r).Batch(toTxnOps(req.Ops, time.Now()))
+	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		switch {
+		case err == raft.ErrNotLeader:
+			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+		case errors.Is(err, raft.ErrInvalidBatch):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			s.logger.Error("failed to apply batch", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	for _, res := range results {
+		switch res.Op {
+		case "get":
+			if res.Found {
+				s.metrics.IncGetHit()
+			} else if res.Error == "" {
+				s.metrics.IncGetMiss()
+			}
+		case "set":
+			s.metrics.IncSet()
+		case "delete":
+			s.metrics.IncDelete()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batchResponse{Results: results})
+}
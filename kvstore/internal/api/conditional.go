@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+)
+
+// errInvalidETag is returned for a conditional header that does not hold
+// ETags issued by the server
+var errInvalidETag = errors.New("invalid ETag")
+
+// etag returns the entity tag of a value at revision
+func etag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// setRevisionHeaders reports the revision of a value to the client
+func setRevisionHeaders(w http.ResponseWriter, revision uint64) {
+	w.Header().Set("ETag", etag(revision))
+	w.Header().Set("X-Revision", strconv.FormatUint(revision, 10))
+}
+
+// parseETags parses the value of an If-Match or If-None-Match header into
+// either "*" or a list of revisions
+func parseETags(header string) (bool, []uint64, error) {
+	var revisions []uint64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true, nil, nil
+		}
+
+		// Revisions are exact, a weak tag compares the same as a strong one
+		tag = strings.TrimPrefix(tag, "W/")
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			return false, nil, errInvalidETag
+		}
+		revision, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+		if err != nil {
+			return false, nil, errInvalidETag
+		}
+		revisions = append(revisions, revision)
+	}
+	return false, revisions, nil
+}
+
+// preconditionFromRequest builds the precondition of a conditional write
+// from its If-Match and If-None-Match headers, nil if there are none
+func preconditionFromRequest(r *http.Request) (*raft.Precondition, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, nil
+	}
+
+	pre := &raft.Precondition{}
+	if ifMatch != "" {
+		wildcard, revisions, err := parseETags(ifMatch)
+		if err != nil {
+			return nil, err
+		}
+		pre.Exists = wildcard
+		pre.Match = revisions
+	}
+	if ifNoneMatch != "" {
+		wildcard, revisions, err := parseETags(ifNoneMatch)
+		if err != nil {
+			return nil, err
+		}
+		pre.NotExists = wildcard
+		pre.NoneMatch = revisions
+	}
+	return pre, nil
+}
+
+// notModified reports whether a GET with an If-None-Match header matching
+// revision may be answered with 304 Not Modified
+func notModified(r *http.Request, revision uint64) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	wildcard, revisions, err := parseETags(header)
+	if err != nil {
+		return false
+	}
+	if wildcard {
+		return true
+	}
+	for _, rev := range revisions {
+		if rev == revision {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseETags(t *testing.T) {
+	wildcard, revisions, err := parseETags(`"3", W/"5"`)
+	require.NoError(t, err)
+	assert.False(t, wildcard)
+	assert.Equal(t, []uint64{3, 5}, revisions)
+
+	wildcard, _, err = parseETags("*")
+	require.NoError(t, err)
+	assert.True(t, wildcard)
+
+	_, _, err = parseETags("3")
+	assert.Equal(t, errInvalidETag, err)
+	_, _, err = parseETags(`"abc"`)
+	assert.Equal(t, errInvalidETag, err)
+}
+
+func TestPreconditionFromRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/v1/kv/a", nil)
+	pre, err := preconditionFromRequest(r)
+	require.NoError(t, err)
+	assert.Nil(t, pre)
+
+	r.Header.Set("If-Match", `"7"`)
+	pre, err = preconditionFromRequest(r)
+	require.NoError(t, err)
+	assert.Equal(t, &raft.Precondition{Match: []uint64{7}}, pre)
+
+	r = httptest.NewRequest("PUT", "/v1/kv/a", nil)
+	r.Header.Set("If-None-Match", "*")
+	pre, err = preconditionFromRequest(r)
+	require.NoError(t, err)
+	assert.Equal(t, &raft.Precondition{NotExists: true}, pre)
+}
+
+func TestNotModified(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/kv/a", nil)
+	assert.False(t, notModified(r, 4))
+
+	r.Header.Set("If-None-Match", etag(4))
+	assert.True(t, notModified(r, 4))
+	assert.False(t, notModified(r, 5))
+}
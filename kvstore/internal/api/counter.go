@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errInvalidIncrement is returned for an increment that is not a number
+var errInvalidIncrement = errors.New("invalid increment")
+
+// expirationFromRequest returns the expiration given by the ttl query
+// parameter in seconds, 0 if there is none
+func expirationFromRequest(r *http.Request) (int64, error) {
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid TTL")
+	}
+	if ttl <= 0 {
+		return 0, nil
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second).UnixNano(), nil
+}
+
+// handleIncr handles POST requests adding the by query parameter, 1 by
+// default, to the integer stored under a key. The ttl parameter only
+// applies if the key is created.
+func (s *Server) handleIncr(w http.ResponseWriter, r *http.Request) {
+	s.increment(w, r, false)
+}
+
+// handleDecr handles POST requests subtracting the by query parameter, 1
+// by default, from the integer stored under a key
+func (s *Server) handleDecr(w http.ResponseWriter, r *http.Request) {
+	s.increment(w, r, true)
+}
+
+// increment adds the by query parameter to the integer stored under the key
+// of the request, or subtracts it if negate is set
+func (s *Server) increment(w http.ResponseWriter, r *http.Request, negate bool) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	by := int64(1)
+	if v := r.URL.Query().Get("by"); v != "" {
+		if by, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, errInvalidIncrement.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if negate {
+		if by == math.MinInt64 {
+			http.Error(w, errInvalidIncrement.Error(), http.StatusBadRequest)
+			return
+		}
+		by = -by
+	}
+	expiration, err := expirationFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.keyspace(r).Incr(key, by, expiration)
+	if err != nil {
+		s.writeError(w, err, "failed to increment key", key)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(strconv.AppendInt(nil, result, 10))
+}
+
+// handleIncrByFloat handles POST requests adding the by query parameter to
+// the number stored under a key
+func (s *Server) handleIncrByFloat(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	by, err := strconv.ParseFloat(r.URL.Query().Get("by"), 64)
+	if err != nil || math.IsNaN(by) || math.IsInf(by, 0) {
+		http.Error(w, errInvalidIncrement.Error(), http.StatusBadRequest)
+		return
+	}
+	expiration, err := expirationFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.keyspace(r).IncrByFloat(key, by, expiration)
+	if err != nil {
+		s.writeError(w, err, "failed to increment key", key)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(strconv.AppendFloat(nil, result, 'f', -1, 64))
+}
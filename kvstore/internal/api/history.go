@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"go.uber.org/zap"
+)
+
+// errInvalidRevision is returned for a revision that is not a positive number
+var errInvalidRevision = errors.New("invalid revision")
+
+// historyResponse is the body of a key's history
+type historyResponse struct {
+	Key      string         `json:"key"`
+	Versions []raft.Version `json:"versions"`
+	Trimmed  bool           `json:"trimmed"`
+}
+
+// revisionFromRequest returns the revision query parameter, 0 if absent
+func revisionFromRequest(r *http.Request) (uint64, error) {
+	s := r.URL.Query().Get("revision")
+	if s == "" {
+		return 0, nil
+	}
+	revision, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || revision == 0 {
+		return 0, errInvalidRevision
+	}
+	return revision, nil
+}
+
+// handleHistory handles GET requests for the retained versions of a key
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	kh, err := s.keyspace(r).History(key)
+	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		if err == storage.ErrKeyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.logger.Error("failed to get history", zap.String("key", key), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(historyResponse{Key: key, Versions: kh.Versions, Trimmed: kh.Trimmed})
+}
+
+// handleCompact handles POST requests discarding the versions replaced
+// before a revision
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Revision uint64 `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Revision == 0 {
+		http.Error(w, errInvalidRevision.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.node.Compact(request.Revision); err != nil {
+		switch err {
+		case raft.ErrNotLeader:
+			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+		case raft.ErrFutureRevision:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			s.logger.Error("failed to compact history", zap.Uint64("revision", request.Revision), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+const (
+	// defaultListLimit is the page size when the request does not set one
+	defaultListLimit = 1000
+
+	// maxListLimit bounds the page size a request may ask for
+	maxListLimit = 10000
+)
+
+var (
+	// errInvalidCursor is returned for a cursor that was not issued by the server
+	errInvalidCursor = errors.New("invalid cursor")
+
+	// errInvalidLimit is returned for a limit that is not a positive number
+	errInvalidLimit = errors.New("invalid limit")
+
+	// errInvalidMatch is returned for a malformed glob pattern
+	errInvalidMatch = errors.New("invalid match pattern")
+)
+
+// iterateFunc walks keys as storage.Storage.Iterate does
+type iterateFunc func(prefix, startAfter string, fn func(key string, value storage.Value) bool) error
+
+// listOptions are the parameters of a key listing
+type listOptions struct {
+	Prefix    string
+	Delimiter string
+	Match     string
+	Limit     int
+	Values    bool
+	Metadata  bool
+	cursor    listCursor
+}
+
+// listCursor marks where a listing stopped. A cursor after a common prefix
+// skips every key under it.
+type listCursor struct {
+	after    string
+	isPrefix bool
+}
+
+// encode returns the opaque form of the cursor handed to clients
+func (c listCursor) encode() string {
+	kind := "k"
+	if c.isPrefix {
+		kind = "p"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + c.after))
+}
+
+// decodeCursor parses a cursor returned by encode
+func decodeCursor(s string) (listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 || (b[0] != 'k' && b[0] != 'p') {
+		return listCursor{}, errInvalidCursor
+	}
+	return listCursor{after: string(b[1:]), isPrefix: b[0] == 'p'}, nil
+}
+
+// listResponse is the body of a key listing
+type listResponse struct {
+	Keys           []string               `json:"keys"`
+	Values         map[string][]byte      `json:"values,omitempty"`
+	Metadata       map[string]keyMetadata `json:"metadata,omitempty"`
+	CommonPrefixes []string               `json:"common_prefixes,omitempty"`
+	NextCursor     string                 `json:"next_cursor,omitempty"`
+	Truncated      bool                   `json:"truncated"`
+}
+
+// parseListOptions reads listing parameters from a query string
+func parseListOptions(q url.Values) (listOptions, error) {
+	opts := listOptions{
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		Match:     q.Get("match"),
+		Limit:     defaultListLimit,
+	}
+
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return opts, errInvalidLimit
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+		opts.Limit = limit
+	}
+
+	if opts.Match != "" {
+		if _, err := path.Match(opts.Match, ""); err != nil {
+			return opts, errInvalidMatch
+		}
+	}
+
+	if s := q.Get("values"); s != "" {
+		values, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errors.New("invalid values flag")
+		}
+		opts.Values = values
+	}
+
+	if s := q.Get("metadata"); s != "" {
+		metadata, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errors.New("invalid metadata flag")
+		}
+		opts.Metadata = metadata
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.cursor = cursor
+	}
+
+	return opts, nil
+}
+
+// listKeys returns one page of keys in ascending order. Keys containing the
+// delimiter after the prefix are rolled up into a single common prefix,
+// which counts against the limit like a key.
+func listKeys(iterate iterateFunc, opts listOptions) (listResponse, error) {
+	resp := listResponse{Keys: []string{}}
+	if opts.Values {
+		resp.Values = make(map[string][]byte)
+	}
+	if opts.Metadata {
+		resp.Metadata = make(map[string]keyMetadata)
+	}
+
+	count := 0
+	last := opts.cursor
+	err := iterate(opts.Prefix, opts.cursor.after, func(key string, value storage.Value) bool {
+		if last.isPrefix && strings.HasPrefix(key, last.after) {
+			return true
+		}
+		if opts.Match != "" {
+			if ok, _ := path.Match(opts.Match, key); !ok {
+				return true
+			}
+		}
+
+		item := listCursor{after: key}
+		if opts.Delimiter != "" {
+			rest := key[len(opts.Prefix):]
+			if i := strings.Index(rest, opts.Delimiter); i >= 0 {
+				item = listCursor{after: key[:len(opts.Prefix)+i+len(opts.Delimiter)], isPrefix: true}
+			}
+		}
+
+		if count == opts.Limit {
+			// One more entry exists, the page is full
+			resp.Truncated = true
+			resp.NextCursor = last.encode()
+			return false
+		}
+		count++
+		last = item
+
+		if item.isPrefix {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, item.after)
+			return true
+		}
+		resp.Keys = append(resp.Keys, key)
+		if opts.Values {
+			resp.Values[key] = value.Data
+		}
+		if opts.Metadata {
+			resp.Metadata[key] = newKeyMetadata(value)
+		}
+		return true
+	})
+
+	return resp, err
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, keys ...string) storage.Storage {
+	store := storage.NewMemoryStorage()
+	for _, key := range keys {
+		require.NoError(t, store.Set(key, storage.Value{Data: []byte("v-" + key)}))
+	}
+	return store
+}
+
+// listAll follows cursors until the listing is complete
+func listAll(t *testing.T, store storage.Storage, query string) ([]string, []string) {
+	var keys, prefixes []string
+	q, err := url.ParseQuery(query)
+	require.NoError(t, err)
+	for {
+		opts, err := parseListOptions(q)
+		require.NoError(t, err)
+		resp, err := listKeys(store.Iterate, opts)
+		require.NoError(t, err)
+
+		keys = append(keys, resp.Keys...)
+		prefixes = append(prefixes, resp.CommonPrefixes...)
+		if !resp.Truncated {
+			return keys, prefixes
+		}
+		q.Set("cursor", resp.NextCursor)
+	}
+}
+
+func TestListKeysPagination(t *testing.T) {
+	store := testStore(t, "a", "b", "c", "d", "e")
+
+	opts, err := parseListOptions(url.Values{"limit": {"2"}})
+	require.NoError(t, err)
+	resp, err := listKeys(store.Iterate, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, resp.Keys)
+	assert.True(t, resp.Truncated)
+
+	// Keys written behind the cursor do not shift later pages
+	require.NoError(t, store.Set("aa", storage.Value{}))
+	keys, _ := listAll(t, store, "limit=2&cursor="+resp.NextCursor)
+	assert.Equal(t, []string{"c", "d", "e"}, keys)
+
+	// A full last page is not reported as truncated
+	opts.Limit = 6
+	resp, err = listKeys(store.Iterate, opts)
+	require.NoError(t, err)
+	assert.Len(t, resp.Keys, 6)
+	assert.False(t, resp.Truncated)
+	assert.Empty(t, resp.NextCursor)
+}
+
+func TestListKeysPrefixAndMatch(t *testing.T) {
+	store := testStore(t, "user/1/name", "user/1/email", "user/2/name", "users", "order/1")
+
+	keys, _ := listAll(t, store, "prefix=user/&limit=1")
+	assert.Equal(t, []string{"user/1/email", "user/1/name", "user/2/name"}, keys)
+
+	keys, _ = listAll(t, store, "prefix=user/&match=user/*/name")
+	assert.Equal(t, []string{"user/1/name", "user/2/name"}, keys)
+
+	_, err := parseListOptions(url.Values{"match": {"[a-"}})
+	assert.Equal(t, errInvalidMatch, err)
+}
+
+func TestListKeysDelimiter(t *testing.T) {
+	store := testStore(t, "a/1", "a/2", "a/3", "b", "c/x/1", "c/y", "d")
+
+	keys, prefixes := listAll(t, store, "delimiter=/&limit=1")
+	assert.Equal(t, []string{"b", "d"}, keys)
+	assert.Equal(t, []string{"a/", "c/"}, prefixes)
+
+	keys, prefixes = listAll(t, store, "prefix=c/&delimiter=/")
+	assert.Equal(t, []string{"c/y"}, keys)
+	assert.Equal(t, []string{"c/x/"}, prefixes)
+}
+
+func TestListKeysValues(t *testing.T) {
+	store := testStore(t, "a", "b")
+
+	opts, err := parseListOptions(url.Values{"values": {"true"}})
+	require.NoError(t, err)
+	resp, err := listKeys(store.Iterate, opts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"a": []byte("v-a"), "b": []byte("v-b")}, resp.Values)
+}
+
+func TestParseListOptionsErrors(t *testing.T) {
+	_, err := parseListOptions(url.Values{"limit": {"0"}})
+	assert.Equal(t, errInvalidLimit, err)
+	_, err = parseListOptions(url.Values{"cursor": {"!!"}})
+	assert.Equal(t, errInvalidCursor, err)
+}
+
+func TestListKeysMetadata(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	require.NoError(t, store.Set("a", storage.Value{Data: []byte("abc"), Revision: 3, ContentType: "text/plain", Created: 10, Modified: 20}))
+
+	opts, err := parseListOptions(url.Values{"metadata": {"true"}})
+	require.NoError(t, err)
+	resp, err := listKeys(store.Iterate, opts)
+	require.NoError(t, err)
+	assert.Nil(t, resp.Values)
+	assert.Equal(t, map[string]keyMetadata{
+		"a": {Size: 3, Revision: 3, ContentType: "text/plain", Created: 10, Modified: 20},
+	}, resp.Metadata)
+}
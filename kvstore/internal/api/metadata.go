@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+const (
+	// metaHeaderPrefix starts the headers carrying user metadata, in the
+	// canonical form Go gives X-KV-Meta-*
+	metaHeaderPrefix = "X-Kv-Meta-"
+
+	// maxMetadataSize is the most bytes of user metadata names and values
+	// a value may carry
+	maxMetadataSize = 8 << 10
+
+	// defaultContentType is returned for values written without one
+	defaultContentType = "application/octet-stream"
+)
+
+// errMetadataTooLarge is returned for writes with more user metadata than
+// maxMetadataSize
+var errMetadataTooLarge = errors.New("user metadata too large")
+
+// metadataFromRequest sets the content type and user metadata of value from
+// the headers of a write. Metadata names are case-insensitive and stored in
+// lower case, repeated headers are joined with commas.
+func metadataFromRequest(r *http.Request, value *storage.Value) error {
+	value.ContentType = r.Header.Get("Content-Type")
+
+	size := 0
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, metaHeaderPrefix) || len(name) == len(metaHeaderPrefix) {
+			continue
+		}
+		name = strings.ToLower(name[len(metaHeaderPrefix):])
+		v := strings.Join(values, ", ")
+		if size += len(name) + len(v); size > maxMetadataSize {
+			return errMetadataTooLarge
+		}
+		if value.Meta == nil {
+			value.Meta = make(map[string]string)
+		}
+		value.Meta[name] = v
+	}
+	return nil
+}
+
+// setMetadataHeaders reports the content type, timestamps and user metadata
+// of a value to the client
+func setMetadataHeaders(w http.ResponseWriter, value storage.Value) {
+	contentType := value.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if value.Created != 0 {
+		w.Header().Set("X-Created", time.Unix(0, value.Created).UTC().Format(time.RFC3339Nano))
+	}
+	if value.Modified != 0 {
+		w.Header().Set("Last-Modified", time.Unix(0, value.Modified).UTC().Format(http.TimeFormat))
+	}
+	for name, v := range value.Meta {
+		w.Header().Set(metaHeaderPrefix+name, v)
+	}
+}
+
+// keyMetadata describes a value in listings. Times are Unix nanoseconds of
+// the replicated clock, 0 if the value predates them.
+type keyMetadata struct {
+	Type        string            `json:"type,omitempty"`
+	Size        int               `json:"size"`
+	Revision    uint64            `json:"revision,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Created     int64             `json:"created,omitempty"`
+	Modified    int64             `json:"modified,omitempty"`
+	Expiration  int64             `json:"expiration,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// newKeyMetadata describes value. The size of a chunked value is that of
+// its chunks together.
+func newKeyMetadata(value storage.Value) keyMetadata {
+	meta := keyMetadata{
+		Type:        value.Type,
+		Size:        len(value.Data),
+		Revision:    value.Revision,
+		ContentType: value.ContentType,
+		Created:     value.Created,
+		Modified:    value.Modified,
+		Expiration:  value.Expiration,
+		Meta:        value.Meta,
+	}
+	if manifest, err := raft.DecodeManifest(value); err == nil {
+		meta.Size = int(manifest.Size)
+	}
+	return meta
+}
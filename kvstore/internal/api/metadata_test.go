@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/v1/kv/a", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-KV-Meta-Owner", "billing")
+	r.Header.Add("x-kv-meta-tags", "a")
+	r.Header.Add("x-kv-meta-tags", "b")
+
+	var value storage.Value
+	require.NoError(t, metadataFromRequest(r, &value))
+	assert.Equal(t, "application/json", value.ContentType)
+	assert.Equal(t, map[string]string{"owner": "billing", "tags": "a, b"}, value.Meta)
+
+	value.Created = 1e18
+	value.Modified = 1e18 + 5e8
+	w := httptest.NewRecorder()
+	setMetadataHeaders(w, value)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "billing", w.Header().Get("X-KV-Meta-Owner"))
+	assert.Equal(t, "2001-09-09T01:46:40Z", w.Header().Get("X-Created"))
+	assert.Equal(t, "Sun, 09 Sep 2001 01:46:40 GMT", w.Header().Get("Last-Modified"))
+
+	// Values written before metadata existed
+	w = httptest.NewRecorder()
+	setMetadataHeaders(w, storage.Value{Data: []byte("x")})
+	assert.Equal(t, defaultContentType, w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Last-Modified"))
+
+	r = httptest.NewRequest("PUT", "/v1/kv/a", nil)
+	r.Header.Set("X-KV-Meta-Big", strings.Repeat("x", maxMetadataSize))
+	assert.Equal(t, errMetadataTooLarge, metadataFromRequest(r, &storage.Value{}))
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// keyspace is the set of keys a request operates on, the default namespace
+// for /v1/kv and a named one for /v1/ns/{ns}/kv
+type keyspace interface {
+	Get(key string) (storage.Value, error)
+	GetAt(key string, revision uint64) (storage.Value, error)
+	History(key string) (raft.KeyHistory, error)
+	SetIf(key string, value storage.Value, pre *raft.Precondition) (*raft.ApplyResult, error)
+	DeleteIf(key string, pre *raft.Precondition) (*raft.ApplyResult, error)
+	Txn(txn *raft.Txn) (*raft.TxnResult, error)
+	Batch(ops []raft.TxnOp) ([]raft.BatchResult, error)
+	Incr(key string, by int64, expiration int64) (int64, error)
+	IncrByFloat(key string, by float64, expiration int64) (float64, error)
+	Append(key string, value storage.Value) (int64, error)
+	SetRange(key string, offset int64, value storage.Value) (int64, error)
+	Iterate(prefix, startAfter string, fn func(key string, value storage.Value) bool) error
+}
+
+// keyspace returns the namespace named in the request path, or the
+// default namespace if there is none
+func (s *Server) keyspace(r *http.Request) keyspace {
+	if ns, ok := mux.Vars(r)["ns"]; ok {
+		return s.node.Namespace(ns)
+	}
+	return s.node
+}
+
+// valueSizeLimit returns the largest value the namespace named in the
+// request path accepts, 0 if there is no limit
+func (s *Server) valueSizeLimit(r *http.Request) int64 {
+	ns, ok := mux.Vars(r)["ns"]
+	if !ok {
+		return 0
+	}
+	config, err := s.node.NamespaceConfig(ns)
+	if err != nil {
+		return 0
+	}
+	return config.MaxValueSize
+}
+
+// namespaceError writes the response for an error about a namespace and
+// reports whether err was one
+func namespaceError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == raft.ErrNamespaceNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, raft.ErrInvalidNamespace), err == raft.ErrReservedKey:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, raft.ErrValueTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, raft.ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		return false
+	}
+	return true
+}
+
+// namespaceSettings are the settings of a namespace in requests and
+// responses. The default TTL is in seconds, like the ttl query parameter of
+// writes.
+type namespaceSettings struct {
+	DefaultTTL   int64 `json:"default_ttl,omitempty"`
+	MaxKeys      int64 `json:"max_keys,omitempty"`
+	MaxBytes     int64 `json:"max_bytes,omitempty"`
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+}
+
+// namespaceInfo describes a namespace in responses
+type namespaceInfo struct {
+	Name string `json:"name"`
+	namespaceSettings
+	Usage *raft.NamespaceUsage `json:"usage,omitempty"`
+}
+
+// newNamespaceInfo describes namespace name
+func newNamespaceInfo(name string, config raft.NamespaceConfig) namespaceInfo {
+	return namespaceInfo{
+		Name: name,
+		namespaceSettings: namespaceSettings{
+			DefaultTTL:   int64(config.DefaultTTL / time.Second),
+			MaxKeys:      config.MaxKeys,
+			MaxBytes:     config.MaxBytes,
+			MaxValueSize: config.MaxValueSize,
+		},
+	}
+}
+
+// handleListNamespaces handles GET requests listing the namespaces
+func (s *Server) handleListNamespaces(w http.ResponseWriter, r *http.Request) {
+	configs := s.node.Namespaces()
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]namespaceInfo, len(names))
+	for i, name := range names {
+		infos[i] = newNamespaceInfo(name, configs[name])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Namespaces []namespaceInfo `json:"namespaces"`
+	}{infos})
+}
+
+// handleGetNamespace handles GET requests for the settings and usage of a
+// namespace
+func (s *Server) handleGetNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["ns"]
+	config, err := s.node.NamespaceConfig(name)
+	if err != nil {
+		namespaceError(w, err)
+		return
+	}
+	usage, err := s.node.NamespaceUsage(name)
+	if err != nil {
+		namespaceError(w, err)
+		return
+	}
+
+	info := newNamespaceInfo(name, config)
+	info.Usage = &usage
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handlePutNamespace handles PUT requests creating or reconfiguring a
+// namespace
+func (s *Server) handlePutNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["ns"]
+	var request namespaceSettings
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	config := raft.NamespaceConfig{
+		DefaultTTL:   time.Duration(request.DefaultTTL) * time.Second,
+		MaxKeys:      request.MaxKeys,
+		MaxBytes:     request.MaxBytes,
+		MaxValueSize: request.MaxValueSize,
+	}
+	if err := s.node.PutNamespace(name, config); err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		if err == raft.ErrNotLeader {
+			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+			return
+		}
+		s.logger.Error("failed to put namespace", zap.String("namespace", name), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleNamespaceUsage handles GET requests for what a namespace holds
+// against its quotas
+func (s *Server) handleNamespaceUsage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["ns"]
+	config, err := s.node.NamespaceConfig(name)
+	if err != nil {
+		namespaceError(w, err)
+		return
+	}
+	usage, err := s.node.NamespaceUsage(name)
+	if err != nil {
+		namespaceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		raft.NamespaceUsage
+		MaxKeys      int64 `json:"max_keys,omitempty"`
+		MaxBytes     int64 `json:"max_bytes,omitempty"`
+		MaxValueSize int64 `json:"max_value_size,omitempty"`
+	}{usage, config.MaxKeys, config.MaxBytes, config.MaxValueSize})
+}
+
+// handleDropNamespace handles DELETE requests dropping a namespace and all
+// of its keys
+func (s *Server) handleDropNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["ns"]
+	deleted, err := s.node.DropNamespace(name)
+	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		if err == raft.ErrNotLeader {
+			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+			return
+		}
+		s.logger.Error("failed to drop namespace", zap.String("namespace", name), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Deleted int `json:"deleted"`
+	}{deleted})
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// readValue reads the body of a write, no more of it than the namespace
+// accepts or fits a single log entry. It writes the error response and
+// returns false if the body cannot be read or is too large.
+func (s *Server) readValue(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	limit, limitErr := s.valueSizeLimit(r), raft.ErrValueTooLarge
+	if entry := s.node.MaxEntrySize(); entry > 0 && (limit <= 0 || entry < limit) {
+		limit, limitErr = entry, raft.ErrEntryTooLarge
+	}
+	body := io.Reader(r.Body)
+	if limit > 0 {
+		body = io.LimitReader(r.Body, limit+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		http.Error(w, limitErr.Error(), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return data, true
+}
+
+// handleAppend handles POST requests adding the body to the end of the
+// value of a key. A missing key is created with the content type and ttl of
+// the request.
+func (s *Server) handleAppend(w http.ResponseWriter, r *http.Request) {
+	s.writeRange(w, r, func(ks keyspace, key string, value storage.Value) (int64, error) {
+		return ks.Append(key, value)
+	})
+}
+
+// handleSetRange handles POST requests writing the body over the value of a
+// key, starting at the offset query parameter
+func (s *Server) handleSetRange(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, raft.ErrInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeRange(w, r, func(ks keyspace, key string, value storage.Value) (int64, error) {
+		return ks.SetRange(key, offset, value)
+	})
+}
+
+// writeRange reads an append or setrange request, applies it with write
+// and responds with the new length of the value
+func (s *Server) writeRange(w http.ResponseWriter, r *http.Request, write func(ks keyspace, key string, value storage.Value) (int64, error)) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	expiration, err := expirationFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+
+	value := storage.Value{
+		Data:        data,
+		Expiration:  expiration,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	length, err := write(s.keyspace(r), key, value)
+	if err != nil {
+		s.writeError(w, err, "failed to write range", key)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(strconv.AppendInt(nil, length, 10))
+}
+
+// parseRange parses the Range header of a GET of a value of size bytes into
+// the first and last byte to send. ok is false if the whole value should be
+// sent, as for malformed headers and multiple ranges, and satisfiable is
+// false if the range lies past the end of the value.
+func parseRange(header string, size int64) (first, last int64, ok, satisfiable bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false, false
+	}
+	from, to := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	// A suffix range selects the last bytes of the value
+	if from == "" {
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false, false
+	}
+	last = size - 1
+	if to != "" {
+		if last, err = strconv.ParseInt(to, 10, 64); err != nil || last < first {
+			return 0, 0, false, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	if first >= size {
+		return 0, 0, true, false
+	}
+	return first, last, true, true
+}
+
+// writeValueRange answers a GET with a Range header with the requested
+// bytes of data. It returns false if the whole value should be sent
+// instead, because the header asks for it or If-Range names another
+// revision.
+func writeValueRange(w http.ResponseWriter, r *http.Request, data []byte, revision uint64) bool {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return false
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag(revision) {
+		return false
+	}
+
+	size := int64(len(data))
+	first, last, ok, satisfiable := parseRange(header, size)
+	if !ok {
+		return false
+	}
+	if !satisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data[first : last+1])
+	return true
+}
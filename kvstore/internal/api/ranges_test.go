@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header      string
+		first, last int64
+		ok          bool
+		satisfiable bool
+	}{
+		{"bytes=0-4", 0, 4, true, true},
+		{"bytes=6-", 6, 10, true, true},
+		{"bytes=-3", 8, 10, true, true},
+		{"bytes=-50", 0, 10, true, true},
+		{"bytes=5-100", 5, 10, true, true},
+		{"bytes=11-", 0, 0, true, false},
+		{"bytes=-0", 0, 0, true, false},
+		{"bytes=0-1,3-4", 0, 0, false, false},
+		{"bytes=4-2", 0, 0, false, false},
+		{"items=0-1", 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		first, last, ok, satisfiable := parseRange(tt.header, 11)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.satisfiable, satisfiable, tt.header)
+		if satisfiable {
+			assert.Equal(t, tt.first, first, tt.header)
+			assert.Equal(t, tt.last, last, tt.header)
+		}
+	}
+}
+
+func TestWriteValueRange(t *testing.T) {
+	data := []byte("hello world")
+
+	r := httptest.NewRequest("GET", "/v1/kv/a", nil)
+	r.Header.Set("Range", "bytes=6-")
+	w := httptest.NewRecorder()
+	assert.True(t, writeValueRange(w, r, data, 3))
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 6-10/11", w.Header().Get("Content-Range"))
+	assert.Equal(t, "world", w.Body.String())
+
+	r.Header.Set("Range", "bytes=20-")
+	w = httptest.NewRecorder()
+	assert.True(t, writeValueRange(w, r, data, 3))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */11", w.Header().Get("Content-Range"))
+
+	// A range of another revision gets the whole value
+	r.Header.Set("Range", "bytes=0-4")
+	r.Header.Set("If-Range", etag(2))
+	assert.False(t, writeValueRange(httptest.NewRecorder(), r, data, 3))
+	r.Header.Set("If-Range", etag(3))
+	assert.True(t, writeValueRange(httptest.NewRecorder(), r, data, 3))
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"go.uber.org/zap"
+)
+
+// codeStatus maps the error codes of applied commands to HTTP statuses.
+// Codes missing here are answered with 500.
+var codeStatus = map[raft.ErrorCode]int{
+	raft.CodeNotFound:           http.StatusNotFound,
+	raft.CodeNamespaceNotFound:  http.StatusNotFound,
+	raft.CodePreconditionFailed: http.StatusPreconditionFailed,
+	raft.CodeInvalidArgument:    http.StatusBadRequest,
+	raft.CodeWrongType:          http.StatusConflict,
+	raft.CodeNotANumber:         http.StatusConflict,
+	raft.CodeQuotaExceeded:      http.StatusForbidden,
+	raft.CodeValueTooLarge:      http.StatusRequestEntityTooLarge,
+	raft.CodeOutOfMemory:        http.StatusInsufficientStorage,
+}
+
+// writeError writes the response for err, the error of a write to key. The
+// error code is sent in the X-Error-Code header, and errors without a
+// specific status are logged with msg.
+func (s *Server) writeError(w http.ResponseWriter, err error, msg, key string) {
+	if err == raft.ErrNotLeader {
+		http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+		return
+	}
+
+	code := raft.CodeOf(err)
+	w.Header().Set("X-Error-Code", string(code))
+	status, ok := codeStatus[code]
+	if !ok {
+		s.logger.Error(msg, zap.String("key", key), zap.String("code", string(code)), zap.Error(err))
+		status = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// writePrev answers a write made with prev=true with the value it replaced,
+// sent like the response to a GET of it with its revision in
+// X-Prev-Revision. A key that had no value gets an empty body and no
+// X-Prev-Revision.
+func writePrev(w http.ResponseWriter, prev *storage.Value) {
+	if prev == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("X-Prev-Revision", strconv.FormatUint(prev.Revision, 10))
+	setMetadataHeaders(w, *prev)
+	w.Header().Set("Content-Length", strconv.Itoa(len(prev.Data)))
+	w.Write(prev.Data)
+}
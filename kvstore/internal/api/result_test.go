@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWriteError(t *testing.T) {
+	s := &Server{logger: zap.NewNop()}
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{raft.ErrNotLeader, http.StatusTemporaryRedirect},
+		{raft.ErrPreconditionFailed, http.StatusPreconditionFailed},
+		{fmt.Errorf("%w: 10 bytes", raft.ErrValueTooLarge), http.StatusRequestEntityTooLarge},
+		{storage.ErrWrongType, http.StatusConflict},
+		{storage.ErrOutOfMemory, http.StatusInsufficientStorage},
+		{raft.ErrUnknownCommand, http.StatusInternalServerError},
+		{storage.ErrStorageClosed, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.writeError(w, tt.err, "failed", "k")
+		assert.Equal(t, tt.status, w.Code, tt.err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	s.writeError(w, raft.ErrUnknownCommand, "failed", "k")
+	assert.Equal(t, string(raft.CodeUnknownCommand), w.Header().Get("X-Error-Code"))
+}
+
+func TestWritePrev(t *testing.T) {
+	w := httptest.NewRecorder()
+	writePrev(w, &storage.Value{Data: []byte("old"), Revision: 7})
+	assert.Equal(t, "old", w.Body.String())
+	assert.Equal(t, "7", w.Header().Get("X-Prev-Revision"))
+
+	w = httptest.NewRecorder()
+	writePrev(w, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Prev-Revision"))
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"go.uber.org/zap"
+)
+
+// errNoHealthyCopy is returned when no peer could provide a key that is at
+// least as recent as the local state
+var errNoHealthyCopy = errors.New("no peer has a healthy copy")
+
+// peerSecretHeader carries the secret shared by the nodes of a cluster on
+// peer requests
+const peerSecretHeader = "X-Peer-Secret"
+
+// recordResponse is the body of an internal record read. AppliedIndex
+// tells the reader how recent the value is.
+type recordResponse struct {
+	AppliedIndex uint64         `json:"applied_index"`
+	Found        bool           `json:"found"`
+	Value        *storage.Value `json:"value,omitempty"`
+}
+
+// SetScrubber makes scrubber available through the admin endpoints
+func (s *Server) SetScrubber(scrubber *storage.Scrubber) {
+	s.scrubber = scrubber
+}
+
+// EnablePeerRecords serves the raw records of every key to peers that
+// present secret. Records are served decoded and regardless of namespace,
+// so the endpoint is not registered without a secret.
+func (s *Server) EnablePeerRecords(secret string) {
+	s.router.HandleFunc("/v1/internal/record/{key:.+}", func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		s.handleRecord(w, r)
+	}).Methods("GET")
+}
+
+// handleRecord handles GET requests from peers for the local copy of a key,
+// used to repair corrupt records. The applied index is read before the
+// value, so the value is at least as recent as the index reported.
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	response := recordResponse{AppliedIndex: s.node.AppliedIndex()}
+	value, err := s.node.GetRecord(key)
+	switch err {
+	case nil:
+		response.Found = true
+		response.Value = &value
+	case storage.ErrKeyNotFound, storage.ErrKeyExpired:
+	default:
+		s.logger.Error("failed to read record", zap.String("key", key), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleScrub handles POST requests running a scrub and returns its report
+func (s *Server) handleScrub(w http.ResponseWriter, r *http.Request) {
+	if s.scrubber == nil {
+		http.Error(w, "scrubbing is not supported by this storage", http.StatusNotImplemented)
+		return
+	}
+
+	report := s.scrubber.Run()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleScrubReport handles GET requests for the report of the last scrub
+func (s *Server) handleScrubReport(w http.ResponseWriter, r *http.Request) {
+	if s.scrubber == nil {
+		http.Error(w, "scrubbing is not supported by this storage", http.StatusNotImplemented)
+		return
+	}
+
+	report, ok := s.scrubber.LastReport()
+	if !ok {
+		http.Error(w, "no scrub has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// PeerRepair returns a repair function that fetches keys from the HTTP API
+// of peers, in order, and has node rewrite the corrupt record with the
+// first copy that matches its applied state. A key a peer does not have is
+// not deleted locally, the local state still holds it.
+func PeerRepair(peers []string, secret string, node *raft.Node, client *http.Client) storage.RepairFunc {
+	return func(key string) error {
+		var errs []string
+		for _, peer := range peers {
+			response, err := fetchRecord(client, peer, secret, key)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", peer, err))
+				continue
+			}
+			if !response.Found || response.Value == nil {
+				errs = append(errs, fmt.Sprintf("%s: key not found at index %d", peer, response.AppliedIndex))
+				continue
+			}
+			if err := node.RepairRecord(key, *response.Value, response.AppliedIndex); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", peer, err))
+				continue
+			}
+			return nil
+		}
+		if len(errs) == 0 {
+			return errNoHealthyCopy
+		}
+		return fmt.Errorf("%w: %s", errNoHealthyCopy, strings.Join(errs, "; "))
+	}
+}
+
+// fetchRecord reads a peer's copy of key
+func fetchRecord(client *http.Client, peer, secret, key string) (recordResponse, error) {
+	var response recordResponse
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/v1/internal/record/%s", peer, url.PathEscape(key)), nil)
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set(peerSecretHeader, secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
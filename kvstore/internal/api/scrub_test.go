@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestPeerRecordsNeedSecret(t *testing.T) {
+	s := NewServer(nil, "", nil, zap.NewNop())
+	get := func(secret string) int {
+		r := httptest.NewRequest("GET", "/v1/internal/record/%00ns%2Fother%2Fkey", nil)
+		if secret != "" {
+			r.Header.Set(peerSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Records are not served at all without a shared secret
+	assert.Equal(t, http.StatusNotFound, get(""))
+
+	s.EnablePeerRecords("s3cret")
+	assert.Equal(t, http.StatusForbidden, get(""))
+	assert.Equal(t, http.StatusForbidden, get("wrong"))
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -21,6 +22,7 @@ type Server struct {
 	metrics   *metrics.Metrics
 	router    *mux.Router
 	address   string
+	scrubber  *storage.Scrubber
 }
 
 // NewServer creates a new API server
@@ -32,19 +34,60 @@ func NewServer(node *raft.Node, addr string, metrics *metrics.Metrics, logger *z
 		address: addr,
 	}
 	
-	// Create router
-	router := mux.NewRouter()
+	// Create router. Paths are matched in their encoded form and never
+	// cleaned so keys may contain slashes, dot segments or any escaped byte.
+	router := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	
-	// Key-value endpoints
-	router.HandleFunc("/v1/kv/{key}", s.handleGet).Methods("GET")
-	router.HandleFunc("/v1/kv/{key}", s.handleSet).Methods("PUT", "POST")
-	router.HandleFunc("/v1/kv/{key}", s.handleDelete).Methods("DELETE")
+	// Key-value endpoints. The history, counter and range routes come
+	// first, a key that itself ends in "/history" or "/append" is used with
+	// its last slash escaped.
+	router.HandleFunc("/v1/kv/{key:.+}/history", s.handleHistory).Methods("GET")
+	router.HandleFunc("/v1/kv/{key:.+}/incr", s.handleIncr).Methods("POST")
+	router.HandleFunc("/v1/kv/{key:.+}/decr", s.handleDecr).Methods("POST")
+	router.HandleFunc("/v1/kv/{key:.+}/incrbyfloat", s.handleIncrByFloat).Methods("POST")
+	router.HandleFunc("/v1/kv/{key:.+}/append", s.handleAppend).Methods("POST")
+	router.HandleFunc("/v1/kv/{key:.+}/setrange", s.handleSetRange).Methods("POST")
+	router.HandleFunc("/v1/kv/{key:.+}", s.handleGet).Methods("GET", "HEAD")
+	router.HandleFunc("/v1/kv/{key:.+}", s.handleSet).Methods("PUT", "POST")
+	router.HandleFunc("/v1/kv/{key:.+}", s.handleDelete).Methods("DELETE")
 	router.HandleFunc("/v1/kv", s.handleGetAll).Methods("GET")
+	router.HandleFunc("/v1/txn", s.handleTxn).Methods("POST")
+	router.HandleFunc("/v1/batch", s.handleBatch).Methods("POST")
+	router.HandleFunc("/v1/compact", s.handleCompact).Methods("POST")
+	
+	// Namespaces, each with the key-value endpoints above
+	router.HandleFunc("/v1/ns", s.handleListNamespaces).Methods("GET")
+	router.HandleFunc("/v1/ns/{ns}", s.handleGetNamespace).Methods("GET")
+	router.HandleFunc("/v1/ns/{ns}", s.handlePutNamespace).Methods("PUT")
+	router.HandleFunc("/v1/ns/{ns}", s.handleDropNamespace).Methods("DELETE")
+	router.HandleFunc("/v1/ns/{ns}/usage", s.handleNamespaceUsage).Methods("GET")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/history", s.handleHistory).Methods("GET")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/incr", s.handleIncr).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/decr", s.handleDecr).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/incrbyfloat", s.handleIncrByFloat).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/append", s.handleAppend).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}/setrange", s.handleSetRange).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}", s.handleGet).Methods("GET", "HEAD")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}", s.handleSet).Methods("PUT", "POST")
+	router.HandleFunc("/v1/ns/{ns}/kv/{key:.+}", s.handleDelete).Methods("DELETE")
+	router.HandleFunc("/v1/ns/{ns}/kv", s.handleGetAll).Methods("GET")
+	router.HandleFunc("/v1/ns/{ns}/txn", s.handleTxn).Methods("POST")
+	router.HandleFunc("/v1/ns/{ns}/batch", s.handleBatch).Methods("POST")
+	
+	// Data structures, in the default namespace and in named ones
+	s.addStructureRoutes(router, "/v1")
+	s.addStructureRoutes(router, "/v1/ns/{ns}")
+	s.addUploadRoutes(router, "/v1")
+	s.addUploadRoutes(router, "/v1/ns/{ns}")
 	
 	// Raft endpoints
 	router.HandleFunc("/v1/raft/status", s.handleRaftStatus).Methods("GET")
 	router.HandleFunc("/v1/raft/join", s.handleRaftJoin).Methods("POST")
 	
+	// Admin endpoints
+	router.HandleFunc("/v1/admin/scrub", s.handleScrub).Methods("POST")
+	router.HandleFunc("/v1/admin/scrub", s.handleScrubReport).Methods("GET")
+	
 	// Metrics endpoint
 	router.Handle("/metrics", promhttp.Handler())
 	
@@ -61,23 +104,53 @@ func (s *Server) Run() error {
 	return http.ListenAndServe(s.address, s.router)
 }
 
+// keyFromRequest returns the unescaped key from the request path
+func keyFromRequest(r *http.Request) (string, error) {
+	return url.PathUnescape(mux.Vars(r)["key"])
+}
+
 // handleGet handles GET requests for a key
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	
+	revision, err := revisionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
 	start := time.Now()
-	value, err := s.node.Get(key)
+	var value storage.Value
+	if revision > 0 {
+		value, err = s.keyspace(r).GetAt(key, revision)
+	} else {
+		value, err = s.keyspace(r).Get(key)
+	}
 	duration := time.Since(start)
 	
 	s.metrics.ObserveGetLatency(duration.Seconds())
 	
 	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
 		if err == storage.ErrKeyNotFound || err == storage.ErrKeyExpired {
 			s.metrics.IncGetMiss()
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		if err == raft.ErrCompacted {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err == raft.ErrFutureRevision {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		
 		s.logger.Error("failed to get key", zap.String("key", key), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -86,25 +159,62 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	
 	s.metrics.IncGetHit()
 	
-	// Set content type based on data
-	w.Header().Set("Content-Type", "application/octet-stream")
+	// Data structures are read through their own endpoints, chunked values
+	// are streamed from their chunks
+	var chunks *raft.ChunkReader
+	switch value.Type {
+	case "":
+	case storage.TypeChunked:
+		if chunks, err = s.uploads(r).Open(value); err != nil {
+			s.writeError(w, err, "failed to read chunked value", key)
+			return
+		}
+	default:
+		http.Error(w, storage.ErrWrongType.Error(), http.StatusConflict)
+		return
+	}
 	
-	// Write the value
+	setRevisionHeaders(w, value.Revision)
+	setMetadataHeaders(w, value)
+	if notModified(r, value.Revision) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	
+	// Write the value, or the part of it a Range header asks for. HEAD
+	// requests only get the headers.
+	if chunks != nil {
+		http.ServeContent(w, r, "", time.Time{}, chunks)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if writeValueRange(w, r, value.Data, value.Revision) {
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(value.Data)))
 	w.Write(value.Data)
 }
 
 // handleSet handles PUT/POST requests to set a key
 func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
 	
-	// Read the value from the request body
-	data, err := io.ReadAll(r.Body)
+	pre, err := preconditionFromRequest(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	
+	// Read the value from the request body
+	data, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+	
 	// Parse TTL from query string
 	var expiration int64 = 0
 	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
@@ -124,67 +234,88 @@ func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
 		Data:       data,
 		Expiration: expiration,
 	}
+	if err := metadataFromRequest(r, &value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
 	// Set the key
 	start := time.Now()
-	err = s.node.Set(key, value)
+	result, err := s.keyspace(r).SetIf(key, value, pre)
 	duration := time.Since(start)
 	
 	s.metrics.ObserveSetLatency(duration.Seconds())
 	s.metrics.IncSet()
 	
 	if err != nil {
-		if err == raft.ErrNotLeader {
-			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
-			return
-		}
-		
-		s.logger.Error("failed to set key", zap.String("key", key), zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, err, "failed to set key", key)
 		return
 	}
 	
-	// Return success
+	// Return success, with the replaced value if it was asked for
+	setRevisionHeaders(w, result.Revision)
+	if r.URL.Query().Get("prev") == "true" {
+		writePrev(w, result.Prev)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
 // handleDelete handles DELETE requests for a key
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	
+	pre, err := preconditionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
 	start := time.Now()
-	err := s.node.Delete(key)
+	result, err := s.keyspace(r).DeleteIf(key, pre)
 	duration := time.Since(start)
 	
 	s.metrics.ObserveDeleteLatency(duration.Seconds())
 	s.metrics.IncDelete()
 	
 	if err != nil {
-		if err == raft.ErrNotLeader {
-			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
-			return
-		}
-		
-		s.logger.Error("failed to delete key", zap.String("key", key), zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, err, "failed to delete key", key)
 		return
 	}
 	
-	// Return success
+	// Return success, with the deleted value if it was asked for
+	w.Header().Set("X-Revision", strconv.FormatUint(result.Revision, 10))
+	if r.URL.Query().Get("prev") == "true" {
+		writePrev(w, result.Prev)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-// handleGetAll handles GET requests for all keys
+// handleGetAll handles GET requests listing keys. Results are paginated
+// and may be filtered by prefix and glob pattern, grouped by a delimiter
+// and include values.
 func (s *Server) handleGetAll(w http.ResponseWriter, r *http.Request) {
-	keys := s.node.Keys()
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
-	response := struct {
-		Keys []string `json:"keys"`
-	}{
-		Keys: keys,
+	response, err := listKeys(s.keyspace(r).Iterate, opts)
+	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		s.logger.Error("failed to list keys", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	
 	// Return the keys as JSON
@@ -0,0 +1,455 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/gorilla/mux"
+)
+
+// errNoMembers is returned for a removal that names no field or member
+var errNoMembers = errors.New("no field or member given")
+
+// addStructureRoutes registers the data structure endpoints under prefix.
+// The push and pop routes come first, a list key that itself ends in
+// "/push" or "/pop" is used with its last slash escaped.
+func (s *Server) addStructureRoutes(router *mux.Router, prefix string) {
+	router.HandleFunc(prefix+"/list/{key:.+}/push", s.handleListPush).Methods("POST")
+	router.HandleFunc(prefix+"/list/{key:.+}/pop", s.handleListPop).Methods("POST")
+	router.HandleFunc(prefix+"/list/{key:.+}", s.handleListRange).Methods("GET")
+	router.HandleFunc(prefix+"/hash/{key:.+}", s.handleHashGet).Methods("GET")
+	router.HandleFunc(prefix+"/hash/{key:.+}", s.handleHashSet).Methods("PUT", "POST")
+	router.HandleFunc(prefix+"/hash/{key:.+}", s.handleHashDelete).Methods("DELETE")
+	router.HandleFunc(prefix+"/sets/intersect", s.handleSetIntersect).Methods("GET")
+	router.HandleFunc(prefix+"/set/{key:.+}", s.handleSetMembers).Methods("GET")
+	router.HandleFunc(prefix+"/set/{key:.+}", s.handleSetAdd).Methods("PUT", "POST")
+	router.HandleFunc(prefix+"/set/{key:.+}", s.handleSetRemove).Methods("DELETE")
+	router.HandleFunc(prefix+"/zset/{key:.+}", s.handleZSetRange).Methods("GET")
+	router.HandleFunc(prefix+"/zset/{key:.+}", s.handleZSetAdd).Methods("PUT", "POST")
+	router.HandleFunc(prefix+"/zset/{key:.+}", s.handleZSetRemove).Methods("DELETE")
+}
+
+// structures returns the data structures of the namespace named in the
+// request path, or of the default namespace if there is none
+func (s *Server) structures(r *http.Request) *raft.Structures {
+	if ns, ok := mux.Vars(r)["ns"]; ok {
+		return s.node.Namespace(ns).Structures()
+	}
+	return s.node.Structures()
+}
+
+// structError writes the response for an error of a data structure
+// operation on key
+func (s *Server) structError(w http.ResponseWriter, err error, key string) {
+	if err == errNoMembers {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeError(w, err, "failed data structure operation", key)
+}
+
+// structRequest reads the key and JSON body of a data structure write into
+// body. It writes the error response and returns false if either is
+// invalid.
+func structRequest(w http.ResponseWriter, r *http.Request, body interface{}) (string, bool) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return "", false
+	}
+	if body != nil {
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// writeJSON writes v as the JSON body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// intParam returns the integer query parameter name, def if it is absent
+func intParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("invalid " + name)
+	}
+	return n, nil
+}
+
+// leftSide reports whether a push or pop request is for the head of the
+// list, given as side=left. The tail is the default.
+func leftSide(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("side") {
+	case "", "right":
+		return false, nil
+	case "left":
+		return true, nil
+	default:
+		return false, errors.New("invalid side")
+	}
+}
+
+// handleListPush handles POST requests pushing elements to a list
+func (s *Server) handleListPush(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Values []string `json:"values"`
+	}
+	key, ok := structRequest(w, r, &body)
+	if !ok {
+		return
+	}
+	left, err := leftSide(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	length, err := s.structures(r).Push(key, body.Values, left)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Length int `json:"length"`
+	}{length})
+}
+
+// handleListPop handles POST requests popping elements from a list
+func (s *Server) handleListPop(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	left, err := leftSide(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count, err := intParam(r, "count", 1)
+	if err != nil || count <= 0 {
+		http.Error(w, "invalid count", http.StatusBadRequest)
+		return
+	}
+
+	values, err := s.structures(r).Pop(key, count, left)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	if values == nil {
+		values = []string{}
+	}
+	writeJSON(w, struct {
+		Values []string `json:"values"`
+	}{values})
+}
+
+// handleListRange handles GET requests for the elements of a list between
+// the start and stop indexes, inclusive. Negative indexes count from the
+// end and the whole list is returned by default.
+func (s *Server) handleListRange(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	start, err := intParam(r, "start", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stop, err := intParam(r, "stop", -1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := s.structures(r).List(key)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Values []string `json:"values"`
+		Length int      `json:"length"`
+	}{raft.ListRange(list, start, stop), len(list)})
+}
+
+// handleHashGet handles GET requests for the fields of a hash, only those
+// named by field parameters if there are any
+func (s *Server) handleHashGet(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+
+	hash, err := s.structures(r).Hash(key)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	if fields, ok := r.URL.Query()["field"]; ok {
+		selected := make(map[string]string, len(fields))
+		for _, field := range fields {
+			if v, ok := hash[field]; ok {
+				selected[field] = v
+			}
+		}
+		hash = selected
+	}
+	writeJSON(w, struct {
+		Fields map[string]string `json:"fields"`
+	}{hash})
+}
+
+// handleHashSet handles PUT/POST requests setting fields of a hash
+func (s *Server) handleHashSet(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	key, ok := structRequest(w, r, &body)
+	if !ok {
+		return
+	}
+
+	added, err := s.structures(r).HSet(key, body.Fields)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Added int `json:"added"`
+	}{added})
+}
+
+// handleHashDelete handles DELETE requests removing the fields of a hash
+// named by field parameters
+func (s *Server) handleHashDelete(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	fields := r.URL.Query()["field"]
+	if len(fields) == 0 {
+		s.structError(w, errNoMembers, key)
+		return
+	}
+
+	removed, err := s.structures(r).HDel(key, fields)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Removed int `json:"removed"`
+	}{removed})
+}
+
+// handleSetMembers handles GET requests for the members of a set. With
+// member parameters only those that belong to the set are returned.
+func (s *Server) handleSetMembers(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+
+	set, err := s.structures(r).Set(key)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	if members, ok := r.URL.Query()["member"]; ok {
+		set = raft.Intersect(set, members)
+	}
+	writeJSON(w, struct {
+		Members []string `json:"members"`
+	}{set})
+}
+
+// handleSetAdd handles PUT/POST requests adding members to a set
+func (s *Server) handleSetAdd(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Members []string `json:"members"`
+	}
+	key, ok := structRequest(w, r, &body)
+	if !ok {
+		return
+	}
+
+	added, err := s.structures(r).SAdd(key, body.Members)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Added int `json:"added"`
+	}{added})
+}
+
+// handleSetRemove handles DELETE requests removing the members of a set
+// named by member parameters
+func (s *Server) handleSetRemove(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	members := r.URL.Query()["member"]
+	if len(members) == 0 {
+		s.structError(w, errNoMembers, key)
+		return
+	}
+
+	removed, err := s.structures(r).SRem(key, members)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Removed int `json:"removed"`
+	}{removed})
+}
+
+// handleSetIntersect handles GET requests for the members common to the
+// sets named by key parameters
+func (s *Server) handleSetIntersect(w http.ResponseWriter, r *http.Request) {
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		http.Error(w, "no key given", http.StatusBadRequest)
+		return
+	}
+
+	structures := s.structures(r)
+	sets := make([][]string, len(keys))
+	for i, key := range keys {
+		set, err := structures.Set(key)
+		if err != nil {
+			s.structError(w, err, key)
+			return
+		}
+		sets[i] = set
+	}
+	writeJSON(w, struct {
+		Members []string `json:"members"`
+	}{raft.Intersect(sets...)})
+}
+
+// zsetEntry is a member of a sorted set in responses
+type zsetEntry struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	Rank   int     `json:"rank"`
+}
+
+// floatParam returns the float query parameter name, def if it is absent.
+// "-inf" and "+inf" are accepted.
+func floatParam(r *http.Request, name string, def float64) (float64, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.New("invalid " + name)
+	}
+	return f, nil
+}
+
+// handleZSetRange handles GET requests for the members of a sorted set
+// with a score between min and max, inclusive, or for the rank and score
+// of a single member given as member
+func (s *Server) handleZSetRange(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	min, err := floatParam(r, "min", math.Inf(-1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	max, err := floatParam(r, "max", math.Inf(1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zset, err := s.structures(r).ZSet(key)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+
+	entries := []zsetEntry{}
+	if member := r.URL.Query().Get("member"); member != "" {
+		rank, score, ok := raft.ZRank(zset, member)
+		if !ok {
+			http.Error(w, "member not found", http.StatusNotFound)
+			return
+		}
+		entries = append(entries, zsetEntry{Member: member, Score: score, Rank: rank})
+	} else {
+		members, first := raft.ZRangeByScore(zset, min, max)
+		for i, m := range members {
+			entries = append(entries, zsetEntry{Member: m.Member, Score: m.Score, Rank: first + i})
+		}
+	}
+	writeJSON(w, struct {
+		Members []zsetEntry `json:"members"`
+	}{entries})
+}
+
+// handleZSetAdd handles PUT/POST requests adding members to a sorted set,
+// given as an object of members to scores
+func (s *Server) handleZSetAdd(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Members map[string]float64 `json:"members"`
+	}
+	key, ok := structRequest(w, r, &body)
+	if !ok {
+		return
+	}
+
+	added, err := s.structures(r).ZAdd(key, body.Members)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Added int `json:"added"`
+	}{added})
+}
+
+// handleZSetRemove handles DELETE requests removing the members of a
+// sorted set named by member parameters
+func (s *Server) handleZSetRemove(w http.ResponseWriter, r *http.Request) {
+	key, ok := structRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	members := r.URL.Query()["member"]
+	if len(members) == 0 {
+		s.structError(w, errNoMembers, key)
+		return
+	}
+
+	removed, err := s.structures(r).ZRem(key, members)
+	if err != nil {
+		s.structError(w, err, key)
+		return
+	}
+	writeJSON(w, struct {
+		Removed int `json:"removed"`
+	}{removed})
+}
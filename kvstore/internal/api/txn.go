@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"go.uber.org/zap"
+)
+
+// txnOp is an operation in a transaction request. Values are base64
+// encoded in JSON.
+type txnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"` // Seconds until a set value expires
+}
+
+// txnRequest is the body of POST /v1/txn
+type txnRequest struct {
+	Compare []raft.Compare `json:"compare"`
+	Success []txnOp        `json:"success"`
+	Failure []txnOp        `json:"failure"`
+}
+
+// toTxnOps converts requested operations into operations for the state
+// machine, turning TTLs into expirations relative to now
+func toTxnOps(ops []txnOp, now time.Time) []raft.TxnOp {
+	out := make([]raft.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		value := storage.Value{Data: op.Value}
+		if op.TTL > 0 {
+			value.Expiration = now.Add(time.Duration(op.TTL) * time.Second).UnixNano()
+		}
+		out = append(out, raft.TxnOp{Op: op.Op, Key: op.Key, Value: value})
+	}
+	return out
+}
+
+// toTxn converts the request into a transaction for the state machine
+func (req *txnRequest) toTxn(now time.Time) *raft.Txn {
+	return &raft.Txn{
+		Compare: req.Compare,
+		Success: toTxnOps(req.Success, now),
+		Failure: toTxnOps(req.Failure, now),
+	}
+}
+
+// handleTxn handles POST requests applying a transaction
+func (s *Server) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.keyspace(r).Txn(req.toTxn(time.Now()))
+	if err != nil {
+		if namespaceError(w, err) {
+			return
+		}
+		switch {
+		case err == raft.ErrNotLeader:
+			http.Error(w, "not the leader", http.StatusTemporaryRedirect)
+		case errors.Is(err, raft.ErrInvalidTxn):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err == storage.ErrOutOfMemory:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			s.logger.Error("failed to apply transaction", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
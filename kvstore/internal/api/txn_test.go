@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnRequestToTxn(t *testing.T) {
+	body := `{
+		"compare": [{"key": "a", "target": "revision", "result": "=", "revision": 7}],
+		"success": [{"op": "set", "key": "a", "value": "aGk=", "ttl": 10}],
+		"failure": [{"op": "get", "key": "a"}]
+	}`
+	var req txnRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+
+	now := time.Unix(100, 0)
+	txn := req.toTxn(now)
+	require.NoError(t, txn.Validate())
+
+	require.Len(t, txn.Compare, 1)
+	assert.Equal(t, uint64(7), txn.Compare[0].Revision)
+
+	require.Len(t, txn.Success, 1)
+	assert.Equal(t, []byte("hi"), txn.Success[0].Value.Data)
+	assert.Equal(t, now.Add(10*time.Second).UnixNano(), txn.Success[0].Value.Expiration)
+
+	require.Len(t, txn.Failure, 1)
+	assert.Equal(t, "get", txn.Failure[0].Op)
+	assert.Zero(t, txn.Failure[0].Value.Expiration)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/SirCodeKnight/kvstore/internal/raft"
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// addUploadRoutes registers the multipart upload endpoints under prefix
+func (s *Server) addUploadRoutes(router *mux.Router, prefix string) {
+	router.HandleFunc(prefix+"/uploads", s.handleInitiateUpload).Methods("POST")
+	router.HandleFunc(prefix+"/uploads/{id}", s.handleGetUpload).Methods("GET")
+	router.HandleFunc(prefix+"/uploads/{id}", s.handleAbortUpload).Methods("DELETE")
+	router.HandleFunc(prefix+"/uploads/{id}/parts/{part:[0-9]+}", s.handleUploadPart).Methods("PUT")
+	router.HandleFunc(prefix+"/uploads/{id}/complete", s.handleCompleteUpload).Methods("POST")
+}
+
+// uploads returns the multipart uploads of the namespace named in the
+// request path, or of the default namespace if there is none
+func (s *Server) uploads(r *http.Request) *raft.Uploads {
+	if ns, ok := mux.Vars(r)["ns"]; ok {
+		return s.node.Namespace(ns).Uploads()
+	}
+	return s.node.Uploads()
+}
+
+// uploadInfo describes a multipart upload in responses
+type uploadInfo struct {
+	ID      string      `json:"upload_id"`
+	Key     string      `json:"key"`
+	Created int64       `json:"created,omitempty"`
+	Parts   []raft.Part `json:"parts,omitempty"`
+}
+
+// handleInitiateUpload handles POST requests starting a multipart upload of
+// the value of the key query parameter. The content type, user metadata
+// and ttl of the request are those of the completed value.
+func (s *Server) handleInitiateUpload(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	expiration, err := expirationFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value := storage.Value{Expiration: expiration}
+	if err := metadataFromRequest(r, &value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.uploads(r).Initiate(key, value)
+	if err != nil {
+		s.writeError(w, err, "failed to initiate upload", key)
+		return
+	}
+	writeJSON(w, uploadInfo{ID: id, Key: key})
+}
+
+// handleGetUpload handles GET requests describing a multipart upload and
+// the parts uploaded so far
+func (s *Server) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	upload, parts, err := s.uploads(r).Get(id)
+	if err != nil {
+		s.writeError(w, err, "failed to read upload", id)
+		return
+	}
+	writeJSON(w, uploadInfo{ID: id, Key: upload.Key, Created: upload.Created, Parts: parts})
+}
+
+// handleUploadPart handles PUT requests storing a part of a multipart
+// upload. A part is written as a single log entry, so it is limited like
+// any other value.
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	part, err := strconv.Atoi(mux.Vars(r)["part"])
+	if err != nil {
+		http.Error(w, raft.ErrInvalidPart.Error(), http.StatusBadRequest)
+		return
+	}
+	data, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.uploads(r).UploadPart(id, part, data); err != nil {
+		s.writeError(w, err, "failed to upload part", id)
+		return
+	}
+	writeJSON(w, raft.Part{Number: part, Size: int64(len(data))})
+}
+
+// handleCompleteUpload handles POST requests completing a multipart upload.
+// The optional JSON body lists the parts to keep in order, all uploaded
+// parts are kept without it.
+func (s *Server) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var body struct {
+		Parts []int `json:"parts"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := s.uploads(r).Complete(id, body.Parts)
+	if err != nil {
+		s.writeError(w, err, "failed to complete upload", id)
+		return
+	}
+	manifest, _ := result.Data.(raft.Manifest)
+	setRevisionHeaders(w, result.Revision)
+	writeJSON(w, struct {
+		ID    string      `json:"upload_id"`
+		Size  int64       `json:"size"`
+		Parts []raft.Part `json:"parts"`
+	}{id, manifest.Size, manifest.Parts})
+}
+
+// handleAbortUpload handles DELETE requests aborting a multipart upload
+func (s *Server) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.uploads(r).Abort(id); err != nil {
+		s.writeError(w, err, "failed to abort upload", id)
+		return
+	}
+	w.Write([]byte("OK"))
+}
@@ -6,6 +6,8 @@ import (
 
 // Metrics represents the metrics collection for the key-value store
 type Metrics struct {
+	namespace string
+	
 	// Counters
 	gets        prometheus.Counter
 	sets        prometheus.Counter
@@ -13,11 +15,21 @@ type Metrics struct {
 	getHits     prometheus.Counter
 	getMisses   prometheus.Counter
 	raftApplies prometheus.Counter
+	keysExpired prometheus.Counter
+	keysEvicted prometheus.Counter
+	
+	compressedRawBytes    prometheus.Counter
+	compressedStoredBytes prometheus.Counter
+	
+	scrubChecked  prometheus.Counter
+	scrubIssues   prometheus.Counter
+	scrubRepaired prometheus.Counter
 	
 	// Histograms
-	getLatency    prometheus.Histogram
-	setLatency    prometheus.Histogram
-	deleteLatency prometheus.Histogram
+	getLatency       prometheus.Histogram
+	setLatency       prometheus.Histogram
+	deleteLatency    prometheus.Histogram
+	compressionRatio prometheus.Histogram
 	
 	// Gauges
 	clusterSize   prometheus.Gauge
@@ -29,6 +41,8 @@ type Metrics struct {
 // NewMetrics creates a new metrics collection
 func NewMetrics(namespace string) *Metrics {
 	m := &Metrics{
+		namespace: namespace,
+		
 		// Counters
 		gets: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
@@ -66,6 +80,48 @@ func NewMetrics(namespace string) *Metrics {
 			Help:      "Total number of Raft log entries applied",
 		}),
 		
+		keysExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "keys_expired_total",
+			Help:      "Total number of expired keys reclaimed by active expiration",
+		}),
+		
+		keysEvicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "keys_evicted_total",
+			Help:      "Total number of keys evicted to stay within the memory limit",
+		}),
+		
+		compressedRawBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_raw_bytes_total",
+			Help:      "Total bytes of values before compression",
+		}),
+		
+		compressedStoredBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_stored_bytes_total",
+			Help:      "Total bytes of compressed values as stored",
+		}),
+		
+		scrubChecked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrub_records_checked_total",
+			Help:      "Total number of records verified by the scrubber",
+		}),
+		
+		scrubIssues: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrub_issues_total",
+			Help:      "Total number of corrupt records found by the scrubber",
+		}),
+		
+		scrubRepaired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrub_repaired_total",
+			Help:      "Total number of corrupt records repaired from a healthy replica",
+		}),
+		
 		// Histograms
 		getLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -88,6 +144,13 @@ func NewMetrics(namespace string) *Metrics {
 			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
 		}),
 		
+		compressionRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "compression_ratio",
+			Help:      "Stored size of compressed values relative to their raw size",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		
 		// Gauges
 		clusterSize: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -122,9 +185,17 @@ func NewMetrics(namespace string) *Metrics {
 		m.getHits,
 		m.getMisses,
 		m.raftApplies,
+		m.keysExpired,
+		m.keysEvicted,
+		m.compressedRawBytes,
+		m.compressedStoredBytes,
+		m.scrubChecked,
+		m.scrubIssues,
+		m.scrubRepaired,
 		m.getLatency,
 		m.setLatency,
 		m.deleteLatency,
+		m.compressionRatio,
 		m.clusterSize,
 		m.isLeader,
 		m.keysCount,
@@ -164,6 +235,32 @@ func (m *Metrics) IncRaftApply() {
 	m.raftApplies.Inc()
 }
 
+// AddKeysExpired adds to the expired keys counter
+func (m *Metrics) AddKeysExpired(count int) {
+	m.keysExpired.Add(float64(count))
+}
+
+// AddKeysEvicted adds to the evicted keys counter
+func (m *Metrics) AddKeysEvicted(count int) {
+	m.keysEvicted.Add(float64(count))
+}
+
+// ObserveCompression records the raw and stored size of a compressed value
+func (m *Metrics) ObserveCompression(raw, stored int) {
+	m.compressedRawBytes.Add(float64(raw))
+	m.compressedStoredBytes.Add(float64(stored))
+	if raw > 0 {
+		m.compressionRatio.Observe(float64(stored) / float64(raw))
+	}
+}
+
+// ObserveScrub records the outcome of a scrub
+func (m *Metrics) ObserveScrub(checked, issues, repaired int) {
+	m.scrubChecked.Add(float64(checked))
+	m.scrubIssues.Add(float64(issues))
+	m.scrubRepaired.Add(float64(repaired))
+}
+
 // ObserveGetLatency observes a GET latency
 func (m *Metrics) ObserveGetLatency(seconds float64) {
 	m.getLatency.Observe(seconds)
@@ -206,4 +303,80 @@ func (m *Metrics) AddBytesStored(bytes int) {
 // SubBytesStored subtracts from the bytes stored gauge
 func (m *Metrics) SubBytesStored(bytes int) {
 	m.bytesStored.Sub(float64(bytes))
-}
\ No newline at end of file
+}
+
+// RegisterMemoryUsage exposes the memory accounted by a budgeted store and
+// its limit as gauges
+func (m *Metrics) RegisterMemoryUsage(used func() int64, limit int64) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: m.namespace,
+			Name:      "memory_used_bytes",
+			Help:      "Bytes accounted against the memory limit",
+		}, func() float64 { return float64(used()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: m.namespace,
+			Name:      "memory_limit_bytes",
+			Help:      "Configured memory limit in bytes",
+		}, func() float64 { return float64(limit) }),
+	)
+}
+// NamespaceUsage is what a namespace holds and its quotas, 0 meaning no
+// limit
+type NamespaceUsage struct {
+	Name     string
+	Keys     int64
+	Bytes    int64
+	MaxKeys  int64
+	MaxBytes int64
+}
+
+// namespaceCollector reports the usage of every namespace as gauges
+// labelled with its name
+type namespaceCollector struct {
+	usage    func() []NamespaceUsage
+	keys     *prometheus.Desc
+	bytes    *prometheus.Desc
+	maxKeys  *prometheus.Desc
+	maxBytes *prometheus.Desc
+}
+
+// Describe sends the descriptors of the namespace gauges
+func (c *namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.bytes
+	ch <- c.maxKeys
+	ch <- c.maxBytes
+}
+
+// Collect sends the current usage of every namespace. Quota gauges are
+// only sent for namespaces with a limit.
+func (c *namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range c.usage() {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(u.Keys), u.Name)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(u.Bytes), u.Name)
+		if u.MaxKeys > 0 {
+			ch <- prometheus.MustNewConstMetric(c.maxKeys, prometheus.GaugeValue, float64(u.MaxKeys), u.Name)
+		}
+		if u.MaxBytes > 0 {
+			ch <- prometheus.MustNewConstMetric(c.maxBytes, prometheus.GaugeValue, float64(u.MaxBytes), u.Name)
+		}
+	}
+}
+
+// RegisterNamespaceUsage exposes the usage and quotas of the namespaces
+// returned by usage as gauges
+func (m *Metrics) RegisterNamespaceUsage(usage func() []NamespaceUsage) {
+	labels := []string{"namespace"}
+	prometheus.MustRegister(&namespaceCollector{
+		usage: usage,
+		keys: prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "", "namespace_keys"),
+			"Keys held by a namespace", labels, nil),
+		bytes: prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "", "namespace_bytes"),
+			"Bytes of keys and values held by a namespace", labels, nil),
+		maxKeys: prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "", "namespace_max_keys"),
+			"Key quota of a namespace", labels, nil),
+		maxBytes: prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "", "namespace_max_bytes"),
+			"Byte quota of a namespace", labels, nil),
+	})
+}
@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"errors"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// maxRangeOffset is the largest offset setrange writes at, so that a single
+// command cannot grow a value without bound
+const maxRangeOffset = 512 << 20
+
+// ErrInvalidOffset is returned for a setrange offset that is negative or
+// past maxRangeOffset
+var ErrInvalidOffset = errors.New("offset is out of range")
+
+// applyAppend applies an append or setrange command: the data of the
+// command is added to the end of the value of key, or written over it at
+// the command's offset, padding the value with zero bytes if it is
+// shorter. It returns the new length of the value. A new key takes the
+// expiration and content type of the command, an existing one keeps its
+// own.
+func (f *FSM) applyAppend(cmd Command, index uint64) interface{} {
+	if cmd.Op == "setrange" && (cmd.Offset < 0 || cmd.Offset > maxRangeOffset) {
+		return ErrInvalidOffset
+	}
+
+	prior, exists, err := f.lookup(cmd.Key)
+	if err != nil {
+		return err
+	}
+	if exists && prior.Type != "" {
+		return storage.ErrWrongType
+	}
+
+	// Writing no data changes nothing, and does not create a missing key
+	if len(cmd.Value.Data) == 0 {
+		return int64(len(prior.Data))
+	}
+
+	var data []byte
+	if cmd.Op == "append" {
+		data = make([]byte, 0, len(prior.Data)+len(cmd.Value.Data))
+		data = append(append(data, prior.Data...), cmd.Value.Data...)
+	} else {
+		end := int(cmd.Offset) + len(cmd.Value.Data)
+		if end < len(prior.Data) {
+			end = len(prior.Data)
+		}
+		data = make([]byte, end)
+		copy(data, prior.Data)
+		copy(data[cmd.Offset:], cmd.Value.Data)
+	}
+
+	value := storage.Value{
+		Data:        data,
+		Expiration:  cmd.Value.Expiration,
+		ContentType: cmd.Value.ContentType,
+	}
+	if exists {
+		value.Expiration = prior.Expiration
+		value.ContentType = prior.ContentType
+		value.Meta = prior.Meta
+	}
+	f.stamp(&value, index, prior, exists)
+	existed := f.priorExists(cmd.Key)
+	if err := f.store.Set(cmd.Key, value); err != nil {
+		return err
+	}
+	f.history.recordSet(cmd.Key, value, existed, f.now())
+	return int64(len(data))
+}
+
+// appendRange proposes an append or setrange command on a stored key of
+// namespace and returns the new length of its value
+func (n *Node) appendRange(namespace, key, op string, offset int64, value storage.Value) (int64, error) {
+	result, err := n.apply(Command{
+		Op:        op,
+		Namespace: namespace,
+		Key:       key,
+		Value:     value,
+		Offset:    offset,
+	})
+	if err != nil {
+		return 0, err
+	}
+	length, _ := result.Data.(int64)
+	return length, nil
+}
+
+// Append atomically adds the data of value to the end of the value stored
+// under key and returns its new length. A missing key is created with the
+// expiration and content type of value.
+func (n *Node) Append(key string, value storage.Value) (int64, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return 0, err
+	}
+	return n.appendRange("", key, "append", 0, value)
+}
+
+// SetRange atomically overwrites the value stored under key with the data
+// of value, starting at offset, and returns its new length
+func (n *Node) SetRange(key string, offset int64, value storage.Value) (int64, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > maxRangeOffset {
+		return 0, ErrInvalidOffset
+	}
+	return n.appendRange("", key, "setrange", offset, value)
+}
+
+// Append atomically adds the data of value to the end of the value stored
+// under a key of the namespace and returns its new length
+func (ns *Namespace) Append(key string, value storage.Value) (int64, error) {
+	config, err := ns.check(key)
+	if err != nil {
+		return 0, err
+	}
+	return ns.node.appendRange(ns.name, ns.prefix+key, "append", 0, withDefaultTTL(value, config))
+}
+
+// SetRange atomically overwrites the value stored under a key of the
+// namespace with the data of value, starting at offset, and returns its new
+// length
+func (ns *Namespace) SetRange(key string, offset int64, value storage.Value) (int64, error) {
+	config, err := ns.check(key)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > maxRangeOffset {
+		return 0, ErrInvalidOffset
+	}
+	return ns.node.appendRange(ns.name, ns.prefix+key, "setrange", offset, withDefaultTTL(value, config))
+}
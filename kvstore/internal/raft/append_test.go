@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMAppendAndSetRange(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	write := func(op, key string, offset int64, data string) interface{} {
+		return applyCommand(t, f, Command{Op: op, Key: key, Offset: offset, Value: storage.Value{Data: []byte(data), ContentType: "text/plain"}})
+	}
+	read := func(key string) storage.Value {
+		value, err := store.Get(key)
+		require.NoError(t, err)
+		return value
+	}
+
+	// Appending creates a missing key with the content type of the command
+	assert.Equal(t, int64(5), write("append", "log", 0, "hello"))
+	assert.Equal(t, int64(11), write("append", "log", 0, " world"))
+	value := read("log")
+	assert.Equal(t, "hello world", string(value.Data))
+	assert.Equal(t, "text/plain", value.ContentType)
+
+	// Setrange overwrites in place and pads past the end with zero bytes
+	assert.Equal(t, int64(11), write("setrange", "log", 6, "WORLD"))
+	assert.Equal(t, "hello WORLD", string(read("log").Data))
+	assert.Equal(t, int64(5), write("setrange", "pad", 3, "ab"))
+	assert.Equal(t, []byte{0, 0, 0, 'a', 'b'}, read("pad").Data)
+
+	// Writing no data leaves a missing key missing
+	assert.Equal(t, int64(0), write("append", "empty", 0, ""))
+	assert.False(t, store.Has("empty"))
+
+	assert.Equal(t, ErrInvalidOffset, write("setrange", "log", -1, "x"))
+	applyCommand(t, f, Command{Op: "rpush", Key: "list", Args: &StructArgs{Values: []string{"a"}}})
+	assert.Equal(t, storage.ErrWrongType, write("append", "list", 0, "x"))
+}
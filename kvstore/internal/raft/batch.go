@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// ErrInvalidBatch is returned for an empty batch or one with unknown
+// operations
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// BatchResult is the outcome of one operation of a batch
+type BatchResult struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Found    bool   `json:"found,omitempty"`    // Whether a get found the key
+	Value    []byte `json:"value,omitempty"`    // Value read by a get
+	Revision uint64 `json:"revision,omitempty"` // Revision read by a get or written by a set
+	Error    string `json:"error,omitempty"`    // Why the operation failed
+}
+
+// ValidateBatch checks that a batch is not empty and only uses known
+// operations
+func ValidateBatch(ops []TxnOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("%w: no operations", ErrInvalidBatch)
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "get", "set", "delete":
+		default:
+			return fmt.Errorf("%w: unknown operation %q", ErrInvalidBatch, op.Op)
+		}
+		if op.Key == "" {
+			return fmt.Errorf("%w: operation without a key", ErrInvalidBatch)
+		}
+	}
+	return nil
+}
+
+// applyBatch runs the operations of a batch in order at log index index.
+// Unlike a transaction a batch is not atomic: an operation that fails is
+// reported in its result and the others still apply.
+func (f *FSM) applyBatch(ops []TxnOp, index uint64) ([]BatchResult, error) {
+	if err := ValidateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, 0, len(ops))
+	for _, op := range ops {
+		res := BatchResult{Op: op.Op, Key: op.Key}
+		switch op.Op {
+		case "get":
+			value, exists, err := f.lookup(op.Key)
+			if err != nil {
+				res.Error = err.Error()
+				break
+			}
+			res.Found = exists
+			if exists {
+				res.Value = value.Data
+				res.Revision = value.Revision
+			}
+		case "set":
+			prior, exists := f.lookupPrior(op.Key)
+			f.stamp(&op.Value, index, prior, exists)
+			existed := f.priorExists(op.Key)
+			if err := f.store.Set(op.Key, op.Value); err != nil {
+				res.Error = err.Error()
+				break
+			}
+			f.history.recordSet(op.Key, op.Value, existed, f.now())
+			f.releaseChunks(op.Key, prior)
+			res.Revision = index
+		case "delete":
+			prior, _ := f.lookupPrior(op.Key)
+			if err := f.store.Delete(op.Key); err != nil {
+				res.Error = err.Error()
+				break
+			}
+			f.history.recordDelete(op.Key, index, f.now())
+			f.releaseChunks(op.Key, prior)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// getBatch reads every key locally without going through the log
+func getBatch(store storage.Storage, keys []string) []BatchResult {
+	results := make([]BatchResult, 0, len(keys))
+	for _, key := range keys {
+		res := BatchResult{Op: "get", Key: key}
+		value, err := store.Get(key)
+		switch err {
+		case nil:
+			res.Found = true
+			res.Value = value.Data
+			res.Revision = value.Revision
+		case storage.ErrKeyNotFound, storage.ErrKeyExpired:
+		default:
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMBatch(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	applyCommand(t, f, Command{Op: "set", Key: "c", Value: storage.Value{Data: []byte("3")}})
+
+	res := applyCommand(t, f, Command{Op: "batch", Batch: []TxnOp{
+		{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}},
+		{Op: "set", Key: "b", Value: storage.Value{Data: []byte("2")}},
+		{Op: "delete", Key: "c"},
+		{Op: "get", Key: "a"},
+		{Op: "get", Key: "c"},
+	}})
+	results, ok := res.([]BatchResult)
+	require.True(t, ok, "unexpected result %v", res)
+	require.Len(t, results, 5)
+
+	// Every write of the batch has the revision of its log entry
+	assert.Equal(t, logIndex, results[0].Revision)
+	assert.Equal(t, logIndex, results[1].Revision)
+	assert.True(t, results[3].Found)
+	assert.Equal(t, []byte("1"), results[3].Value)
+	assert.False(t, results[4].Found)
+
+	assert.True(t, store.Has("a"))
+	assert.True(t, store.Has("b"))
+	assert.False(t, store.Has("c"))
+}
+
+func TestFSMBatchPartialFailure(t *testing.T) {
+	// A failed write does not undo the other writes of the batch
+	store := storage.NewMemoryStorageWithOptions(storage.MemoryStorageOptions{MaxMemory: 300})
+	f := newFSM(store, zap.NewNop())
+
+	res := applyCommand(t, f, Command{Op: "batch", Batch: []TxnOp{
+		{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}},
+		{Op: "set", Key: "b", Value: storage.Value{Data: make([]byte, 1000)}},
+	}})
+	results := res.([]BatchResult)
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, storage.ErrOutOfMemory.Error(), results[1].Error)
+	assert.True(t, store.Has("a"))
+	assert.False(t, store.Has("b"))
+}
+
+func TestValidateBatch(t *testing.T) {
+	assert.True(t, errors.Is(ValidateBatch(nil), ErrInvalidBatch))
+	assert.True(t, errors.Is(ValidateBatch([]TxnOp{{Op: "incr", Key: "a"}}), ErrInvalidBatch))
+	assert.True(t, errors.Is(ValidateBatch([]TxnOp{{Op: "get"}}), ErrInvalidBatch))
+	assert.NoError(t, ValidateBatch([]TxnOp{{Op: "get", Key: "a"}}))
+}
+
+func TestGetBatch(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Set("a", storage.Value{Data: []byte("1"), Revision: 4})
+
+	results := getBatch(store, []string{"a", "missing"})
+	assert.Equal(t, []BatchResult{
+		{Op: "get", Key: "a", Found: true, Value: []byte("1"), Revision: 4},
+		{Op: "get", Key: "missing"},
+	}, results)
+}
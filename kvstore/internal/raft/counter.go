@@ -0,0 +1,166 @@
+package raft
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+var (
+	// ErrNotInteger is returned when incrementing a value that is not a
+	// decimal integer
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	// ErrNotFloat is returned when incrementing a value that is not a number
+	ErrNotFloat = errors.New("value is not a valid float")
+	// ErrOverflow is returned when an increment would leave the range of
+	// the counter
+	ErrOverflow = errors.New("increment or decrement would overflow")
+)
+
+// Increment is the amount of an incr or incrbyfloat operation
+type Increment struct {
+	By      int64   `json:"by,omitempty"`
+	ByFloat float64 `json:"by_float,omitempty"`
+}
+
+// Counters are plain values holding a decimal number, so they read and
+// write like any other value. A missing key counts as 0.
+
+// applyIncr adds the increment of cmd to the number stored under key and
+// returns the new number, an int64 for incr and a float64 for
+// incrbyfloat. A new key takes the expiration of the command, an existing
+// one keeps its own.
+func (f *FSM) applyIncr(cmd Command, index uint64) interface{} {
+	var inc Increment
+	if cmd.Incr != nil {
+		inc = *cmd.Incr
+	}
+
+	prior, exists, err := f.lookup(cmd.Key)
+	if err != nil {
+		return err
+	}
+	if exists && prior.Type != "" {
+		return storage.ErrWrongType
+	}
+
+	var result interface{}
+	var data []byte
+	if cmd.Op == "incr" {
+		var n int64
+		if exists {
+			if n, err = strconv.ParseInt(string(prior.Data), 10, 64); err != nil {
+				return ErrNotInteger
+			}
+		}
+		if (inc.By > 0 && n > math.MaxInt64-inc.By) || (inc.By < 0 && n < math.MinInt64-inc.By) {
+			return ErrOverflow
+		}
+		n += inc.By
+		result, data = n, strconv.AppendInt(nil, n, 10)
+	} else {
+		var n float64
+		if exists {
+			if n, err = strconv.ParseFloat(string(prior.Data), 64); err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return ErrNotFloat
+			}
+		}
+		n += inc.ByFloat
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return ErrOverflow
+		}
+		result, data = n, strconv.AppendFloat(nil, n, 'f', -1, 64)
+	}
+
+	value := storage.Value{Data: data, Expiration: cmd.Value.Expiration}
+	if exists {
+		value.Expiration = prior.Expiration
+		value.ContentType = prior.ContentType
+		value.Meta = prior.Meta
+	}
+	f.stamp(&value, index, prior, exists)
+	existed := f.priorExists(cmd.Key)
+	if err := f.store.Set(cmd.Key, value); err != nil {
+		return err
+	}
+	f.history.recordSet(cmd.Key, value, existed, f.now())
+	return result
+}
+
+// incr proposes an increment of a stored key in namespace
+func (n *Node) incr(namespace, key, op string, inc Increment, expiration int64) (interface{}, error) {
+	result, err := n.apply(Command{
+		Op:        op,
+		Namespace: namespace,
+		Key:       key,
+		Value:     storage.Value{Expiration: expiration},
+		Incr:      &inc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// Incr atomically adds by to the integer stored under key and returns the
+// result. A missing key starts at 0 and is given expiration, 0 for none.
+func (n *Node) Incr(key string, by int64, expiration int64) (int64, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return 0, err
+	}
+	resp, err := n.incr("", key, "incr", Increment{By: by}, expiration)
+	if err != nil {
+		return 0, err
+	}
+	result, _ := resp.(int64)
+	return result, nil
+}
+
+// IncrByFloat atomically adds by to the number stored under key and
+// returns the result. A missing key starts at 0 and is given expiration, 0
+// for none.
+func (n *Node) IncrByFloat(key string, by float64, expiration int64) (float64, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return 0, err
+	}
+	resp, err := n.incr("", key, "incrbyfloat", Increment{ByFloat: by}, expiration)
+	if err != nil {
+		return 0, err
+	}
+	result, _ := resp.(float64)
+	return result, nil
+}
+
+// Incr atomically adds by to the integer stored under a key of the
+// namespace and returns the result
+func (ns *Namespace) Incr(key string, by int64, expiration int64) (int64, error) {
+	config, err := ns.check(key)
+	if err != nil {
+		return 0, err
+	}
+	value := withDefaultTTL(storage.Value{Expiration: expiration}, config)
+	resp, err := ns.node.incr(ns.name, ns.prefix+key, "incr", Increment{By: by}, value.Expiration)
+	if err != nil {
+		return 0, err
+	}
+	result, _ := resp.(int64)
+	return result, nil
+}
+
+// IncrByFloat atomically adds by to the number stored under a key of the
+// namespace and returns the result
+func (ns *Namespace) IncrByFloat(key string, by float64, expiration int64) (float64, error) {
+	config, err := ns.check(key)
+	if err != nil {
+		return 0, err
+	}
+	value := withDefaultTTL(storage.Value{Expiration: expiration}, config)
+	resp, err := ns.node.incr(ns.name, ns.prefix+key, "incrbyfloat", Increment{ByFloat: by}, value.Expiration)
+	if err != nil {
+		return 0, err
+	}
+	result, _ := resp.(float64)
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package raft
+
+import (
+	"math"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMCounters(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	incr := func(key string, by int64, expiration int64) interface{} {
+		return applyCommand(t, f, Command{Op: "incr", Key: key, Value: storage.Value{Expiration: expiration}, Incr: &Increment{By: by}})
+	}
+	incrByFloat := func(key string, by float64) interface{} {
+		return applyCommand(t, f, Command{Op: "incrbyfloat", Key: key, Incr: &Increment{ByFloat: by}})
+	}
+
+	// A missing key starts at 0 and takes the expiration of the command
+	expiration := int64(math.MaxInt64 / 2)
+	assert.Equal(t, int64(5), incr("c", 5, expiration))
+	assert.Equal(t, int64(3), incr("c", -2, 0))
+	value, err := store.Get("c")
+	require.NoError(t, err)
+	assert.Equal(t, "3", string(value.Data))
+	assert.Equal(t, expiration, value.Expiration)
+
+	// Overflow leaves the value unchanged
+	applyCommand(t, f, Command{Op: "set", Key: "max", Value: storage.Value{Data: []byte("9223372036854775807")}})
+	assert.Equal(t, ErrOverflow, incr("max", 1, 0))
+	assert.Equal(t, int64(math.MaxInt64-1), incr("max", -1, 0))
+
+	// Values that are not numbers cannot be incremented
+	applyCommand(t, f, Command{Op: "set", Key: "s", Value: storage.Value{Data: []byte("abc")}})
+	assert.Equal(t, ErrNotInteger, incr("s", 1, 0))
+	assert.Equal(t, ErrNotFloat, incrByFloat("s", 1))
+	applyCommand(t, f, Command{Op: "sadd", Key: "set", Args: &StructArgs{Members: []string{"a"}}})
+	assert.Equal(t, storage.ErrWrongType, incr("set", 1, 0))
+
+	// Floats
+	assert.Equal(t, 3.5, incrByFloat("c", 0.5))
+	assert.Equal(t, ErrNotInteger, incr("c", 1, 0))
+	value, err = store.Get("c")
+	require.NoError(t, err)
+	assert.Equal(t, "3.5", string(value.Data))
+	assert.Equal(t, math.MaxFloat64, incrByFloat("f", math.MaxFloat64))
+	assert.Equal(t, ErrOverflow, incrByFloat("f", math.MaxFloat64))
+}
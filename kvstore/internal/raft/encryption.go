@@ -0,0 +1,403 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/hashicorp/raft"
+)
+
+// logAAD binds an encrypted log entry to its index, so entries cannot be
+// swapped around on disk
+func logAAD(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return b
+}
+
+// snapshotAAD binds an encrypted snapshot to the index it was taken at
+func snapshotAAD(index uint64) []byte {
+	return []byte("snapshot:" + strconv.FormatUint(index, 10))
+}
+
+// encryptedLogStore encrypts the data of log entries before they reach the
+// wrapped store. Entries written before encryption was enabled are read
+// back as they are.
+type encryptedLogStore struct {
+	raft.LogStore
+	keyring *storage.Keyring
+	mutex   sync.Mutex // Serializes writes with re-encryption
+}
+
+// newEncryptedLogStore wraps store, encrypting entries with keyring
+func newEncryptedLogStore(store raft.LogStore, keyring *storage.Keyring) *encryptedLogStore {
+	return &encryptedLogStore{LogStore: store, keyring: keyring}
+}
+
+// seal returns a copy of log with its data encrypted. Raft keeps using the
+// entries it stores, so they are never modified.
+func (s *encryptedLogStore) seal(log *raft.Log) (*raft.Log, error) {
+	sealed := *log
+	data, err := s.keyring.Seal(log.Data, logAAD(log.Index))
+	if err != nil {
+		return nil, err
+	}
+	sealed.Data = data
+	return &sealed, nil
+}
+
+// GetLog gets and decrypts a log entry at a given index
+func (s *encryptedLogStore) GetLog(index uint64, log *raft.Log) error {
+	if err := s.LogStore.GetLog(index, log); err != nil {
+		return err
+	}
+	if _, ok := storage.SealedKeyID(log.Data); !ok {
+		return nil
+	}
+	data, err := s.keyring.Unseal(log.Data, logAAD(log.Index))
+	if err != nil {
+		return err
+	}
+	log.Data = data
+	return nil
+}
+
+// StoreLog encrypts and stores a log entry
+func (s *encryptedLogStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs encrypts and stores multiple log entries
+func (s *encryptedLogStore) StoreLogs(logs []*raft.Log) error {
+	sealed := make([]*raft.Log, len(logs))
+	for i, log := range logs {
+		var err error
+		if sealed[i], err = s.seal(log); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.LogStore.StoreLogs(sealed)
+}
+
+// DeleteRange deletes a range of log entries
+func (s *encryptedLogStore) DeleteRange(min, max uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.LogStore.DeleteRange(min, max)
+}
+
+// reencrypt rewrites every entry that is not encrypted with the active key
+// and returns how many were rewritten. Each entry is rewritten under the
+// write lock, so an entry truncated meanwhile is never brought back.
+func (s *encryptedLogStore) reencrypt() (int, error) {
+	first, err := s.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	last, err := s.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for index := first; index <= last && index > 0; index++ {
+		rewritten, err := s.reencryptEntry(index)
+		if err != nil {
+			return count, err
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reencryptEntry rewrites the entry at index if it is not encrypted with
+// the active key
+func (s *encryptedLogStore) reencryptEntry(index uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	first, err := s.LogStore.FirstIndex()
+	if err != nil {
+		return false, err
+	}
+	last, err := s.LogStore.LastIndex()
+	if err != nil {
+		return false, err
+	}
+	if index < first || index > last {
+		return false, nil
+	}
+
+	var log raft.Log
+	if err := s.LogStore.GetLog(index, &log); err != nil {
+		if err == raft.ErrLogNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if id, ok := storage.SealedKeyID(log.Data); ok {
+		if id == s.keyring.ActiveID() {
+			return false, nil
+		}
+		if log.Data, err = s.keyring.Unseal(log.Data, logAAD(log.Index)); err != nil {
+			return false, err
+		}
+	}
+
+	sealed, err := s.seal(&log)
+	if err != nil {
+		return false, err
+	}
+	return true, s.LogStore.StoreLog(sealed)
+}
+
+// sealedStreamMagic starts data sealed as a stream of frames. Each frame
+// is sealed on its own, so the data is never held in memory whole.
+var sealedStreamMagic = []byte("KVS\x01")
+
+// sealedFrameSize is the most plaintext a frame of a sealed stream holds
+const sealedFrameSize = 1 << 20
+
+// frameAAD binds a frame of a sealed stream to the stream, its position in
+// it and whether it is the last, so frames cannot be reordered or dropped
+func frameAAD(aad []byte, frame uint64, last bool) []byte {
+	b := make([]byte, len(aad)+9)
+	copy(b, aad)
+	binary.BigEndian.PutUint64(b[len(aad):], frame)
+	if last {
+		b[len(b)-1] = 1
+	}
+	return b
+}
+
+// sealingWriter seals what is written to it as a stream of frames. Each
+// frame is a flag marking the last one, the size of the sealed frame and
+// the frame as written by Keyring.Seal.
+type sealingWriter struct {
+	w       io.Writer
+	keyring *storage.Keyring
+	aad     []byte
+	buf     []byte
+	frame   uint64
+}
+
+// newSealingWriter returns a writer sealing a stream to w. It must be
+// closed to write the last frame.
+func newSealingWriter(w io.Writer, keyring *storage.Keyring, aad []byte) *sealingWriter {
+	return &sealingWriter{w: w, keyring: keyring, aad: aad}
+}
+
+// Write buffers p, sealing every frame it fills
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := sealedFrameSize - len(s.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		s.buf = append(s.buf, p[:room]...)
+		p = p[room:]
+		if len(s.buf) == sealedFrameSize {
+			if err := s.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close seals the last frame
+func (s *sealingWriter) Close() error {
+	return s.flush(true)
+}
+
+// flush seals the buffered plaintext as the next frame
+func (s *sealingWriter) flush(last bool) error {
+	if s.frame == 0 {
+		if _, err := s.w.Write(sealedStreamMagic); err != nil {
+			return err
+		}
+	}
+	sealed, err := s.keyring.Seal(s.buf, frameAAD(s.aad, s.frame, last))
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 5)
+	if last {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := s.w.Write(append(header, sealed...)); err != nil {
+		return err
+	}
+	s.frame++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// openingReader reads the plaintext of a stream written by sealingWriter,
+// one frame at a time
+type openingReader struct {
+	r       io.Reader
+	keyring *storage.Keyring
+	aad     []byte
+	buf     []byte
+	frame   uint64
+	started bool
+	done    bool
+}
+
+// newOpeningReader returns a reader of the sealed stream r
+func newOpeningReader(r io.Reader, keyring *storage.Keyring, aad []byte) *openingReader {
+	return &openingReader{r: r, keyring: keyring, aad: aad}
+}
+
+// Read reads plaintext, opening the next frame when the current one has
+// been read. A stream cut short fails rather than ending early.
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// next opens the next frame
+func (o *openingReader) next() error {
+	if !o.started {
+		magic := make([]byte, len(sealedStreamMagic))
+		if _, err := io.ReadFull(o.r, magic); err != nil || !bytes.Equal(magic, sealedStreamMagic) {
+			return storage.ErrCorruptRecord
+		}
+		o.started = true
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(o.r, header); err != nil {
+		return storage.ErrCorruptRecord
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 2*sealedFrameSize {
+		return storage.ErrCorruptRecord
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return storage.ErrCorruptRecord
+	}
+	last := header[0] == 1
+	data, err := o.keyring.Unseal(sealed, frameAAD(o.aad, o.frame, last))
+	if err != nil {
+		return err
+	}
+	o.frame++
+	o.buf, o.done = data, last
+	return nil
+}
+
+// encryptedSnapshotStore encrypts snapshots before they reach the wrapped
+// store. Snapshots are sealed and opened as a stream, one frame at a time.
+type encryptedSnapshotStore struct {
+	raft.SnapshotStore
+	keyring *storage.Keyring
+}
+
+// newEncryptedSnapshotStore wraps store, encrypting snapshots with keyring
+func newEncryptedSnapshotStore(store raft.SnapshotStore, keyring *storage.Keyring) *encryptedSnapshotStore {
+	return &encryptedSnapshotStore{SnapshotStore: store, keyring: keyring}
+}
+
+// Create begins a snapshot that is encrypted as it is written
+func (s *encryptedSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	sink, err := s.SnapshotStore.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingSink{SnapshotSink: sink, sealer: newSealingWriter(sink, s.keyring, snapshotAAD(index))}, nil
+}
+
+// Open opens and decrypts a snapshot. Snapshots written before encryption
+// was enabled are returned as they are, those sealed whole before
+// snapshots were streamed are read into memory to be opened.
+func (s *encryptedSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.SnapshotStore.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(rc)
+	magic, _ := r.Peek(len(sealedStreamMagic))
+	if bytes.Equal(magic, sealedStreamMagic) {
+		// Followers are sent the decrypted snapshot, its size must match,
+		// so the snapshot is opened once to count it and again to read it
+		size, err := io.Copy(io.Discard, newOpeningReader(r, s.keyring, snapshotAAD(meta.Index)))
+		rc.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if meta, rc, err = s.SnapshotStore.Open(id); err != nil {
+			return nil, nil, err
+		}
+		opened := *meta
+		opened.Size = size
+		return &opened, readCloser{newOpeningReader(rc, s.keyring, snapshotAAD(meta.Index)), rc}, nil
+	}
+	// A sealed blob starts with a 4 byte magic and the 4 byte ID of its key
+	head, _ := r.Peek(8)
+	if _, ok := storage.SealedKeyID(head); !ok {
+		return meta, readCloser{r, rc}, nil
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data, err = s.keyring.Unseal(data, snapshotAAD(meta.Index)); err != nil {
+		return nil, nil, err
+	}
+	opened := *meta
+	opened.Size = int64(len(data))
+	return &opened, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readCloser reads from a reader and closes the closer it was read from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// encryptingSink seals a snapshot as it is written
+type encryptingSink struct {
+	raft.SnapshotSink
+	sealer *sealingWriter
+}
+
+// Write seals snapshot data
+func (s *encryptingSink) Write(p []byte) (int, error) {
+	return s.sealer.Write(p)
+}
+
+// Close seals the last of the snapshot and closes the wrapped sink
+func (s *encryptingSink) Close() error {
+	if err := s.sealer.Close(); err != nil {
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	return s.SnapshotSink.Close()
+}
@@ -0,0 +1,126 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyring creates a keyring with keys 1 to n, the last one active
+func testKeyring(t *testing.T, n uint32) *storage.Keyring {
+	keys := make(map[uint32][]byte)
+	for id := uint32(1); id <= n; id++ {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	keyring, err := storage.NewKeyring(keys, n)
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestEncryptedLogStore(t *testing.T) {
+	inner := raft.NewInmemStore()
+	require.NoError(t, inner.StoreLog(&raft.Log{Index: 1, Data: []byte(`{"op":"legacy"}`)}))
+
+	logs := newEncryptedLogStore(inner, testKeyring(t, 1))
+	entry := &raft.Log{Index: 2, Term: 1, Data: []byte(`{"op":"set","key":"secret"}`)}
+	require.NoError(t, logs.StoreLog(entry))
+	assert.Equal(t, []byte(`{"op":"set","key":"secret"}`), entry.Data, "stored entries are not modified")
+
+	var raw raft.Log
+	require.NoError(t, inner.GetLog(2, &raw))
+	id, ok := storage.SealedKeyID(raw.Data)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), id)
+
+	var log raft.Log
+	require.NoError(t, logs.GetLog(2, &log))
+	assert.Equal(t, entry.Data, log.Data)
+	require.NoError(t, logs.GetLog(1, &log))
+	assert.Equal(t, []byte(`{"op":"legacy"}`), log.Data)
+
+	// After a rotation every entry is rewritten with the new key
+	logs.keyring = testKeyring(t, 2)
+	n, err := logs.reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for index := uint64(1); index <= 2; index++ {
+		require.NoError(t, inner.GetLog(index, &raw))
+		id, _ := storage.SealedKeyID(raw.Data)
+		assert.Equal(t, uint32(2), id)
+	}
+	require.NoError(t, logs.GetLog(2, &log))
+	assert.Equal(t, entry.Data, log.Data)
+}
+
+func TestEncryptedSnapshotStore(t *testing.T) {
+	inner := raft.NewInmemSnapshotStore()
+	snaps := newEncryptedSnapshotStore(inner, testKeyring(t, 1))
+
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = sink.Write([]byte(`{"data":{"secret":"value"}}`))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	_, rc, err := inner.Open(sink.ID())
+	require.NoError(t, err)
+	raw, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+
+	meta, rc, err := snaps.Open(sink.ID())
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"data":{"secret":"value"}}`), data)
+	assert.Equal(t, int64(len(data)), meta.Size)
+}
+
+func TestEncryptedSnapshotStreams(t *testing.T) {
+	inner := raft.NewInmemSnapshotStore()
+	keyring := testKeyring(t, 1)
+	snaps := newEncryptedSnapshotStore(inner, keyring)
+
+	// A snapshot spanning several frames reads back whole
+	data := bytes.Repeat([]byte("0123456789"), sealedFrameSize/4)
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	meta, rc, err := snaps.Open(sink.ID())
+	require.NoError(t, err)
+	read, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.Equal(t, int64(len(data)), meta.Size)
+
+	// A stream cut short fails instead of ending early
+	_, rc, err = inner.Open(sink.ID())
+	require.NoError(t, err)
+	raw, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	truncated := raw[:len(raw)-len(raw)/3]
+	_, err = io.ReadAll(newOpeningReader(bytes.NewReader(truncated), keyring, snapshotAAD(10)))
+	assert.Error(t, err)
+
+	// Snapshots sealed whole before they were streamed still open
+	sealed, err := keyring.Seal([]byte(`{"data":{}}`), snapshotAAD(11))
+	require.NoError(t, err)
+	sink, err = inner.Create(raft.SnapshotVersionMax, 11, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = sink.Write(sealed)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	_, rc, err = snaps.Open(sink.ID())
+	require.NoError(t, err)
+	read, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"data":{}}`), read)
+}
@@ -1,127 +1,845 @@
 package raft
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/SirCodeKnight/kvstore/internal/storage"
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrCorruptSnapshot is returned when restoring a snapshot that does
+	// not match its checksum
+	ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+	// ErrStaleRepair is returned for a repair copy of a key that may not
+	// match the value the local state holds
+	ErrStaleRepair = errors.New("repair copy does not match the applied state")
+)
+
 // FSM implements the raft.FSM interface for the key-value store
 type FSM struct {
-	store  storage.Storage
-	logger *zap.Logger
+	store      storage.Storage
+	logger     *zap.Logger
+	history    *history
+	namespaces *namespaceRegistry
+	quotas     *quotaStore      // Wraps snapshots
+	snapshots  *snapshotStore   // Wraps the store the FSM was created with
+	keyring    *storage.Keyring // Encrypts snapshots spooled to disk, nil for none
+	spoolDir   string           // Where snapshots are spooled while restored, the temporary directory if empty
+	applyMutex sync.Mutex       // Held while entries are applied or the store restored
+	releases   []pendingRelease // Chunk releases in the order they are due, guarded by applyMutex
+	evictions  []eviction       // Keys evicted by the entry being applied, guarded by applyMutex
+	clock      int64  // Replicated time in Unix nanoseconds, accessed atomically
+	index      uint64 // Index of the last applied entry, accessed atomically
+}
+
+// newFSM creates a state machine over store. Backends that accept a clock
+// check expirations against the replicated time, so every replica agrees
+// on which keys are expired at a given log index. Writes go through a
+// wrapper that enforces namespace quotas, and one that keeps what open
+// snapshots need.
+func newFSM(store storage.Storage, logger *zap.Logger) *FSM {
+	f := &FSM{
+		logger:     logger,
+		history:    newHistory(HistoryOptions{}),
+		namespaces: newNamespaceRegistry(),
+	}
+	if setter, ok := store.(storage.ClockSetter); ok {
+		setter.SetClock(f.now)
+	}
+	if evictor, ok := store.(storage.Evictor); ok {
+		evictor.SetEvictable(evictable)
+		evictor.SetEvictionHandler(f.evicted)
+	}
+	f.snapshots = newSnapshotStore(store)
+	f.quotas = newQuotaStore(f.snapshots, f.namespaces)
+	f.store = f.quotas
+	return f
+}
+
+// now returns the replicated time. Until the first timestamped entry has
+// been applied the local wall clock is used instead.
+func (f *FSM) now() int64 {
+	if t := atomic.LoadInt64(&f.clock); t > 0 {
+		return t
+	}
+	return time.Now().UnixNano()
+}
+
+// advance moves the replicated time forward to t. The clock never goes
+// backwards, even if a new leader's wall clock is behind the old one's.
+func (f *FSM) advance(t int64) {
+	for {
+		current := atomic.LoadInt64(&f.clock)
+		if t <= current || atomic.CompareAndSwapInt64(&f.clock, current, t) {
+			return
+		}
+	}
 }
 
-// Apply applies a Raft log entry to the key-value store
+// Apply applies a Raft log entry to the key-value store and returns its
+// *ApplyResult
 func (f *FSM) Apply(log *raft.Log) interface{} {
 	var cmd Command
 	if err := json.Unmarshal(log.Data, &cmd); err != nil {
 		f.logger.Error("failed to unmarshal command", zap.Error(err))
-		return err
+		return newApplyResult(log.Index, nil, err)
+	}
+	f.applyMutex.Lock()
+	defer f.applyMutex.Unlock()
+	f.advance(cmd.Time)
+	defer atomic.StoreUint64(&f.index, log.Index)
+	f.releaseDue()
+
+	// The value a key command replaces is read first, so that every write
+	// reports it
+	var prev *storage.Value
+	if cmd.Key != "" {
+		if value, exists := f.lookupPrior(cmd.Key); exists {
+			prev = &value
+		}
+	}
+	resp := f.execute(cmd, log.Index)
+	if prev != nil {
+		f.releaseChunks(cmd.Key, *prev)
+	}
+	f.settleEvictions(log.Index)
+	f.releaseDropped()
+	return newApplyResult(log.Index, prev, resp)
+}
+
+// execute applies cmd, the log entry at index, and returns the response of
+// its op, an error if it failed
+func (f *FSM) execute(cmd Command, index uint64) interface{} {
+	// Writes to a namespace dropped after they were proposed must not
+	// bring its keys back
+	if cmd.Namespace != "" && cmd.Op != "put_namespace" && cmd.Op != "drop_namespace" {
+		if _, ok := f.namespaces.get(cmd.Namespace); !ok {
+			return ErrNamespaceNotFound
+		}
 	}
 
 	switch cmd.Op {
 	case "set":
-		err := f.store.Set(cmd.Key, cmd.Value)
-		if err != nil {
+		if err := f.checkPrecondition(cmd.Key, cmd.If); err != nil {
+			return err
+		}
+		prior, exists := f.lookupPrior(cmd.Key)
+		f.stamp(&cmd.Value, index, prior, exists)
+		existed := f.priorExists(cmd.Key)
+		if err := f.store.Set(cmd.Key, cmd.Value); err != nil {
 			f.logger.Error("failed to set value", zap.String("key", cmd.Key), zap.Error(err))
 			return err
 		}
+		f.history.recordSet(cmd.Key, cmd.Value, existed, f.now())
 		f.logger.Debug("set value", zap.String("key", cmd.Key))
-		return nil
+		return index
 
 	case "delete":
+		if err := f.checkPrecondition(cmd.Key, cmd.If); err != nil {
+			return err
+		}
 		err := f.store.Delete(cmd.Key)
 		if err != nil {
 			f.logger.Error("failed to delete key", zap.String("key", cmd.Key), zap.Error(err))
 			return err
 		}
+		f.history.recordDelete(cmd.Key, index, f.now())
 		f.logger.Debug("deleted key", zap.String("key", cmd.Key))
 		return nil
 
 	case "deleteAll":
-		err := f.store.Clear()
+		// Only the keys of the command's namespace are deleted
+		prefix := ""
+		if cmd.Namespace != "" {
+			prefix = namespacePrefix(cmd.Namespace)
+		}
+		n, err := f.deleteKeys(prefix, index)
+		if err != nil {
+			f.logger.Error("failed to delete all keys", zap.String("namespace", cmd.Namespace), zap.Error(err))
+			return err
+		}
+		f.logger.Debug("deleted all keys", zap.String("namespace", cmd.Namespace), zap.Int("count", n))
+		return nil
+
+	case "put_namespace":
+		var config NamespaceConfig
+		if cmd.Config != nil {
+			config = *cmd.Config
+		}
+		f.namespaces.put(cmd.Namespace, config)
+		f.logger.Debug("put namespace", zap.String("namespace", cmd.Namespace))
+		return nil
+
+	case "drop_namespace":
+		if !f.namespaces.remove(cmd.Namespace) {
+			return ErrNamespaceNotFound
+		}
+		n, err := f.deleteKeys(namespacePrefix(cmd.Namespace), index)
+		if err != nil {
+			f.logger.Error("failed to drop namespace", zap.String("namespace", cmd.Namespace), zap.Error(err))
+			return err
+		}
+		f.quotas.forget(cmd.Namespace)
+		f.logger.Debug("dropped namespace", zap.String("namespace", cmd.Namespace), zap.Int("keys", n))
+		return n
+
+	case "txn":
+		result, err := f.applyTxn(cmd.Txn, index)
 		if err != nil {
-			f.logger.Error("failed to clear store", zap.Error(err))
+			f.logger.Error("failed to apply transaction", zap.Error(err))
 			return err
 		}
-		f.logger.Debug("cleared store")
+		f.logger.Debug("applied transaction", zap.Bool("succeeded", result.Succeeded))
+		return result
+
+	case "batch":
+		results, err := f.applyBatch(cmd.Batch, index)
+		if err != nil {
+			f.logger.Error("failed to apply batch", zap.Error(err))
+			return err
+		}
+		f.logger.Debug("applied batch", zap.Int("ops", len(results)))
+		return results
+
+	case "compact":
+		// Compacting past the entry itself would remove versions written
+		// later, which differs between replicas
+		revision := cmd.Revision
+		if revision > index {
+			revision = index
+		}
+		f.history.compact(revision, f.now())
+		f.logger.Debug("compacted history", zap.Uint64("revision", revision))
 		return nil
 
+	case "prune_history":
+		f.history.pruneAll(f.now())
+		f.logger.Debug("pruned history")
+		return nil
+
+	case "expire":
+		// Keys are only removed if they are expired at the replicated time,
+		// a key rewritten since the leader found it expired stays
+		n, err := storage.ExpireKeys(f.store, cmd.Keys)
+		if err != nil {
+			f.logger.Error("failed to expire keys", zap.Error(err))
+			return err
+		}
+		for _, key := range cmd.Keys {
+			if f.history.tracks(key) && !f.store.Has(key) {
+				f.history.recordDelete(key, index, f.now())
+			}
+		}
+		f.logger.Debug("expired keys", zap.Int("count", n))
+		return n
+
+	case "incr", "incrbyfloat":
+		result := f.applyIncr(cmd, index)
+		if err, ok := result.(error); ok {
+			if err != ErrNotInteger && err != ErrNotFloat && err != ErrOverflow && err != storage.ErrWrongType {
+				f.logger.Error("failed to increment", zap.String("key", cmd.Key), zap.Error(err))
+			}
+			return err
+		}
+		f.logger.Debug("incremented key", zap.String("key", cmd.Key))
+		return result
+
+	case "append", "setrange":
+		result := f.applyAppend(cmd, index)
+		if err, ok := result.(error); ok {
+			if CodeOf(err) == CodeInternal {
+				f.logger.Error("failed to write range", zap.String("op", cmd.Op), zap.String("key", cmd.Key), zap.Error(err))
+			}
+			return err
+		}
+		f.logger.Debug("wrote range", zap.String("op", cmd.Op), zap.String("key", cmd.Key))
+		return result
+
+	case "upload_init", "upload_part", "upload_complete", "upload_abort":
+		result := f.applyUpload(cmd, index)
+		if err, ok := result.(error); ok {
+			if CodeOf(err) == CodeInternal {
+				f.logger.Error("failed to apply upload command", zap.String("op", cmd.Op), zap.Error(err))
+			}
+			return err
+		}
+		f.logger.Debug("applied upload command", zap.String("op", cmd.Op), zap.String("upload", cmd.Upload.ID))
+		return result
+
+	case "lpush", "rpush", "lpop", "rpop", "hset", "hdel", "sadd", "srem", "zadd", "zrem":
+		result := f.applyStruct(cmd, index)
+		if err, ok := result.(error); ok {
+			if err != storage.ErrWrongType && err != ErrInvalidScore {
+				f.logger.Error("failed to apply data structure command", zap.String("op", cmd.Op), zap.String("key", cmd.Key), zap.Error(err))
+			}
+			return err
+		}
+		f.logger.Debug("applied data structure command", zap.String("op", cmd.Op), zap.String("key", cmd.Key))
+		return result
+
 	default:
-		err := json.Unmarshal(log.Data, &cmd)
-		f.logger.Error("unknown command", zap.String("op", cmd.Op), zap.Error(err))
-		return err
+		f.logger.Error("unknown command", zap.String("op", cmd.Op))
+		return ErrUnknownCommand
 	}
 }
 
-// Snapshot returns a snapshot of the key-value store
-func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
-	f.logger.Debug("creating snapshot")
-	
-	// Get all keys
-	keys := f.store.Keys()
+// priorExists reports whether key has a value the history does not know
+// about before it is written. The store is only consulted for keys the
+// history does not track yet.
+func (f *FSM) priorExists(key string) bool {
+	if !f.history.opts.enabled() || f.history.tracks(key) {
+		return false
+	}
+	_, exists, _ := f.lookup(key)
+	return exists
+}
+
+// eviction is a key the memory budget of the store evicted and the value
+// it held
+type eviction struct {
+	key   string
+	value storage.Value
+}
+
+// evictable reports whether the memory budget of the store may evict the
+// stored key. Upload records and chunks are part of other values.
+func evictable(key string) bool {
+	return !isUploadKey(key[len(keyPrefix(key)):])
+}
+
+// evicted accounts for a key the store evicted during a write. The store
+// is locked, so what writes to it waits for settleEvictions.
+func (f *FSM) evicted(key string, value storage.Value) {
+	f.quotas.untrack(key)
+	f.snapshots.saveEvicted(key, value)
+	f.evictions = append(f.evictions, eviction{key: key, value: value})
+}
+
+// settleEvictions records the keys evicted while applying the entry at
+// index as deleted in the history and releases the chunks of evicted
+// chunked values
+func (f *FSM) settleEvictions(index uint64) {
+	for len(f.evictions) > 0 {
+		e := f.evictions[0]
+		f.evictions = f.evictions[1:]
+		f.history.recordDelete(e.key, index, f.now())
+		f.releaseChunks(e.key, e.value)
+	}
+}
+
+// appliedIndex returns the index of the last applied log entry
+func (f *FSM) appliedIndex() uint64 {
+	return atomic.LoadUint64(&f.index)
+}
+
+// repair rewrites the record of key with value, a copy read from a replica
+// that had applied the log up to index. No entry can be applied while it
+// is written, and it is only written if it is the value key holds at the
+// local applied index: the replica was not behind, and the copy was not
+// written after that index. The value is already accounted for, so quotas
+// and history are left alone.
+func (f *FSM) repair(key string, value storage.Value, index uint64) error {
+	f.applyMutex.Lock()
+	defer f.applyMutex.Unlock()
+
+	applied := f.appliedIndex()
+	if index < applied || value.Revision > applied {
+		return ErrStaleRepair
+	}
+	return f.quotas.Storage.Set(key, value)
+}
+
+// GetAt returns the value key had at revision
+func (f *FSM) GetAt(key string, revision uint64) (storage.Value, error) {
+	applied := f.appliedIndex()
+	if revision > applied {
+		return storage.Value{}, ErrFutureRevision
+	}
+	if revision == applied {
+		return f.store.Get(key)
+	}
 	
-	// Create a map to hold all key-value pairs
-	data := make(map[string]storage.Value, len(keys))
+	v, tracked, err := f.history.at(key, revision)
+	if err != nil {
+		return storage.Value{}, err
+	}
+	if tracked {
+		if v.Deleted {
+			return storage.Value{}, storage.ErrKeyNotFound
+		}
+		value, err := storage.DecodeValue(storage.Value{
+			Data:       v.Value,
+			Expiration: v.Expiration,
+			Revision:   v.Revision,
+			Encoding:   v.Encoding,
+			Type:       v.Type,
+		})
+		if err != nil {
+			return storage.Value{}, err
+		}
+		// Chunks outlive their version in the history, unless something
+		// like dropping the namespace deleted them
+		if value.Type == storage.TypeChunked && !f.hasChunks(key, value) {
+			return storage.Value{}, ErrCompacted
+		}
+		return value, nil
+	}
 	
-	// Populate the map
-	for _, key := range keys {
-		value, err := f.store.Get(key)
-		if err == nil {
-			data[key] = value
+	// The key has not been written since history was enabled, the current
+	// value is the only one known
+	value, exists, err := f.lookup(key)
+	if err != nil {
+		return storage.Value{}, err
+	}
+	if !exists {
+		return storage.Value{}, storage.ErrKeyNotFound
+	}
+	if value.Revision > revision {
+		return storage.Value{}, ErrCompacted
+	}
+	return value, nil
+}
+
+// History returns the retained versions of key
+func (f *FSM) History(key string) (KeyHistory, error) {
+	if kh, ok := f.history.get(key); ok {
+		for i, v := range kh.Versions {
+			if v.Encoding == "" {
+				continue
+			}
+			value, err := storage.DecodeValue(storage.Value{Data: v.Value, Encoding: v.Encoding})
+			if err != nil {
+				return KeyHistory{}, err
+			}
+			kh.Versions[i].Value = value.Data
+			kh.Versions[i].Encoding = ""
 		}
+		return kh, nil
+	}
+	
+	value, exists, err := f.lookup(key)
+	if err != nil {
+		return KeyHistory{}, err
+	}
+	if !exists {
+		return KeyHistory{}, storage.ErrKeyNotFound
+	}
+	return KeyHistory{
+		Versions: []Version{{Revision: value.Revision, Value: value.Data, Expiration: value.Expiration}},
+		Trimmed:  value.Revision > 0,
+	}, nil
+}
+
+// checkPrecondition checks a write's precondition against the current
+// revision of key
+func (f *FSM) checkPrecondition(key string, pre *Precondition) error {
+	if pre == nil {
+		return nil
 	}
 	
-	return &fsmSnapshot{data: data}, nil
+	value, exists := f.lookupPrior(key)
+	if !pre.check(value.Revision, exists) {
+		f.logger.Debug("precondition failed", zap.String("key", key))
+		return ErrPreconditionFailed
+	}
+	return nil
 }
 
-// Restore restores the key-value store from a snapshot
+// Snapshot returns a snapshot of the key-value store. Keys are not
+// copied, the snapshot reads them from the store when it is persisted.
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.logger.Debug("creating snapshot")
+	
+	snap := &fsmSnapshot{
+		view: f.snapshots.open(),
+		header: snapshotHeader{
+			Time:       atomic.LoadInt64(&f.clock),
+			Index:      f.appliedIndex(),
+			History:    f.history.snapshot(),
+			Namespaces: f.namespaces.snapshot(),
+		},
+	}
+	if ranker, ok := f.store.(storage.EvictionRanker); ok {
+		snap.header.Ranks = ranker.EvictionRanks()
+	}
+	return snap, nil
+}
+
+// Restore restores the key-value store from a snapshot. Snapshots are read
+// one key at a time, those written before they were streamed are read
+// whole.
 func (f *FSM) Restore(rc io.ReadCloser) error {
 	f.logger.Debug("restoring from snapshot")
 	
-	// Clear the store first
-	if err := f.store.Clear(); err != nil {
-		f.logger.Error("failed to clear store", zap.Error(err))
+	r := bufio.NewReader(rc)
+	if magic, _ := r.Peek(len(snapshotMagic)); string(magic) != snapshotMagic {
+		snap, err := decodeSnapshot(r)
+		if err != nil {
+			f.logger.Error("failed to decode snapshot", zap.Error(err))
+			return err
+		}
+		return f.restoreLegacy(snap)
+	}
+	
+	// Verify the snapshot before anything is thrown away
+	spool, err := f.spoolSnapshot(r)
+	if err != nil {
+		f.logger.Error("failed to verify snapshot", zap.Error(err))
 		return err
 	}
+	defer spool.Close()
 	
-	// Read the snapshot data
-	var data map[string]storage.Value
-	if err := json.NewDecoder(rc).Decode(&data); err != nil {
+	body := bufio.NewReader(spool)
+	if _, err := body.Discard(len(snapshotMagic)); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(body)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
 		f.logger.Error("failed to decode snapshot", zap.Error(err))
 		return err
 	}
+	return f.restore(header, func() (string, storage.Value, error) {
+		var record snapshotRecord
+		err := dec.Decode(&record)
+		return record.Key, record.Value, err
+	})
+}
+
+// restoreLegacy restores a snapshot written before snapshots were
+// streamed, in key order so that a store with a memory budget ends up the
+// same on every replica
+func (f *FSM) restoreLegacy(snap snapshotData) error {
+	keys := make([]string, 0, len(snap.Data))
+	for key := range snap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	
-	// Restore each key-value pair
-	for key, value := range data {
-		if err := f.store.Set(key, value); err != nil {
+	header := snapshotHeader{
+		Time:       snap.Time,
+		Index:      snap.Index,
+		Ranks:      snap.Ranks,
+		History:    snap.History,
+		Namespaces: snap.Namespaces,
+	}
+	return f.restore(header, func() (string, storage.Value, error) {
+		if len(keys) == 0 {
+			return "", storage.Value{}, io.EOF
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return key, snap.Data[key], nil
+	})
+}
+
+// restore replaces the state with that of a verified snapshot. next
+// returns its keys one at a time, then io.EOF.
+func (f *FSM) restore(header snapshotHeader, next func() (string, storage.Value, error)) error {
+	f.applyMutex.Lock()
+	defer f.applyMutex.Unlock()
+	
+	// Clear the store
+	if err := f.store.Clear(); err != nil {
+		f.logger.Error("failed to clear store", zap.Error(err))
+		return err
+	}
+	atomic.StoreInt64(&f.clock, header.Time)
+	atomic.StoreUint64(&f.index, header.Index)
+	f.history.restore(header.History)
+	f.namespaces.restore(header.Namespaces)
+	f.releases = nil
+	
+	// Restore each key-value pair in the order of the snapshot, the same
+	// on every replica
+	for {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.logger.Error("failed to decode snapshot", zap.Error(err))
+			return err
+		}
+		// Quotas lowered since a key was written must not lose it
+		if err := f.quotas.force(key, value); err != nil {
 			f.logger.Error("failed to restore key", zap.String("key", key), zap.Error(err))
 			// Continue restoring other keys
+			continue
 		}
+		f.restoreRelease(key)
+	}
+	sort.SliceStable(f.releases, func(i, j int) bool { return f.releases[i].at < f.releases[j].at })
+	f.evictions = nil
+	if ranker, ok := f.store.(storage.EvictionRanker); ok && header.Ranks != nil {
+		ranker.SetEvictionRanks(header.Ranks)
 	}
 	
 	return nil
 }
 
+// snapshotMagic starts a streamed snapshot. It is followed by a
+// snapshotHeader and a snapshotRecord per key, one JSON document per line,
+// then by a snapshotTrailer holding the checksum of everything before it.
+const snapshotMagic = "kvstore-snapshot/2\n"
+
+// snapshotHeader is the state of a streamed snapshot other than its keys
+type snapshotHeader struct {
+	Time       int64                           `json:"time"`
+	Index      uint64                          `json:"index,omitempty"`
+	Ranks      map[string]storage.EvictionRank `json:"ranks,omitempty"`
+	History    *historySnapshot                `json:"history,omitempty"`
+	Namespaces map[string]NamespaceConfig      `json:"namespaces,omitempty"`
+}
+
+// snapshotRecord is a key of a streamed snapshot
+type snapshotRecord struct {
+	Key   string        `json:"key"`
+	Value storage.Value `json:"value"`
+}
+
+// spoolAAD binds a spooled snapshot to its purpose
+var spoolAAD = []byte("snapshot spool")
+
+// spoolSnapshot copies a streamed snapshot to a temporary file, checking it
+// against its trailer on the way, and returns a reader of it without the
+// trailer. The file is encrypted if the FSM has a keyring, and removed
+// when the reader is closed.
+func (f *FSM) spoolSnapshot(r *bufio.Reader) (io.ReadCloser, error) {
+	file, err := os.CreateTemp(f.spoolDir, "kvstore-snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := &spooledSnapshot{Reader: file, file: file}
+	fail := func(err error) (io.ReadCloser, error) {
+		spool.Close()
+		return nil, err
+	}
+	var out io.Writer = file
+	var sealer *sealingWriter
+	if f.keyring != nil {
+		sealer = newSealingWriter(file, f.keyring, spoolAAD)
+		out = sealer
+	}
+
+	// Every line but the last is part of the body, which is only known once
+	// the next line has been read
+	hash := crc32.New(snapshotCRC)
+	w := bufio.NewWriter(io.MultiWriter(out, hash))
+	var last []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if last != nil {
+				if _, err := w.Write(last); err != nil {
+					return fail(err)
+				}
+			}
+			last = line
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return fail(err)
+		}
+	}
+
+	var trailer snapshotTrailer
+	if err := json.Unmarshal(last, &trailer); err != nil || trailer.Checksum == nil {
+		return fail(fmt.Errorf("%w: missing trailer", ErrCorruptSnapshot))
+	}
+	if *trailer.Checksum != hash.Sum32() {
+		return fail(ErrCorruptSnapshot)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	if f.keyring != nil {
+		spool.Reader = newOpeningReader(file, f.keyring, spoolAAD)
+	}
+	return spool, nil
+}
+
+// spooledSnapshot reads a snapshot spooled to a temporary file
+type spooledSnapshot struct {
+	io.Reader
+	file *os.File
+}
+
+// Close closes and removes the file
+func (s *spooledSnapshot) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// snapshotData is the encoded form of a snapshot written before snapshots
+// were streamed
+type snapshotData struct {
+	Time       int64                           `json:"time"`
+	Index      uint64                          `json:"index,omitempty"`
+	Data       map[string]storage.Value        `json:"data"`
+	Ranks      map[string]storage.EvictionRank `json:"ranks,omitempty"`
+	History    *historySnapshot                `json:"history,omitempty"`
+	Namespaces map[string]NamespaceConfig      `json:"namespaces,omitempty"`
+}
+
+// snapshotTrailer follows the encoded snapshot and holds its checksum
+type snapshotTrailer struct {
+	Checksum *uint32 `json:"checksum"`
+}
+
+// snapshotCRC is the CRC32 table snapshots are checksummed with
+var snapshotCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// decodeSnapshot reads and verifies a snapshot written before snapshots
+// were streamed. Snapshots written before
+// the time was recorded are a plain map of keys to values and restore with
+// a zero time, those written before checksums were added have no trailer.
+func decodeSnapshot(r io.Reader) (snapshotData, error) {
+	var snap snapshotData
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return snap, err
+	}
+	
+	var raw map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&raw); err != nil {
+		return snap, err
+	}
+	body := data[:dec.InputOffset()]
+	
+	var trailer snapshotTrailer
+	if err := dec.Decode(&trailer); err != nil && err != io.EOF {
+		return snap, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	if trailer.Checksum != nil && *trailer.Checksum != crc32.Checksum(body, snapshotCRC) {
+		return snap, ErrCorruptSnapshot
+	}
+
+	// Values in the legacy format are objects, the time never is
+	if t, ok := raw["time"]; ok && len(t) > 0 && t[0] != '{' {
+		if err := json.Unmarshal(t, &snap.Time); err != nil {
+			return snap, err
+		}
+		if err := json.Unmarshal(raw["data"], &snap.Data); err != nil {
+			return snap, err
+		}
+		if b, ok := raw["index"]; ok {
+			if err := json.Unmarshal(b, &snap.Index); err != nil {
+				return snap, err
+			}
+		}
+		if b, ok := raw["ranks"]; ok {
+			if err := json.Unmarshal(b, &snap.Ranks); err != nil {
+				return snap, err
+			}
+		}
+		if b, ok := raw["history"]; ok {
+			if err := json.Unmarshal(b, &snap.History); err != nil {
+				return snap, err
+			}
+		}
+		if b, ok := raw["namespaces"]; ok {
+			if err := json.Unmarshal(b, &snap.Namespaces); err != nil {
+				return snap, err
+			}
+		}
+		return snap, nil
+	}
+
+	snap.Data = make(map[string]storage.Value, len(raw))
+	for key, b := range raw {
+		var value storage.Value
+		if err := json.Unmarshal(b, &value); err != nil {
+			return snap, err
+		}
+		snap.Data[key] = value
+	}
+	return snap, nil
+}
+
 // fsmSnapshot implements the raft.FSMSnapshot interface
 type fsmSnapshot struct {
-	data map[string]storage.Value
+	view   *storeView
+	header snapshotHeader
 }
 
-// Persist writes the snapshot to the given sink
+// Persist streams the snapshot to the given sink one key at a time,
+// followed by its checksum
 func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	err := json.NewEncoder(sink).Encode(s.data)
+	defer s.view.close()
+	
+	hash := crc32.New(snapshotCRC)
+	w := bufio.NewWriter(io.MultiWriter(sink, hash))
+	if err := s.write(w); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	
+	checksum := hash.Sum32()
+	trailer, err := json.Marshal(snapshotTrailer{Checksum: &checksum})
 	if err != nil {
 		sink.Cancel()
 		return err
 	}
+	if _, err := sink.Write(append(trailer, '\n')); err != nil {
+		sink.Cancel()
+		return err
+	}
 	
 	return sink.Close()
 }
 
-// Release is a no-op
-func (s *fsmSnapshot) Release() {}
\ No newline at end of file
+// write writes the body of the snapshot to w
+func (s *fsmSnapshot) write(w io.Writer) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(s.header); err != nil {
+		return err
+	}
+	
+	var encodeErr error
+	err := s.view.iterate(func(key string, value storage.Value) bool {
+		encodeErr = enc.Encode(snapshotRecord{Key: key, Value: value})
+		return encodeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return encodeErr
+}
+
+// Release stops the store keeping values for the snapshot
+func (s *fsmSnapshot) Release() {
+	s.view.close()
+}
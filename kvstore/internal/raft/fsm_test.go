@@ -0,0 +1,405 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// logIndex numbers the entries applied by tests
+var logIndex uint64
+
+// applyResult applies cmd as the next log entry and returns its result
+func applyResult(t *testing.T, f *FSM, cmd Command) *ApplyResult {
+	b, err := json.Marshal(cmd)
+	require.NoError(t, err)
+	logIndex++
+	result, ok := f.Apply(&raft.Log{Index: logIndex, Data: b}).(*ApplyResult)
+	require.True(t, ok)
+	return result
+}
+
+// applyCommand applies cmd and returns the response of its op, its error
+// if it failed
+func applyCommand(t *testing.T, f *FSM, cmd Command) interface{} {
+	result := applyResult(t, f, cmd)
+	if result.Err != nil {
+		return result.Err
+	}
+	return result.Data
+}
+
+// snapshotSink collects a persisted snapshot in memory
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "test" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
+func TestFSMReplicatedExpiration(t *testing.T) {
+	// Two replicas applying the same log agree on expirations regardless
+	// of when they apply it
+	replicas := []*storage.MemoryStorage{storage.NewMemoryStorage(), storage.NewMemoryStorage()}
+	for _, store := range replicas {
+		f := newFSM(store, zap.NewNop())
+
+		assert.IsType(t, uint64(0), applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1"), Expiration: 2000}, Time: 1000}))
+		assert.IsType(t, uint64(0), applyCommand(t, f, Command{Op: "set", Key: "b", Value: storage.Value{Data: []byte("2"), Expiration: 4000}, Time: 1500}))
+
+		// The wall clock is far past both expirations, the replicated one is not
+		assert.True(t, store.Has("a"))
+		assert.True(t, store.Has("b"))
+
+		assert.Equal(t, 1, applyCommand(t, f, Command{Op: "expire", Keys: []string{"a", "b"}, Time: 3000}))
+		assert.False(t, store.Has("a"))
+		assert.True(t, store.Has("b"))
+		assert.Equal(t, []string{"b"}, store.Keys())
+	}
+}
+
+func TestFSMClockIsMonotonic(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+
+	applyCommand(t, f, Command{Op: "delete", Key: "x", Time: 5000})
+	applyCommand(t, f, Command{Op: "delete", Key: "x", Time: 4000})
+	assert.Equal(t, int64(5000), f.now())
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1"), Expiration: 9000}, Time: 7000})
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	store := storage.NewMemoryStorage()
+	restored := newFSM(store, zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	assert.Equal(t, int64(7000), restored.now())
+	assert.True(t, store.Has("a"))
+}
+
+func TestFSMRestoreEncryptedSpool(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("secret")}})
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	// The spooled copy of the snapshot is encrypted and removed afterwards
+	store := storage.NewMemoryStorage()
+	restored := newFSM(store, zap.NewNop())
+	restored.keyring = testKeyring(t, 1)
+	restored.spoolDir = t.TempDir()
+	spool, err := restored.spoolSnapshot(bufio.NewReader(bytes.NewReader(sink.Bytes())))
+	require.NoError(t, err)
+	files, err := os.ReadDir(restored.spoolDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	raw, err := os.ReadFile(filepath.Join(restored.spoolDir, files[0].Name()))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte(`"key":"a"`)))
+	require.NoError(t, spool.Close())
+
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	value, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(value.Data))
+	files, err = os.ReadDir(restored.spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFSMRejectsCorruptSnapshot(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}, Time: 7000})
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	corrupt := bytes.Replace(sink.Bytes(), []byte(`"MQ=="`), []byte(`"OQ=="`), 1)
+
+	// The store is left alone when a snapshot fails verification
+	store := storage.NewMemoryStorage()
+	require.NoError(t, store.Set("b", storage.Value{Data: []byte("2")}))
+	restored := newFSM(store, zap.NewNop())
+	assert.ErrorIs(t, restored.Restore(io.NopCloser(bytes.NewReader(corrupt))), ErrCorruptSnapshot)
+	assert.True(t, store.Has("b"))
+	assert.False(t, store.Has("a"))
+
+	// So is it when the trailer is cut off
+	truncated := sink.Bytes()[:bytes.LastIndexByte(sink.Bytes()[:sink.Len()-1], '\n')+1]
+	assert.ErrorIs(t, restored.Restore(io.NopCloser(bytes.NewReader(truncated))), ErrCorruptSnapshot)
+	assert.True(t, store.Has("b"))
+
+	// Snapshots written before checksums were added have no trailer
+	body, err := json.Marshal(snapshotData{Time: 7000, Data: map[string]storage.Value{"a": {Data: []byte("1")}}})
+	require.NoError(t, err)
+	require.NoError(t, restored.Restore(io.NopCloser(bytes.NewReader(body))))
+	assert.True(t, store.Has("a"))
+}
+
+func TestFSMSnapshotIsPointInTime(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	for _, key := range []string{"a", "b", "c"} {
+		applyCommand(t, f, Command{Op: "set", Key: key, Value: storage.Value{Data: []byte("1")}})
+	}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+
+	// Entries applied before the snapshot is persisted do not show in it
+	applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("2")}})
+	applyCommand(t, f, Command{Op: "delete", Key: "b"})
+	applyCommand(t, f, Command{Op: "set", Key: "d", Value: storage.Value{Data: []byte("2")}})
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	store := storage.NewMemoryStorage()
+	restored := newFSM(store, zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, store.Keys())
+	value, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(value.Data))
+
+	// Keys written once the snapshot has been iterated past them are only
+	// read once
+	snap, err = f.Snapshot()
+	require.NoError(t, err)
+	var keys []string
+	err = snap.(*fsmSnapshot).view.iterate(func(key string, value storage.Value) bool {
+		keys = append(keys, key+"="+string(value.Data))
+		if key == "c" {
+			applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("3")}})
+			applyCommand(t, f, Command{Op: "delete", Key: "c"})
+		}
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=2", "c=1", "d=2"}, keys)
+	snap.Release()
+
+	// Nothing is saved once the snapshot is released
+	applyCommand(t, f, Command{Op: "set", Key: "c", Value: storage.Value{Data: []byte("2")}})
+	assert.Empty(t, f.snapshots.views)
+}
+
+func TestFSMRestoreLegacySnapshot(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	legacy := `{"time":{"Data":"MQ==","Expiration":0},"data":{"Data":"Mg==","Expiration":0}}`
+	require.NoError(t, f.Restore(io.NopCloser(bytes.NewBufferString(legacy))))
+
+	val, err := store.Get("time")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val.Data)
+	assert.ElementsMatch(t, []string{"time", "data"}, store.Keys())
+}
+
+func TestFSMSnapshotKeepsEvictionOrder(t *testing.T) {
+	opts := storage.MemoryStorageOptions{MaxMemory: 3 * 98, EvictionPolicy: storage.AllKeysLRU}
+	source := storage.NewMemoryStorageWithOptions(opts)
+	f := newFSM(source, zap.NewNop())
+	for _, key := range []string{"c", "a", "b"} {
+		applyCommand(t, f, Command{Op: "set", Key: key, Value: storage.Value{Data: []byte("x")}})
+	}
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	target := storage.NewMemoryStorageWithOptions(opts)
+	restored := newFSM(target, zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	// Both replicas evict the least recently written key, not the first in key order
+	for _, fsm := range []*FSM{f, restored} {
+		applyCommand(t, fsm, Command{Op: "set", Key: "d", Value: storage.Value{Data: []byte("x")}})
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, source.Keys())
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, target.Keys())
+}
+
+func TestFSMRevisions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	rev := applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}}).(uint64)
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, rev, val.Revision)
+
+	// Compare-and-swap against the current revision
+	stale := &Precondition{Match: []uint64{rev - 1}}
+	assert.Equal(t, ErrPreconditionFailed, applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("2")}, If: stale}))
+	next := applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("2")}, If: &Precondition{Match: []uint64{rev}}})
+	assert.Greater(t, next.(uint64), rev)
+
+	// Create only if absent
+	assert.Equal(t, ErrPreconditionFailed, applyCommand(t, f, Command{Op: "set", Key: "a", If: &Precondition{NotExists: true}}))
+	assert.IsType(t, uint64(0), applyCommand(t, f, Command{Op: "set", Key: "b", If: &Precondition{NotExists: true}}))
+
+	// Conditional delete
+	assert.Equal(t, ErrPreconditionFailed, applyCommand(t, f, Command{Op: "delete", Key: "a", If: &Precondition{Match: []uint64{rev}}}))
+	assert.Nil(t, applyCommand(t, f, Command{Op: "delete", Key: "a", If: &Precondition{NoneMatch: []uint64{rev}}}))
+	assert.False(t, store.Has("a"))
+	assert.Equal(t, ErrPreconditionFailed, applyCommand(t, f, Command{Op: "delete", Key: "a", If: &Precondition{Exists: true}}))
+}
+
+func TestFSMTimestamps(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	set := func(data string, at int64) storage.Value {
+		applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte(data), ContentType: "text/plain"}, Time: at})
+		val, err := store.Get("a")
+		require.NoError(t, err)
+		return val
+	}
+
+	// Times come from the entry, a key keeps its creation time when rewritten
+	first := set("1", 1000)
+	assert.Equal(t, int64(1000), first.Created)
+	assert.Equal(t, int64(1000), first.Modified)
+	assert.Equal(t, "text/plain", first.ContentType)
+	second := set("2", 2000)
+	assert.Equal(t, int64(1000), second.Created)
+	assert.Equal(t, int64(2000), second.Modified)
+
+	applyCommand(t, f, Command{Op: "delete", Key: "a", Time: 3000})
+	assert.Equal(t, int64(4000), set("3", 4000).Created)
+}
+
+func TestFSMRepair(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	revision := applyResult(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}}).Revision
+	healthy, err := store.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("a", storage.Value{Data: []byte("garbage")}))
+
+	// Copies from a replica that is behind, or of a later write, would not
+	// match the applied state
+	assert.Equal(t, ErrStaleRepair, f.repair("a", healthy, revision-1))
+	assert.Equal(t, ErrStaleRepair, f.repair("a", storage.Value{Data: []byte("2"), Revision: revision + 1}, revision+1))
+
+	require.NoError(t, f.repair("a", healthy, revision+5))
+	value, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value.Data)
+}
+
+func TestFSMEvictions(t *testing.T) {
+	// An entry of one byte under a one byte key of namespace q takes 104
+	// bytes of the budget
+	store := storage.NewMemoryStorageWithOptions(storage.MemoryStorageOptions{MaxMemory: 3 * 104, EvictionPolicy: storage.AllKeysLRU})
+	f := newFSM(store, zap.NewNop())
+	f.history = newHistory(HistoryOptions{MaxVersions: 10})
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "q"})
+
+	key := func(k string) string { return namespacePrefix("q") + k }
+	set := func(k string, data []byte) interface{} {
+		return applyCommand(t, f, Command{Op: "set", Namespace: "q", Key: key(k), Value: storage.Value{Data: data}})
+	}
+	set("a", []byte("x"))
+	set("b", []byte("x"))
+	set("c", []byte("x"))
+	rev := set("d", []byte("x")).(uint64)
+
+	// The evicted key stops counting against the quotas
+	assert.False(t, store.Has(key("a")))
+	assert.Equal(t, NamespaceUsage{Keys: 3, Bytes: 6}, f.quotas.usage("q"))
+
+	// A transaction that is rolled back brings back the keys its writes
+	// evicted
+	res := applyCommand(t, f, Command{Op: "txn", Namespace: "q", Txn: &Txn{
+		Success: []TxnOp{
+			{Op: "set", Key: key("e"), Value: storage.Value{Data: []byte("x")}},
+			{Op: "set", Key: key("f"), Value: storage.Value{Data: make([]byte, 1000)}},
+		},
+	}})
+	assert.Equal(t, storage.ErrOutOfMemory, res)
+	assert.ElementsMatch(t, []string{key("b"), key("c"), key("d")}, store.Keys())
+	assert.Equal(t, NamespaceUsage{Keys: 3, Bytes: 6}, f.quotas.usage("q"))
+
+	// The history records the eviction as a delete
+	value, err := f.GetAt(key("a"), rev-1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("x"), value.Data)
+	_, err = f.GetAt(key("a"), rev)
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+
+	// Upload records and chunks are part of other values and never evicted
+	assert.True(t, evictable(key("a")))
+	assert.False(t, evictable(uploadKey(namespacePrefix("q"), "u1")))
+	assert.False(t, evictable(chunkKey("", "u1", 1)))
+}
+
+func TestFSMWritesOverCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewLogStorage(dir, storage.DefaultLogStorageOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	f := newFSM(store, zap.NewNop())
+
+	// Flip a byte of the key of each record, so that it fails its checksum
+	for _, key := range []string{"key-a", "key-b", "key-c"} {
+		applyCommand(t, f, Command{Op: "set", Key: key, Value: storage.Value{Data: []byte("1")}})
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.data"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	file, err := os.OpenFile(files[0], os.O_WRONLY, 0)
+	require.NoError(t, err)
+	for _, key := range []string{"key-a", "key-b", "key-c"} {
+		offset := bytes.Index(data, []byte(key))
+		_, err = file.WriteAt([]byte{data[offset] ^ 0xff}, int64(offset))
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.Close())
+	_, err = store.Get("key-a")
+	require.Equal(t, storage.ErrCorruptRecord, err)
+
+	// Writes take a record this replica cannot read as missing, like
+	// replicas that never held it, instead of failing
+	rev := applyCommand(t, f, Command{Op: "set", Key: "key-a", Value: storage.Value{Data: []byte("2")}})
+	assert.IsType(t, uint64(0), rev)
+	value, err := store.Get("key-a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value.Data)
+
+	res := applyCommand(t, f, Command{Op: "set", Key: "key-b", Value: storage.Value{Data: []byte("2")}, If: &Precondition{NotExists: true}})
+	assert.IsType(t, uint64(0), res)
+
+	res = applyCommand(t, f, Command{Op: "txn", Txn: &Txn{
+		Compare: []Compare{{Key: "key-c", Target: "exists", Exists: false}},
+		Success: []TxnOp{{Op: "set", Key: "key-c", Value: storage.Value{Data: []byte("2")}}},
+	}})
+	require.IsType(t, &TxnResult{}, res)
+	assert.True(t, res.(*TxnResult).Succeeded)
+	value, err = store.Get("key-c")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value.Data)
+}
@@ -0,0 +1,311 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+var (
+	// ErrCompacted is returned when reading a revision whose versions have
+	// been discarded by compaction or retention
+	ErrCompacted = errors.New("revision has been compacted")
+
+	// ErrFutureRevision is returned when reading or compacting a revision
+	// that has not been applied yet
+	ErrFutureRevision = errors.New("revision has not been applied yet")
+)
+
+// HistoryOptions controls how many prior versions of each key are kept.
+// Every replica must use the same options, retention is applied as part
+// of the state machine.
+type HistoryOptions struct {
+	MaxVersions int           // Versions kept per key, 0 for no limit
+	MaxAge      time.Duration // How long a replaced version is kept, 0 for no limit
+}
+
+// enabled reports whether any history is kept. Without a limit on either
+// count or age history would grow forever, so it is off.
+func (o HistoryOptions) enabled() bool {
+	return o.MaxVersions > 0 || o.MaxAge > 0
+}
+
+// Version is a value a key had from a revision on
+type Version struct {
+	Revision   uint64 `json:"revision"`
+	Value      []byte `json:"value,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+	Encoding   string `json:"encoding,omitempty"` // Codec Value is compressed with
+	Type       string `json:"type,omitempty"`     // Data structure or chunked value Value holds
+	Deleted    bool   `json:"deleted,omitempty"`  // The key was deleted at this revision
+	Time       int64  `json:"time"`               // Replicated time the version was written at
+}
+
+// KeyHistory is the retained versions of a key, oldest first
+type KeyHistory struct {
+	Versions []Version `json:"versions"`
+	Trimmed  bool      `json:"trimmed,omitempty"` // Older versions were discarded
+}
+
+// droppedVersion is a chunked version discarded by retention or
+// compaction, whose chunks may be released
+type droppedVersion struct {
+	key     string
+	version Version
+}
+
+// history keeps the versions of every key written while it is enabled
+type history struct {
+	opts      HistoryOptions
+	mutex     sync.RWMutex
+	keys      map[string]*KeyHistory
+	compacted uint64           // Revisions before this one have been compacted
+	dropped   []droppedVersion // Chunked versions discarded since the last takeDropped
+}
+
+// newHistory creates an empty history
+func newHistory(opts HistoryOptions) *history {
+	return &history{
+		opts: opts,
+		keys: make(map[string]*KeyHistory),
+	}
+}
+
+// tracks reports whether the history has versions of key
+func (h *history) tracks(key string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	_, ok := h.keys[key]
+	return ok
+}
+
+// recordSet records value as the version of key written at its revision.
+// existed reports whether the key had a value the history does not know.
+func (h *history) recordSet(key string, value storage.Value, existed bool, now int64) {
+	h.record(key, Version{
+		Revision:   value.Revision,
+		Value:      value.Data,
+		Expiration: value.Expiration,
+		Encoding:   value.Encoding,
+		Type:       value.Type,
+		Time:       now,
+	}, existed, now)
+}
+
+// recordDelete records that key was deleted at revision
+func (h *history) recordDelete(key string, revision uint64, now int64) {
+	h.record(key, Version{Revision: revision, Deleted: true, Time: now}, false, now)
+}
+
+// record appends a version of key and applies retention to its versions
+func (h *history) record(key string, v Version, existed bool, now int64) {
+	if !h.opts.enabled() {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	kh, ok := h.keys[key]
+	if !ok {
+		if v.Deleted {
+			// Nothing is known about a key that was never written
+			return
+		}
+		kh = &KeyHistory{Trimmed: existed}
+		h.keys[key] = kh
+	} else if last := kh.Versions[len(kh.Versions)-1]; v.Deleted && last.Deleted {
+		return
+	}
+
+	kh.Versions = append(kh.Versions, v)
+	h.prune(key, kh, now)
+}
+
+// prune discards the versions of key beyond the retention limits
+func (h *history) prune(key string, kh *KeyHistory, now int64) {
+	drop := 0
+	if h.opts.MaxVersions > 0 && len(kh.Versions) > h.opts.MaxVersions {
+		drop = len(kh.Versions) - h.opts.MaxVersions
+	}
+	if h.opts.MaxAge > 0 {
+		// A version ages from the moment the next one replaced it
+		cutoff := now - int64(h.opts.MaxAge)
+		for drop < len(kh.Versions)-1 && kh.Versions[drop+1].Time < cutoff {
+			drop++
+		}
+	}
+	if drop > 0 {
+		h.drop(key, kh.Versions[:drop])
+		kh.Versions = append([]Version(nil), kh.Versions[drop:]...)
+		kh.Trimmed = true
+	}
+
+	if len(kh.Versions) == 1 && kh.Versions[0].Deleted {
+		delete(h.keys, key)
+	}
+}
+
+// pruneAll applies retention to the versions of every key. Versions of a
+// key that is not written again only age out this way.
+func (h *history) pruneAll(now int64) {
+	if !h.opts.enabled() {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for key, kh := range h.keys {
+		h.prune(key, kh, now)
+	}
+}
+
+// drop remembers the chunked versions among the discarded versions of key
+func (h *history) drop(key string, versions []Version) {
+	for _, v := range versions {
+		if v.Type == storage.TypeChunked {
+			h.dropped = append(h.dropped, droppedVersion{key: key, version: v})
+		}
+	}
+}
+
+// takeDropped returns the chunked versions discarded since it was last
+// called
+func (h *history) takeDropped() []droppedVersion {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	dropped := h.dropped
+	h.dropped = nil
+	return dropped
+}
+
+// retains reports whether the version of key written at revision is kept
+func (h *history) retains(key string, revision uint64) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if kh, ok := h.keys[key]; ok {
+		for _, v := range kh.Versions {
+			if v.Revision == revision && !v.Deleted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// at returns the version of key at revision. tracked is false if the
+// history knows nothing about the key.
+func (h *history) at(key string, revision uint64) (v Version, tracked bool, err error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if revision < h.compacted {
+		return Version{}, true, ErrCompacted
+	}
+	kh, ok := h.keys[key]
+	if !ok {
+		return Version{}, false, nil
+	}
+
+	for i := len(kh.Versions) - 1; i >= 0; i-- {
+		if kh.Versions[i].Revision <= revision {
+			return kh.Versions[i], true, nil
+		}
+	}
+	if kh.Trimmed {
+		return Version{}, true, ErrCompacted
+	}
+	// The key did not exist yet
+	return Version{Revision: revision, Deleted: true}, true, nil
+}
+
+// get returns a copy of the versions of key
+func (h *history) get(key string) (KeyHistory, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	kh, ok := h.keys[key]
+	if !ok {
+		return KeyHistory{}, false
+	}
+	return KeyHistory{
+		Versions: append([]Version(nil), kh.Versions...),
+		Trimmed:  kh.Trimmed || h.compacted > 0,
+	}, true
+}
+
+// compact discards every version that was replaced before revision, so
+// that reads at earlier revisions fail with ErrCompacted
+func (h *history) compact(revision uint64, now int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if revision <= h.compacted {
+		return
+	}
+	h.compacted = revision
+
+	for key, kh := range h.keys {
+		// Keep the version current at revision and every later one
+		keep := 0
+		for i, v := range kh.Versions {
+			if v.Revision <= revision {
+				keep = i
+			}
+		}
+		if keep > 0 {
+			h.drop(key, kh.Versions[:keep])
+			kh.Versions = append([]Version(nil), kh.Versions[keep:]...)
+			kh.Trimmed = true
+		}
+		h.prune(key, kh, now)
+	}
+}
+
+// historySnapshot is the encoded form of a history in a snapshot
+type historySnapshot struct {
+	Keys      map[string]*KeyHistory `json:"keys"`
+	Compacted uint64                 `json:"compacted,omitempty"`
+}
+
+// snapshot returns a copy of the history
+func (h *history) snapshot() *historySnapshot {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if len(h.keys) == 0 && h.compacted == 0 {
+		return nil
+	}
+	keys := make(map[string]*KeyHistory, len(h.keys))
+	for key, kh := range h.keys {
+		keys[key] = &KeyHistory{
+			Versions: append([]Version(nil), kh.Versions...),
+			Trimmed:  kh.Trimmed,
+		}
+	}
+	return &historySnapshot{Keys: keys, Compacted: h.compacted}
+}
+
+// restore replaces the history with a snapshot of it
+func (h *history) restore(snap *historySnapshot) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.keys = make(map[string]*KeyHistory)
+	h.compacted = 0
+	h.dropped = nil
+	if snap == nil {
+		return
+	}
+	for key, kh := range snap.Keys {
+		if kh != nil && len(kh.Versions) > 0 {
+			h.keys[key] = kh
+		}
+	}
+	h.compacted = snap.Compacted
+}
@@ -0,0 +1,208 @@
+package raft
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newHistoryFSM creates a state machine keeping history with opts
+func newHistoryFSM(opts HistoryOptions) (*FSM, *storage.MemoryStorage) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+	f.history = newHistory(opts)
+	return f, store
+}
+
+func setValue(t *testing.T, f *FSM, key, data string, at int64) uint64 {
+	return applyCommand(t, f, Command{Op: "set", Key: key, Value: storage.Value{Data: []byte(data)}, Time: at}).(uint64)
+}
+
+func TestFSMGetAt(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxVersions: 10})
+
+	r1 := setValue(t, f, "a", "1", 1000)
+	r2 := setValue(t, f, "a", "2", 2000)
+	applyCommand(t, f, Command{Op: "delete", Key: "a", Time: 3000})
+	r4 := setValue(t, f, "a", "4", 4000)
+
+	value, err := f.GetAt("a", r1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value.Data)
+	assert.Equal(t, r1, value.Revision)
+
+	value, err = f.GetAt("a", r2+1)
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+
+	value, err = f.GetAt("a", r4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4"), value.Data)
+
+	_, err = f.GetAt("a", r1-1)
+	assert.Equal(t, storage.ErrKeyNotFound, err, "the key did not exist before its first write")
+	_, err = f.GetAt("a", r4+1)
+	assert.Equal(t, ErrFutureRevision, err)
+
+	kh, err := f.History("a")
+	require.NoError(t, err)
+	require.Len(t, kh.Versions, 4)
+	assert.True(t, kh.Versions[2].Deleted)
+	assert.Equal(t, int64(2000), kh.Versions[1].Time)
+	assert.False(t, kh.Trimmed)
+}
+
+func TestFSMHistoryRetention(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxVersions: 2})
+
+	r1 := setValue(t, f, "a", "1", 1000)
+	r2 := setValue(t, f, "a", "2", 2000)
+	setValue(t, f, "a", "3", 3000)
+
+	_, err := f.GetAt("a", r1)
+	assert.Equal(t, ErrCompacted, err)
+	value, err := f.GetAt("a", r2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value.Data)
+
+	// Versions replaced longer ago than the age limit are discarded
+	f, _ = newHistoryFSM(HistoryOptions{MaxAge: time.Duration(1500)})
+	r1 = setValue(t, f, "a", "1", 1000)
+	r2 = setValue(t, f, "a", "2", 2000)
+	setValue(t, f, "a", "3", 4000)
+
+	_, err = f.GetAt("a", r1)
+	assert.Equal(t, ErrCompacted, err)
+	_, err = f.GetAt("a", r2)
+	assert.NoError(t, err)
+}
+
+func TestFSMPruneHistory(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxAge: time.Duration(1500)})
+	r1 := setValue(t, f, "a", "1", 1000)
+	setValue(t, f, "a", "2", 2000)
+	r3 := setValue(t, f, "b", "1", 2000)
+	applyCommand(t, f, Command{Op: "delete", Key: "b", Time: 2000})
+
+	// Versions age out without their key being written again
+	applyCommand(t, f, Command{Op: "prune_history", Time: 3000})
+	_, err := f.GetAt("a", r1)
+	assert.NoError(t, err)
+	applyCommand(t, f, Command{Op: "prune_history", Time: 4000})
+	_, err = f.GetAt("a", r1)
+	assert.Equal(t, ErrCompacted, err)
+
+	// Nothing is left of a deleted key once its versions aged out
+	_, err = f.GetAt("b", r3)
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+	assert.False(t, f.history.tracks("b"))
+}
+
+func TestFSMHistoryDisabled(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+
+	r1 := setValue(t, f, "a", "1", 1000)
+	r2 := setValue(t, f, "a", "2", 2000)
+
+	_, err := f.GetAt("a", r1)
+	assert.Equal(t, ErrCompacted, err)
+	value, err := f.GetAt("a", r2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value.Data)
+
+	kh, err := f.History("a")
+	require.NoError(t, err)
+	assert.Len(t, kh.Versions, 1)
+	assert.True(t, kh.Trimmed)
+}
+
+func TestFSMCompact(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxVersions: 10})
+
+	r1 := setValue(t, f, "a", "1", 1000)
+	r2 := setValue(t, f, "a", "2", 2000)
+	r3 := setValue(t, f, "a", "3", 3000)
+
+	applyCommand(t, f, Command{Op: "compact", Revision: r2})
+
+	_, err := f.GetAt("a", r1)
+	assert.Equal(t, ErrCompacted, err)
+	value, err := f.GetAt("a", r2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value.Data)
+
+	// The version current at the compaction revision is kept
+	kh, err := f.History("a")
+	require.NoError(t, err)
+	require.Len(t, kh.Versions, 2)
+	assert.Equal(t, r2, kh.Versions[0].Revision)
+	assert.Equal(t, r3, kh.Versions[1].Revision)
+	assert.True(t, kh.Trimmed)
+}
+
+func TestFSMHistoryTxn(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxVersions: 10})
+
+	r1 := setValue(t, f, "a", "1", 1000)
+	applyCommand(t, f, Command{Op: "txn", Txn: &Txn{Success: []TxnOp{
+		{Op: "set", Key: "a", Value: storage.Value{Data: []byte("2")}},
+		{Op: "delete", Key: "b"},
+	}}, Time: 2000})
+
+	value, err := f.GetAt("a", r1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value.Data)
+
+	kh, err := f.History("a")
+	require.NoError(t, err)
+	assert.Len(t, kh.Versions, 2)
+	_, err = f.History("b")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+}
+
+func TestFSMSnapshotKeepsHistory(t *testing.T) {
+	f, _ := newHistoryFSM(HistoryOptions{MaxVersions: 10})
+	r1 := setValue(t, f, "a", "1", 1000)
+	setValue(t, f, "a", "2", 2000)
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	restored, _ := newHistoryFSM(HistoryOptions{MaxVersions: 10})
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	value, err := restored.GetAt("a", r1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value.Data)
+	assert.Equal(t, f.appliedIndex(), restored.appliedIndex())
+}
+
+func TestFSMHistoryDecodesCompressedValues(t *testing.T) {
+	codec := storage.FlateCodec{Level: 1}
+	store := storage.NewCompressedStorage(storage.NewMemoryStorage(), codec)
+	f := newFSM(store, zap.NewNop())
+	f.history = newHistory(HistoryOptions{MaxVersions: 10})
+
+	data := []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	compressed, err := codec.Compress(data)
+	require.NoError(t, err)
+
+	// The leader replicates values already compressed
+	r1 := applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: compressed, Encoding: "flate"}}).(uint64)
+	setValue(t, f, "a", "2", 0)
+
+	value, err := f.GetAt("a", r1)
+	require.NoError(t, err)
+	assert.Equal(t, data, value.Data)
+	assert.Empty(t, value.Encoding)
+
+	kh, err := f.History("a")
+	require.NoError(t, err)
+	assert.Equal(t, data, kh.Versions[0].Value)
+}
@@ -0,0 +1,450 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+var (
+	// ErrNamespaceNotFound is returned for operations on a namespace that
+	// has not been created or has been dropped
+	ErrNamespaceNotFound = errors.New("namespace not found")
+
+	// ErrInvalidNamespace is returned for a namespace name that is not
+	// allowed
+	ErrInvalidNamespace = errors.New("invalid namespace name")
+
+	// ErrReservedKey is returned when a key uses a prefix the keys of
+	// named namespaces or of uploads are stored under
+	ErrReservedKey = errors.New("key uses a reserved prefix")
+)
+
+// namespaceKeyPrefix starts the stored keys of every named namespace. Keys
+// of namespace ns are stored as namespaceKeyPrefix + ns + "/" + key, the
+// default namespace uses its keys as they are.
+const namespaceKeyPrefix = "\x00ns/"
+
+// namespaceName is the pattern namespace names must match, which keeps
+// them free of slashes and safe in a URL path
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// ValidateNamespace checks that name can be used as a namespace name
+func ValidateNamespace(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("%w %q", ErrInvalidNamespace, name)
+	}
+	return nil
+}
+
+// namespacePrefix returns the prefix the keys of namespace name are
+// stored under
+func namespacePrefix(name string) string {
+	return namespaceKeyPrefix + name + "/"
+}
+
+// checkDefaultKey rejects keys of the default namespace that would be
+// stored among the keys of a named namespace or of an upload
+func checkDefaultKey(key string) error {
+	if strings.HasPrefix(key, namespaceKeyPrefix) || isUploadKey(key) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// checkNamespaceKey rejects keys of a named namespace that would be stored
+// among the keys of its uploads
+func checkNamespaceKey(key string) error {
+	if isUploadKey(key) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// checkTxnKeys checks every key a transaction compares or writes with check
+func checkTxnKeys(txn *Txn, check func(key string) error) error {
+	for _, c := range txn.Compare {
+		if err := check(c.Key); err != nil {
+			return err
+		}
+	}
+	return checkOpKeys(append(append([]TxnOp(nil), txn.Success...), txn.Failure...), check)
+}
+
+// checkOpKeys checks the key of every op with check
+func checkOpKeys(ops []TxnOp, check func(key string) error) error {
+	for _, op := range ops {
+		if err := check(op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NamespaceConfig holds the settings of a namespace. Quotas of 0 mean no
+// limit.
+type NamespaceConfig struct {
+	DefaultTTL   time.Duration `json:"default_ttl,omitempty"`    // Expiration of writes that set none, 0 for none
+	MaxKeys      int64         `json:"max_keys,omitempty"`       // Keys the namespace may hold
+	MaxBytes     int64         `json:"max_bytes,omitempty"`      // Total size of its keys and values
+	MaxValueSize int64         `json:"max_value_size,omitempty"` // Size of a single value
+}
+
+// namespaceRegistry holds the configuration of every named namespace
+type namespaceRegistry struct {
+	mutex   sync.RWMutex
+	configs map[string]NamespaceConfig
+}
+
+// newNamespaceRegistry creates an empty registry
+func newNamespaceRegistry() *namespaceRegistry {
+	return &namespaceRegistry{configs: make(map[string]NamespaceConfig)}
+}
+
+// get returns the configuration of namespace name
+func (r *namespaceRegistry) get(name string) (NamespaceConfig, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	config, ok := r.configs[name]
+	return config, ok
+}
+
+// put creates or reconfigures namespace name
+func (r *namespaceRegistry) put(name string, config NamespaceConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.configs[name] = config
+}
+
+// remove removes namespace name and reports whether it existed
+func (r *namespaceRegistry) remove(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.configs[name]
+	delete(r.configs, name)
+	return ok
+}
+
+// snapshot returns a copy of the registry, nil if it is empty
+func (r *namespaceRegistry) snapshot() map[string]NamespaceConfig {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.configs) == 0 {
+		return nil
+	}
+	configs := make(map[string]NamespaceConfig, len(r.configs))
+	for name, config := range r.configs {
+		configs[name] = config
+	}
+	return configs
+}
+
+// restore replaces the registry with a snapshot of it
+func (r *namespaceRegistry) restore(configs map[string]NamespaceConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.configs = make(map[string]NamespaceConfig, len(configs))
+	for name, config := range configs {
+		r.configs[name] = config
+	}
+}
+
+// deleteKeys deletes every key stored under prefix at log index index and
+// returns how many were deleted. The default namespace, with an empty
+// prefix, leaves the keys of named namespaces alone.
+func (f *FSM) deleteKeys(prefix string, index uint64) (int, error) {
+	var keys []string
+	err := f.store.Iterate(prefix, "", func(key string, value storage.Value) bool {
+		if prefix != "" || !strings.HasPrefix(key, namespaceKeyPrefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	now := f.now()
+	for _, key := range keys {
+		if err := f.store.Delete(key); err != nil {
+			return 0, err
+		}
+		f.history.recordDelete(key, index, now)
+	}
+	return len(keys), nil
+}
+
+// Namespaces returns the configuration of every named namespace
+func (n *Node) Namespaces() map[string]NamespaceConfig {
+	configs := n.fsm.namespaces.snapshot()
+	if configs == nil {
+		configs = make(map[string]NamespaceConfig)
+	}
+	return configs
+}
+
+// NamespaceConfig returns the configuration of namespace name
+func (n *Node) NamespaceConfig(name string) (NamespaceConfig, error) {
+	if err := ValidateNamespace(name); err != nil {
+		return NamespaceConfig{}, err
+	}
+	config, ok := n.fsm.namespaces.get(name)
+	if !ok {
+		return NamespaceConfig{}, ErrNamespaceNotFound
+	}
+	return config, nil
+}
+
+// PutNamespace creates namespace name, or reconfigures it if it exists
+func (n *Node) PutNamespace(name string, config NamespaceConfig) error {
+	if err := ValidateNamespace(name); err != nil {
+		return err
+	}
+	if config.DefaultTTL < 0 || config.MaxKeys < 0 || config.MaxBytes < 0 || config.MaxValueSize < 0 {
+		return fmt.Errorf("%w: negative setting", ErrInvalidNamespace)
+	}
+
+	_, err := n.apply(Command{
+		Op:        "put_namespace",
+		Namespace: name,
+		Config:    &config,
+	})
+	return err
+}
+
+// DropNamespace deletes namespace name and all of its keys in a single log
+// entry and returns how many keys were deleted
+func (n *Node) DropNamespace(name string) (int, error) {
+	if err := ValidateNamespace(name); err != nil {
+		return 0, err
+	}
+
+	resp, err := n.apply(Command{
+		Op:        "drop_namespace",
+		Namespace: name,
+	})
+	if err != nil {
+		return 0, err
+	}
+	count, _ := resp.Data.(int)
+	return count, nil
+}
+
+// NamespaceUsage returns the keys namespace name holds and their size, as
+// counted against its quotas
+func (n *Node) NamespaceUsage(name string) (NamespaceUsage, error) {
+	if _, err := n.NamespaceConfig(name); err != nil {
+		return NamespaceUsage{}, err
+	}
+	return n.fsm.quotas.usage(name), nil
+}
+
+// Namespace is a handle on the keys of a named namespace. Every method
+// fails with ErrNamespaceNotFound if the namespace does not exist.
+type Namespace struct {
+	node   *Node
+	name   string
+	prefix string
+}
+
+// Namespace returns a handle on the keys of namespace name
+func (n *Node) Namespace(name string) *Namespace {
+	return &Namespace{node: n, name: name, prefix: namespacePrefix(name)}
+}
+
+// Name returns the name of the namespace
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// config checks that the namespace exists and returns its configuration
+func (ns *Namespace) config() (NamespaceConfig, error) {
+	return ns.node.NamespaceConfig(ns.name)
+}
+
+// check checks that the namespace exists and that key may be used in it,
+// and returns the configuration of the namespace
+func (ns *Namespace) check(key string) (NamespaceConfig, error) {
+	config, err := ns.config()
+	if err != nil {
+		return config, err
+	}
+	return config, checkNamespaceKey(key)
+}
+
+// withDefaultTTL gives value the namespace's default expiration if it has
+// none of its own
+func withDefaultTTL(value storage.Value, config NamespaceConfig) storage.Value {
+	if value.Expiration == 0 && config.DefaultTTL > 0 {
+		value.Expiration = time.Now().Add(config.DefaultTTL).UnixNano()
+	}
+	return value
+}
+
+// mapOps returns ops with their keys stored under the namespace prefix and
+// the default expiration applied to their values
+func (ns *Namespace) mapOps(ops []TxnOp, config NamespaceConfig) []TxnOp {
+	if ops == nil {
+		return nil
+	}
+	out := make([]TxnOp, len(ops))
+	for i, op := range ops {
+		op.Key = ns.prefix + op.Key
+		if op.Op == "set" {
+			op.Value = withDefaultTTL(op.Value, config)
+		}
+		out[i] = op
+	}
+	return out
+}
+
+// Get gets a key of the namespace
+func (ns *Namespace) Get(key string) (storage.Value, error) {
+	if _, err := ns.check(key); err != nil {
+		return storage.Value{}, err
+	}
+	return ns.node.store.Get(ns.prefix + key)
+}
+
+// GetAt gets the value a key of the namespace had at a past revision
+func (ns *Namespace) GetAt(key string, revision uint64) (storage.Value, error) {
+	if _, err := ns.check(key); err != nil {
+		return storage.Value{}, err
+	}
+	return ns.node.fsm.GetAt(ns.prefix+key, revision)
+}
+
+// History returns the retained versions of a key of the namespace
+func (ns *Namespace) History(key string) (KeyHistory, error) {
+	if _, err := ns.check(key); err != nil {
+		return KeyHistory{}, err
+	}
+	return ns.node.fsm.History(ns.prefix + key)
+}
+
+// SetIf sets a key of the namespace if the precondition holds when the
+// write is applied. The result holds the revision of the new value and the
+// value it replaced.
+func (ns *Namespace) SetIf(key string, value storage.Value, pre *Precondition) (*ApplyResult, error) {
+	config, err := ns.check(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ns.node.apply(Command{
+		Op:        "set",
+		Namespace: ns.name,
+		Key:       ns.prefix + key,
+		Value:     withDefaultTTL(value, config),
+		If:        pre,
+	})
+}
+
+// DeleteIf deletes a key of the namespace if the precondition holds when
+// the delete is applied. The result holds the deleted value.
+func (ns *Namespace) DeleteIf(key string, pre *Precondition) (*ApplyResult, error) {
+	if _, err := ns.check(key); err != nil {
+		return nil, err
+	}
+
+	return ns.node.apply(Command{
+		Op:        "delete",
+		Namespace: ns.name,
+		Key:       ns.prefix + key,
+		If:        pre,
+	})
+}
+
+// Txn applies a transaction on keys of the namespace
+func (ns *Namespace) Txn(txn *Txn) (*TxnResult, error) {
+	config, err := ns.config()
+	if err != nil {
+		return nil, err
+	}
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkTxnKeys(txn, checkNamespaceKey); err != nil {
+		return nil, err
+	}
+
+	mapped := &Txn{
+		Compare: make([]Compare, len(txn.Compare)),
+		Success: ns.mapOps(txn.Success, config),
+		Failure: ns.mapOps(txn.Failure, config),
+	}
+	for i, c := range txn.Compare {
+		c.Key = ns.prefix + c.Key
+		mapped.Compare[i] = c
+	}
+
+	resp, err := ns.node.apply(Command{
+		Op:        "txn",
+		Namespace: ns.name,
+		Txn:       mapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, _ := resp.Data.(*TxnResult)
+	if result != nil {
+		for i := range result.Results {
+			result.Results[i].Key = strings.TrimPrefix(result.Results[i].Key, ns.prefix)
+		}
+	}
+	return result, nil
+}
+
+// Batch applies a batch of operations on keys of the namespace
+func (ns *Namespace) Batch(ops []TxnOp) ([]BatchResult, error) {
+	config, err := ns.config()
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateBatch(ops); err != nil {
+		return nil, err
+	}
+	if err := checkOpKeys(ops, checkNamespaceKey); err != nil {
+		return nil, err
+	}
+
+	results, err := ns.node.batch(ns.name, ns.mapOps(ops, config))
+	for i := range results {
+		results[i].Key = strings.TrimPrefix(results[i].Key, ns.prefix)
+	}
+	return results, err
+}
+
+// Iterate calls fn for each key of the namespace with prefix after
+// startAfter in ascending order, stopping early when fn returns false
+func (ns *Namespace) Iterate(prefix, startAfter string, fn func(key string, value storage.Value) bool) error {
+	if _, err := ns.config(); err != nil {
+		return err
+	}
+	if startAfter != "" {
+		startAfter = ns.prefix + startAfter
+	}
+	return ns.node.store.Iterate(ns.prefix+prefix, startAfter, func(key string, value storage.Value) bool {
+		if isUploadKey(key[len(ns.prefix):]) {
+			return true
+		}
+		return fn(key[len(ns.prefix):], value)
+	})
+}
+
+// Keys returns all keys of the namespace in ascending order
+func (ns *Namespace) Keys() ([]string, error) {
+	var keys []string
+	err := ns.Iterate("", "", func(key string, value storage.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, err
+}
@@ -0,0 +1,119 @@
+package raft
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	for _, name := range []string{"a", "team-1", "billing_v2", "x.y"} {
+		assert.NoError(t, ValidateNamespace(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "-a", "with space", string(make([]byte, 65))} {
+		assert.ErrorIs(t, ValidateNamespace(name), ErrInvalidNamespace, name)
+	}
+
+	assert.Equal(t, ErrReservedKey, checkDefaultKey(namespacePrefix("a")+"k"))
+	assert.NoError(t, checkDefaultKey("ns/a/k"))
+}
+
+func TestFSMNamespaces(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	set := func(ns, key string) interface{} {
+		stored := key
+		if ns != "" {
+			stored = namespacePrefix(ns) + key
+		}
+		return applyCommand(t, f, Command{Op: "set", Namespace: ns, Key: stored, Value: storage.Value{Data: []byte(key)}})
+	}
+
+	// Writes to a namespace that does not exist are rejected
+	assert.Equal(t, ErrNamespaceNotFound, set("a", "k"))
+
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "a", Config: &NamespaceConfig{DefaultTTL: time.Minute}})
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "b"})
+	config, ok := f.namespaces.get("a")
+	require.True(t, ok)
+	assert.Equal(t, time.Minute, config.DefaultTTL)
+
+	assert.IsType(t, uint64(0), set("a", "k1"))
+	assert.IsType(t, uint64(0), set("a", "k2"))
+	assert.IsType(t, uint64(0), set("b", "k1"))
+	assert.IsType(t, uint64(0), set("", "k1"))
+
+	// Deleting everything in the default namespace leaves the others alone
+	assert.Nil(t, applyCommand(t, f, Command{Op: "deleteAll"}))
+	assert.False(t, store.Has("k1"))
+	assert.True(t, store.Has(namespacePrefix("a")+"k1"))
+	assert.True(t, store.Has(namespacePrefix("b")+"k1"))
+
+	assert.Equal(t, 2, applyCommand(t, f, Command{Op: "drop_namespace", Namespace: "a"}))
+	assert.False(t, store.Has(namespacePrefix("a")+"k1"))
+	assert.False(t, store.Has(namespacePrefix("a")+"k2"))
+	assert.True(t, store.Has(namespacePrefix("b")+"k1"))
+	assert.Equal(t, ErrNamespaceNotFound, applyCommand(t, f, Command{Op: "drop_namespace", Namespace: "a"}))
+	assert.Equal(t, ErrNamespaceNotFound, set("a", "k3"))
+
+	// Reads only see the keys of their namespace
+	set("", "k1")
+	n := &Node{store: store, fsm: f}
+	keys, err := n.Namespace("b").Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k1"}, keys)
+	assert.Equal(t, []string{"k1"}, n.Keys())
+	_, err = n.Namespace("a").Get("k1")
+	assert.Equal(t, ErrNamespaceNotFound, err)
+	_, err = n.Get(namespacePrefix("b") + "k1")
+	assert.Equal(t, ErrReservedKey, err)
+	usage, err := n.NamespaceUsage("b")
+	require.NoError(t, err)
+	assert.Equal(t, NamespaceUsage{Keys: 1, Bytes: 4}, usage)
+
+	// The registry is part of snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	restored := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	_, ok = restored.namespaces.get("b")
+	assert.True(t, ok)
+	_, ok = restored.namespaces.get("a")
+	assert.False(t, ok)
+}
+
+func TestNamespaceRejectsUploadKeys(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "a", Config: &NamespaceConfig{}})
+	n := &Node{store: store, fsm: f}
+	ns := n.Namespace("a")
+
+	// Keys of a namespace's uploads and chunks cannot be used directly
+	key := uploadKeyPrefix + "id/00001"
+	_, err := ns.Get(key)
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.SetIf(key, storage.Value{Data: []byte("x")}, nil)
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.DeleteIf(key, nil)
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.Incr(key, 1, 0)
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.Append(key, storage.Value{Data: []byte("x")})
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.Structures().Push(key, []string{"x"}, false)
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.Batch([]TxnOp{{Op: "delete", Key: key}})
+	assert.Equal(t, ErrReservedKey, err)
+	_, err = ns.Txn(&Txn{Success: []TxnOp{{Op: "delete", Key: "ok"}, {Op: "delete", Key: key}}})
+	assert.Equal(t, ErrReservedKey, err)
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -22,6 +21,10 @@ const (
 	raftTimeout         = 10 * time.Second
 	leaderWaitDelay     = 100 * time.Millisecond
 	maxLeaderWait       = 10 * time.Second
+	
+	// DefaultMaxEntrySize is the most value data a log entry carries
+	// unless NodeOptions say otherwise
+	DefaultMaxEntrySize = 16 << 20
 )
 
 var (
@@ -30,13 +33,74 @@ var (
 	
 	// ErrTimeout is returned when an operation times out
 	ErrTimeout = errors.New("timeout")
+	
+	// ErrPreconditionFailed is returned when a conditional write finds the
+	// key at a different revision than required
+	ErrPreconditionFailed = errors.New("precondition failed")
+	
+	// ErrEntryTooLarge is returned for a write carrying more value data
+	// than fits a single log entry. Larger values are written with a
+	// multipart upload.
+	ErrEntryTooLarge = errors.New("value too large for a single log entry, use a multipart upload")
 )
 
+// Precondition restricts a write to a key's current revision. A key that
+// does not exist has no revision.
+type Precondition struct {
+	Exists    bool     `json:"exists,omitempty"`     // Key must exist, If-Match: *
+	NotExists bool     `json:"not_exists,omitempty"` // Key must not exist, If-None-Match: *
+	Match     []uint64 `json:"match,omitempty"`      // Revision must be one of these
+	NoneMatch []uint64 `json:"none_match,omitempty"` // Revision must not be one of these
+}
+
+// check reports whether a key at revision, or missing if exists is false,
+// satisfies the precondition
+func (p *Precondition) check(revision uint64, exists bool) bool {
+	if p == nil {
+		return true
+	}
+	if (p.Exists || len(p.Match) > 0) && !exists {
+		return false
+	}
+	if p.NotExists && exists {
+		return false
+	}
+	if len(p.Match) > 0 && !containsRevision(p.Match, revision) {
+		return false
+	}
+	if exists && containsRevision(p.NoneMatch, revision) {
+		return false
+	}
+	return true
+}
+
+// containsRevision reports whether revisions contains revision
+func containsRevision(revisions []uint64, revision uint64) bool {
+	for _, r := range revisions {
+		if r == revision {
+			return true
+		}
+	}
+	return false
+}
+
 // Command represents a command to be executed by the state machine
 type Command struct {
-	Op    string         `json:"op"`    // "set", "delete", "deleteAll"
-	Key   string         `json:"key"`   // Key to operate on
-	Value storage.Value  `json:"value"` // Value for set operation
+	Op        string           `json:"op"`                  // "set", "delete", "deleteAll", "txn", "batch", "compact", "prune_history", "expire", "put_namespace", "drop_namespace", "incr", "incrbyfloat", "append", "setrange", an upload op or a data structure op
+	Key       string           `json:"key"`                 // Key to operate on
+	Value     storage.Value    `json:"value"`               // Value for set operation, data for append and setrange
+	Keys      []string         `json:"keys,omitempty"`      // Keys for expire operation
+	Time      int64            `json:"time,omitempty"`      // Leader time in Unix nanoseconds when proposed
+	If        *Precondition    `json:"if,omitempty"`        // Condition for set and delete operations
+	Txn       *Txn             `json:"txn,omitempty"`       // Transaction for txn operation
+	Batch     []TxnOp          `json:"batch,omitempty"`     // Operations for batch operation
+	Revision  uint64           `json:"revision,omitempty"`  // Revision for compact operation
+	Namespace string           `json:"namespace,omitempty"` // Namespace the keys belong to, empty for the default one
+	Config    *NamespaceConfig `json:"config,omitempty"`    // Configuration for put_namespace operation
+	Args      *StructArgs      `json:"args,omitempty"`      // Arguments for data structure operations
+	Incr      *Increment       `json:"incr,omitempty"`      // Amount for incr and incrbyfloat operations
+	Offset    int64            `json:"offset,omitempty"`    // Offset for setrange operation
+	Upload    *UploadArgs      `json:"upload,omitempty"`    // Arguments for multipart upload operations
 }
 
 // Node represents a node in the Raft cluster
@@ -45,13 +109,29 @@ type Node struct {
 	RaftDir     string
 	RaftBind    string
 	logger      *zap.Logger
+	compressor  *storage.Compressor
 	store       storage.Storage // The actual key-value store
 	raft        *raft.Raft      // The Raft consensus module
 	fsm         *FSM            // The finite state machine
+	logs        *encryptedLogStore
+	maxEntrySize int64
+}
+
+// NodeOptions configures a Raft node
+type NodeOptions struct {
+	History      HistoryOptions      // Retention of prior versions, none are kept by default
+	Compressor   *storage.Compressor // Compresses values before they are replicated, nil for none
+	Keyring      *storage.Keyring    // Encrypts the Raft log and snapshots at rest, nil for none
+	MaxEntrySize int64               // Most value data a log entry may carry, DefaultMaxEntrySize if 0 and no limit if negative
 }
 
 // NewNode creates a new Raft node
 func NewNode(id, raftDir, raftBind string, store storage.Storage, logger *zap.Logger) (*Node, error) {
+	return NewNodeWithOptions(id, raftDir, raftBind, store, logger, NodeOptions{})
+}
+
+// NewNodeWithOptions creates a new Raft node with the given options
+func NewNodeWithOptions(id, raftDir, raftBind string, store storage.Storage, logger *zap.Logger, opts NodeOptions) (*Node, error) {
 	if logger == nil {
 		var err error
 		logger, err = zap.NewProduction()
@@ -65,15 +145,20 @@ func NewNode(id, raftDir, raftBind string, store storage.Storage, logger *zap.Lo
 		ID:       id,
 		RaftDir:  raftDir,
 		RaftBind: raftBind,
-		logger:   logger,
-		store:    store,
+		logger:       logger,
+		compressor:   opts.Compressor,
+		store:        store,
+		maxEntrySize: opts.MaxEntrySize,
+	}
+	if node.maxEntrySize == 0 {
+		node.maxEntrySize = DefaultMaxEntrySize
 	}
 	
 	// Create the FSM for this node
-	node.fsm = &FSM{
-		store:  store,
-		logger: logger,
-	}
+	node.fsm = newFSM(store, logger)
+	node.fsm.history = newHistory(opts.History)
+	node.fsm.keyring = opts.Keyring
+	node.fsm.spoolDir = raftDir
 	
 	// Create Raft directory if it doesn't exist
 	if err := os.MkdirAll(raftDir, 0755); err != nil {
@@ -112,8 +197,18 @@ func NewNode(id, raftDir, raftBind string, store storage.Storage, logger *zap.Lo
 		return nil, err
 	}
 	
+	// Encrypt log entries and snapshots at rest. The stable store only
+	// holds terms and votes.
+	var logs raft.LogStore = logStore
+	var snaps raft.SnapshotStore = snapshots
+	if opts.Keyring != nil {
+		node.logs = newEncryptedLogStore(logStore, opts.Keyring)
+		logs = node.logs
+		snaps = newEncryptedSnapshotStore(snapshots, opts.Keyring)
+	}
+	
 	// Instantiate the Raft system
-	ra, err := raft.NewRaft(config, node.fsm, logStore, stableStore, snapshots, transport)
+	ra, err := raft.NewRaft(config, node.fsm, logs, stableStore, snaps, transport)
 	if err != nil {
 		return nil, err
 	}
@@ -184,55 +279,335 @@ func (n *Node) JoinCluster(leaderAddr string) error {
 	return nil
 }
 
+// AddNode adds a voting member to the cluster, must be called on the leader
+func (n *Node) AddNode(nodeID, addr string) error {
+	if n.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	f := n.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, raftTimeout)
+	return f.Error()
+}
+
 // Get gets a key from the store
 func (n *Node) Get(key string) (storage.Value, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return storage.Value{}, err
+	}
 	return n.store.Get(key)
 }
 
-// Set sets a key in the store
-func (n *Node) Set(key string, value storage.Value) error {
+// GetRecord gets a key as it is stored, whichever namespace it belongs to
+func (n *Node) GetRecord(key string) (storage.Value, error) {
+	return n.store.Get(key)
+}
+
+// RepairRecord rewrites the corrupt local record of a key with a healthy
+// copy from a replica that had applied the log up to index. It fails with
+// ErrStaleRepair unless the copy is the value the key holds locally, so a
+// repair never rolls back or skips ahead of a write.
+func (n *Node) RepairRecord(key string, value storage.Value, index uint64) error {
+	return n.fsm.repair(key, value, index)
+}
+
+// AppliedIndex returns the index of the last log entry applied to the store
+func (n *Node) AppliedIndex() uint64 {
+	return n.fsm.appliedIndex()
+}
+
+// GetAt gets the value a key had at a past revision
+func (n *Node) GetAt(key string, revision uint64) (storage.Value, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return storage.Value{}, err
+	}
+	return n.fsm.GetAt(key, revision)
+}
+
+// History returns the retained versions of a key, oldest first
+func (n *Node) History(key string) (KeyHistory, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return KeyHistory{}, err
+	}
+	return n.fsm.History(key)
+}
+
+// Compact discards the versions replaced before revision
+func (n *Node) Compact(revision uint64) error {
+	if revision > n.fsm.appliedIndex() {
+		return ErrFutureRevision
+	}
+	
+	_, err := n.apply(Command{
+		Op:       "compact",
+		Revision: revision,
+	})
+	return err
+}
+
+// PruneHistory discards the versions every key has kept for longer than
+// the history allows, at the time the command is applied. Writing a key
+// prunes its own versions, the leader calls this periodically for the
+// keys that are not written again.
+func (n *Node) PruneHistory() error {
+	if n.fsm.history.opts.MaxAge <= 0 {
+		return nil
+	}
+	
+	_, err := n.apply(Command{Op: "prune_history"})
+	return err
+}
+
+// apply stamps cmd with the leader's time, replicates it and returns the
+// state machine's response
+func (n *Node) apply(cmd Command) (*ApplyResult, error) {
 	if n.raft.State() != raft.Leader {
-		return ErrNotLeader
+		return nil, ErrNotLeader
+	}
+	if size := cmd.dataSize(); n.maxEntrySize > 0 && size > n.maxEntrySize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrEntryTooLarge, size, n.maxEntrySize)
 	}
 	
-	cmd := Command{
-		Op:    "set",
-		Key:   key,
-		Value: value,
+	if err := n.compress(&cmd); err != nil {
+		return nil, err
 	}
 	
+	cmd.Time = time.Now().UnixNano()
 	b, err := json.Marshal(cmd)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	
 	f := n.raft.Apply(b, raftTimeout)
-	return f.Error()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	result, ok := f.Response().(*ApplyResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected apply response %T", f.Response())
+	}
+	if result.Err != nil {
+		return result, result.Err
+	}
+	return result, nil
+}
+
+// dataSize returns the size of the value data cmd carries
+func (cmd *Command) dataSize() int64 {
+	size := int64(len(cmd.Value.Data))
+	ops := cmd.Batch
+	if cmd.Txn != nil {
+		ops = append(append(append([]TxnOp(nil), ops...), cmd.Txn.Success...), cmd.Txn.Failure...)
+	}
+	for _, op := range ops {
+		size += int64(len(op.Value.Data))
+	}
+	return size
+}
+
+// MaxEntrySize returns the most value data a single write may carry, 0 or
+// less for no limit
+func (n *Node) MaxEntrySize() int64 {
+	return n.maxEntrySize
+}
+
+// compress compresses the values cmd writes, so that they are replicated
+// and stored compressed
+func (n *Node) compress(cmd *Command) error {
+	if n.compressor == nil {
+		return nil
+	}
+	
+	encodeOps := func(ops []TxnOp) ([]TxnOp, error) {
+		out := make([]TxnOp, len(ops))
+		for i, op := range ops {
+			if op.Op == "set" {
+				value, err := n.compressor.Encode(op.Value)
+				if err != nil {
+					return nil, err
+				}
+				op.Value = value
+			}
+			out[i] = op
+		}
+		return out, nil
+	}
+	
+	var err error
+	switch cmd.Op {
+	case "set":
+		cmd.Value, err = n.compressor.Encode(cmd.Value)
+	case "txn":
+		txn := *cmd.Txn
+		if txn.Success, err = encodeOps(txn.Success); err != nil {
+			return err
+		}
+		txn.Failure, err = encodeOps(txn.Failure)
+		cmd.Txn = &txn
+	case "batch":
+		cmd.Batch, err = encodeOps(cmd.Batch)
+	}
+	return err
+}
+
+// Set sets a key in the store
+func (n *Node) Set(key string, value storage.Value) error {
+	_, err := n.SetIf(key, value, nil)
+	return err
+}
+
+// SetIf sets a key in the store if the precondition holds when the write is
+// applied. The result holds the revision of the new value and the value it
+// replaced.
+func (n *Node) SetIf(key string, value storage.Value, pre *Precondition) (*ApplyResult, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return nil, err
+	}
+	
+	return n.apply(Command{
+		Op:    "set",
+		Key:   key,
+		Value: value,
+		If:    pre,
+	})
 }
 
 // Delete deletes a key from the store
 func (n *Node) Delete(key string) error {
-	if n.raft.State() != raft.Leader {
-		return ErrNotLeader
+	_, err := n.DeleteIf(key, nil)
+	return err
+}
+
+// DeleteIf deletes a key from the store if the precondition holds when the
+// delete is applied. The result holds the deleted value.
+func (n *Node) DeleteIf(key string, pre *Precondition) (*ApplyResult, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return nil, err
 	}
 	
-	cmd := Command{
+	return n.apply(Command{
 		Op:  "delete",
 		Key: key,
+		If:  pre,
+	})
+}
+
+// Txn applies a transaction atomically and returns its outcome
+func (n *Node) Txn(txn *Txn) (*TxnResult, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkTxnKeys(txn, checkDefaultKey); err != nil {
+		return nil, err
 	}
 	
-	b, err := json.Marshal(cmd)
+	resp, err := n.apply(Command{
+		Op:  "txn",
+		Txn: txn,
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result, _ := resp.Data.(*TxnResult)
+	return result, nil
+}
+
+// Batch applies a batch of operations as a single log entry and returns
+// the result of each. Batches of only gets are read locally like Get.
+func (n *Node) Batch(ops []TxnOp) ([]BatchResult, error) {
+	if err := checkOpKeys(ops, checkDefaultKey); err != nil {
+		return nil, err
+	}
+	return n.batch("", ops)
+}
+
+// batch applies a batch of operations on keys of namespace, which are
+// already in their stored form
+func (n *Node) batch(namespace string, ops []TxnOp) ([]BatchResult, error) {
+	if err := ValidateBatch(ops); err != nil {
+		return nil, err
 	}
 	
-	f := n.raft.Apply(b, raftTimeout)
-	return f.Error()
+	readOnly := true
+	for _, op := range ops {
+		if op.Op != "get" {
+			readOnly = false
+			break
+		}
+	}
+	if readOnly {
+		keys := make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = op.Key
+		}
+		return getBatch(n.store, keys), nil
+	}
+	
+	resp, err := n.apply(Command{
+		Op:        "batch",
+		Namespace: namespace,
+		Batch:     ops,
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, _ := resp.Data.([]BatchResult)
+	return results, nil
+}
+
+// Expire removes those of keys that are expired at the time the command is
+// applied and returns how many were removed. The leader calls it for keys
+// its expirer found, followers never expire keys on their own.
+func (n *Node) Expire(keys []string) (int, error) {
+	resp, err := n.apply(Command{
+		Op:   "expire",
+		Keys: keys,
+	})
+	if err != nil {
+		return 0, err
+	}
+	count, _ := resp.Data.(int)
+	return count, nil
 }
 
-// Keys returns all keys in the store
+// Reencrypt rewrites the Raft log entries that are not encrypted with the
+// active key and takes a snapshot, which is written with the active key.
+// Older retained snapshots keep their key until they are replaced, so a
+// retired key must stay in the keyring until then.
+func (n *Node) Reencrypt() (int, error) {
+	if n.logs == nil {
+		return 0, nil
+	}
+	
+	count, err := n.logs.reencrypt()
+	if err != nil {
+		return count, err
+	}
+	if err := n.raft.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+		return count, err
+	}
+	return count, nil
+}
+
+// Keys returns all keys of the default namespace
 func (n *Node) Keys() []string {
-	return n.store.Keys()
+	var keys []string
+	for _, key := range n.store.Keys() {
+		if checkDefaultKey(key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Iterate calls fn for each key of the default namespace with prefix after
+// startAfter in ascending order, stopping early when fn returns false
+func (n *Node) Iterate(prefix, startAfter string, fn func(key string, value storage.Value) bool) error {
+	return n.store.Iterate(prefix, startAfter, func(key string, value storage.Value) bool {
+		if checkDefaultKey(key) != nil {
+			return true
+		}
+		return fn(key, value)
+	})
 }
 
 // WaitForLeader blocks until a leader is elected or timeout occurs
@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a write would take a namespace over
+	// its key or byte quota
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+	// ErrValueTooLarge is returned when a value is larger than its
+	// namespace allows
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// NamespaceUsage is what a namespace holds, as counted against its quotas.
+// Bytes is the size of the keys without the namespace prefix plus the
+// uncompressed size of the values, so it is the same on every replica
+// whether or not the leader compressed them.
+// The chunks of uploaded values count towards Bytes but not Keys.
+type NamespaceUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// namespaceUsage tracks the size of every key of a namespace
+type namespaceUsage struct {
+	NamespaceUsage
+	sizes map[string]int64
+}
+
+// quotaStore enforces namespace quotas on writes to the wrapped store. It
+// sits inside the FSM, so every replica rejects the same writes. Keys
+// evicted by a memory budget stop counting as they are evicted.
+type quotaStore struct {
+	storage.Storage
+	namespaces *namespaceRegistry
+	mutex      sync.RWMutex
+	usages     map[string]*namespaceUsage
+}
+
+// newQuotaStore wraps store, enforcing the quotas of namespaces. Usage is
+// counted from the keys store already holds.
+func newQuotaStore(store storage.Storage, namespaces *namespaceRegistry) *quotaStore {
+	q := &quotaStore{Storage: store, namespaces: namespaces}
+	q.reset()
+	q.Storage.Iterate(namespaceKeyPrefix, "", func(key string, value storage.Value) bool {
+		q.track(key, value)
+		return true
+	})
+	return q
+}
+
+// splitNamespaceKey returns the namespace of a stored key and the key within
+// it. ok is false for keys of the default namespace.
+func splitNamespaceKey(key string) (namespace, rest string, ok bool) {
+	if !strings.HasPrefix(key, namespaceKeyPrefix) {
+		return "", "", false
+	}
+	key = key[len(namespaceKeyPrefix):]
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// Set stores value under key unless it breaks the quotas of the key's
+// namespace
+func (q *quotaStore) Set(key string, value storage.Value) error {
+	if err := q.check(key, value); err != nil {
+		return err
+	}
+	return q.force(key, value)
+}
+
+// force stores value under key without checking quotas. Rollbacks and
+// snapshot restores use it to put back state that was already admitted.
+func (q *quotaStore) force(key string, value storage.Value) error {
+	if err := q.Storage.Set(key, value); err != nil {
+		return err
+	}
+	q.track(key, value)
+	return nil
+}
+
+// Delete removes key and releases its share of the quotas
+func (q *quotaStore) Delete(key string) error {
+	if err := q.Storage.Delete(key); err != nil {
+		return err
+	}
+	q.untrack(key)
+	return nil
+}
+
+// Clear removes all keys and resets usage
+func (q *quotaStore) Clear() error {
+	if err := q.Storage.Clear(); err != nil {
+		return err
+	}
+	q.reset()
+	return nil
+}
+
+// EvictionRanks returns the eviction ranks of the wrapped storage, nil if
+// it keeps none
+func (q *quotaStore) EvictionRanks() map[string]storage.EvictionRank {
+	if ranker, ok := q.Storage.(storage.EvictionRanker); ok {
+		return ranker.EvictionRanks()
+	}
+	return nil
+}
+
+// SetEvictionRanks sets the eviction ranks of the wrapped storage
+func (q *quotaStore) SetEvictionRanks(ranks map[string]storage.EvictionRank) {
+	if ranker, ok := q.Storage.(storage.EvictionRanker); ok {
+		ranker.SetEvictionRanks(ranks)
+	}
+}
+
+// check returns an error if writing value under key breaks a quota. A
+// write that does not grow the namespace is always allowed, so a tenant
+// over a lowered quota can still shrink or delete its keys.
+func (q *quotaStore) check(key string, value storage.Value) error {
+	namespace, rest, ok := splitNamespaceKey(key)
+	if !ok {
+		return nil
+	}
+	config, ok := q.namespaces.get(namespace)
+	if !ok {
+		return nil
+	}
+	if config.MaxValueSize == 0 && config.MaxBytes == 0 && config.MaxKeys == 0 {
+		return nil
+	}
+	length := valueSize(value)
+	if config.MaxValueSize > 0 && length > config.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, namespace %s allows %d", ErrValueTooLarge, length, namespace, config.MaxValueSize)
+	}
+
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	var usage NamespaceUsage
+	old, exists := int64(0), false
+	if u, ok := q.usages[namespace]; ok {
+		usage = u.NamespaceUsage
+		old, exists = u.sizes[key]
+	}
+	if config.MaxKeys > 0 && !exists && !isUploadKey(rest) && usage.Keys >= config.MaxKeys {
+		return fmt.Errorf("%w: namespace %s is limited to %d keys", ErrQuotaExceeded, namespace, config.MaxKeys)
+	}
+	size := int64(len(rest)) + length
+	if config.MaxBytes > 0 && size > old && usage.Bytes-old+size > config.MaxBytes {
+		return fmt.Errorf("%w: namespace %s is limited to %d bytes", ErrQuotaExceeded, namespace, config.MaxBytes)
+	}
+	return nil
+}
+
+// track counts value as the current size of key
+func (q *quotaStore) track(key string, value storage.Value) {
+	namespace, rest, ok := splitNamespaceKey(key)
+	if !ok {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	u, ok := q.usages[namespace]
+	if !ok {
+		u = &namespaceUsage{sizes: make(map[string]int64)}
+		q.usages[namespace] = u
+	}
+	size := int64(len(rest)) + valueSize(value)
+	if old, exists := u.sizes[key]; exists {
+		u.Bytes -= old
+	} else if !isUploadKey(rest) {
+		u.Keys++
+	}
+	u.sizes[key] = size
+	u.Bytes += size
+}
+
+// valueSize returns the size of the data of value once uncompressed. The
+// leader compresses values before they are replicated, quotas apply to
+// what was written.
+func valueSize(value storage.Value) int64 {
+	if value.Encoding == "" {
+		return int64(len(value.Data))
+	}
+	decoded, err := storage.DecodeValue(value)
+	if err != nil {
+		return int64(len(value.Data))
+	}
+	return int64(len(decoded.Data))
+}
+
+// untrack stops counting key
+func (q *quotaStore) untrack(key string) {
+	namespace, rest, ok := splitNamespaceKey(key)
+	if !ok {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	u, ok := q.usages[namespace]
+	if !ok {
+		return
+	}
+	if size, exists := u.sizes[key]; exists {
+		delete(u.sizes, key)
+		if !isUploadKey(rest) {
+			u.Keys--
+		}
+		u.Bytes -= size
+	}
+}
+
+// forget drops the usage of a namespace. Keys of a dropped namespace that
+// were left behind, because they had expired, no longer count.
+func (q *quotaStore) forget(namespace string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.usages, namespace)
+}
+
+// reset drops the usage of every namespace
+func (q *quotaStore) reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.usages = make(map[string]*namespaceUsage)
+}
+
+// usage returns the usage of namespace
+func (q *quotaStore) usage(namespace string) NamespaceUsage {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if u, ok := q.usages[namespace]; ok {
+		return u.NamespaceUsage
+	}
+	return NamespaceUsage{}
+}
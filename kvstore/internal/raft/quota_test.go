@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMQuotas(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "q", Config: &NamespaceConfig{MaxKeys: 2, MaxBytes: 9, MaxValueSize: 4}})
+
+	set := func(key, data string) interface{} {
+		return applyCommand(t, f, Command{Op: "set", Namespace: "q", Key: namespacePrefix("q") + key, Value: storage.Value{Data: []byte(data)}})
+	}
+	errorIs := func(target error, result interface{}) {
+		t.Helper()
+		err, ok := result.(error)
+		require.True(t, ok, "expected an error, got %v", result)
+		assert.ErrorIs(t, err, target)
+	}
+
+	errorIs(ErrValueTooLarge, set("a", "12345"))
+	assert.IsType(t, uint64(0), set("a", "1234"))
+	assert.IsType(t, uint64(0), set("b", "1"))
+	assert.Equal(t, NamespaceUsage{Keys: 2, Bytes: 7}, f.quotas.usage("q"))
+
+	// Overwrites do not add a key, but may not grow past the byte quota
+	errorIs(ErrQuotaExceeded, set("c", "1"))
+	assert.IsType(t, uint64(0), set("b", "12"))
+	errorIs(ErrQuotaExceeded, set("b", "1234"))
+
+	// A transaction that breaks a quota leaves nothing behind
+	result := applyCommand(t, f, Command{Op: "txn", Namespace: "q", Txn: &Txn{Success: []TxnOp{
+		{Op: "delete", Key: namespacePrefix("q") + "a"},
+		{Op: "set", Key: namespacePrefix("q") + "c", Value: storage.Value{Data: []byte("1")}},
+		{Op: "set", Key: namespacePrefix("q") + "d", Value: storage.Value{Data: []byte("1")}},
+	}}})
+	errorIs(ErrQuotaExceeded, result)
+	assert.Equal(t, NamespaceUsage{Keys: 2, Bytes: 8}, f.quotas.usage("q"))
+	assert.True(t, f.store.Has(namespacePrefix("q")+"a"))
+
+	// Deletes free their share, and the default namespace is not limited
+	applyCommand(t, f, Command{Op: "delete", Namespace: "q", Key: namespacePrefix("q") + "a"})
+	assert.Equal(t, NamespaceUsage{Keys: 1, Bytes: 3}, f.quotas.usage("q"))
+	assert.IsType(t, uint64(0), applyCommand(t, f, Command{Op: "set", Key: "big", Value: storage.Value{Data: []byte("1234567890")}}))
+
+	// Usage is rebuilt from snapshots, even over a quota lowered since
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "q", Config: &NamespaceConfig{MaxBytes: 1}})
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	assert.Equal(t, NamespaceUsage{Keys: 1, Bytes: 3}, restored.quotas.usage("q"))
+
+	applyCommand(t, f, Command{Op: "drop_namespace", Namespace: "q"})
+	assert.Equal(t, NamespaceUsage{}, f.quotas.usage("q"))
+}
+
+func TestFSMQuotasCountUncompressedSize(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+	applyCommand(t, f, Command{Op: "put_namespace", Namespace: "q", Config: &NamespaceConfig{MaxBytes: 2000, MaxValueSize: 1000}})
+	compressor := storage.NewCompressor(storage.CompressionOptions{Codec: storage.FlateCodec{Level: 9}})
+
+	set := func(key string, size int) interface{} {
+		value, err := compressor.Encode(storage.Value{Data: bytes.Repeat([]byte("a"), size)})
+		require.NoError(t, err)
+		require.NotEmpty(t, value.Encoding)
+		return applyCommand(t, f, Command{Op: "set", Namespace: "q", Key: namespacePrefix("q") + key, Value: value})
+	}
+
+	// Values compressed by the leader count at the size they were written
+	result := set("a", 5000)
+	err, ok := result.(error)
+	require.True(t, ok, "expected an error, got %v", result)
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+	assert.IsType(t, uint64(0), set("a", 1000))
+	assert.Equal(t, NamespaceUsage{Keys: 1, Bytes: 1001}, f.quotas.usage("q"))
+	result = set("b", 1000)
+	err, ok = result.(error)
+	require.True(t, ok, "expected an error, got %v", result)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"errors"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// ErrUnknownCommand is returned for a log entry whose op the state machine
+// does not know, such as one written by a newer version
+var ErrUnknownCommand = errors.New("unknown command")
+
+// ErrorCode classifies the error of an applied command, so that callers do
+// not have to compare errors
+type ErrorCode string
+
+// Error codes of applied commands
+const (
+	CodeOK                 ErrorCode = ""
+	CodeNotFound           ErrorCode = "not_found"
+	CodeNamespaceNotFound  ErrorCode = "namespace_not_found"
+	CodePreconditionFailed ErrorCode = "precondition_failed"
+	CodeInvalidArgument    ErrorCode = "invalid_argument"
+	CodeWrongType          ErrorCode = "wrong_type"
+	CodeNotANumber         ErrorCode = "not_a_number"
+	CodeQuotaExceeded      ErrorCode = "quota_exceeded"
+	CodeValueTooLarge      ErrorCode = "value_too_large"
+	CodeOutOfMemory        ErrorCode = "out_of_memory"
+	CodeUnknownCommand     ErrorCode = "unknown_command"
+	CodeInternal           ErrorCode = "internal"
+)
+
+// errorCodes maps errors to their codes, wrapped errors included
+var errorCodes = []struct {
+	err  error
+	code ErrorCode
+}{
+	{storage.ErrKeyNotFound, CodeNotFound},
+	{storage.ErrKeyExpired, CodeNotFound},
+	{ErrUploadNotFound, CodeNotFound},
+	{ErrNamespaceNotFound, CodeNamespaceNotFound},
+	{ErrPreconditionFailed, CodePreconditionFailed},
+	{ErrInvalidNamespace, CodeInvalidArgument},
+	{ErrReservedKey, CodeInvalidArgument},
+	{ErrInvalidTxn, CodeInvalidArgument},
+	{ErrInvalidBatch, CodeInvalidArgument},
+	{ErrInvalidScore, CodeInvalidArgument},
+	{ErrInvalidOffset, CodeInvalidArgument},
+	{ErrInvalidPart, CodeInvalidArgument},
+	{ErrMissingPart, CodeInvalidArgument},
+	{storage.ErrWrongType, CodeWrongType},
+	{ErrNotInteger, CodeNotANumber},
+	{ErrNotFloat, CodeNotANumber},
+	{ErrOverflow, CodeNotANumber},
+	{ErrQuotaExceeded, CodeQuotaExceeded},
+	{ErrValueTooLarge, CodeValueTooLarge},
+	{ErrEntryTooLarge, CodeValueTooLarge},
+	{storage.ErrOutOfMemory, CodeOutOfMemory},
+	{ErrUnknownCommand, CodeUnknownCommand},
+}
+
+// CodeOf returns the code of err, CodeOK for nil and CodeInternal for
+// errors without a more specific code
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return CodeOK
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// ApplyResult is the outcome of a command applied by the state machine,
+// returned for every log entry
+type ApplyResult struct {
+	Revision uint64         // Index of the entry, the revision of the values it wrote
+	Prev     *storage.Value // Value of the command's key before it was applied, nil if it had none
+	Code     ErrorCode      // Code of Err, CodeOK if the command succeeded
+	Err      error          // Error the command failed with
+	Data     interface{}    // Result of the op, such as a count or a transaction outcome
+}
+
+// newApplyResult returns the result of a command applied at index, given
+// the response of its op
+func newApplyResult(index uint64, prev *storage.Value, resp interface{}) *ApplyResult {
+	result := &ApplyResult{Revision: index, Prev: prev}
+	if err, ok := resp.(error); ok {
+		result.Err = err
+		result.Code = CodeOf(err)
+	} else {
+		result.Data = resp
+	}
+	return result
+}
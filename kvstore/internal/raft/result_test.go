@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMApplyResult(t *testing.T) {
+	f := newFSM(storage.NewMemoryStorage(), zap.NewNop())
+
+	// A new key has no previous value
+	first := applyResult(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}})
+	require.NoError(t, first.Err)
+	assert.Equal(t, CodeOK, first.Code)
+	assert.Nil(t, first.Prev)
+	assert.Equal(t, first.Revision, first.Data)
+
+	// Writes report the value they replace
+	second := applyResult(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("2")}})
+	require.NotNil(t, second.Prev)
+	assert.Equal(t, "1", string(second.Prev.Data))
+	assert.Equal(t, first.Revision, second.Prev.Revision)
+
+	deleted := applyResult(t, f, Command{Op: "delete", Key: "a"})
+	require.NotNil(t, deleted.Prev)
+	assert.Equal(t, "2", string(deleted.Prev.Data))
+
+	// Failures carry their code
+	failed := applyResult(t, f, Command{Op: "set", Key: "a", If: &Precondition{Exists: true}})
+	assert.Equal(t, ErrPreconditionFailed, failed.Err)
+	assert.Equal(t, CodePreconditionFailed, failed.Code)
+
+	unknown := applyResult(t, f, Command{Op: "frobnicate", Key: "a"})
+	assert.Equal(t, ErrUnknownCommand, unknown.Err)
+	assert.Equal(t, CodeUnknownCommand, unknown.Code)
+}
+
+func TestCodeOf(t *testing.T) {
+	assert.Equal(t, CodeOK, CodeOf(nil))
+	assert.Equal(t, CodeNotFound, CodeOf(storage.ErrKeyNotFound))
+	assert.Equal(t, CodeQuotaExceeded, CodeOf(fmt.Errorf("%w: 2 keys", ErrQuotaExceeded)))
+	assert.Equal(t, CodeInternal, CodeOf(storage.ErrStorageClosed))
+}
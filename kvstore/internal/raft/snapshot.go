@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// snapshotStore wraps the store of the FSM so that snapshots are persisted
+// from the store itself while entries keep being applied. Before a key is
+// first written while a snapshot is open, the value it had is saved for
+// that snapshot, so the snapshot reads the keys as they were when it was
+// taken while only holding the ones written since.
+type snapshotStore struct {
+	storage.Storage
+	mutex sync.Mutex
+	views map[*storeView]struct{}
+}
+
+// newSnapshotStore wraps store
+func newSnapshotStore(store storage.Storage) *snapshotStore {
+	return &snapshotStore{Storage: store, views: make(map[*storeView]struct{})}
+}
+
+// storeView is the store as it was when a snapshot was taken
+type storeView struct {
+	store   *snapshotStore
+	mutex   sync.Mutex
+	saved   map[string]savedValue // Keys written since the view was opened
+	last    string                // Last key iterated, once visited
+	visited bool                  // The store has been iterated past a key
+}
+
+// savedValue is the value a key had when a view was opened
+type savedValue struct {
+	value  storage.Value
+	exists bool
+	read   bool // The view has been iterated past the key
+}
+
+// open returns a view of the store as it is now. It must be closed once
+// the snapshot is persisted or released.
+func (s *snapshotStore) open() *storeView {
+	view := &storeView{store: s, saved: make(map[string]savedValue)}
+	s.mutex.Lock()
+	s.views[view] = struct{}{}
+	s.mutex.Unlock()
+	return view
+}
+
+// save keeps the current value of key for every open view that has not
+// saved it yet. Entries are applied one at a time, so nothing writes key
+// between the check and the read.
+func (s *snapshotStore) save(key string) {
+	s.mutex.Lock()
+	var views []*storeView
+	for view := range s.views {
+		if !view.has(key) {
+			views = append(views, view)
+		}
+	}
+	s.mutex.Unlock()
+	if len(views) == 0 {
+		return
+	}
+
+	// The store is read without holding a view, which is locked while
+	// the store is iterated
+	value, err := s.Storage.Get(key)
+	for _, view := range views {
+		view.mutex.Lock()
+		if _, ok := view.saved[key]; !ok {
+			// The view has read the key if it has been iterated past it
+			read := view.visited && key <= view.last
+			view.saved[key] = savedValue{value: value, exists: err == nil, read: read}
+		}
+		view.mutex.Unlock()
+	}
+}
+
+// saveEvicted keeps value, which key held until a write evicted it, for
+// every open view that has not saved key yet. It is called while the
+// wrapped store is locked, so the store is not read.
+func (s *snapshotStore) saveEvicted(key string, value storage.Value) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for view := range s.views {
+		view.mutex.Lock()
+		if _, ok := view.saved[key]; !ok {
+			// The view has read the key if it has been iterated past it
+			read := view.visited && key <= view.last
+			view.saved[key] = savedValue{value: value, exists: true, read: read}
+		}
+		view.mutex.Unlock()
+	}
+}
+
+// Set saves the value key had for open views, then stores value
+func (s *snapshotStore) Set(key string, value storage.Value) error {
+	s.save(key)
+	return s.Storage.Set(key, value)
+}
+
+// Delete saves the value key had for open views, then removes it
+func (s *snapshotStore) Delete(key string) error {
+	s.save(key)
+	return s.Storage.Delete(key)
+}
+
+// EvictionRanks returns the eviction ranks of the wrapped storage, nil if
+// it keeps none
+func (s *snapshotStore) EvictionRanks() map[string]storage.EvictionRank {
+	if ranker, ok := s.Storage.(storage.EvictionRanker); ok {
+		return ranker.EvictionRanks()
+	}
+	return nil
+}
+
+// SetEvictionRanks sets the eviction ranks of the wrapped storage
+func (s *snapshotStore) SetEvictionRanks(ranks map[string]storage.EvictionRank) {
+	if ranker, ok := s.Storage.(storage.EvictionRanker); ok {
+		ranker.SetEvictionRanks(ranks)
+	}
+}
+
+// has reports whether the view saved key
+func (v *storeView) has(key string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	_, ok := v.saved[key]
+	return ok
+}
+
+// iterate calls fn for each key of the view, stopping early when fn
+// returns false. Keys are visited in key order, except those deleted since
+// the view was opened, which come last.
+func (v *storeView) iterate(fn func(key string, value storage.Value) bool) error {
+	stopped := false
+	err := v.store.Storage.Iterate("", "", func(key string, value storage.Value) bool {
+		// A key written after it was read from the store was saved before
+		// the write, so the saved value wins
+		v.mutex.Lock()
+		v.last, v.visited = key, true
+		saved, ok := v.saved[key]
+		if ok {
+			saved.read = true
+			v.saved[key] = saved
+			value = saved.value
+		}
+		v.mutex.Unlock()
+		if ok && !saved.exists {
+			return true
+		}
+		if !fn(key, value) {
+			stopped = true
+			return false
+		}
+		return true
+	})
+	if err != nil || stopped {
+		return err
+	}
+
+	v.mutex.Lock()
+	var deleted []string
+	for key, saved := range v.saved {
+		if saved.exists && !saved.read {
+			deleted = append(deleted, key)
+		}
+	}
+	v.mutex.Unlock()
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		v.mutex.Lock()
+		value := v.saved[key].value
+		v.mutex.Unlock()
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// close stops saving values for the view
+func (v *storeView) close() {
+	v.store.mutex.Lock()
+	delete(v.store.views, v)
+	v.store.mutex.Unlock()
+}
@@ -0,0 +1,537 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+// ErrInvalidScore is returned for a sorted set score that is not a finite
+// number
+var ErrInvalidScore = errors.New("invalid score")
+
+// structTypes maps the ops of data structure commands to the type of value
+// they operate on
+var structTypes = map[string]string{
+	"lpush": storage.TypeList,
+	"rpush": storage.TypeList,
+	"lpop":  storage.TypeList,
+	"rpop":  storage.TypeList,
+	"hset":  storage.TypeHash,
+	"hdel":  storage.TypeHash,
+	"sadd":  storage.TypeSet,
+	"srem":  storage.TypeSet,
+	"zadd":  storage.TypeZSet,
+	"zrem":  storage.TypeZSet,
+}
+
+// StructArgs are the arguments of a data structure command
+type StructArgs struct {
+	Values  []string           `json:"values,omitempty"`  // Elements pushed to a list
+	Count   int                `json:"count,omitempty"`   // Elements popped from a list
+	Fields  map[string]string  `json:"fields,omitempty"`  // Hash fields to set
+	Members []string           `json:"members,omitempty"` // Hash fields to delete, or set and sorted set members
+	Scores  map[string]float64 `json:"scores,omitempty"`  // Sorted set members to add, with their scores
+}
+
+// ZMember is a member of a sorted set
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// Data structures are stored as JSON in the data of a value: lists as an
+// array, hashes as an object, sets as a sorted array and sorted sets as an
+// array of members ordered by score, then member.
+
+// decodeStruct decodes the data structure held by value into dst
+func decodeStruct(value storage.Value, typ string, dst interface{}) error {
+	if value.Type != typ {
+		return storage.ErrWrongType
+	}
+	return json.Unmarshal(value.Data, dst)
+}
+
+// sortZSet orders the members of a sorted set by score, then member
+func sortZSet(zset []ZMember) {
+	sort.Slice(zset, func(i, j int) bool {
+		if zset[i].Score != zset[j].Score {
+			return zset[i].Score < zset[j].Score
+		}
+		return zset[i].Member < zset[j].Member
+	})
+}
+
+// applyStruct applies a data structure command: the current value is
+// decoded, changed and written back in a single entry. A structure left
+// empty is deleted, and a new one takes the expiration of the command.
+func (f *FSM) applyStruct(cmd Command, index uint64) interface{} {
+	var args StructArgs
+	if cmd.Args != nil {
+		args = *cmd.Args
+	}
+	typ := structTypes[cmd.Op]
+
+	prior, exists, err := f.lookup(cmd.Key)
+	if err != nil {
+		return err
+	}
+	if exists && prior.Type != typ {
+		return storage.ErrWrongType
+	}
+
+	var (
+		result  interface{}
+		changed bool
+		size    int
+		data    []byte
+	)
+	switch typ {
+	case storage.TypeList:
+		var list []string
+		if exists {
+			if err := json.Unmarshal(prior.Data, &list); err != nil {
+				return err
+			}
+		}
+		result, changed = applyList(&list, cmd.Op, args)
+		size = len(list)
+		data, err = json.Marshal(list)
+
+	case storage.TypeHash:
+		hash := make(map[string]string)
+		if exists {
+			if err := json.Unmarshal(prior.Data, &hash); err != nil {
+				return err
+			}
+		}
+		result, changed = applyHash(hash, cmd.Op, args)
+		size = len(hash)
+		data, err = json.Marshal(hash)
+
+	case storage.TypeSet:
+		var set []string
+		if exists {
+			if err := json.Unmarshal(prior.Data, &set); err != nil {
+				return err
+			}
+		}
+		result, changed = applySet(&set, cmd.Op, args)
+		size = len(set)
+		data, err = json.Marshal(set)
+
+	case storage.TypeZSet:
+		var zset []ZMember
+		if exists {
+			if err := json.Unmarshal(prior.Data, &zset); err != nil {
+				return err
+			}
+		}
+		var n int
+		if n, changed, err = applyZSet(&zset, cmd.Op, args); err != nil {
+			return err
+		}
+		result = n
+		size = len(zset)
+		data, err = json.Marshal(zset)
+	}
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return result
+	}
+
+	if size == 0 {
+		if err := f.store.Delete(cmd.Key); err != nil {
+			return err
+		}
+		f.history.recordDelete(cmd.Key, index, f.now())
+		return result
+	}
+
+	value := storage.Value{Data: data, Type: typ, Expiration: cmd.Value.Expiration}
+	if exists {
+		value.Expiration = prior.Expiration
+		value.ContentType = prior.ContentType
+		value.Meta = prior.Meta
+	}
+	f.stamp(&value, index, prior, exists)
+	existed := f.priorExists(cmd.Key)
+	if err := f.store.Set(cmd.Key, value); err != nil {
+		return err
+	}
+	f.history.recordSet(cmd.Key, value, existed, f.now())
+	return result
+}
+
+// applyList applies a list op and returns its result and whether the list
+// changed. Pushes return the new length and pops the removed elements.
+func applyList(list *[]string, op string, args StructArgs) (interface{}, bool) {
+	l := *list
+	switch op {
+	case "lpush":
+		// Elements are pushed one at a time, so the last one ends up first
+		pushed := make([]string, 0, len(args.Values)+len(l))
+		for i := len(args.Values) - 1; i >= 0; i-- {
+			pushed = append(pushed, args.Values[i])
+		}
+		*list = append(pushed, l...)
+		return len(*list), len(args.Values) > 0
+	case "rpush":
+		*list = append(l, args.Values...)
+		return len(*list), len(args.Values) > 0
+	}
+
+	count := args.Count
+	if count <= 0 {
+		count = 1
+	}
+	if count > len(l) {
+		count = len(l)
+	}
+	popped := make([]string, count)
+	if op == "lpop" {
+		copy(popped, l[:count])
+		*list = l[count:]
+	} else {
+		for i := range popped {
+			popped[i] = l[len(l)-1-i]
+		}
+		*list = l[:len(l)-count]
+	}
+	return popped, count > 0
+}
+
+// applyHash applies a hash op and returns how many fields were added or
+// deleted and whether the hash changed
+func applyHash(hash map[string]string, op string, args StructArgs) (int, bool) {
+	n, changed := 0, false
+	switch op {
+	case "hset":
+		for field, v := range args.Fields {
+			old, ok := hash[field]
+			if !ok {
+				n++
+			}
+			if !ok || old != v {
+				hash[field] = v
+				changed = true
+			}
+		}
+	case "hdel":
+		for _, field := range args.Members {
+			if _, ok := hash[field]; ok {
+				delete(hash, field)
+				n++
+			}
+		}
+		changed = n > 0
+	}
+	return n, changed
+}
+
+// applySet applies a set op and returns how many members were added or
+// removed and whether the set changed
+func applySet(set *[]string, op string, args StructArgs) (int, bool) {
+	members := make(map[string]struct{}, len(*set))
+	for _, member := range *set {
+		members[member] = struct{}{}
+	}
+
+	n := 0
+	for _, member := range args.Members {
+		_, ok := members[member]
+		switch {
+		case op == "sadd" && !ok:
+			members[member] = struct{}{}
+			n++
+		case op == "srem" && ok:
+			delete(members, member)
+			n++
+		}
+	}
+
+	out := make([]string, 0, len(members))
+	for member := range members {
+		out = append(out, member)
+	}
+	sort.Strings(out)
+	*set = out
+	return n, n > 0
+}
+
+// applyZSet applies a sorted set op and returns how many members were added
+// or removed and whether the set changed. Adding an existing member
+// updates its score.
+func applyZSet(zset *[]ZMember, op string, args StructArgs) (int, bool, error) {
+	scores := make(map[string]float64, len(*zset))
+	for _, m := range *zset {
+		scores[m.Member] = m.Score
+	}
+
+	n, changed := 0, false
+	switch op {
+	case "zadd":
+		for member, score := range args.Scores {
+			if math.IsNaN(score) || math.IsInf(score, 0) {
+				return 0, false, ErrInvalidScore
+			}
+			old, ok := scores[member]
+			if !ok {
+				n++
+			}
+			if !ok || old != score {
+				scores[member] = score
+				changed = true
+			}
+		}
+	case "zrem":
+		for _, member := range args.Members {
+			if _, ok := scores[member]; ok {
+				delete(scores, member)
+				n++
+			}
+		}
+		changed = n > 0
+	}
+
+	out := make([]ZMember, 0, len(scores))
+	for member, score := range scores {
+		out = append(out, ZMember{Member: member, Score: score})
+	}
+	sortZSet(out)
+	*zset = out
+	return n, changed, nil
+}
+
+// ListRange returns the elements of list from start to stop inclusive.
+// Negative indexes count from the end, -1 being the last element.
+func ListRange(list []string, start, stop int) []string {
+	n := len(list)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+	return list[start : stop+1]
+}
+
+// Intersect returns the members found in every set, in sorted order
+func Intersect(sets ...[]string) []string {
+	out := []string{}
+	if len(sets) == 0 {
+		return out
+	}
+	counts := make(map[string]int)
+	for _, set := range sets {
+		for _, member := range set {
+			counts[member]++
+		}
+	}
+	for member, count := range counts {
+		if count == len(sets) {
+			out = append(out, member)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ZRangeByScore returns the members of zset with a score in [min, max], in
+// order, and the rank of the first one
+func ZRangeByScore(zset []ZMember, min, max float64) ([]ZMember, int) {
+	start := sort.Search(len(zset), func(i int) bool { return zset[i].Score >= min })
+	end := sort.Search(len(zset), func(i int) bool { return zset[i].Score > max })
+	if start >= end {
+		return []ZMember{}, start
+	}
+	return zset[start:end], start
+}
+
+// ZRank returns the position of member in zset, lowest score first. ok is
+// false if it is not a member.
+func ZRank(zset []ZMember, member string) (rank int, score float64, ok bool) {
+	for i, m := range zset {
+		if m.Member == member {
+			return i, m.Score, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Structures is a handle on the data structures of a keyspace, the default
+// namespace or a named one
+type Structures struct {
+	node      *Node
+	namespace string
+	prefix    string
+}
+
+// Structures returns a handle on the data structures of the default
+// namespace
+func (n *Node) Structures() *Structures {
+	return &Structures{node: n}
+}
+
+// Structures returns a handle on the data structures of the namespace
+func (ns *Namespace) Structures() *Structures {
+	return &Structures{node: ns.node, namespace: ns.name, prefix: ns.prefix}
+}
+
+// check checks that key may be used and returns the configuration of its
+// namespace
+func (s *Structures) check(key string) (NamespaceConfig, error) {
+	if s.namespace == "" {
+		return NamespaceConfig{}, checkDefaultKey(key)
+	}
+	return s.node.Namespace(s.namespace).check(key)
+}
+
+// mutate proposes a data structure command on key
+func (s *Structures) mutate(key, op string, args StructArgs) (interface{}, error) {
+	config, err := s.check(key)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.node.apply(Command{
+		Op:        op,
+		Namespace: s.namespace,
+		Key:       s.prefix + key,
+		Value:     withDefaultTTL(storage.Value{}, config),
+		Args:      &args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// count proposes a data structure command whose result is a count
+func (s *Structures) count(key, op string, args StructArgs) (int, error) {
+	resp, err := s.mutate(key, op, args)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := resp.(int)
+	return n, nil
+}
+
+// read decodes the data structure stored under key into dst. A missing key
+// reads as an empty structure.
+func (s *Structures) read(key, typ string, dst interface{}) error {
+	if _, err := s.check(key); err != nil {
+		return err
+	}
+	value, err := s.node.store.Get(s.prefix + key)
+	if err == storage.ErrKeyNotFound || err == storage.ErrKeyExpired {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return decodeStruct(value, typ, dst)
+}
+
+// Push adds values to the head of the list at key if left is set, to its
+// tail otherwise, and returns the new length
+func (s *Structures) Push(key string, values []string, left bool) (int, error) {
+	op := "rpush"
+	if left {
+		op = "lpush"
+	}
+	return s.count(key, op, StructArgs{Values: values})
+}
+
+// Pop removes up to count elements from the head of the list at key if
+// left is set, from its tail otherwise, and returns them
+func (s *Structures) Pop(key string, count int, left bool) ([]string, error) {
+	op := "rpop"
+	if left {
+		op = "lpop"
+	}
+	resp, err := s.mutate(key, op, StructArgs{Count: count})
+	if err != nil {
+		return nil, err
+	}
+	popped, _ := resp.([]string)
+	return popped, nil
+}
+
+// List returns the elements of the list at key
+func (s *Structures) List(key string) ([]string, error) {
+	list := []string{}
+	err := s.read(key, storage.TypeList, &list)
+	return list, err
+}
+
+// HSet sets fields of the hash at key and returns how many were new
+func (s *Structures) HSet(key string, fields map[string]string) (int, error) {
+	return s.count(key, "hset", StructArgs{Fields: fields})
+}
+
+// HDel deletes fields of the hash at key and returns how many existed
+func (s *Structures) HDel(key string, fields []string) (int, error) {
+	return s.count(key, "hdel", StructArgs{Members: fields})
+}
+
+// Hash returns the fields of the hash at key
+func (s *Structures) Hash(key string) (map[string]string, error) {
+	hash := make(map[string]string)
+	err := s.read(key, storage.TypeHash, &hash)
+	return hash, err
+}
+
+// SAdd adds members to the set at key and returns how many were new
+func (s *Structures) SAdd(key string, members []string) (int, error) {
+	return s.count(key, "sadd", StructArgs{Members: members})
+}
+
+// SRem removes members from the set at key and returns how many existed
+func (s *Structures) SRem(key string, members []string) (int, error) {
+	return s.count(key, "srem", StructArgs{Members: members})
+}
+
+// Set returns the members of the set at key in sorted order
+func (s *Structures) Set(key string) ([]string, error) {
+	set := []string{}
+	err := s.read(key, storage.TypeSet, &set)
+	return set, err
+}
+
+// ZAdd adds members to the sorted set at key, or updates their scores, and
+// returns how many were new
+func (s *Structures) ZAdd(key string, scores map[string]float64) (int, error) {
+	for _, score := range scores {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			return 0, ErrInvalidScore
+		}
+	}
+	return s.count(key, "zadd", StructArgs{Scores: scores})
+}
+
+// ZRem removes members from the sorted set at key and returns how many
+// existed
+func (s *Structures) ZRem(key string, members []string) (int, error) {
+	return s.count(key, "zrem", StructArgs{Members: members})
+}
+
+// ZSet returns the members of the sorted set at key, lowest score first
+func (s *Structures) ZSet(key string) ([]ZMember, error) {
+	zset := []ZMember{}
+	err := s.read(key, storage.TypeZSet, &zset)
+	return zset, err
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMStructures(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+	n := &Node{store: store, fsm: f}
+	structs := n.Structures()
+
+	apply := func(op, key string, args StructArgs) interface{} {
+		return applyCommand(t, f, Command{Op: op, Key: key, Args: &args})
+	}
+
+	// Lists
+	assert.Equal(t, 2, apply("rpush", "l", StructArgs{Values: []string{"b", "c"}}))
+	assert.Equal(t, 4, apply("lpush", "l", StructArgs{Values: []string{"x", "a"}}))
+	list, err := structs.List("l")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "x", "b", "c"}, list)
+	assert.Equal(t, []string{"c", "b"}, apply("rpop", "l", StructArgs{Count: 2}))
+	assert.Equal(t, []string{"a"}, apply("lpop", "l", StructArgs{}))
+	assert.Equal(t, []string{"x"}, ListRange(list, 1, -3))
+
+	// Hashes
+	assert.Equal(t, 2, apply("hset", "h", StructArgs{Fields: map[string]string{"a": "1", "b": "2"}}))
+	assert.Equal(t, 0, apply("hset", "h", StructArgs{Fields: map[string]string{"a": "3"}}))
+	assert.Equal(t, 1, apply("hdel", "h", StructArgs{Members: []string{"b", "missing"}}))
+	hash, err := structs.Hash("h")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "3"}, hash)
+
+	// Sets
+	assert.Equal(t, 3, apply("sadd", "s1", StructArgs{Members: []string{"c", "a", "b", "a"}}))
+	apply("sadd", "s2", StructArgs{Members: []string{"b", "c", "d"}})
+	assert.Equal(t, 1, apply("srem", "s2", StructArgs{Members: []string{"d"}}))
+	s1, err := structs.Set("s1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, s1)
+	s2, err := structs.Set("s2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, Intersect(s1, s2))
+
+	// Sorted sets
+	assert.Equal(t, 3, apply("zadd", "z", StructArgs{Scores: map[string]float64{"a": 3, "b": 1, "c": 2}}))
+	assert.Equal(t, 0, apply("zadd", "z", StructArgs{Scores: map[string]float64{"a": 0.5}}))
+	zset, err := structs.ZSet("z")
+	require.NoError(t, err)
+	members, first := ZRangeByScore(zset, 1, 2)
+	assert.Equal(t, []ZMember{{"b", 1}, {"c", 2}}, members)
+	assert.Equal(t, 1, first)
+	rank, score, ok := ZRank(zset, "a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, rank)
+	assert.Equal(t, 0.5, score)
+
+	// Operations on a key of another type fail, and empty structures are
+	// removed
+	applyCommand(t, f, Command{Op: "set", Key: "plain", Value: storage.Value{Data: []byte("v")}})
+	assert.Equal(t, storage.ErrWrongType, apply("rpush", "plain", StructArgs{Values: []string{"a"}}))
+	assert.Equal(t, storage.ErrWrongType, apply("sadd", "l", StructArgs{Members: []string{"a"}}))
+	_, err = structs.Hash("l")
+	assert.Equal(t, storage.ErrWrongType, err)
+	assert.Equal(t, []string{"x"}, apply("lpop", "l", StructArgs{Count: 5}))
+	assert.False(t, store.Has("l"))
+	assert.Equal(t, []string{}, apply("lpop", "l", StructArgs{}))
+}
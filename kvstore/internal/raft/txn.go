@@ -0,0 +1,278 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidTxn is returned for a transaction with unknown comparisons or
+// operations
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// Compare is a condition of a transaction on the current state of one key
+type Compare struct {
+	Key      string `json:"key"`
+	Target   string `json:"target"`             // "value", "revision" or "exists"
+	Result   string `json:"result,omitempty"`   // "=", "!=", "<" or ">", "=" if empty
+	Value    []byte `json:"value,omitempty"`    // Compared against for target "value"
+	Revision uint64 `json:"revision,omitempty"` // Compared against for target "revision"
+	Exists   bool   `json:"exists,omitempty"`   // Compared against for target "exists"
+}
+
+// TxnOp is an operation run by a transaction
+type TxnOp struct {
+	Op    string        `json:"op"` // "get", "set" or "delete"
+	Key   string        `json:"key"`
+	Value storage.Value `json:"value"` // Value for set operations
+}
+
+// Txn is a transaction: if every comparison holds the success operations
+// run, otherwise the failure operations do. Either way the transaction is
+// a single log entry and applies atomically.
+type Txn struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []TxnOp   `json:"success,omitempty"`
+	Failure []TxnOp   `json:"failure,omitempty"`
+}
+
+// TxnOpResult is the outcome of one operation of a transaction
+type TxnOpResult struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Found    bool   `json:"found,omitempty"`    // Whether a get found the key
+	Value    []byte `json:"value,omitempty"`    // Value read by a get
+	Revision uint64 `json:"revision,omitempty"` // Revision read by a get or written by a set
+}
+
+// TxnResult is the outcome of a transaction
+type TxnResult struct {
+	Succeeded bool          `json:"succeeded"` // Whether the comparisons held
+	Revision  uint64        `json:"revision"`  // Log index the transaction was applied at
+	Results   []TxnOpResult `json:"results"`
+}
+
+// Validate checks that the transaction only uses known comparisons and
+// operations
+func (t *Txn) Validate() error {
+	for _, c := range t.Compare {
+		switch c.Target {
+		case "value", "revision", "exists":
+		default:
+			return fmt.Errorf("%w: unknown compare target %q", ErrInvalidTxn, c.Target)
+		}
+		switch c.Result {
+		case "", "=", "!=", "<", ">":
+		default:
+			return fmt.Errorf("%w: unknown compare result %q", ErrInvalidTxn, c.Result)
+		}
+		if c.Target == "exists" && (c.Result == "<" || c.Result == ">") {
+			return fmt.Errorf("%w: existence can only be compared with = or !=", ErrInvalidTxn)
+		}
+	}
+
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for _, op := range ops {
+			switch op.Op {
+			case "get", "set", "delete":
+			default:
+				return fmt.Errorf("%w: unknown operation %q", ErrInvalidTxn, op.Op)
+			}
+			if op.Key == "" {
+				return fmt.Errorf("%w: operation without a key", ErrInvalidTxn)
+			}
+		}
+	}
+	return nil
+}
+
+// holds reports whether the comparison holds for a key with the given
+// value, exists being false if the key does not exist
+func (c Compare) holds(value storage.Value, exists bool) bool {
+	var cmp int
+	switch c.Target {
+	case "exists":
+		if exists == c.Exists {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	case "revision":
+		switch {
+		case value.Revision < c.Revision:
+			cmp = -1
+		case value.Revision > c.Revision:
+			cmp = 1
+		}
+	case "value":
+		if !exists {
+			// A missing key has no value to compare
+			return false
+		}
+		cmp = bytes.Compare(value.Data, c.Value)
+	}
+
+	switch c.Result {
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp == 0
+	}
+}
+
+// txnUndo is the state of a key before a transaction wrote it
+type txnUndo struct {
+	key    string
+	value  storage.Value
+	exists bool
+}
+
+// applyTxn runs a transaction against the store at log index index. If an
+// operation fails, the writes already made are rolled back so that the
+// transaction has no effect.
+func (f *FSM) applyTxn(txn *Txn, index uint64) (*TxnResult, error) {
+	if txn == nil {
+		return nil, ErrInvalidTxn
+	}
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &TxnResult{Succeeded: true, Revision: index}
+	for _, c := range txn.Compare {
+		value, exists := f.lookupPrior(c.Key)
+		if !c.holds(value, exists) {
+			result.Succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Success
+	if !result.Succeeded {
+		ops = txn.Failure
+	}
+
+	var undo []txnUndo
+	var record []func()
+	existed := make(map[string]bool) // Whether each written key existed before the transaction
+	evictedBefore := len(f.evictions)
+	rollback := func() {
+		evicted := append([]eviction(nil), f.evictions[evictedBefore:]...)
+		f.evictions = f.evictions[:evictedBefore]
+		undone := make(map[string]bool, len(undo))
+		for i := len(undo) - 1; i >= 0; i-- {
+			u := undo[i]
+			undone[u.key] = true
+			if u.exists {
+				f.quotas.force(u.key, u.value)
+			} else {
+				f.store.Delete(u.key)
+			}
+		}
+		// Keys the writes evicted come back too, unless the transaction
+		// wrote them and so has just put them back as they were
+		for _, e := range evicted {
+			if !undone[e.key] {
+				f.quotas.force(e.key, e.value)
+			}
+		}
+	}
+
+	result.Results = make([]TxnOpResult, 0, len(ops))
+	for _, op := range ops {
+		value, exists := f.lookupPrior(op.Key)
+
+		res := TxnOpResult{Op: op.Op, Key: op.Key}
+		if _, ok := existed[op.Key]; !ok && op.Op != "get" {
+			existed[op.Key] = exists
+		}
+		switch op.Op {
+		case "get":
+			res.Found = exists
+			if exists {
+				res.Value = value.Data
+				res.Revision = value.Revision
+			}
+		case "set":
+			undo = append(undo, txnUndo{key: op.Key, value: value, exists: exists})
+			f.stamp(&op.Value, index, value, exists)
+
+			if err := f.store.Set(op.Key, op.Value); err != nil {
+				rollback()
+				return nil, err
+			}
+			key, value := op.Key, op.Value
+			record = append(record, func() {
+				f.history.recordSet(key, value, existed[key] && !f.history.tracks(key), f.now())
+			})
+			res.Revision = index
+		case "delete":
+			undo = append(undo, txnUndo{key: op.Key, value: value, exists: exists})
+			if err := f.store.Delete(op.Key); err != nil {
+				rollback()
+				return nil, err
+			}
+			key := op.Key
+			record = append(record, func() { f.history.recordDelete(key, index, f.now()) })
+		}
+		result.Results = append(result.Results, res)
+	}
+
+	// The history only learns of the writes once none can be rolled back,
+	// and so are the chunks of replaced values released
+	for _, fn := range record {
+		fn()
+	}
+	for _, u := range undo {
+		if u.exists {
+			f.releaseChunks(u.key, u.value)
+		}
+	}
+	return result, nil
+}
+
+// stamp sets the revision and timestamps of a value written at index over
+// prior. The log index orders every write and the time is the replicated
+// clock, so both are the same on every replica. A key keeps the creation
+// time of the value it replaces.
+func (f *FSM) stamp(value *storage.Value, index uint64, prior storage.Value, exists bool) {
+	value.Revision = index
+	value.Modified = f.now()
+	value.Created = value.Modified
+	if exists {
+		value.Created = prior.Created
+	}
+}
+
+// lookupPrior returns the live value key has before a write and whether it
+// exists. A value this replica cannot read, such as a corrupt record, is
+// taken as missing and left to the scrubber, so that the outcome of the
+// write only depends on the log.
+func (f *FSM) lookupPrior(key string) (storage.Value, bool) {
+	value, exists, err := f.lookup(key)
+	if err != nil {
+		f.logger.Warn("failed to read prior value", zap.String("key", key), zap.Error(err))
+		return storage.Value{}, false
+	}
+	return value, exists
+}
+
+// lookup returns the live value of key and whether it exists
+func (f *FSM) lookup(key string) (storage.Value, bool, error) {
+	value, err := f.store.Get(key)
+	switch err {
+	case nil:
+		return value, true, nil
+	case storage.ErrKeyNotFound, storage.ErrKeyExpired:
+		return storage.Value{}, false, nil
+	default:
+		return storage.Value{}, false, err
+	}
+}
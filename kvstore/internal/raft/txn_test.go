@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMTxn(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	rev := applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}}).(uint64)
+
+	// Comparisons hold: the success branch runs
+	res := applyCommand(t, f, Command{Op: "txn", Txn: &Txn{
+		Compare: []Compare{
+			{Key: "a", Target: "value", Value: []byte("1")},
+			{Key: "a", Target: "revision", Revision: rev},
+			{Key: "b", Target: "exists", Exists: false},
+		},
+		Success: []TxnOp{
+			{Op: "get", Key: "a"},
+			{Op: "set", Key: "b", Value: storage.Value{Data: []byte("2")}},
+			{Op: "delete", Key: "a"},
+		},
+		Failure: []TxnOp{{Op: "set", Key: "c", Value: storage.Value{Data: []byte("3")}}},
+	}})
+	result, ok := res.(*TxnResult)
+	require.True(t, ok, "unexpected result %v", res)
+	assert.True(t, result.Succeeded)
+	require.Len(t, result.Results, 3)
+	assert.True(t, result.Results[0].Found)
+	assert.Equal(t, []byte("1"), result.Results[0].Value)
+	assert.Equal(t, rev, result.Results[0].Revision)
+	assert.Equal(t, result.Revision, result.Results[1].Revision)
+
+	assert.False(t, store.Has("a"))
+	assert.False(t, store.Has("c"))
+	value, err := store.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, result.Revision, value.Revision)
+
+	// A comparison fails: the failure branch runs
+	res = applyCommand(t, f, Command{Op: "txn", Txn: &Txn{
+		Compare: []Compare{{Key: "b", Target: "value", Result: ">", Value: []byte("2")}},
+		Success: []TxnOp{{Op: "delete", Key: "b"}},
+		Failure: []TxnOp{{Op: "get", Key: "a"}, {Op: "set", Key: "c", Value: storage.Value{Data: []byte("3")}}},
+	}})
+	result = res.(*TxnResult)
+	assert.False(t, result.Succeeded)
+	assert.False(t, result.Results[0].Found)
+	assert.True(t, store.Has("b"))
+	assert.True(t, store.Has("c"))
+}
+
+func TestFSMTxnInvalid(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+
+	res := applyCommand(t, f, Command{Op: "txn", Txn: &Txn{
+		Success: []TxnOp{
+			{Op: "set", Key: "a", Value: storage.Value{Data: []byte("1")}},
+			{Op: "rename", Key: "a"},
+		},
+	}})
+	err, ok := res.(error)
+	require.True(t, ok)
+	assert.True(t, errors.Is(err, ErrInvalidTxn))
+	assert.False(t, store.Has("a"))
+}
+
+func TestFSMTxnRollback(t *testing.T) {
+	// The second write exceeds the memory limit, so the first is undone
+	store := storage.NewMemoryStorageWithOptions(storage.MemoryStorageOptions{MaxMemory: 300})
+	f := newFSM(store, zap.NewNop())
+
+	applyCommand(t, f, Command{Op: "set", Key: "a", Value: storage.Value{Data: []byte("old")}})
+
+	res := applyCommand(t, f, Command{Op: "txn", Txn: &Txn{
+		Success: []TxnOp{
+			{Op: "set", Key: "a", Value: storage.Value{Data: []byte("new")}},
+			{Op: "set", Key: "b", Value: storage.Value{Data: make([]byte, 1000)}},
+		},
+	}})
+	assert.Equal(t, storage.ErrOutOfMemory, res)
+
+	value, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), value.Data)
+	assert.False(t, store.Has("b"))
+}
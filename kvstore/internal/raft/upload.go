@@ -0,0 +1,672 @@
+package raft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+)
+
+const (
+	// uploadKeyPrefix starts the stored keys of multipart uploads within a
+	// namespace. The record of upload id is stored as uploadKeyPrefix + id
+	// and its parts as uploadKeyPrefix + id + "/" + part number.
+	uploadKeyPrefix = "\x00up/"
+
+	// releaseKeyPrefix starts the stored keys of chunks waiting to be
+	// deleted within a namespace. Upload IDs are hex, so it never starts
+	// the key of an upload.
+	releaseKeyPrefix = uploadKeyPrefix + "~"
+
+	// MaxUploadParts is the most parts a multipart upload may have
+	MaxUploadParts = 10000
+
+	// uploadExpiry is how long an upload may stay incomplete before it
+	// expires with its parts
+	uploadExpiry = 24 * time.Hour
+
+	// chunkReleaseDelay is how long the chunks of a chunked value are kept
+	// once it is replaced or deleted, so that reads that opened it before
+	// can finish. A download taking longer may be cut short.
+	chunkReleaseDelay = time.Hour
+)
+
+var (
+	// ErrUploadNotFound is returned for an upload that was never initiated,
+	// or was completed, aborted or expired
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrInvalidPart is returned for a part number outside 1 to
+	// MaxUploadParts, or part numbers not in ascending order
+	ErrInvalidPart = errors.New("invalid part number")
+	// ErrMissingPart is returned when completing an upload with a part that
+	// was never uploaded
+	ErrMissingPart = errors.New("part has not been uploaded")
+	// ErrMissingChunk is returned when reading a chunked value that lost a
+	// chunk, such as a past revision whose chunks were released
+	ErrMissingChunk = errors.New("chunk of value is missing")
+)
+
+// Upload is a multipart upload in progress. Its parts are stored as keys of
+// their own until it is completed into a chunked value or aborted.
+type Upload struct {
+	ID          string            `json:"id"`
+	Key         string            `json:"key"`                    // Key the value is written to
+	ContentType string            `json:"content_type,omitempty"` // Content type of the value
+	Meta        map[string]string `json:"meta,omitempty"`         // User metadata of the value
+	Expiration  int64             `json:"expiration,omitempty"`   // Expiration of the value
+	Created     int64             `json:"created"`                // Replicated time of initiation
+}
+
+// Part is a part of a multipart upload, or a chunk of a chunked value
+type Part struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
+// Manifest is the data of a chunked value: the parts of the upload it was
+// completed from, in order
+type Manifest struct {
+	Upload string `json:"upload"`
+	Size   int64  `json:"size"`
+	Parts  []Part `json:"parts"`
+}
+
+// UploadArgs are the arguments of multipart upload commands
+type UploadArgs struct {
+	ID    string `json:"id"`
+	Part  int    `json:"part,omitempty"`  // Part written by upload_part
+	Parts []int  `json:"parts,omitempty"` // Parts upload_complete keeps, all of them if empty
+}
+
+// isUploadKey reports whether key, without its namespace prefix, belongs
+// to an upload
+func isUploadKey(key string) bool {
+	return strings.HasPrefix(key, uploadKeyPrefix)
+}
+
+// uploadKey returns the stored key of the record of upload id in the
+// keyspace with the given prefix
+func uploadKey(prefix, id string) string {
+	return prefix + uploadKeyPrefix + id
+}
+
+// chunkKey returns the stored key of a part of upload id. Part numbers are
+// padded so that parts are stored in order.
+func chunkKey(prefix, id string, part int) string {
+	return fmt.Sprintf("%s%s%s/%05d", prefix, uploadKeyPrefix, id, part)
+}
+
+// keyPrefix returns the namespace prefix of a stored key, empty for the
+// default namespace
+func keyPrefix(key string) string {
+	if namespace, _, ok := splitNamespaceKey(key); ok {
+		return namespacePrefix(namespace)
+	}
+	return ""
+}
+
+// releaseKey returns the stored key of the pending release of the chunks
+// of upload id
+func releaseKey(prefix, id string) string {
+	return prefix + releaseKeyPrefix + id
+}
+
+// isReleaseKey reports whether the stored key is that of a pending release
+func isReleaseKey(key string) bool {
+	if !strings.Contains(key, releaseKeyPrefix) {
+		return false
+	}
+	return strings.HasPrefix(key[len(keyPrefix(key)):], releaseKeyPrefix)
+}
+
+// DecodeManifest returns the manifest held by a chunked value
+func DecodeManifest(value storage.Value) (Manifest, error) {
+	var manifest Manifest
+	if value.Type != storage.TypeChunked {
+		return manifest, storage.ErrWrongType
+	}
+	err := json.Unmarshal(value.Data, &manifest)
+	return manifest, err
+}
+
+// applyUpload applies a multipart upload command. Parts expire with their
+// upload until it is completed, when they take the expiration of the value.
+func (f *FSM) applyUpload(cmd Command, index uint64) interface{} {
+	if cmd.Upload == nil || cmd.Upload.ID == "" {
+		return ErrUploadNotFound
+	}
+	args := *cmd.Upload
+	prefix := ""
+	if cmd.Namespace != "" {
+		prefix = namespacePrefix(cmd.Namespace)
+	}
+	now := f.now()
+
+	if cmd.Op == "upload_init" {
+		data, err := json.Marshal(Upload{
+			ID:          args.ID,
+			Key:         cmd.Key,
+			ContentType: cmd.Value.ContentType,
+			Meta:        cmd.Value.Meta,
+			Expiration:  cmd.Value.Expiration,
+			Created:     now,
+		})
+		if err != nil {
+			return err
+		}
+		record := storage.Value{Data: data, Expiration: now + int64(uploadExpiry)}
+		f.stamp(&record, index, storage.Value{}, false)
+		if err := f.store.Set(uploadKey(prefix, args.ID), record); err != nil {
+			return err
+		}
+		return args.ID
+	}
+
+	record, exists, err := f.lookup(uploadKey(prefix, args.ID))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUploadNotFound
+	}
+
+	switch cmd.Op {
+	case "upload_part":
+		if args.Part < 1 || args.Part > MaxUploadParts {
+			return ErrInvalidPart
+		}
+		chunk := storage.Value{Data: cmd.Value.Data, Expiration: record.Expiration}
+		f.stamp(&chunk, index, storage.Value{}, false)
+		if err := f.store.Set(chunkKey(prefix, args.ID, args.Part), chunk); err != nil {
+			return err
+		}
+		return int64(len(chunk.Data))
+
+	case "upload_complete":
+		var upload Upload
+		if err := json.Unmarshal(record.Data, &upload); err != nil {
+			return err
+		}
+		return f.completeUpload(prefix, upload, args.Parts, index)
+
+	case "upload_abort":
+		parts, err := listParts(f.store, prefix, args.ID)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err := f.store.Delete(chunkKey(prefix, args.ID, part.Number)); err != nil {
+				return err
+			}
+		}
+		return f.store.Delete(uploadKey(prefix, args.ID))
+	}
+	return ErrUnknownCommand
+}
+
+// completeUpload writes the chunked value of upload made of the given
+// parts, all uploaded ones if there are none, and deletes the parts left
+// out
+func (f *FSM) completeUpload(prefix string, upload Upload, numbers []int, index uint64) interface{} {
+	uploaded, err := listParts(f.store, prefix, upload.ID)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[int]int64, len(uploaded))
+	for _, part := range uploaded {
+		sizes[part.Number] = part.Size
+	}
+
+	manifest := Manifest{Upload: upload.ID, Parts: uploaded}
+	if len(numbers) > 0 {
+		manifest.Parts = make([]Part, 0, len(numbers))
+		for i, number := range numbers {
+			if number < 1 || number > MaxUploadParts || (i > 0 && number <= numbers[i-1]) {
+				return ErrInvalidPart
+			}
+			size, ok := sizes[number]
+			if !ok {
+				return fmt.Errorf("%w: %d", ErrMissingPart, number)
+			}
+			manifest.Parts = append(manifest.Parts, Part{Number: number, Size: size})
+		}
+	}
+	if len(manifest.Parts) == 0 {
+		return fmt.Errorf("%w: no parts", ErrMissingPart)
+	}
+	for _, part := range manifest.Parts {
+		manifest.Size += part.Size
+	}
+	if namespace, _, ok := splitNamespaceKey(upload.Key); ok {
+		config, _ := f.namespaces.get(namespace)
+		if config.MaxValueSize > 0 && manifest.Size > config.MaxValueSize {
+			return fmt.Errorf("%w: %d bytes, namespace %s allows %d", ErrValueTooLarge, manifest.Size, namespace, config.MaxValueSize)
+		}
+	}
+
+	// The kept parts become the chunks of the value and expire with it
+	kept := make(map[int]bool, len(manifest.Parts))
+	for _, part := range manifest.Parts {
+		kept[part.Number] = true
+	}
+	for _, part := range uploaded {
+		key := chunkKey(prefix, upload.ID, part.Number)
+		if !kept[part.Number] {
+			if err := f.store.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		chunk, err := f.store.Get(key)
+		if err != nil {
+			return err
+		}
+		chunk.Expiration = upload.Expiration
+		if err := f.store.Set(key, chunk); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	prior, exists, err := f.lookup(upload.Key)
+	if err != nil {
+		return err
+	}
+	value := storage.Value{
+		Data:        data,
+		Type:        storage.TypeChunked,
+		ContentType: upload.ContentType,
+		Meta:        upload.Meta,
+		Expiration:  upload.Expiration,
+	}
+	f.stamp(&value, index, prior, exists)
+	existed := f.priorExists(upload.Key)
+	if err := f.store.Set(upload.Key, value); err != nil {
+		return err
+	}
+	f.history.recordSet(upload.Key, value, existed, f.now())
+	if err := f.store.Delete(uploadKey(prefix, upload.ID)); err != nil {
+		return err
+	}
+	return manifest
+}
+
+// listParts returns the parts of upload id stored in store, in order
+func listParts(store storage.Storage, prefix, id string) ([]Part, error) {
+	partPrefix := uploadKey(prefix, id) + "/"
+	var parts []Part
+	err := store.Iterate(partPrefix, "", func(key string, value storage.Value) bool {
+		if number, err := strconv.Atoi(key[len(partPrefix):]); err == nil {
+			parts = append(parts, Part{Number: number, Size: int64(len(value.Data))})
+		}
+		return true
+	})
+	return parts, err
+}
+
+// chunkRelease is the stored record of the chunks of a manifest waiting
+// to be deleted
+type chunkRelease struct {
+	Manifest Manifest `json:"manifest"`
+	At       int64    `json:"at"` // Replicated time the chunks are deleted at
+}
+
+// pendingRelease is a stored chunkRelease in the queue of the FSM
+type pendingRelease struct {
+	key string
+	at  int64
+}
+
+// releaseChunks releases the chunks of prior, the value key held before a
+// write, unless key still holds it or the history keeps it. Values that
+// are not chunked have none.
+func (f *FSM) releaseChunks(key string, prior storage.Value) {
+	if prior.Type != storage.TypeChunked {
+		return
+	}
+	current, exists, _ := f.lookup(key)
+	if exists && current.Type == storage.TypeChunked && current.Revision == prior.Revision {
+		return
+	}
+	if f.history.retains(key, prior.Revision) {
+		// Released when the history discards the version
+		return
+	}
+	f.scheduleRelease(key, prior)
+}
+
+// releaseDropped releases the chunks of the chunked versions the history
+// has discarded
+func (f *FSM) releaseDropped() {
+	for _, dropped := range f.history.takeDropped() {
+		value, err := storage.DecodeValue(storage.Value{
+			Data:     dropped.version.Value,
+			Encoding: dropped.version.Encoding,
+			Type:     dropped.version.Type,
+		})
+		if err == nil {
+			f.scheduleRelease(dropped.key, value)
+		}
+	}
+}
+
+// scheduleRelease records that the chunks of value, a chunked value key
+// held, are deleted once chunkReleaseDelay has passed. Reads that opened
+// the value before it was replaced keep working until then.
+func (f *FSM) scheduleRelease(key string, value storage.Value) {
+	manifest, err := DecodeManifest(value)
+	if err != nil {
+		return
+	}
+	prefix := keyPrefix(key)
+	stored := releaseKey(prefix, manifest.Upload)
+	if f.store.Has(stored) {
+		return
+	}
+
+	release := chunkRelease{Manifest: manifest, At: f.now() + int64(chunkReleaseDelay)}
+	data, err := json.Marshal(release)
+	if err == nil {
+		// Bookkeeping must not fail on a quota
+		err = f.quotas.force(stored, storage.Value{Data: data})
+	}
+	if err != nil {
+		f.deleteChunks(prefix, manifest)
+		return
+	}
+	f.releases = append(f.releases, pendingRelease{key: stored, at: release.At})
+}
+
+// releaseDue deletes the chunks whose release is due at the replicated
+// time. The clock never goes backwards, so releases are queued in the
+// order they are due.
+func (f *FSM) releaseDue() {
+	now := f.now()
+	for len(f.releases) > 0 && f.releases[0].at <= now {
+		key := f.releases[0].key
+		f.releases = f.releases[1:]
+
+		// A dropped namespace takes its pending releases with it
+		record, exists, err := f.lookup(key)
+		if err != nil || !exists {
+			continue
+		}
+		var release chunkRelease
+		if err := json.Unmarshal(record.Data, &release); err == nil {
+			f.deleteChunks(keyPrefix(key), release.Manifest)
+		}
+		f.store.Delete(key)
+	}
+}
+
+// restoreRelease queues the release stored under key, if it is one, while
+// a snapshot is restored. Restore puts the queue in order once every key
+// is back.
+func (f *FSM) restoreRelease(key string) {
+	if !isReleaseKey(key) {
+		return
+	}
+	record, exists, err := f.lookup(key)
+	if err != nil || !exists {
+		return
+	}
+	var release chunkRelease
+	if err := json.Unmarshal(record.Data, &release); err != nil {
+		return
+	}
+	f.releases = append(f.releases, pendingRelease{key: key, at: release.At})
+}
+
+// deleteChunks deletes the chunks of manifest from the keyspace with the
+// given prefix
+func (f *FSM) deleteChunks(prefix string, manifest Manifest) {
+	for _, part := range manifest.Parts {
+		f.store.Delete(chunkKey(prefix, manifest.Upload, part.Number))
+	}
+}
+
+// hasChunks reports whether every chunk of value, a chunked value key
+// holds or held, is stored
+func (f *FSM) hasChunks(key string, value storage.Value) bool {
+	manifest, err := DecodeManifest(value)
+	if err != nil {
+		return false
+	}
+	prefix := keyPrefix(key)
+	for _, part := range manifest.Parts {
+		if !f.store.Has(chunkKey(prefix, manifest.Upload, part.Number)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newUploadID returns a random upload ID
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Uploads is a handle on the multipart uploads of a keyspace, the default
+// namespace or a named one
+type Uploads struct {
+	node      *Node
+	namespace string
+	prefix    string
+}
+
+// Uploads returns a handle on the multipart uploads of the default
+// namespace
+func (n *Node) Uploads() *Uploads {
+	return &Uploads{node: n}
+}
+
+// Uploads returns a handle on the multipart uploads of the namespace
+func (ns *Namespace) Uploads() *Uploads {
+	return &Uploads{node: ns.node, namespace: ns.name, prefix: ns.prefix}
+}
+
+// check checks that key may be used and returns the configuration of its
+// namespace
+func (u *Uploads) check(key string) (NamespaceConfig, error) {
+	if u.namespace == "" {
+		return NamespaceConfig{}, checkDefaultKey(key)
+	}
+	return u.node.Namespace(u.namespace).check(key)
+}
+
+// Initiate starts a multipart upload of a value for key and returns its ID.
+// The content type, user metadata and expiration of value are those of the
+// completed value, its data is ignored.
+func (u *Uploads) Initiate(key string, value storage.Value) (string, error) {
+	config, err := u.check(key)
+	if err != nil {
+		return "", err
+	}
+	id, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+	value.Data = nil
+	_, err = u.node.apply(Command{
+		Op:        "upload_init",
+		Namespace: u.namespace,
+		Key:       u.prefix + key,
+		Value:     withDefaultTTL(value, config),
+		Upload:    &UploadArgs{ID: id},
+	})
+	return id, err
+}
+
+// UploadPart stores part number part of upload id, replacing any earlier
+// upload of the same part. Each part is a log entry of its own, so it must
+// fit the largest entry the node accepts.
+func (u *Uploads) UploadPart(id string, part int, data []byte) error {
+	if part < 1 || part > MaxUploadParts {
+		return ErrInvalidPart
+	}
+	if _, err := u.check(""); err != nil {
+		return err
+	}
+	_, err := u.node.apply(Command{
+		Op:        "upload_part",
+		Namespace: u.namespace,
+		Value:     storage.Value{Data: data},
+		Upload:    &UploadArgs{ID: id, Part: part},
+	})
+	return err
+}
+
+// Complete atomically writes the value of upload id made of the given
+// parts in order, all uploaded parts if there are none. The result holds
+// the revision of the value, the value it replaced and its Manifest.
+func (u *Uploads) Complete(id string, parts []int) (*ApplyResult, error) {
+	upload, err := u.record(id)
+	if err != nil {
+		return nil, err
+	}
+	return u.node.apply(Command{
+		Op:        "upload_complete",
+		Namespace: u.namespace,
+		Key:       u.prefix + upload.Key,
+		Upload:    &UploadArgs{ID: id, Parts: parts},
+	})
+}
+
+// Abort deletes upload id and the parts uploaded so far
+func (u *Uploads) Abort(id string) error {
+	if _, err := u.check(""); err != nil {
+		return err
+	}
+	_, err := u.node.apply(Command{
+		Op:        "upload_abort",
+		Namespace: u.namespace,
+		Upload:    &UploadArgs{ID: id},
+	})
+	return err
+}
+
+// record reads the record of upload id
+func (u *Uploads) record(id string) (Upload, error) {
+	var upload Upload
+	if _, err := u.check(""); err != nil {
+		return upload, err
+	}
+	record, err := u.node.store.Get(uploadKey(u.prefix, id))
+	if err == storage.ErrKeyNotFound || err == storage.ErrKeyExpired {
+		return upload, ErrUploadNotFound
+	}
+	if err != nil {
+		return upload, err
+	}
+	if err := json.Unmarshal(record.Data, &upload); err != nil {
+		return upload, err
+	}
+	upload.Key = strings.TrimPrefix(upload.Key, u.prefix)
+	return upload, nil
+}
+
+// Get returns upload id, with the key it writes to relative to the
+// namespace, and the parts uploaded so far
+func (u *Uploads) Get(id string) (Upload, []Part, error) {
+	upload, err := u.record(id)
+	if err != nil {
+		return upload, nil, err
+	}
+	parts, err := listParts(u.node.store, u.prefix, id)
+	return upload, parts, err
+}
+
+// Open returns a reader of the data of a chunked value of the keyspace. It
+// checks that every chunk is present, but reads them one at a time.
+func (u *Uploads) Open(value storage.Value) (*ChunkReader, error) {
+	manifest, err := DecodeManifest(value)
+	if err != nil {
+		return nil, err
+	}
+	r := &ChunkReader{
+		store:  u.node.store,
+		keys:   make([]string, len(manifest.Parts)),
+		starts: make([]int64, len(manifest.Parts)),
+		size:   manifest.Size,
+		index:  -1,
+	}
+	var start int64
+	for i, part := range manifest.Parts {
+		r.keys[i] = chunkKey(u.prefix, manifest.Upload, part.Number)
+		r.starts[i] = start
+		start += part.Size
+		if !r.store.Has(r.keys[i]) {
+			return nil, ErrMissingChunk
+		}
+	}
+	return r, nil
+}
+
+// ChunkReader reads a chunked value, holding no more than one chunk in
+// memory. It implements io.ReadSeeker.
+type ChunkReader struct {
+	store  storage.Storage
+	keys   []string
+	starts []int64 // Offset of each chunk in the value
+	size   int64
+	offset int64
+	index  int // Chunk held in chunk, -1 for none
+	chunk  []byte
+}
+
+// Size returns the size of the value
+func (r *ChunkReader) Size() int64 {
+	return r.size
+}
+
+// Read reads from the chunk holding the current offset, loading it first if
+// needed
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > r.offset }) - 1
+	if i != r.index {
+		value, err := r.store.Get(r.keys[i])
+		if err != nil {
+			return 0, ErrMissingChunk
+		}
+		r.index, r.chunk = i, value.Data
+	}
+	if r.offset-r.starts[i] >= int64(len(r.chunk)) {
+		return 0, ErrMissingChunk
+	}
+	n := copy(p, r.chunk[r.offset-r.starts[i]:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset of the next Read
+func (r *ChunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
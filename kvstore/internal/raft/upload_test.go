@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/SirCodeKnight/kvstore/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFSMMultipartUpload(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	f := newFSM(store, zap.NewNop())
+	n := &Node{store: store, fsm: f}
+
+	upload := func(op string, args UploadArgs, data string) interface{} {
+		return applyCommand(t, f, Command{Op: op, Key: "big", Value: storage.Value{Data: []byte(data), ContentType: "text/plain"}, Upload: &args})
+	}
+
+	assert.Equal(t, "u1", upload("upload_init", UploadArgs{ID: "u1"}, ""))
+	assert.Equal(t, int64(6), upload("upload_part", UploadArgs{ID: "u1", Part: 1}, "hello "))
+	assert.Equal(t, int64(5), upload("upload_part", UploadArgs{ID: "u1", Part: 3}, "world"))
+	assert.Equal(t, int64(4), upload("upload_part", UploadArgs{ID: "u1", Part: 2}, "big "))
+	assert.Equal(t, ErrInvalidPart, upload("upload_part", UploadArgs{ID: "u1", Part: 0}, "x"))
+	assert.Equal(t, ErrUploadNotFound, upload("upload_part", UploadArgs{ID: "nope", Part: 1}, "x"))
+
+	// Nothing is visible under the key until the upload completes
+	assert.False(t, store.Has("big"))
+	_, parts, err := n.Uploads().Get("u1")
+	require.NoError(t, err)
+	assert.Len(t, parts, 3)
+
+	err, _ = upload("upload_complete", UploadArgs{ID: "u1", Parts: []int{1, 4}}, "").(error)
+	assert.True(t, errors.Is(err, ErrMissingPart))
+
+	// Completing keeps the listed parts in order and drops the rest
+	manifest := upload("upload_complete", UploadArgs{ID: "u1", Parts: []int{1, 3}}, "").(Manifest)
+	assert.Equal(t, int64(11), manifest.Size)
+	assert.False(t, store.Has(chunkKey("", "u1", 2)))
+	_, _, err = n.Uploads().Get("u1")
+	assert.Equal(t, ErrUploadNotFound, err)
+
+	value, err := store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, storage.TypeChunked, value.Type)
+	assert.Equal(t, "text/plain", value.ContentType)
+
+	r, err := n.Uploads().Open(value)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	_, err = r.Seek(-5, io.SeekEnd)
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "wor", string(buf))
+
+	// Overwriting the value releases its chunks, once reads that opened
+	// it have had time to finish
+	applyCommand(t, f, Command{Op: "set", Key: "big", Value: storage.Value{Data: []byte("small")}})
+	assert.True(t, store.Has(chunkKey("", "u1", 1)))
+	_, err = r.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	// The pending release survives a snapshot
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restoredStore := storage.NewMemoryStorage()
+	restored := newFSM(restoredStore, zap.NewNop())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	later := time.Now().Add(chunkReleaseDelay + time.Minute).UnixNano()
+	for _, replica := range []*FSM{f, restored} {
+		applyCommand(t, replica, Command{Op: "set", Key: "other", Value: storage.Value{Data: []byte("x")}, Time: later})
+	}
+	for _, s := range []*storage.MemoryStorage{store, restoredStore} {
+		assert.False(t, s.Has(chunkKey("", "u1", 1)))
+		assert.False(t, s.Has(chunkKey("", "u1", 3)))
+		assert.False(t, s.Has(releaseKey("", "u1")))
+	}
+
+	// Aborting deletes the parts uploaded so far
+	upload("upload_init", UploadArgs{ID: "u2"}, "")
+	upload("upload_part", UploadArgs{ID: "u2", Part: 1}, "data")
+	assert.Nil(t, upload("upload_abort", UploadArgs{ID: "u2"}, ""))
+	assert.False(t, store.Has(uploadKey("", "u2")))
+	assert.False(t, store.Has(chunkKey("", "u2", 1)))
+}
+
+func TestFSMChunkedHistory(t *testing.T) {
+	f, store := newHistoryFSM(HistoryOptions{MaxVersions: 2})
+	n := &Node{store: store, fsm: f}
+
+	upload := func(id string, parts ...string) uint64 {
+		applyCommand(t, f, Command{Op: "upload_init", Key: "big", Upload: &UploadArgs{ID: id}, Time: 1000})
+		for i, part := range parts {
+			applyCommand(t, f, Command{Op: "upload_part", Value: storage.Value{Data: []byte(part)}, Upload: &UploadArgs{ID: id, Part: i + 1}, Time: 1000})
+		}
+		result := applyResult(t, f, Command{Op: "upload_complete", Key: "big", Upload: &UploadArgs{ID: id}, Time: 1000})
+		require.NoError(t, result.Err)
+		return result.Revision
+	}
+
+	r1 := upload("u1", "hello ", "world")
+	setValue(t, f, "big", "small", 2000)
+
+	// The history keeps the chunks of the version it retains
+	value, err := f.GetAt("big", r1)
+	require.NoError(t, err)
+	assert.Equal(t, storage.TypeChunked, value.Type)
+	r, err := n.Uploads().Open(value)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.False(t, store.Has(releaseKey("", "u1")))
+
+	// A version whose chunks are gone reads as compacted
+	r3 := upload("u2", "other")
+	setValue(t, f, "big", "small", 2000)
+	require.NoError(t, store.Delete(chunkKey("", "u2", 1)))
+	_, err = f.GetAt("big", r3)
+	assert.Equal(t, ErrCompacted, err)
+
+	// Discarding the version releases its chunks
+	later := 3000 + int64(chunkReleaseDelay)
+	assert.True(t, store.Has(releaseKey("", "u1")))
+	assert.True(t, store.Has(chunkKey("", "u1", 2)))
+	setValue(t, f, "a", "1", later)
+	assert.False(t, store.Has(chunkKey("", "u1", 1)))
+	assert.False(t, store.Has(chunkKey("", "u1", 2)))
+	assert.False(t, store.Has(releaseKey("", "u1")))
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrUnknownCodec is returned when reading a value compressed with a codec
+// that is not registered
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses and decompresses values. The name is stored with every
+// compressed value, so it must never change once data has been written.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(FlateCodec{Level: flate.DefaultCompression})
+	RegisterCodec(GzipCodec{Level: gzip.DefaultCompression})
+}
+
+// RegisterCodec makes a codec available for decoding stored values under
+// its name, replacing any codec registered under the same name
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// LookupCodec returns the codec registered under name
+func LookupCodec(name string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+	}
+	return codec, nil
+}
+
+// ParseCodec returns the codec registered under name, or nil for "none"
+func ParseCodec(name string) (Codec, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	return LookupCodec(name)
+}
+
+// FlateCodec compresses with DEFLATE
+type FlateCodec struct {
+	Level int
+}
+
+// Name returns "flate"
+func (c FlateCodec) Name() string { return "flate" }
+
+// Compress compresses data
+func (c FlateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses data
+func (c FlateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// GzipCodec compresses with gzip
+type GzipCodec struct {
+	Level int
+}
+
+// Name returns "gzip"
+func (c GzipCodec) Name() string { return "gzip" }
+
+// Compress compresses data
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses data
+func (c GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CompressionOptions configures value compression
+type CompressionOptions struct {
+	Codec      Codec                 // Codec for new values, nil to store them as is
+	Threshold  int                   // Values smaller than this many bytes are stored as is
+	OnCompress func(raw, stored int) // Called with the sizes of every compressed value
+}
+
+// Compressor compresses values according to its options
+type Compressor struct {
+	opts CompressionOptions
+}
+
+// NewCompressor creates a compressor
+func NewCompressor(opts CompressionOptions) *Compressor {
+	return &Compressor{opts: opts}
+}
+
+// Encode compresses the data of value if it is large enough and the codec
+// makes it smaller. Values that are already encoded are returned as is.
+func (c *Compressor) Encode(value Value) (Value, error) {
+	if c == nil || c.opts.Codec == nil || value.Encoding != "" || len(value.Data) < c.opts.Threshold {
+		return value, nil
+	}
+
+	data, err := c.opts.Codec.Compress(value.Data)
+	if err != nil {
+		return value, err
+	}
+	if len(data) >= len(value.Data) {
+		return value, nil
+	}
+	if c.opts.OnCompress != nil {
+		c.opts.OnCompress(len(value.Data), len(data))
+	}
+
+	value.Data = data
+	value.Encoding = c.opts.Codec.Name()
+	return value, nil
+}
+
+// DecodeValue decompresses the data of a value stored compressed
+func DecodeValue(value Value) (Value, error) {
+	if value.Encoding == "" {
+		return value, nil
+	}
+
+	codec, err := LookupCodec(value.Encoding)
+	if err != nil {
+		return value, err
+	}
+	data, err := codec.Decompress(value.Data)
+	if err != nil {
+		return value, fmt.Errorf("decompressing %s value: %w", value.Encoding, err)
+	}
+	value.Data = data
+	value.Encoding = ""
+	return value, nil
+}
+
+// CompressedStorage wraps a Storage, compressing values on the way in and
+// decompressing them on the way out. Values written compressed by someone
+// else, such as a Raft leader, are stored as they are, and values written
+// before compression was enabled read back unchanged.
+type CompressedStorage struct {
+	Storage
+	compressor *Compressor
+}
+
+// NewCompressedStorage wraps store, compressing values with codec
+func NewCompressedStorage(store Storage, codec Codec) *CompressedStorage {
+	return NewCompressedStorageWithOptions(store, CompressionOptions{Codec: codec})
+}
+
+// NewCompressedStorageWithOptions wraps store with the given options
+func NewCompressedStorageWithOptions(store Storage, opts CompressionOptions) *CompressedStorage {
+	return &CompressedStorage{Storage: store, compressor: NewCompressor(opts)}
+}
+
+// Unwrap returns the wrapped storage
+func (s *CompressedStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Get retrieves and decompresses a value for the given key
+func (s *CompressedStorage) Get(key string) (Value, error) {
+	value, err := s.Storage.Get(key)
+	if err != nil {
+		return value, err
+	}
+	return DecodeValue(value)
+}
+
+// Set compresses and stores a value for the given key
+func (s *CompressedStorage) Set(key string, value Value) error {
+	value, err := s.compressor.Encode(value)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Set(key, value)
+}
+
+// Iterate calls fn with the decompressed value of each live key with
+// prefix after startAfter in ascending order
+func (s *CompressedStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	var decodeErr error
+	err := s.Storage.Iterate(prefix, startAfter, func(key string, value Value) bool {
+		value, decodeErr = DecodeValue(value)
+		if decodeErr != nil {
+			return false
+		}
+		return fn(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// SetClock sets the clock of the wrapped storage if it accepts one
+func (s *CompressedStorage) SetClock(clock Clock) {
+	if setter, ok := s.Storage.(ClockSetter); ok {
+		setter.SetClock(clock)
+	}
+}
+
+// EvictionRanks returns the eviction ranks of the wrapped storage, nil if
+// it keeps none
+func (s *CompressedStorage) EvictionRanks() map[string]EvictionRank {
+	if ranker, ok := s.Storage.(EvictionRanker); ok {
+		return ranker.EvictionRanks()
+	}
+	return nil
+}
+
+// SetEvictionRanks sets the eviction ranks of the wrapped storage
+func (s *CompressedStorage) SetEvictionRanks(ranks map[string]EvictionRank) {
+	if ranker, ok := s.Storage.(EvictionRanker); ok {
+		ranker.SetEvictionRanks(ranks)
+	}
+}
+
+// SetEvictable sets which keys the wrapped storage may evict, if it evicts
+func (s *CompressedStorage) SetEvictable(fn func(key string) bool) {
+	if evictor, ok := s.Storage.(Evictor); ok {
+		evictor.SetEvictable(fn)
+	}
+}
+
+// SetEvictionHandler sets a function called with every key the wrapped
+// storage evicts and the decompressed value it held
+func (s *CompressedStorage) SetEvictionHandler(fn func(key string, value Value)) {
+	evictor, ok := s.Storage.(Evictor)
+	if !ok {
+		return
+	}
+	if fn == nil {
+		evictor.SetEvictionHandler(nil)
+		return
+	}
+	evictor.SetEvictionHandler(func(key string, value Value) {
+		if decoded, err := DecodeValue(value); err == nil {
+			value = decoded
+		}
+		fn(key, value)
+	})
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compressible is a value that shrinks well
+var compressible = bytes.Repeat([]byte(`{"name":"kvstore","tags":["a","b"]}`), 64)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, name := range []string{"flate", "gzip"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := ParseCodec(name)
+			require.NoError(t, err)
+
+			compressed, err := codec.Compress(compressible)
+			require.NoError(t, err)
+			assert.Less(t, len(compressed), len(compressible))
+
+			data, err := codec.Decompress(compressed)
+			require.NoError(t, err)
+			assert.Equal(t, compressible, data)
+		})
+	}
+
+	codec, err := ParseCodec("none")
+	assert.NoError(t, err)
+	assert.Nil(t, codec)
+	_, err = ParseCodec("zstd")
+	assert.True(t, errors.Is(err, ErrUnknownCodec))
+}
+
+func TestCompressedStorage(t *testing.T) {
+	inner := NewMemoryStorage()
+	var raw, stored int
+	store := NewCompressedStorageWithOptions(inner, CompressionOptions{
+		Codec:     FlateCodec{Level: flate.BestSpeed},
+		Threshold: 64,
+		OnCompress: func(r, s int) {
+			raw += r
+			stored += s
+		},
+	})
+
+	require.NoError(t, store.Set("big", Value{Data: compressible, Revision: 3}))
+	require.NoError(t, store.Set("small", Value{Data: []byte("tiny")}))
+	require.NoError(t, store.Set("random", Value{Data: []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!?")}))
+
+	// Only the large compressible value is stored compressed
+	v, err := inner.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, "flate", v.Encoding)
+	assert.Equal(t, len(compressible), raw)
+	assert.Equal(t, len(v.Data), stored)
+
+	v, err = inner.Get("small")
+	require.NoError(t, err)
+	assert.Empty(t, v.Encoding)
+	v, err = inner.Get("random")
+	require.NoError(t, err)
+	assert.Empty(t, v.Encoding)
+
+	v, err = store.Get("big")
+	require.NoError(t, err)
+	assert.Equal(t, Value{Data: compressible, Revision: 3}, v)
+
+	values := make(map[string][]byte)
+	require.NoError(t, store.Iterate("", "", func(key string, value Value) bool {
+		assert.Empty(t, value.Encoding)
+		values[key] = value.Data
+		return true
+	}))
+	assert.Equal(t, compressible, values["big"])
+	assert.Equal(t, []byte("tiny"), values["small"])
+}
+
+func TestCompressedStorageMixedData(t *testing.T) {
+	// Values written before compression was enabled, and values encoded
+	// with another codec by someone else, both read back
+	inner := NewMemoryStorage()
+	require.NoError(t, inner.Set("plain", Value{Data: compressible}))
+
+	gz, err := GzipCodec{Level: flate.DefaultCompression}.Compress(compressible)
+	require.NoError(t, err)
+
+	store := NewCompressedStorage(inner, FlateCodec{Level: flate.DefaultCompression})
+	require.NoError(t, store.Set("gzipped", Value{Data: gz, Encoding: "gzip"}))
+
+	for _, key := range []string{"plain", "gzipped"} {
+		v, err := store.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, compressible, v.Data, key)
+	}
+
+	require.NoError(t, inner.Set("unknown", Value{Data: []byte("x"), Encoding: "zstd"}))
+	_, err = store.Get("unknown")
+	assert.True(t, errors.Is(err, ErrUnknownCodec))
+}
@@ -1,48 +1,297 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// tempFilePrefix marks files that are still being written
+	tempFilePrefix = ".tmp-"
+
+	// quarantineDir holds files that failed to load
+	quarantineDir = ".quarantine"
+
+	// maxEncodedKeyLen keeps file names well below common filesystem limits
+	maxEncodedKeyLen = 200
+)
+
+// keyEncoding is case-insensitive, filename-safe and preserves key order
+var keyEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// keyFileName maps an arbitrary binary key to a safe file name. Short keys
+// use a reversible base32 encoding, keys too long for a file name are
+// hashed. Either way the key itself is stored in the file.
+func keyFileName(key string) string {
+	encoded := keyEncoding.EncodeToString([]byte(key))
+	if len(encoded) <= maxEncodedKeyLen {
+		return "k" + encoded
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return "h" + hex.EncodeToString(sum[:])
+}
+
+// fileNameKey returns the key a file is named after. ok is false for
+// hashed names, which cannot be reversed.
+func fileNameKey(name string) (string, bool) {
+	if !strings.HasPrefix(name, "k") {
+		return "", false
+	}
+	key, err := keyEncoding.DecodeString(name[1:])
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// diskRecord is the on-disk form of a key and its value. Files written
+// before keys were encoded hold a bare Value and have no key, files written
+// before checksums were added have none.
+type diskRecord struct {
+	Key []byte `json:"key"`
+	Value
+	Checksum uint32 `json:"checksum,omitempty"` // CRC32-C of the record encoded without it
+}
+
+// legacyRecord is the encoding of a diskRecord from before Revision,
+// Encoding and KeyID were omitted when empty. Checksums of records written
+// then were computed over it.
+type legacyRecord struct {
+	Key         []byte `json:"key"`
+	Data        []byte
+	Expiration  int64
+	Revision    uint64
+	Encoding    string
+	KeyID       uint32
+	ContentType string            `json:",omitempty"`
+	Created     int64             `json:",omitempty"`
+	Modified    int64             `json:",omitempty"`
+	Meta        map[string]string `json:",omitempty"`
+	Type        string            `json:",omitempty"`
+}
+
+// castagnoli is the CRC32 table disk records are checksummed with
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the checksum of the record with its checksum cleared
+func (r diskRecord) checksum() (uint32, error) {
+	r.Checksum = 0
+	data, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(data, castagnoli), nil
+}
+
+// legacyChecksum returns the checksum of the record in its legacy encoding
+func (r diskRecord) legacyChecksum() (uint32, error) {
+	data, err := json.Marshal(legacyRecord{
+		Key:         r.Key,
+		Data:        r.Data,
+		Expiration:  r.Expiration,
+		Revision:    r.Revision,
+		Encoding:    r.Encoding,
+		KeyID:       r.KeyID,
+		ContentType: r.ContentType,
+		Created:     r.Created,
+		Modified:    r.Modified,
+		Meta:        r.Meta,
+		Type:        r.Type,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(data, castagnoli), nil
+}
+
+// encodeDiskRecord encodes a key and its value with a checksum
+func encodeDiskRecord(key string, value Value) ([]byte, error) {
+	record := diskRecord{Key: []byte(key), Value: value}
+	sum, err := record.checksum()
+	if err != nil {
+		return nil, err
+	}
+	record.Checksum = sum
+	return json.Marshal(record)
+}
+
+// readRecord reads, decodes and verifies the file at filePath
+func readRecord(filePath string) (diskRecord, error) {
+	var record diskRecord
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	if record.Checksum != 0 {
+		sum, err := record.checksum()
+		if err != nil {
+			return record, err
+		}
+		if sum != record.Checksum {
+			if sum, err = record.legacyChecksum(); err != nil {
+				return record, err
+			}
+		}
+		if sum != record.Checksum {
+			return record, ErrCorruptRecord
+		}
+	}
+	return record, nil
+}
+
+// SyncMode controls when DiskStorage flushes writes to stable storage
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs every write and the directory entry before returning
+	SyncAlways SyncMode = iota
+
+	// SyncBatched fsyncs every write before it replaces the key's file and
+	// the directory periodically in the background
+	SyncBatched
+
+	// SyncNone leaves flushing to the operating system
+	SyncNone
+)
+
+// ParseSyncMode parses "always", "batched" or "none"
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "batched":
+		return SyncBatched, nil
+	case "none":
+		return SyncNone, nil
+	default:
+		return SyncAlways, fmt.Errorf("unknown sync mode %q", s)
+	}
+}
+
+// String returns the name of the sync mode
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncBatched:
+		return "batched"
+	case SyncNone:
+		return "none"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// DiskStorageOptions configures a DiskStorage
+type DiskStorageOptions struct {
+	SyncMode     SyncMode
+	SyncInterval time.Duration // Flush interval for SyncBatched
+}
+
+// DefaultDiskStorageOptions returns the default disk storage options
+func DefaultDiskStorageOptions() DiskStorageOptions {
+	return DiskStorageOptions{
+		SyncMode:     SyncAlways,
+		SyncInterval: time.Second,
+	}
+}
+
+// RecoveryReport describes what DiskStorage found when loading from disk
+type RecoveryReport struct {
+	Loaded           int      // Keys loaded into memory
+	Expired          int      // Loaded keys already expired, left for the expirer
+	TempFilesRemoved int      // Leftovers of interrupted writes removed
+	Quarantined      []string // Files that could not be read or decoded
+}
+
 // DiskStorage implements the Storage interface using files on disk
 type DiskStorage struct {
-	dirPath string
-	memory  *MemoryStorage // In-memory cache
-	mutex   sync.RWMutex
+	dirPath  string
+	opts     DiskStorageOptions
+	memory   *MemoryStorage // In-memory cache
+	now      Clock
+	mutex    sync.RWMutex
+	recovery RecoveryReport
+	lost     map[string]string // Files of quarantined keys not written since, by key
+
+	dirtyMutex sync.Mutex
+	dirty      bool // The directory changed since the last batched sync
+	closeCh    chan struct{}
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
 }
 
-// NewDiskStorage creates a new disk storage
+// NewDiskStorage creates a new disk storage with the default options
 func NewDiskStorage(dirPath string) (*DiskStorage, error) {
+	return NewDiskStorageWithOptions(dirPath, DefaultDiskStorageOptions())
+}
+
+// NewDiskStorageWithOptions creates a new disk storage
+func NewDiskStorageWithOptions(dirPath string, opts DiskStorageOptions) (*DiskStorage, error) {
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
 		return nil, err
 	}
 
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultDiskStorageOptions().SyncInterval
+	}
+
 	ds := &DiskStorage{
 		dirPath: dirPath,
+		opts:    opts,
 		memory:  NewMemoryStorage(),
+		now:     SystemClock,
+		lost:    make(map[string]string),
+		closeCh: make(chan struct{}),
 	}
 
 	// Load existing data from disk
-	if err := ds.loadFromDisk(); err != nil {
+	report, err := ds.loadFromDisk()
+	if err != nil {
 		return nil, err
 	}
+	ds.recovery = report
+
+	if opts.SyncMode == SyncBatched {
+		ds.wg.Add(1)
+		go ds.syncLoop()
+	}
 
 	return ds, nil
 }
 
-// loadFromDisk loads all keys from disk into memory
-func (d *DiskStorage) loadFromDisk() error {
+// RecoveryReport returns what was found when the storage was opened
+func (d *DiskStorage) RecoveryReport() RecoveryReport {
+	return d.recovery
+}
+
+// loadFromDisk loads all keys from disk into memory, removing leftovers of
+// interrupted writes and quarantining files that cannot be decoded
+func (d *DiskStorage) loadFromDisk() (RecoveryReport, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
+	var report RecoveryReport
+
 	files, err := os.ReadDir(d.dirPath)
 	if err != nil {
-		return err
+		return report, err
 	}
 
 	for _, file := range files {
@@ -51,64 +300,192 @@ func (d *DiskStorage) loadFromDisk() error {
 		}
 
 		filePath := filepath.Join(d.dirPath, file.Name())
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			// Skip files that can't be read
+
+		// A crash between writing and renaming a temp file leaves it
+		// behind, the previous version of the key is still intact
+		if strings.HasPrefix(file.Name(), tempFilePrefix) {
+			if err := os.Remove(filePath); err == nil {
+				report.TempFilesRemoved++
+			}
 			continue
 		}
 
-		var value Value
-		if err := json.Unmarshal(data, &value); err != nil {
-			// Skip files that can't be unmarshaled
+		record, err := readRecord(filePath)
+		if err != nil {
+			if err := d.quarantine(file.Name()); err != nil {
+				return report, err
+			}
+			report.Quarantined = append(report.Quarantined, file.Name())
+			if key, ok := fileNameKey(file.Name()); ok {
+				d.lost[key] = file.Name()
+			}
 			continue
 		}
 
-		// Check if the key has expired
-		if value.Expiration > 0 && value.Expiration < time.Now().UnixNano() {
-			// Key has expired, delete the file
-			os.Remove(filePath)
-			continue
+		key := string(record.Key)
+		if record.Key == nil {
+			// Legacy file named after the raw key, move it to its encoded name
+			key = file.Name()
+			if err := d.writeRecord(key, record.Value); err != nil {
+				return report, err
+			}
+			if err := os.Remove(filePath); err != nil {
+				return report, err
+			}
+		}
+		value := record.Value
+
+		// Expired keys are loaded too, the local clock is not the
+		// replicated one and only the expirer removes them
+		if value.Expired(d.now()) {
+			report.Expired++
 		}
 
 		// Store in memory
-		d.memory.Set(file.Name(), value)
+		d.memory.Set(key, value)
+		report.Loaded++
 	}
 
+	return report, nil
+}
+
+// quarantine moves a file that failed to load out of the data directory so
+// it is kept for inspection without shadowing future writes of the key
+func (d *DiskStorage) quarantine(name string) error {
+	dir := filepath.Join(d.dirPath, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	target := filepath.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().UnixNano()))
+	return os.Rename(filepath.Join(d.dirPath, name), target)
+}
+
+// writeRecord encodes and writes the file for a key
+func (d *DiskStorage) writeRecord(key string, value Value) error {
+	data, err := encodeDiskRecord(key, value)
+	if err != nil {
+		return err
+	}
+	return d.writeFile(keyFileName(key), data)
+}
+
+// writeFile atomically replaces the file for a key by writing a temp file
+// and renaming it over the target
+func (d *DiskStorage) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(d.dirPath, tempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// The data is durable before the rename, otherwise a crash could
+	// leave a torn file in place of the previous value
+	if d.opts.SyncMode != SyncNone {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	filePath := filepath.Join(d.dirPath, name)
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return d.synced()
+}
+
+// synced makes a completed rename or removal durable according to the
+// sync mode
+func (d *DiskStorage) synced() error {
+	switch d.opts.SyncMode {
+	case SyncAlways:
+		return syncDir(d.dirPath)
+	case SyncBatched:
+		d.dirtyMutex.Lock()
+		d.dirty = true
+		d.dirtyMutex.Unlock()
+	}
 	return nil
 }
 
-// Get retrieves a value for the given key
+// syncDir fsyncs a directory so renames and removals in it are durable
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// syncLoop flushes the directory in SyncBatched mode
+func (d *DiskStorage) syncLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closeCh:
+			return
+		case <-ticker.C:
+			d.Sync()
+		}
+	}
+}
+
+// Sync flushes the renames and removals made since the last sync. Written
+// files are flushed before they are renamed into place.
+func (d *DiskStorage) Sync() error {
+	d.dirtyMutex.Lock()
+	dirty := d.dirty
+	d.dirty = false
+	d.dirtyMutex.Unlock()
+
+	if !dirty {
+		return nil
+	}
+	return syncDir(d.dirPath)
+}
+
+// Get retrieves a value for the given key. Expired keys are left in place
+// for the expirer, so that reads never change what is stored.
 func (d *DiskStorage) Get(key string) (Value, error) {
 	// Try to get from memory first
 	val, err := d.memory.Get(key)
-	if err == nil {
-		return val, nil
+	if err == nil || err == ErrKeyExpired {
+		return val, err
 	}
 
-	// If not in memory or expired, try to get from disk
+	// If not in memory, try to get from disk
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 
-	filePath := filepath.Join(d.dirPath, key)
-	data, err := os.ReadFile(filePath)
+	record, err := readRecord(filepath.Join(d.dirPath, keyFileName(key)))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return Value{}, ErrKeyNotFound
 		}
 		return Value{}, err
 	}
-
-	var value Value
-	if err := json.Unmarshal(data, &value); err != nil {
-		return Value{}, err
-	}
+	value := record.Value
 
 	// Check for expiration
-	if value.Expiration > 0 && value.Expiration < time.Now().UnixNano() {
-		// Key has expired, delete it
-		d.mutex.RUnlock()
-		d.Delete(key)
-		d.mutex.RLock()
+	if value.Expired(d.now()) {
 		return Value{}, ErrKeyExpired
 	}
 
@@ -118,24 +495,17 @@ func (d *DiskStorage) Get(key string) (Value, error) {
 	return value, nil
 }
 
-// Set stores a value for the given key
+// Set stores a value for the given key. The memory cache only takes the
+// value once it is on disk, so it never serves one a restart would lose.
 func (d *DiskStorage) Set(key string, value Value) error {
-	// Set in memory
-	if err := d.memory.Set(key, value); err != nil {
-		return err
-	}
-
-	// Set on disk
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	data, err := json.Marshal(value)
-	if err != nil {
+	if err := d.writeRecord(key, value); err != nil {
 		return err
 	}
-
-	filePath := filepath.Join(d.dirPath, key)
-	return os.WriteFile(filePath, data, 0644)
+	delete(d.lost, key)
+	return d.memory.Set(key, value)
 }
 
 // Delete removes a key from the storage
@@ -147,15 +517,20 @@ func (d *DiskStorage) Delete(key string) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	filePath := filepath.Join(d.dirPath, key)
+	delete(d.lost, key)
+	filePath := filepath.Join(d.dirPath, keyFileName(key))
 	err := os.Remove(filePath)
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
-	return nil
+	return d.synced()
 }
 
-// Has checks if a key exists in the storage
+// Has checks if a key exists in the storage. Like Get, it leaves expired
+// keys in place.
 func (d *DiskStorage) Has(key string) bool {
 	// Check in memory first
 	if d.memory.Has(key) {
@@ -166,29 +541,21 @@ func (d *DiskStorage) Has(key string) bool {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 
-	filePath := filepath.Join(d.dirPath, key)
+	filePath := filepath.Join(d.dirPath, keyFileName(key))
 	_, err := os.Stat(filePath)
 	if err != nil {
 		return false
 	}
 
 	// Load the key into memory for future access
-	data, err := os.ReadFile(filePath)
+	record, err := readRecord(filePath)
 	if err != nil {
 		return false
 	}
-
-	var value Value
-	if err := json.Unmarshal(data, &value); err != nil {
-		return false
-	}
+	value := record.Value
 
 	// Check for expiration
-	if value.Expiration > 0 && value.Expiration < time.Now().UnixNano() {
-		// Key has expired, delete it
-		d.mutex.RUnlock()
-		d.Delete(key)
-		d.mutex.RLock()
+	if value.Expired(d.now()) {
 		return false
 	}
 
@@ -200,13 +567,17 @@ func (d *DiskStorage) Has(key string) bool {
 
 // Keys returns all keys in the storage
 func (d *DiskStorage) Keys() []string {
-	// Refresh from disk first
-	if err := d.loadFromDisk(); err != nil {
-		return d.memory.Keys()
-	}
+	// Every write goes through the memory cache, which was loaded from
+	// disk on open
 	return d.memory.Keys()
 }
 
+// Iterate calls fn for each live key with prefix after startAfter in
+// ascending order, serving values from the memory cache
+func (d *DiskStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	return d.memory.Iterate(prefix, startAfter, fn)
+}
+
 // Clear removes all keys from the storage
 func (d *DiskStorage) Clear() error {
 	// Clear memory
@@ -216,6 +587,8 @@ func (d *DiskStorage) Clear() error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
+	d.lost = make(map[string]string)
+
 	// Remove all files in the directory
 	files, err := os.ReadDir(d.dirPath)
 	if err != nil {
@@ -233,11 +606,83 @@ func (d *DiskStorage) Clear() error {
 		}
 	}
 
+	if d.opts.SyncMode == SyncAlways {
+		return syncDir(d.dirPath)
+	}
 	return nil
 }
 
+// Verify rereads the file of every key and reports those that are missing
+// or fail their checksum. Keys whose file was quarantined when the storage
+// was opened are reported until they are written again.
+func (d *DiskStorage) Verify(fn func(issue ScrubIssue)) (int, error) {
+	keys := d.memory.Keys()
+	sort.Strings(keys)
+
+	checked := 0
+	for _, key := range keys {
+		name := keyFileName(key)
+		d.mutex.RLock()
+		_, err := readRecord(filepath.Join(d.dirPath, name))
+		d.mutex.RUnlock()
+
+		// The key may have been deleted since the keys were listed
+		if os.IsNotExist(err) && !d.memory.Has(key) {
+			continue
+		}
+		checked++
+		if err != nil {
+			fn(ScrubIssue{Key: key, Location: name, Error: err.Error()})
+		}
+	}
+
+	d.mutex.RLock()
+	lost := make(map[string]string, len(d.lost))
+	for key, name := range d.lost {
+		lost[key] = name
+	}
+	d.mutex.RUnlock()
+
+	for key, name := range lost {
+		checked++
+		fn(ScrubIssue{Key: key, Location: name, Error: "quarantined when loading"})
+	}
+	return checked, nil
+}
+
+// SetClock sets the clock expirations are checked against
+func (d *DiskStorage) SetClock(clock Clock) {
+	d.mutex.Lock()
+	d.now = clock
+	d.mutex.Unlock()
+
+	d.memory.SetClock(clock)
+}
+
+// DueKeys pops up to limit keys whose expiration is before now off the
+// TTL index and returns them
+func (d *DiskStorage) DueKeys(now int64, limit int) []string {
+	return d.memory.DueKeys(now, limit)
+}
+
+// Requeue puts keys popped by DueKeys back on the TTL index
+func (d *DiskStorage) Requeue(keys []string) {
+	d.memory.Requeue(keys)
+}
+
+// SampleKeys checks up to n random keys with an expiration and returns
+// the expired ones
+func (d *DiskStorage) SampleKeys(now int64, n int) (int, []string) {
+	return d.memory.SampleKeys(now, n)
+}
+
 // Close closes the storage
 func (d *DiskStorage) Close() error {
-	// No specific close action needed for disk storage
-	return nil
-}
\ No newline at end of file
+	d.closeOnce.Do(func() {
+		close(d.closeCh)
+	})
+	d.wg.Wait()
+
+	// Flush whatever the batched syncer has not picked up yet
+	return d.Sync()
+}
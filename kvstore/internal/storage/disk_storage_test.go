@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStorageRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("good", Value{Data: []byte("1")}))
+	require.NoError(t, store.Close())
+
+	// Simulate a torn write and an interrupted temp file
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "torn"), []byte(`{"Data":"MQ`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tempFilePrefix+"123"), []byte("{}"), 0644))
+
+	store, err = NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	report := store.RecoveryReport()
+	assert.Equal(t, 1, report.Loaded)
+	assert.Equal(t, 1, report.TempFilesRemoved)
+	assert.Equal(t, []string{"torn"}, report.Quarantined)
+
+	_, err = os.Stat(filepath.Join(dir, "torn"))
+	assert.True(t, os.IsNotExist(err))
+	quarantined, err := os.ReadDir(filepath.Join(dir, quarantineDir))
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+
+	assert.ElementsMatch(t, []string{"good"}, store.Keys())
+}
+
+func TestDiskStorageSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncBatched, SyncNone} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			opts := DefaultDiskStorageOptions()
+			opts.SyncMode = mode
+			store, err := NewDiskStorageWithOptions(dir, opts)
+			require.NoError(t, err)
+
+			require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+			require.NoError(t, store.Set("a", Value{Data: []byte("2")}))
+			require.NoError(t, store.Set("b", Value{Data: []byte("3")}))
+			require.NoError(t, store.Delete("b"))
+			require.NoError(t, store.Close())
+
+			store, err = NewDiskStorageWithOptions(dir, opts)
+			require.NoError(t, err)
+			defer store.Close()
+
+			val, err := store.Get("a")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("2"), val.Data)
+			assert.False(t, store.Has("b"))
+		})
+	}
+}
+
+func TestDiskStorageFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+
+	// A directory in place of the file makes the rename fail
+	path := filepath.Join(dir, keyFileName("a"))
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.MkdirAll(filepath.Join(path, "x"), 0755))
+	assert.Error(t, store.Set("a", Value{Data: []byte("2")}))
+
+	// The cache keeps the value it had
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val.Data)
+}
+
+func TestParseSyncMode(t *testing.T) {
+	mode, err := ParseSyncMode("batched")
+	require.NoError(t, err)
+	assert.Equal(t, SyncBatched, mode)
+
+	_, err = ParseSyncMode("sometimes")
+	assert.Error(t, err)
+}
+
+func TestDiskStorageBinaryKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	keys := []string{
+		"users/42/profile",
+		"../../etc/passwd",
+		"nul\x00byte",
+		"\xff\xfe binary",
+		string(make([]byte, 1000)),
+	}
+
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	for i, key := range keys {
+		require.NoError(t, store.Set(key, Value{Data: []byte{byte(i)}}))
+	}
+	require.NoError(t, store.Close())
+
+	// Everything must stay inside the data directory
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, len(keys))
+
+	store, err = NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.ElementsMatch(t, keys, store.Keys())
+	for i, key := range keys {
+		val, err := store.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, val.Data)
+	}
+
+	require.NoError(t, store.Delete("users/42/profile"))
+	assert.False(t, store.Has("users/42/profile"))
+}
+
+func TestDiskStorageLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy"), []byte(`{"Data":"MQ==","Expiration":0}`), 0644))
+
+	// Checksums of records written before empty metadata was omitted cover
+	// the empty fields
+	record := diskRecord{Key: []byte("summed"), Value: Value{Data: []byte("2")}}
+	sum, err := record.legacyChecksum()
+	require.NoError(t, err)
+	data := fmt.Sprintf(`{"key":"c3VtbWVk","Data":"Mg==","Expiration":0,"Revision":0,"Encoding":"","KeyID":0,"checksum":%d}`, sum)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, keyFileName("summed")), []byte(data), 0644))
+
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	val, err := store.Get("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val.Data)
+	val, err = store.Get("summed")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), val.Data)
+
+	_, err = os.Stat(filepath.Join(dir, keyFileName("legacy")))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "legacy"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskStorageReadsKeepExpiredKeys(t *testing.T) {
+	store, err := NewDiskStorage(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	var clock int64 = 100
+	store.SetClock(func() int64 { return clock })
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: 150}))
+
+	// Reads report the key expired, removing it is left to the expirer
+	clock = 200
+	_, err = store.Get("a")
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.False(t, store.Has("a"))
+	_, err = os.Stat(filepath.Join(store.dirPath, keyFileName("a")))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, store.DueKeys(clock, 10))
+}
+
+func TestDiskStorageLoadKeepsExpiredKeys(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Second).UnixNano()
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: past}))
+	require.NoError(t, store.Close())
+
+	// The key is reported and left in place for the expirer
+	store, err = NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 1, store.RecoveryReport().Loaded)
+	assert.Equal(t, 1, store.RecoveryReport().Expired)
+	_, err = os.Stat(filepath.Join(dir, keyFileName("a")))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, store.DueKeys(time.Now().UnixNano(), 10))
+}
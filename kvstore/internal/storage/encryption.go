@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"sync"
+)
+
+// EncryptedStorage wraps a Storage, encrypting values with AES-GCM before
+// they reach the backend. The key of an entry is authenticated with its
+// value, so ciphertext cannot be moved between keys. Values stored in
+// plaintext before encryption was enabled still read back and are
+// encrypted by Reencrypt.
+type EncryptedStorage struct {
+	Storage
+	keyring *Keyring
+	mutex   sync.Mutex // Serializes writes with re-encryption
+}
+
+// NewEncryptedStorage wraps store, encrypting values with keys from keyring
+func NewEncryptedStorage(store Storage, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{Storage: store, keyring: keyring}
+}
+
+// Unwrap returns the wrapped storage
+func (s *EncryptedStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// decrypt returns value with its data decrypted
+func (s *EncryptedStorage) decrypt(key string, value Value) (Value, error) {
+	if value.KeyID == 0 {
+		return value, nil
+	}
+	data, err := s.keyring.Decrypt(value.KeyID, value.Data, []byte(key))
+	if err != nil {
+		return value, err
+	}
+	value.Data = data
+	value.KeyID = 0
+	return value, nil
+}
+
+// encrypt returns value with its data encrypted with the active key
+func (s *EncryptedStorage) encrypt(key string, value Value) (Value, error) {
+	id, data, err := s.keyring.Encrypt(value.Data, []byte(key))
+	if err != nil {
+		return value, err
+	}
+	value.Data = data
+	value.KeyID = id
+	return value, nil
+}
+
+// Get retrieves and decrypts a value for the given key
+func (s *EncryptedStorage) Get(key string) (Value, error) {
+	value, err := s.Storage.Get(key)
+	if err != nil {
+		return value, err
+	}
+	return s.decrypt(key, value)
+}
+
+// Set encrypts and stores a value for the given key
+func (s *EncryptedStorage) Set(key string, value Value) error {
+	value, err := s.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Storage.Set(key, value)
+}
+
+// Delete removes a key from the storage
+func (s *EncryptedStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Storage.Delete(key)
+}
+
+// Clear removes all keys from the storage
+func (s *EncryptedStorage) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Storage.Clear()
+}
+
+// Iterate calls fn with the decrypted value of each live key with prefix
+// after startAfter in ascending order
+func (s *EncryptedStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	var decryptErr error
+	err := s.Storage.Iterate(prefix, startAfter, func(key string, value Value) bool {
+		value, decryptErr = s.decrypt(key, value)
+		if decryptErr != nil {
+			return false
+		}
+		return fn(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	return decryptErr
+}
+
+// Reencrypt rewrites every value that is not encrypted with the active key
+// and returns how many were rewritten. It runs alongside regular traffic,
+// each value is rewritten under the write lock so that a concurrent write
+// is never lost.
+func (s *EncryptedStorage) Reencrypt() (int, error) {
+	active := s.keyring.ActiveID()
+	var stale []string
+	err := s.Storage.Iterate("", "", func(key string, value Value) bool {
+		if value.KeyID != active {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range stale {
+		rewritten, err := s.reencryptKey(key, active)
+		if err != nil {
+			return count, err
+		}
+		if rewritten {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reencryptKey rewrites the value of key with the active key if it is
+// still encrypted with another one
+func (s *EncryptedStorage) reencryptKey(key string, active uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, err := s.Storage.Get(key)
+	if err == ErrKeyNotFound || err == ErrKeyExpired {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if value.KeyID == active {
+		return false, nil
+	}
+
+	if value, err = s.decrypt(key, value); err != nil {
+		return false, err
+	}
+	if value, err = s.encrypt(key, value); err != nil {
+		return false, err
+	}
+	return true, s.Storage.Set(key, value)
+}
+
+// SetClock sets the clock of the wrapped storage if it accepts one
+func (s *EncryptedStorage) SetClock(clock Clock) {
+	if setter, ok := s.Storage.(ClockSetter); ok {
+		setter.SetClock(clock)
+	}
+}
+
+// EvictionRanks returns the eviction ranks of the wrapped storage, nil if
+// it keeps none
+func (s *EncryptedStorage) EvictionRanks() map[string]EvictionRank {
+	if ranker, ok := s.Storage.(EvictionRanker); ok {
+		return ranker.EvictionRanks()
+	}
+	return nil
+}
+
+// SetEvictionRanks sets the eviction ranks of the wrapped storage
+func (s *EncryptedStorage) SetEvictionRanks(ranks map[string]EvictionRank) {
+	if ranker, ok := s.Storage.(EvictionRanker); ok {
+		ranker.SetEvictionRanks(ranks)
+	}
+}
+
+// SetEvictable sets which keys the wrapped storage may evict, if it evicts
+func (s *EncryptedStorage) SetEvictable(fn func(key string) bool) {
+	if evictor, ok := s.Storage.(Evictor); ok {
+		evictor.SetEvictable(fn)
+	}
+}
+
+// SetEvictionHandler sets a function called with every key the wrapped
+// storage evicts and the decrypted value it held
+func (s *EncryptedStorage) SetEvictionHandler(fn func(key string, value Value)) {
+	evictor, ok := s.Storage.(Evictor)
+	if !ok {
+		return
+	}
+	if fn == nil {
+		evictor.SetEvictionHandler(nil)
+		return
+	}
+	evictor.SetEvictionHandler(func(key string, value Value) {
+		if decrypted, err := s.decrypt(key, value); err == nil {
+			value = decrypted
+		}
+		fn(key, value)
+	})
+}
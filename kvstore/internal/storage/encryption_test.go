@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyring writes a keyring file with the given keys
+func writeKeyring(t *testing.T, path string, active uint32, keys map[uint32][]byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"active": %d, "keys": {`, active)
+	sep := ""
+	for id, key := range keys {
+		fmt.Fprintf(&b, `%s"%d": "%s"`, sep, id, base64.StdEncoding.EncodeToString(key))
+		sep = ", "
+	}
+	b.WriteString("}}")
+	require.NoError(t, os.WriteFile(path, b.Bytes(), 0600))
+}
+
+func TestKeyring(t *testing.T) {
+	key1, err := GenerateKey()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring(t, path, 1, map[uint32][]byte{1: key1})
+
+	keyring, err := LoadKeyring(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), keyring.ActiveID())
+
+	sealed, err := keyring.Seal([]byte("secret"), []byte("aad"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("secret")))
+	id, ok := SealedKeyID(sealed)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), id)
+
+	plaintext, err := keyring.Unseal(sealed, []byte("aad"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+
+	_, err = keyring.Unseal(sealed, []byte("other"))
+	assert.Error(t, err)
+
+	// A rotated keyring still opens data sealed with the old key
+	key2, err := GenerateKey()
+	require.NoError(t, err)
+	writeKeyring(t, path, 2, map[uint32][]byte{1: key1, 2: key2})
+	require.NoError(t, keyring.Reload())
+	assert.Equal(t, uint32(2), keyring.ActiveID())
+	plaintext, err = keyring.Unseal(sealed, []byte("aad"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+
+	// Once the old key is dropped its data is unreadable
+	writeKeyring(t, path, 2, map[uint32][]byte{2: key2})
+	require.NoError(t, keyring.Reload())
+	_, err = keyring.Unseal(sealed, []byte("aad"))
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+
+	writeKeyring(t, path, 3, map[uint32][]byte{2: key2})
+	assert.True(t, errors.Is(keyring.Reload(), ErrInvalidKeyring))
+	_, err = NewKeyring(map[uint32][]byte{1: []byte("short")}, 1)
+	assert.True(t, errors.Is(err, ErrInvalidKeyring))
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	key1, err := GenerateKey()
+	require.NoError(t, err)
+	keyring, err := NewKeyring(map[uint32][]byte{1: key1}, 1)
+	require.NoError(t, err)
+
+	inner := NewMemoryStorage()
+	require.NoError(t, inner.Set("legacy", Value{Data: []byte("plain")}))
+
+	store := NewEncryptedStorage(inner, keyring)
+	require.NoError(t, store.Set("a", Value{Data: []byte("secret"), Revision: 5}))
+
+	raw, err := inner.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), raw.KeyID)
+	assert.False(t, bytes.Contains(raw.Data, []byte("secret")))
+
+	v, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, Value{Data: []byte("secret"), Revision: 5}, v)
+
+	v, err = store.Get("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plain"), v.Data)
+
+	// Ciphertext copied to another key does not decrypt
+	require.NoError(t, inner.Set("b", raw))
+	_, err = store.Get("b")
+	assert.Error(t, err)
+	require.NoError(t, inner.Delete("b"))
+
+	// Rotating re-encrypts old and plaintext values with the new key
+	key2, err := GenerateKey()
+	require.NoError(t, err)
+	keyring, err = NewKeyring(map[uint32][]byte{1: key1, 2: key2}, 2)
+	require.NoError(t, err)
+	store = NewEncryptedStorage(inner, keyring)
+
+	n, err := store.Reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, key := range []string{"a", "legacy"} {
+		raw, err := inner.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2), raw.KeyID, key)
+	}
+
+	values := make(map[string]string)
+	require.NoError(t, store.Iterate("", "", func(key string, value Value) bool {
+		values[key] = string(value.Data)
+		return true
+	}))
+	assert.Equal(t, map[string]string{"a": "secret", "legacy": "plain"}, values)
+
+	n, err = store.Reencrypt()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// entryOverhead approximates the memory kept per key besides the key and
+// value bytes: the map slot, the string and slice headers and the entry in
+// the eviction index
+const entryOverhead = 96
+
+// entrySize returns the number of bytes accounted for a key and its value
+func entrySize(key string, value Value) int64 {
+	return int64(len(key)+len(value.Data)) + metadataSize(value) + entryOverhead
+}
+
+// EvictionPolicy selects which keys MemoryStorage removes when a write
+// would exceed its memory budget
+type EvictionPolicy int
+
+const (
+	// NoEviction rejects writes that would exceed the budget
+	NoEviction EvictionPolicy = iota
+
+	// AllKeysLRU evicts the least recently written key
+	AllKeysLRU
+
+	// AllKeysLFU evicts the least frequently written key, the least
+	// recently written one among equals
+	AllKeysLFU
+
+	// VolatileTTL evicts the key with an expiration that expires first
+	VolatileTTL
+)
+
+// ParseEvictionPolicy parses "noeviction", "allkeys-lru", "allkeys-lfu"
+// or "volatile-ttl"
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "noeviction":
+		return NoEviction, nil
+	case "allkeys-lru":
+		return AllKeysLRU, nil
+	case "allkeys-lfu":
+		return AllKeysLFU, nil
+	case "volatile-ttl":
+		return VolatileTTL, nil
+	default:
+		return NoEviction, fmt.Errorf("unknown eviction policy %q", s)
+	}
+}
+
+// String returns the name of the eviction policy
+func (p EvictionPolicy) String() string {
+	switch p {
+	case NoEviction:
+		return "noeviction"
+	case AllKeysLRU:
+		return "allkeys-lru"
+	case AllKeysLFU:
+		return "allkeys-lfu"
+	case VolatileTTL:
+		return "volatile-ttl"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// EvictionRank is what a key's position in the eviction order is derived
+// from. Ranks only change with writes, so replicas applying the same log
+// agree on them; they are carried in snapshots for the same reason.
+type EvictionRank struct {
+	Seq  int64 `json:"seq"`            // Write sequence number of the last write
+	Freq int64 `json:"freq,omitempty"` // Number of writes
+}
+
+// EvictionRanker is implemented by backends that keep an eviction order
+// which must survive a snapshot and restore
+type EvictionRanker interface {
+	// EvictionRanks returns the rank of every tracked key
+	EvictionRanks() map[string]EvictionRank
+
+	// SetEvictionRanks replaces the ranks of the given keys
+	SetEvictionRanks(ranks map[string]EvictionRank)
+}
+
+// Evictor is implemented by backends that evict keys on their own, so that
+// the layers above them can keep keys they depend on and account for the
+// keys that are evicted
+type Evictor interface {
+	// SetEvictable sets which keys may be evicted, all of them if fn is nil
+	SetEvictable(fn func(key string) bool)
+
+	// SetEvictionHandler sets a function called with every key a write
+	// evicts and the value it held, before the write returns. It is called
+	// with the backend locked and must not use it.
+	SetEvictionHandler(fn func(key string, value Value))
+}
+
+// evictionItem is an entry of an evictionIndex
+type evictionItem struct {
+	key        string
+	rank       EvictionRank
+	expiration int64
+	index      int
+}
+
+// evictionIndex is a heap of keys with the next key to evict on top. Unlike
+// the TTL index it is updated in place, so its order depends only on the
+// sequence of writes.
+type evictionIndex struct {
+	policy    EvictionPolicy
+	evictable func(key string) bool // Keys that are candidates, all if nil
+	items     []*evictionItem
+	byKey     map[string]*evictionItem
+}
+
+// newEvictionIndex creates an empty index ordered for policy, holding the
+// keys evictable accepts
+func newEvictionIndex(policy EvictionPolicy, evictable func(key string) bool) *evictionIndex {
+	return &evictionIndex{
+		policy:    policy,
+		evictable: evictable,
+		byKey:     make(map[string]*evictionItem),
+	}
+}
+
+func (x *evictionIndex) Len() int { return len(x.items) }
+
+func (x *evictionIndex) Less(i, j int) bool {
+	a, b := x.items[i], x.items[j]
+	switch x.policy {
+	case AllKeysLFU:
+		if a.rank.Freq != b.rank.Freq {
+			return a.rank.Freq < b.rank.Freq
+		}
+	case VolatileTTL:
+		if a.expiration != b.expiration {
+			return a.expiration < b.expiration
+		}
+	}
+	return a.rank.Seq < b.rank.Seq
+}
+
+func (x *evictionIndex) Swap(i, j int) {
+	x.items[i], x.items[j] = x.items[j], x.items[i]
+	x.items[i].index = i
+	x.items[j].index = j
+}
+
+func (x *evictionIndex) Push(v interface{}) {
+	item := v.(*evictionItem)
+	item.index = len(x.items)
+	x.items = append(x.items, item)
+}
+
+func (x *evictionIndex) Pop() interface{} {
+	old := x.items
+	item := old[len(old)-1]
+	x.items = old[:len(old)-1]
+	return item
+}
+
+// touch records a write of key with sequence number seq
+func (x *evictionIndex) touch(key string, value Value, seq int64) {
+	item, ok := x.byKey[key]
+	if (x.policy == VolatileTTL && value.Expiration == 0) || (x.evictable != nil && !x.evictable(key)) {
+		// Only keys with an expiration are candidates for volatile-ttl
+		if ok {
+			x.remove(key)
+		}
+		return
+	}
+
+	if !ok {
+		x.add(&evictionItem{
+			key:        key,
+			rank:       EvictionRank{Seq: seq, Freq: 1},
+			expiration: value.Expiration,
+		})
+		return
+	}
+
+	item.rank.Seq = seq
+	item.rank.Freq++
+	item.expiration = value.Expiration
+	heap.Fix(x, item.index)
+}
+
+// add inserts item into the index
+func (x *evictionIndex) add(item *evictionItem) {
+	x.byKey[item.key] = item
+	heap.Push(x, item)
+}
+
+// remove drops key from the index
+func (x *evictionIndex) remove(key string) {
+	item, ok := x.byKey[key]
+	if !ok {
+		return
+	}
+	heap.Remove(x, item.index)
+	delete(x.byKey, key)
+}
+
+// victim returns the next key to evict
+func (x *evictionIndex) victim() (string, bool) {
+	if len(x.items) == 0 {
+		return "", false
+	}
+	return x.items[0].key, true
+}
+
+// ranks returns the rank of every key in the index
+func (x *evictionIndex) ranks() map[string]EvictionRank {
+	ranks := make(map[string]EvictionRank, len(x.items))
+	for _, item := range x.items {
+		ranks[item.key] = item.rank
+	}
+	return ranks
+}
+
+// setRanks replaces the ranks of the given keys that are in the index
+func (x *evictionIndex) setRanks(ranks map[string]EvictionRank) {
+	for key, rank := range ranks {
+		if item, ok := x.byKey[key]; ok {
+			item.rank = rank
+		}
+	}
+	heap.Init(x)
+}
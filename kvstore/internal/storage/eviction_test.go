@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// budgetFor returns a memory budget that fits n entries of the given sizes
+func budgetFor(n, keyLen, valueLen int) int64 {
+	return int64(n) * (int64(keyLen+valueLen) + entryOverhead)
+}
+
+func TestMemoryStorageNoEviction(t *testing.T) {
+	store := NewMemoryStorageWithOptions(MemoryStorageOptions{MaxMemory: budgetFor(2, 1, 1)})
+
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	assert.Equal(t, ErrOutOfMemory, store.Set("c", Value{Data: []byte("3")}))
+
+	// Overwrites that do not grow and deletes are still allowed
+	require.NoError(t, store.Set("a", Value{Data: []byte("4")}))
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Set("c", Value{Data: []byte("3")}))
+	assert.Equal(t, budgetFor(2, 1, 1), store.UsedMemory())
+}
+
+func TestMemoryStorageLRU(t *testing.T) {
+	evicted := 0
+	store := NewMemoryStorageWithOptions(MemoryStorageOptions{
+		MaxMemory:      budgetFor(3, 1, 1),
+		EvictionPolicy: AllKeysLRU,
+		OnEvict:        func(count int) { evicted += count },
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Set(key, Value{Data: []byte("x")}))
+	}
+	require.NoError(t, store.Set("a", Value{Data: []byte("y")}))
+	require.NoError(t, store.Set("d", Value{Data: []byte("x")}))
+
+	assert.ElementsMatch(t, []string{"a", "c", "d"}, store.Keys())
+	assert.Equal(t, 1, evicted)
+
+	// Growing a key may evict others but never the key itself
+	require.NoError(t, store.Set("a", Value{Data: make([]byte, 1+entryOverhead)}))
+	assert.ElementsMatch(t, []string{"a", "d"}, store.Keys())
+	assert.Equal(t, ErrOutOfMemory, store.Set("huge", Value{Data: make([]byte, 1000)}))
+}
+
+func TestMemoryStorageEvictionHooks(t *testing.T) {
+	store := NewMemoryStorageWithOptions(MemoryStorageOptions{
+		MaxMemory:      budgetFor(3, 1, 1),
+		EvictionPolicy: AllKeysLRU,
+	})
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+
+	// Keys that are not evictable are skipped, already stored ones too
+	evicted := make(map[string]string)
+	store.SetEvictable(func(key string) bool { return key != "a" })
+	store.SetEvictionHandler(func(key string, value Value) { evicted[key] = string(value.Data) })
+
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Set("c", Value{Data: []byte("3")}))
+	require.NoError(t, store.Set("d", Value{Data: []byte("4")}))
+	assert.ElementsMatch(t, []string{"a", "c", "d"}, store.Keys())
+	assert.Equal(t, map[string]string{"b": "2"}, evicted)
+
+	// So they are after the store is cleared
+	require.NoError(t, store.Clear())
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, store.Set(key, Value{Data: []byte("5")}))
+	}
+	assert.Contains(t, store.Keys(), "a")
+}
+
+func TestMemoryStorageLFU(t *testing.T) {
+	store := NewMemoryStorageWithOptions(MemoryStorageOptions{
+		MaxMemory:      budgetFor(3, 1, 1),
+		EvictionPolicy: AllKeysLFU,
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Set("a", Value{Data: []byte("x")}))
+	}
+	require.NoError(t, store.Set("b", Value{Data: []byte("x")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("x")}))
+	require.NoError(t, store.Set("c", Value{Data: []byte("x")}))
+	require.NoError(t, store.Set("d", Value{Data: []byte("x")}))
+
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, store.Keys())
+}
+
+func TestMemoryStorageVolatileTTL(t *testing.T) {
+	store := NewMemoryStorageWithOptions(MemoryStorageOptions{
+		MaxMemory:      budgetFor(3, 1, 1),
+		EvictionPolicy: VolatileTTL,
+	})
+	far := SystemClock() + 1e12
+
+	require.NoError(t, store.Set("p", Value{Data: []byte("x")}))
+	require.NoError(t, store.Set("l", Value{Data: []byte("x"), Expiration: far + 2}))
+	require.NoError(t, store.Set("s", Value{Data: []byte("x"), Expiration: far + 1}))
+	require.NoError(t, store.Set("n", Value{Data: []byte("x"), Expiration: far + 3}))
+	assert.ElementsMatch(t, []string{"p", "l", "n"}, store.Keys())
+
+	// Keys without an expiration are never evicted
+	require.NoError(t, store.Set("l", Value{Data: []byte("x")}))
+	require.NoError(t, store.Set("n", Value{Data: []byte("x")}))
+	assert.Equal(t, ErrOutOfMemory, store.Set("q", Value{Data: []byte("x")}))
+}
+
+func TestMemoryStorageEvictionIsDeterministic(t *testing.T) {
+	opts := MemoryStorageOptions{MaxMemory: budgetFor(50, 3, 8), EvictionPolicy: AllKeysLFU}
+	a := NewMemoryStorageWithOptions(opts)
+	b := NewMemoryStorageWithOptions(opts)
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i * 7 % 113)
+		value := Value{Data: []byte(strconv.Itoa(i))}
+		require.NoError(t, a.Set(key, value))
+		require.NoError(t, b.Set(key, value))
+
+		// Reads on one replica must not change what it evicts
+		a.Get(strconv.Itoa(i % 113))
+	}
+	assert.ElementsMatch(t, a.Keys(), b.Keys())
+
+	// A store restored with the ranks keeps evicting in the same order
+	c := NewMemoryStorageWithOptions(opts)
+	for _, key := range a.Keys() {
+		val, err := a.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, c.Set(key, val))
+	}
+	c.SetEvictionRanks(a.EvictionRanks())
+	for i := 0; i < 100; i++ {
+		key := "new" + strconv.Itoa(i)
+		require.NoError(t, a.Set(key, Value{Data: []byte("x")}))
+		require.NoError(t, c.Set(key, Value{Data: []byte("x")}))
+	}
+	assert.ElementsMatch(t, a.Keys(), c.Keys())
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	policy, err := ParseEvictionPolicy("allkeys-lru")
+	require.NoError(t, err)
+	assert.Equal(t, AllKeysLRU, policy)
+	assert.Equal(t, "allkeys-lru", policy.String())
+
+	_, err = ParseEvictionPolicy("random")
+	assert.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// ActiveExpirer is implemented by backends that can find expired keys
+// without waiting for them to be read
+type ActiveExpirer interface {
+	// DueKeys pops up to limit keys whose expiration is before now off the
+	// backend's TTL index and returns them without removing the keys
+	DueKeys(now int64, limit int) []string
+
+	// SampleKeys checks up to n keys with an expiration, chosen at random,
+	// and returns how many were checked and which of them are expired
+	SampleKeys(now int64, n int) (sampled int, expired []string)
+
+	// Requeue puts keys popped by DueKeys back on the TTL index, so that
+	// keys that could not be removed are retried
+	Requeue(keys []string)
+}
+
+// ReapFunc removes expired keys found by an Expirer and returns how many
+// were removed. A replicated store proposes the removal through consensus
+// instead of deleting locally.
+type ReapFunc func(keys []string) (int, error)
+
+// ExpireKeys deletes those of keys that are expired according to the
+// store's own clock and returns how many were deleted. Keys that have been
+// overwritten with a later expiration in the meantime are left alone.
+func ExpireKeys(store Storage, keys []string) (int, error) {
+	n := 0
+	for _, key := range keys {
+		if _, err := store.Get(key); err != ErrKeyExpired {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ExpiryOptions configures an Expirer
+type ExpiryOptions struct {
+	Interval         time.Duration // Time between expiry cycles
+	BatchSize        int           // Keys taken from the TTL index per reap
+	SampleSize       int           // Keys checked per sampling round
+	MaxCycleDuration time.Duration // Time budget of a single cycle
+	Enabled          func() bool   // Reports whether cycles should run, nil means always
+}
+
+// DefaultExpiryOptions returns the default expiry options, modelled on
+// Redis' active expire cycle
+func DefaultExpiryOptions() ExpiryOptions {
+	return ExpiryOptions{
+		Interval:         100 * time.Millisecond,
+		BatchSize:        1000,
+		SampleSize:       20,
+		MaxCycleDuration: 25 * time.Millisecond,
+	}
+}
+
+// Expirer periodically reclaims expired keys from an ActiveExpirer. Each
+// cycle first drains the backend's TTL index and then samples random keys
+// with an expiration, repeating while more than a quarter of a sample
+// turns out to be expired.
+type Expirer struct {
+	target   ActiveExpirer
+	opts     ExpiryOptions
+	reap     ReapFunc
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewExpirer creates an expirer that hands the expired keys it finds in
+// target to reap
+func NewExpirer(target ActiveExpirer, opts ExpiryOptions, reap ReapFunc) *Expirer {
+	defaults := DefaultExpiryOptions()
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = defaults.SampleSize
+	}
+	if opts.MaxCycleDuration <= 0 {
+		opts.MaxCycleDuration = defaults.MaxCycleDuration
+	}
+
+	return &Expirer{
+		target: target,
+		opts:   opts,
+		reap:   reap,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start runs expiry cycles in the background until Stop is called
+func (e *Expirer) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.stopCh:
+				return
+			case <-ticker.C:
+				if e.opts.Enabled == nil || e.opts.Enabled() {
+					e.RunCycle(time.Now())
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background cycles and waits for the current one to finish
+func (e *Expirer) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopCh)
+	})
+	e.wg.Wait()
+}
+
+// RunCycle runs a single expiry cycle and returns the number of keys removed
+func (e *Expirer) RunCycle(now time.Time) int {
+	deadline := time.Now().Add(e.opts.MaxCycleDuration)
+	nowNano := now.UnixNano()
+	total := 0
+
+	for {
+		due := e.target.DueKeys(nowNano, e.opts.BatchSize)
+		if len(due) > 0 {
+			n, err := e.reap(due)
+			total += n
+			if err != nil {
+				// Retry in a later cycle, a failed reap is likely to fail
+				// again right away
+				e.target.Requeue(due)
+				return total
+			}
+		}
+		if len(due) < e.opts.BatchSize || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	for !time.Now().After(deadline) {
+		sampled, expired := e.target.SampleKeys(nowNano, e.opts.SampleSize)
+		if len(expired) == 0 {
+			break
+		}
+
+		removed, err := e.reap(expired)
+		total += removed
+		if err != nil || removed*4 <= sampled {
+			break
+		}
+	}
+
+	return total
+}
+
+// ttlItem is an entry of a ttlIndex
+type ttlItem struct {
+	key        string
+	expiration int64
+}
+
+// ttlIndex is a min-heap of keys ordered by expiration. Entries are not
+// removed when a key is overwritten or deleted, callers must check that an
+// item still matches the stored value before acting on it.
+type ttlIndex []ttlItem
+
+func (h ttlIndex) Len() int            { return len(h) }
+func (h ttlIndex) Less(i, j int) bool  { return h[i].expiration < h[j].expiration }
+func (h ttlIndex) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *ttlIndex) Push(x interface{}) { *h = append(*h, x.(ttlItem)) }
+
+func (h *ttlIndex) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// push adds a key to the index
+func (h *ttlIndex) push(key string, expiration int64) {
+	heap.Push(h, ttlItem{key: key, expiration: expiration})
+}
+
+// popDue removes and returns the earliest item if it expired before now
+func (h *ttlIndex) popDue(now int64) (ttlItem, bool) {
+	if len(*h) == 0 || (*h)[0].expiration >= now {
+		return ttlItem{}, false
+	}
+	return heap.Pop(h).(ttlItem), true
+}
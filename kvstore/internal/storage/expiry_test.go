@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reapLocally returns a ReapFunc that deletes expired keys from store directly
+func reapLocally(t *testing.T, store Storage) ReapFunc {
+	return func(keys []string) (int, error) {
+		n, err := ExpireKeys(store, keys)
+		require.NoError(t, err)
+		return n, nil
+	}
+}
+
+func TestExpirerMemoryStorage(t *testing.T) {
+	store := NewMemoryStorage()
+	now := time.Now()
+	past := now.Add(-time.Second).UnixNano()
+	future := now.Add(time.Hour).UnixNano()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set("expired-"+strconv.Itoa(i), Value{Data: []byte("x"), Expiration: past}))
+	}
+	require.NoError(t, store.Set("live", Value{Data: []byte("x"), Expiration: future}))
+	require.NoError(t, store.Set("persistent", Value{Data: []byte("x")}))
+
+	// Overwriting an expiring key must not let its stale index entry remove it
+	require.NoError(t, store.Set("overwritten", Value{Data: []byte("x"), Expiration: past}))
+	require.NoError(t, store.Set("overwritten", Value{Data: []byte("y")}))
+
+	expirer := NewExpirer(store, DefaultExpiryOptions(), reapLocally(t, store))
+	assert.Equal(t, 100, expirer.RunCycle(now))
+
+	store.mutex.RLock()
+	assert.Len(t, store.data, 3)
+	store.mutex.RUnlock()
+	assert.True(t, store.Has("overwritten"))
+	assert.True(t, store.Has("live"))
+}
+
+func TestSampleKeys(t *testing.T) {
+	store := NewMemoryStorage()
+	past := time.Now().Add(-time.Second).UnixNano()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, store.Set(strconv.Itoa(i), Value{Data: []byte("x"), Expiration: past}))
+	}
+	// Sampling works without the TTL index
+	store.ttl = nil
+
+	sampled, expired := store.SampleKeys(time.Now().UnixNano(), 20)
+	assert.Equal(t, 20, sampled)
+	assert.Len(t, expired, 20)
+	assert.Len(t, store.Keys(), 0)
+
+	expirer := NewExpirer(store, DefaultExpiryOptions(), reapLocally(t, store))
+	assert.Equal(t, 50, expirer.RunCycle(time.Now()))
+}
+
+func TestExpireKeysUsesStoreClock(t *testing.T) {
+	store := NewMemoryStorage()
+	var clock int64 = 100
+	store.SetClock(func() int64 { return clock })
+
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: 150}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("x"), Expiration: 50}))
+
+	// Only keys expired at the store's clock are removed, whatever the caller saw
+	n, err := ExpireKeys(store, []string{"a", "b", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, store.Has("a"))
+
+	clock = 200
+	assert.False(t, store.Has("a"))
+	assert.Equal(t, []string{"a"}, store.DueKeys(clock, 10))
+}
+
+func TestExpirerDisabled(t *testing.T) {
+	store := NewMemoryStorage()
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: 1}))
+
+	opts := DefaultExpiryOptions()
+	opts.Interval = time.Millisecond
+	opts.Enabled = func() bool { return false }
+	expirer := NewExpirer(store, opts, func(keys []string) (int, error) {
+		t.Error("disabled expirer reaped keys")
+		return 0, nil
+	})
+	expirer.Start()
+	time.Sleep(20 * time.Millisecond)
+	expirer.Stop()
+}
+
+func TestExpirerRequeuesFailedReaps(t *testing.T) {
+	store := NewMemoryStorage()
+	past := time.Now().Add(-time.Second).UnixNano()
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: past}))
+
+	// Keys a failed reap took off the TTL index are found again next cycle
+	failing := NewExpirer(store, DefaultExpiryOptions(), func(keys []string) (int, error) {
+		return 0, ErrStorageClosed
+	})
+	assert.Equal(t, 0, failing.RunCycle(time.Now()))
+	assert.Equal(t, []string{"a"}, store.DueKeys(time.Now().UnixNano(), 10))
+	store.Requeue([]string{"a", "missing"})
+
+	assert.Equal(t, 1, NewExpirer(store, DefaultExpiryOptions(), reapLocally(t, store)).RunCycle(time.Now()))
+}
+
+func TestExpirerDiskStorage(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	require.NoError(t, store.Set("a", Value{Data: []byte("x"), Expiration: past}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("x")}))
+
+	assert.Equal(t, 1, NewExpirer(store, DefaultExpiryOptions(), reapLocally(t, store)).RunCycle(time.Now()))
+
+	store2, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store2.Close()
+	assert.Equal(t, 1, store2.RecoveryReport().Loaded)
+	assert.Equal(t, 0, store2.RecoveryReport().Expired)
+}
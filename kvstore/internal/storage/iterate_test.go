@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackends opens one of each storage backend
+func testBackends(t *testing.T) map[string]Storage {
+	disk, err := NewDiskStorage(t.TempDir())
+	require.NoError(t, err)
+	log, err := NewLogStorage(t.TempDir(), DefaultLogStorageOptions())
+	require.NoError(t, err)
+	lsm, err := NewLSMStorage(t.TempDir(), testLSMOptions())
+	require.NoError(t, err)
+
+	backends := map[string]Storage{
+		"memory":  NewMemoryStorage(),
+		"sharded": NewShardedMemoryStorage(4),
+		"disk":    disk,
+		"log":     log,
+		"lsm":     lsm,
+	}
+	t.Cleanup(func() {
+		for _, store := range backends {
+			store.Close()
+		}
+	})
+	return backends
+}
+
+func TestIterate(t *testing.T) {
+	for name, store := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"b/2", "a/1", "b/1", "b/3", "c", "b\xff"} {
+				require.NoError(t, store.Set(key, Value{Data: []byte(key)}))
+			}
+			require.NoError(t, store.Set("b/0", Value{Data: []byte("x"), Expiration: time.Now().Add(-time.Second).UnixNano()}))
+
+			collect := func(prefix, startAfter string, limit int) []string {
+				var keys []string
+				require.NoError(t, store.Iterate(prefix, startAfter, func(key string, value Value) bool {
+					assert.Equal(t, key, string(value.Data))
+					keys = append(keys, key)
+					return len(keys) < limit
+				}))
+				return keys
+			}
+
+			assert.Equal(t, []string{"a/1", "b/1", "b/2", "b/3", "b\xff", "c"}, collect("", "", 100))
+			assert.Equal(t, []string{"b/1", "b/2", "b/3"}, collect("b/", "", 100))
+			assert.Equal(t, []string{"b/2", "b/3"}, collect("b/", "b/1", 100))
+			assert.Equal(t, []string{"b/1", "b/2"}, collect("b/", "", 2))
+			assert.Empty(t, collect("b/", "b/3", 100))
+			assert.Equal(t, []string{"b\xff"}, collect("b\xff", "", 100))
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrUnknownKey is returned when data was encrypted with a key that is
+	// not in the keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	// ErrInvalidKeyring is returned for a keyring without a usable active key
+	ErrInvalidKeyring = errors.New("invalid keyring")
+)
+
+// sealedMagic starts every self-describing blob written by Keyring.Seal
+var sealedMagic = []byte("KVE\x01")
+
+// Keyring holds the AES keys data at rest is encrypted with. Every key has
+// a numeric ID that is stored with the data it encrypted, so a new active
+// key can be added while data under older keys stays readable until it is
+// re-encrypted.
+//
+// A keyring file is JSON naming the active key and mapping key IDs to
+// base64 encoded 16, 24 or 32 byte AES keys:
+//
+//	{"active": 2, "keys": {"1": "...", "2": "..."}}
+type Keyring struct {
+	mutex  sync.RWMutex
+	path   string
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// keyringFile is the encoded form of a keyring
+type keyringFile struct {
+	Active uint32            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// NewKeyring creates a keyring from raw AES keys by ID. IDs must not be 0,
+// which marks unencrypted data.
+func NewKeyring(keys map[uint32][]byte, active uint32) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.set(keys, active); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a keyring file
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload rereads the keyring file, which is how a rotated key is picked up
+// without a restart
+func (k *Keyring) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var file keyringFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKeyring, err)
+	}
+
+	keys := make(map[uint32][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%w: invalid key ID %q", ErrInvalidKeyring, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("%w: key %s is not base64", ErrInvalidKeyring, id)
+		}
+		keys[uint32(n)] = key
+	}
+	return k.set(keys, file.Active)
+}
+
+// set replaces the keys of the keyring
+func (k *Keyring) set(keys map[uint32][]byte, active uint32) error {
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if id == 0 {
+			return fmt.Errorf("%w: key ID 0 is reserved", ErrInvalidKeyring)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("%w: key %d: %v", ErrInvalidKeyring, id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		aeads[id] = aead
+	}
+	if _, ok := aeads[active]; !ok {
+		return fmt.Errorf("%w: active key %d not found", ErrInvalidKeyring, active)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = aeads
+	k.active = active
+	return nil
+}
+
+// ActiveID returns the ID of the key new data is encrypted with
+func (k *Keyring) ActiveID() uint32 {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.active
+}
+
+// Encrypt encrypts plaintext with the active key and returns the key's ID
+// and the nonce followed by the ciphertext. aad is authenticated but not
+// encrypted and must be passed again to decrypt.
+func (k *Keyring) Encrypt(plaintext, aad []byte) (uint32, []byte, error) {
+	k.mutex.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mutex.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, err
+	}
+	return id, aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Decrypt decrypts data returned by Encrypt with key id
+func (k *Keyring) Decrypt(id uint32, data, aad []byte) ([]byte, error) {
+	k.mutex.RLock()
+	aead, ok := k.keys[id]
+	k.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, ErrCorruptRecord
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with key %d: %w", id, err)
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts plaintext into a blob that names its key, for data that
+// has no other place to record it
+func (k *Keyring) Seal(plaintext, aad []byte) ([]byte, error) {
+	id, data, err := k.Encrypt(plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, len(sealedMagic)+4, len(sealedMagic)+4+len(data))
+	copy(sealed, sealedMagic)
+	binary.BigEndian.PutUint32(sealed[len(sealedMagic):], id)
+	return append(sealed, data...), nil
+}
+
+// Unseal decrypts a blob written by Seal
+func (k *Keyring) Unseal(sealed, aad []byte) ([]byte, error) {
+	id, ok := SealedKeyID(sealed)
+	if !ok {
+		return nil, ErrCorruptRecord
+	}
+	return k.Decrypt(id, sealed[len(sealedMagic)+4:], aad)
+}
+
+// SealedKeyID returns the ID of the key a blob written by Seal was
+// encrypted with. ok is false if b is not such a blob.
+func SealedKeyID(b []byte) (id uint32, ok bool) {
+	if len(b) < len(sealedMagic)+4 || !bytes.HasPrefix(b, sealedMagic) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b[len(sealedMagic):]), true
+}
+
+// GenerateKey returns a random 256 bit AES key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
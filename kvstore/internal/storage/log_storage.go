@@ -0,0 +1,1068 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dataFileExt = ".data"
+	hintFileExt = ".hint"
+
+	// recordHeaderSize is crc(4) + expiration(8) + flags(1) + keyLen(4) + valueLen(4)
+	recordHeaderSize = 21
+
+	// hintHeaderSize is crc(4) + expiration(8) + offset(8) + size(4) + keyLen(4)
+	hintHeaderSize = 28
+
+	recordFlagTombstone byte = 1
+
+	// tombstoneHintExpiration is the expiration hint files give tombstones.
+	// It is long past, so loading the hint removes the key like the
+	// tombstone does.
+	tombstoneHintExpiration = 1
+)
+
+// ErrCorruptRecord is returned when a record fails its checksum
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// LogStorageOptions configures a LogStorage
+type LogStorageOptions struct {
+	MaxSegmentSize int64         // Size at which the active segment is rotated
+	MergeInterval  time.Duration // How often to check whether a merge is needed, 0 disables
+	MergeRatio     float64       // Fraction of dead bytes in immutable segments that triggers a merge
+	MergeMinBytes  int64         // Dead bytes required before a merge is considered
+	SyncWrites     bool          // Fsync the active segment after every write
+}
+
+// DefaultLogStorageOptions returns the default log storage options
+func DefaultLogStorageOptions() LogStorageOptions {
+	return LogStorageOptions{
+		MaxSegmentSize: 64 << 20,
+		MergeInterval:  time.Minute,
+		MergeRatio:     0.5,
+		MergeMinBytes:  16 << 20,
+		SyncWrites:     false,
+	}
+}
+
+// keydirEntry locates the latest record for a key
+type keydirEntry struct {
+	fileID     uint32
+	offset     int64
+	size       uint32
+	expiration int64
+}
+
+// segment is a single append-only data file
+type segment struct {
+	id   uint32
+	file *os.File
+	size int64
+	dead int64 // Bytes belonging to overwritten, deleted or tombstone records
+}
+
+// LogStorage implements the Storage interface using append-only segment
+// files and an in-memory key directory, in the style of Bitcask
+type LogStorage struct {
+	dirPath    string
+	opts       LogStorageOptions
+	keydir     map[string]keydirEntry
+	now        Clock
+	segments   map[uint32]*segment
+	damaged    map[uint32]int64 // Offset of the first unreadable record of sealed segments
+	active     *segment
+	mutex      sync.RWMutex
+	mergeMutex sync.Mutex // Serializes merges with Clear and Close
+	closeCh    chan struct{}
+	wg         sync.WaitGroup
+	closed     bool
+}
+
+// NewLogStorage creates a new log-structured storage in dirPath
+func NewLogStorage(dirPath string, opts LogStorageOptions) (*LogStorage, error) {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultLogStorageOptions().MaxSegmentSize
+	}
+
+	l := &LogStorage{
+		dirPath:  dirPath,
+		opts:     opts,
+		keydir:   make(map[string]keydirEntry),
+		now:      SystemClock,
+		segments: make(map[uint32]*segment),
+		damaged:  make(map[uint32]int64),
+		closeCh:  make(chan struct{}),
+	}
+
+	if err := l.load(); err != nil {
+		l.closeFiles()
+		return nil, err
+	}
+
+	if opts.MergeInterval > 0 {
+		l.wg.Add(1)
+		go l.mergeLoop()
+	}
+
+	return l, nil
+}
+
+// load rebuilds the key directory from hint and data files and opens a
+// fresh active segment
+func (l *LogStorage) load() error {
+	ids, err := l.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		path := l.dataPath(id)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		seg := &segment{id: id, file: f}
+		l.segments[id] = seg
+
+		if err := l.loadHint(seg); err == nil {
+			continue
+		}
+
+		if err := l.loadData(seg, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+
+	var next uint32
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	return l.openActive(next)
+}
+
+// segmentIDs returns the IDs of all data files in ascending order
+func (l *LogStorage) segmentIDs() ([]uint32, error) {
+	files, err := os.ReadDir(l.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, dataFileExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, dataFileExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// hint is an entry of a hint file
+type hint struct {
+	key   string
+	entry keydirEntry
+}
+
+// readHints parses the hint file of segment id. Everything is parsed before
+// anything is indexed, so a bad hint file can fall back to scanning the
+// data file.
+func (l *LogStorage) readHints(id uint32) ([]hint, error) {
+	data, err := os.ReadFile(l.hintPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var hints []hint
+	for len(data) > 0 {
+		if len(data) < hintHeaderSize {
+			return nil, ErrCorruptRecord
+		}
+		keyLen := int(binary.BigEndian.Uint32(data[24:28]))
+		if len(data) < hintHeaderSize+keyLen {
+			return nil, ErrCorruptRecord
+		}
+		if crc32.ChecksumIEEE(data[4:hintHeaderSize+keyLen]) != binary.BigEndian.Uint32(data[0:4]) {
+			return nil, ErrCorruptRecord
+		}
+
+		hints = append(hints, hint{
+			key: string(data[hintHeaderSize : hintHeaderSize+keyLen]),
+			entry: keydirEntry{
+				fileID:     id,
+				expiration: int64(binary.BigEndian.Uint64(data[4:12])),
+				offset:     int64(binary.BigEndian.Uint64(data[12:20])),
+				size:       binary.BigEndian.Uint32(data[20:24]),
+			},
+		})
+		data = data[hintHeaderSize+keyLen:]
+	}
+	return hints, nil
+}
+
+// loadHint indexes a segment from its hint file
+func (l *LogStorage) loadHint(seg *segment) error {
+	hints, err := l.readHints(seg.id)
+	if err != nil {
+		return err
+	}
+
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+
+	now := l.now()
+	for _, h := range hints {
+		expired := h.entry.expiration > 0 && h.entry.expiration < now
+		l.index(h.key, h.entry, expired)
+	}
+
+	return nil
+}
+
+// loadData indexes a segment by scanning its records. A torn or corrupt
+// tail of the last segment, the one being written when the process
+// stopped, is truncated. Sealed segments were synced before the next one
+// was started, so a bad record in one is corruption: it is kept in place
+// and reported by Verify.
+func (l *LogStorage) loadData(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	now := l.now()
+	good, err := scanSegment(seg.file, info.Size(), func(key string, value Value, flags byte, offset int64, size uint32) {
+		seg.size = offset + int64(size)
+		entry := keydirEntry{
+			fileID:     seg.id,
+			offset:     offset,
+			size:       size,
+			expiration: value.Expiration,
+		}
+		expired := value.Expiration > 0 && value.Expiration < now
+		l.index(key, entry, flags&recordFlagTombstone != 0 || expired)
+	})
+	if err == nil {
+		return nil
+	}
+	if err != ErrCorruptRecord {
+		return err
+	}
+
+	if !last {
+		seg.size = info.Size()
+		l.damaged[seg.id] = good
+		return nil
+	}
+	seg.size = good
+	return os.Truncate(l.dataPath(seg.id), good)
+}
+
+// scanSegment calls fn for each valid record in the first limit bytes of r
+// and returns the offset following the last valid record
+func scanSegment(r io.ReaderAt, limit int64, fn func(key string, value Value, flags byte, offset int64, size uint32)) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r, 0, limit))
+	header := make([]byte, recordHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, ErrCorruptRecord
+			}
+			return offset, err
+		}
+
+		keyLen := binary.BigEndian.Uint32(header[13:17])
+		valueLen := binary.BigEndian.Uint32(header[17:21])
+		size := int64(recordHeaderSize) + int64(keyLen) + int64(valueLen)
+		if offset+size > limit {
+			return offset, ErrCorruptRecord
+		}
+
+		buf := make([]byte, size)
+		copy(buf, header)
+		if _, err := io.ReadFull(reader, buf[recordHeaderSize:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, ErrCorruptRecord
+			}
+			return offset, err
+		}
+
+		key, value, flags, err := decodeRecord(buf)
+		if err != nil {
+			return offset, err
+		}
+
+		fn(key, value, flags, offset, uint32(size))
+		offset += int64(size)
+	}
+}
+
+// encodeRecord serializes a record with a leading CRC32 of its contents
+func encodeRecord(key string, value Value, flags byte) []byte {
+	var meta []byte
+	if hasValueMeta(value) {
+		flags |= recordFlagMeta
+		meta = appendValueMeta(nil, value)
+	}
+
+	valueLen := len(meta) + len(value.Data)
+	buf := make([]byte, recordHeaderSize+len(key)+valueLen)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(value.Expiration))
+	buf[12] = flags
+	binary.BigEndian.PutUint32(buf[13:17], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[17:21], uint32(valueLen))
+	copy(buf[recordHeaderSize:], key)
+	copy(buf[recordHeaderSize+len(key):], meta)
+	copy(buf[recordHeaderSize+len(key)+len(meta):], value.Data)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeRecord parses and verifies a record produced by encodeRecord
+func decodeRecord(buf []byte) (string, Value, byte, error) {
+	if len(buf) < recordHeaderSize {
+		return "", Value{}, 0, ErrCorruptRecord
+	}
+	if crc32.ChecksumIEEE(buf[4:]) != binary.BigEndian.Uint32(buf[0:4]) {
+		return "", Value{}, 0, ErrCorruptRecord
+	}
+
+	keyLen := int(binary.BigEndian.Uint32(buf[13:17]))
+	valueLen := int(binary.BigEndian.Uint32(buf[17:21]))
+	if recordHeaderSize+keyLen+valueLen != len(buf) {
+		return "", Value{}, 0, ErrCorruptRecord
+	}
+
+	key := string(buf[recordHeaderSize : recordHeaderSize+keyLen])
+	value := Value{Expiration: int64(binary.BigEndian.Uint64(buf[4:12]))}
+	section := buf[recordHeaderSize+keyLen:]
+	if buf[12]&recordFlagMeta != 0 {
+		n, err := decodeValueMeta(section, &value)
+		if err != nil {
+			return "", Value{}, 0, err
+		}
+		section = section[n:]
+	}
+	value.Data = make([]byte, len(section))
+	copy(value.Data, section)
+
+	return key, value, buf[12], nil
+}
+
+// encodeHint serializes a hint file entry
+func encodeHint(key string, entry keydirEntry) []byte {
+	buf := make([]byte, hintHeaderSize+len(key))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(entry.expiration))
+	binary.BigEndian.PutUint64(buf[12:20], uint64(entry.offset))
+	binary.BigEndian.PutUint32(buf[20:24], entry.size)
+	binary.BigEndian.PutUint32(buf[24:28], uint32(len(key)))
+	copy(buf[hintHeaderSize:], key)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// index records that the latest record for key is entry, accounting the
+// record it replaces as dead. Must be called with the write lock held.
+func (l *LogStorage) index(key string, entry keydirEntry, removed bool) {
+	if old, ok := l.keydir[key]; ok {
+		if seg, ok := l.segments[old.fileID]; ok {
+			seg.dead += int64(old.size)
+		}
+	}
+
+	if removed {
+		delete(l.keydir, key)
+		if seg, ok := l.segments[entry.fileID]; ok {
+			seg.dead += int64(entry.size)
+		}
+		return
+	}
+
+	l.keydir[key] = entry
+}
+
+func (l *LogStorage) dataPath(id uint32) string {
+	return filepath.Join(l.dirPath, fmt.Sprintf("%09d%s", id, dataFileExt))
+}
+
+func (l *LogStorage) hintPath(id uint32) string {
+	return filepath.Join(l.dirPath, fmt.Sprintf("%09d%s", id, hintFileExt))
+}
+
+// openActive creates a new active segment with the given ID
+func (l *LogStorage) openActive(id uint32) error {
+	f, err := os.OpenFile(l.dataPath(id), os.O_CREATE|os.O_EXCL|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	seg := &segment{id: id, file: f}
+	l.segments[id] = seg
+	l.active = seg
+	return nil
+}
+
+// rotate seals the active segment and opens a new one with the given ID
+func (l *LogStorage) rotate(next uint32) error {
+	if err := l.active.file.Sync(); err != nil {
+		return err
+	}
+	return l.openActive(next)
+}
+
+// append writes a record to the active segment and indexes it. Must be
+// called with the write lock held.
+func (l *LogStorage) append(key string, value Value, flags byte) error {
+	if l.active.size >= l.opts.MaxSegmentSize {
+		if err := l.rotate(l.active.id + 1); err != nil {
+			return err
+		}
+	}
+
+	buf := encodeRecord(key, value, flags)
+	offset := l.active.size
+	if _, err := l.active.file.Write(buf); err != nil {
+		// Drop whatever part of the record made it to disk
+		l.active.file.Truncate(offset)
+		return err
+	}
+	l.active.size += int64(len(buf))
+
+	if l.opts.SyncWrites {
+		if err := l.active.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	entry := keydirEntry{
+		fileID:     l.active.id,
+		offset:     offset,
+		size:       uint32(len(buf)),
+		expiration: value.Expiration,
+	}
+	l.index(key, entry, flags&recordFlagTombstone != 0)
+	return nil
+}
+
+// readEntry reads and verifies the record an entry points to. Must be
+// called with at least the read lock held.
+func (l *LogStorage) readEntry(entry keydirEntry) (Value, error) {
+	seg, ok := l.segments[entry.fileID]
+	if !ok {
+		return Value{}, ErrKeyNotFound
+	}
+
+	buf := make([]byte, entry.size)
+	if _, err := seg.file.ReadAt(buf, entry.offset); err != nil {
+		return Value{}, err
+	}
+
+	_, value, _, err := decodeRecord(buf)
+	return value, err
+}
+
+// Get retrieves a value for the given key
+func (l *LogStorage) Get(key string) (Value, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.closed {
+		return Value{}, ErrStorageClosed
+	}
+
+	entry, ok := l.keydir[key]
+	if !ok {
+		return Value{}, ErrKeyNotFound
+	}
+
+	// Expired records are dropped from the key directory by the next merge
+	if entry.expiration > 0 && entry.expiration < l.now() {
+		return Value{}, ErrKeyExpired
+	}
+
+	return l.readEntry(entry)
+}
+
+// Set stores a value for the given key
+func (l *LogStorage) Set(key string, value Value) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrStorageClosed
+	}
+
+	return l.append(key, value, 0)
+}
+
+// Delete removes a key from the storage
+func (l *LogStorage) Delete(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrStorageClosed
+	}
+
+	if _, ok := l.keydir[key]; !ok {
+		return nil
+	}
+
+	return l.append(key, Value{}, recordFlagTombstone)
+}
+
+// Has checks if a key exists in the storage
+func (l *LogStorage) Has(key string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	entry, ok := l.keydir[key]
+	if !ok {
+		return false
+	}
+
+	return entry.expiration == 0 || entry.expiration >= l.now()
+}
+
+// SetClock sets the clock expirations are checked against
+func (l *LogStorage) SetClock(clock Clock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.now = clock
+}
+
+// Keys returns all keys in the storage
+func (l *LogStorage) Keys() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	keys := make([]string, 0, len(l.keydir))
+	now := l.now()
+
+	for k, entry := range l.keydir {
+		if entry.expiration > 0 && entry.expiration < now {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// Iterate calls fn for each live key with prefix after startAfter in
+// ascending order. The matching keys are taken from the key directory and
+// their values read from the segments as the iteration reaches them.
+func (l *LogStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return ErrStorageClosed
+	}
+	var keys []string
+	now := l.now()
+	for k, entry := range l.keydir {
+		if keyInRange(k, prefix, startAfter) && (entry.expiration == 0 || entry.expiration >= now) {
+			keys = append(keys, k)
+		}
+	}
+	l.mutex.RUnlock()
+
+	return iterateSorted(keys, l.Get, fn)
+}
+
+// Verify rereads the latest record of every key and reports those that
+// fail their checksum
+func (l *LogStorage) Verify(fn func(issue ScrubIssue)) (int, error) {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return 0, ErrStorageClosed
+	}
+	keys := make([]string, 0, len(l.keydir))
+	for k := range l.keydir {
+		keys = append(keys, k)
+	}
+	damaged := make([]uint32, 0, len(l.damaged))
+	for id := range l.damaged {
+		damaged = append(damaged, id)
+	}
+	sort.Slice(damaged, func(i, j int) bool { return damaged[i] < damaged[j] })
+	for _, id := range damaged {
+		fn(ScrubIssue{
+			Location: fmt.Sprintf("segment %d offset %d", id, l.damaged[id]),
+			Error:    ErrCorruptRecord.Error() + ", the rest of the segment is unreadable",
+		})
+	}
+	l.mutex.RUnlock()
+	sort.Strings(keys)
+
+	checked := 0
+	for _, key := range keys {
+		l.mutex.RLock()
+		if l.closed {
+			l.mutex.RUnlock()
+			return checked, ErrStorageClosed
+		}
+		entry, ok := l.keydir[key]
+		var err error
+		if ok {
+			_, err = l.readEntry(entry)
+		}
+		l.mutex.RUnlock()
+
+		if !ok {
+			continue
+		}
+		checked++
+		if err != nil {
+			fn(ScrubIssue{
+				Key:      key,
+				Location: fmt.Sprintf("segment %d offset %d", entry.fileID, entry.offset),
+				Error:    err.Error(),
+			})
+		}
+	}
+	return checked, nil
+}
+
+// Clear removes all keys from the storage
+func (l *LogStorage) Clear() error {
+	l.mergeMutex.Lock()
+	defer l.mergeMutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrStorageClosed
+	}
+
+	for id, seg := range l.segments {
+		seg.file.Close()
+		if err := os.Remove(l.dataPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(l.hintPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	next := l.active.id + 1
+	l.keydir = make(map[string]keydirEntry)
+	l.segments = make(map[uint32]*segment)
+	l.damaged = make(map[uint32]int64)
+	return l.openActive(next)
+}
+
+// Close closes the storage
+func (l *LogStorage) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mutex.Unlock()
+
+	// Stop the background merger before touching the files it may be reading
+	close(l.closeCh)
+	l.wg.Wait()
+
+	l.mergeMutex.Lock()
+	defer l.mergeMutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var err error
+	if l.active != nil {
+		err = l.active.file.Sync()
+	}
+	if cerr := l.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closeFiles closes every open segment file
+func (l *LogStorage) closeFiles() error {
+	var err error
+	for _, seg := range l.segments {
+		if cerr := seg.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// mergeLoop periodically merges segments once enough of them is dead
+func (l *LogStorage) mergeLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.MergeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closeCh:
+			return
+		case <-ticker.C:
+			if l.needsMerge() {
+				// A failed merge leaves the inputs in place and is retried
+				// on the next tick
+				l.Merge()
+			}
+		}
+	}
+}
+
+// needsMerge reports whether the immutable segments hold enough dead bytes
+// to be worth merging
+func (l *LogStorage) needsMerge() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	var total, dead int64
+	for id, seg := range l.segments {
+		// Damaged segments are kept whatever a merge finds in them
+		if _, damaged := l.damaged[id]; damaged || id == l.active.id {
+			continue
+		}
+		total += seg.size
+		dead += seg.dead
+	}
+
+	if total == 0 || dead < l.opts.MergeMinBytes {
+		return false
+	}
+	return float64(dead)/float64(total) >= l.opts.MergeRatio
+}
+
+// mergeCandidate is a live record to be copied during a merge
+type mergeCandidate struct {
+	key   string
+	entry keydirEntry
+}
+
+// Merge rewrites the live records of every sealed segment into new
+// segments with hint files and removes the originals. Writes continue
+// to be served while the merge runs. A live record that cannot be read is
+// left in place for the scrubber to repair, Verify reports it, and its
+// segment is kept until no key points into it. Segments damaged when the
+// storage was loaded are always kept.
+func (l *LogStorage) Merge() error {
+	l.mergeMutex.Lock()
+	defer l.mergeMutex.Unlock()
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return ErrStorageClosed
+	}
+
+	// Seal the active segment and reserve one output ID per input between
+	// the inputs and the new active segment, so replaying files in ID order
+	// always applies merged records before any write made during the merge
+	inputs := make(map[uint32]*segment, len(l.segments))
+	for id, seg := range l.segments {
+		inputs[id] = seg
+	}
+	firstOutput := l.active.id + 1
+	if err := l.rotate(firstOutput + uint32(len(inputs))); err != nil {
+		l.mutex.Unlock()
+		return err
+	}
+
+	var candidates []mergeCandidate
+	for key, entry := range l.keydir {
+		if _, ok := inputs[entry.fileID]; ok {
+			candidates = append(candidates, mergeCandidate{key: key, entry: entry})
+		}
+	}
+	kept := make(map[uint32]bool)
+	for id := range l.damaged {
+		kept[id] = true
+	}
+	now := l.now()
+	l.mutex.Unlock()
+
+	// Copy in file order so the inputs are read sequentially
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].entry, candidates[j].entry
+		if a.fileID != b.fileID {
+			return a.fileID < b.fileID
+		}
+		return a.offset < b.offset
+	})
+
+	w := &mergeWriter{l: l, nextID: firstOutput, lastID: firstOutput + uint32(len(inputs)) - 1}
+	moved := make(map[string]keydirEntry, len(candidates))
+	unreadable := make(map[string]bool)
+
+	for _, c := range candidates {
+		if c.entry.expiration > 0 && c.entry.expiration < now {
+			continue
+		}
+
+		buf := make([]byte, c.entry.size)
+		_, err := inputs[c.entry.fileID].file.ReadAt(buf, c.entry.offset)
+		if err == nil {
+			_, _, _, err = decodeRecord(buf)
+		}
+		if err != nil {
+			unreadable[c.key] = true
+			kept[c.entry.fileID] = true
+			continue
+		}
+
+		entry, err := w.write(c.key, buf, c.entry.expiration)
+		if err != nil {
+			w.abort()
+			return err
+		}
+		moved[c.key] = entry
+	}
+
+	// Kept segments are replayed on the next load, after the tombstones
+	// of the inputs removed are gone. Keys they hold that are not live
+	// get a tombstone in the outputs instead.
+	var tombstones []keydirEntry
+	for id := range kept {
+		for _, key := range l.segmentKeys(inputs[id]) {
+			l.mutex.RLock()
+			_, live := l.keydir[key]
+			l.mutex.RUnlock()
+			if live {
+				continue
+			}
+			entry, err := w.write(key, encodeRecord(key, Value{}, recordFlagTombstone), tombstoneHintExpiration)
+			if err != nil {
+				w.abort()
+				return err
+			}
+			tombstones = append(tombstones, entry)
+		}
+	}
+
+	outputs, err := w.finish()
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	// The outputs must be durable before any input is removed
+	if err := syncDir(l.dirPath); err != nil {
+		w.abort()
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, seg := range outputs {
+		l.segments[seg.id] = seg
+	}
+	for _, entry := range tombstones {
+		l.segments[entry.fileID].dead += int64(entry.size)
+	}
+
+	// Only repoint keys that were not written or deleted during the merge
+	for _, c := range candidates {
+		if unreadable[c.key] {
+			continue
+		}
+		current, ok := l.keydir[c.key]
+		if !ok || current != c.entry {
+			if entry, ok := moved[c.key]; ok {
+				l.segments[entry.fileID].dead += int64(entry.size)
+			}
+			continue
+		}
+
+		if entry, ok := moved[c.key]; ok {
+			l.keydir[c.key] = entry
+		} else {
+			delete(l.keydir, c.key)
+		}
+	}
+
+	// Remove the inputs oldest first. A crash part way leaves only newer
+	// inputs behind, whose tombstones still shadow the records they
+	// deleted.
+	ids := make([]uint32, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if kept[id] {
+			// Nothing more can be reclaimed from it until it is repaired
+			inputs[id].dead = 0
+			continue
+		}
+		inputs[id].file.Close()
+		delete(l.segments, id)
+		os.Remove(l.dataPath(id))
+		os.Remove(l.hintPath(id))
+	}
+
+	return syncDir(l.dirPath)
+}
+
+// segmentKeys returns the keys loading seg would index: those of its hint
+// file, or those of the records it holds up to the first unreadable one
+func (l *LogStorage) segmentKeys(seg *segment) []string {
+	var keys []string
+	if hints, err := l.readHints(seg.id); err == nil {
+		for _, h := range hints {
+			keys = append(keys, h.key)
+		}
+		return keys
+	}
+
+	info, err := seg.file.Stat()
+	if err != nil {
+		return nil
+	}
+	scanSegment(seg.file, info.Size(), func(key string, value Value, flags byte, offset int64, size uint32) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// mergeWriter writes merge output segments and their hint files
+type mergeWriter struct {
+	l       *LogStorage
+	nextID  uint32
+	lastID  uint32
+	current *segment
+	hints   []byte
+	done    []*segment
+}
+
+// write appends an already encoded record to the current output segment
+func (w *mergeWriter) write(key string, record []byte, expiration int64) (keydirEntry, error) {
+	if w.current == nil || (w.current.size >= w.l.opts.MaxSegmentSize && w.nextID <= w.lastID) {
+		if err := w.seal(); err != nil {
+			return keydirEntry{}, err
+		}
+
+		f, err := os.OpenFile(w.l.dataPath(w.nextID), os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return keydirEntry{}, err
+		}
+		w.current = &segment{id: w.nextID, file: f}
+		w.nextID++
+	}
+
+	entry := keydirEntry{
+		fileID:     w.current.id,
+		offset:     w.current.size,
+		size:       uint32(len(record)),
+		expiration: expiration,
+	}
+
+	if _, err := w.current.file.Write(record); err != nil {
+		return keydirEntry{}, err
+	}
+	w.current.size += int64(len(record))
+	w.hints = append(w.hints, encodeHint(key, entry)...)
+
+	return entry, nil
+}
+
+// seal syncs the current output segment and writes its hint file
+func (w *mergeWriter) seal() error {
+	if w.current == nil {
+		return nil
+	}
+
+	if err := w.current.file.Sync(); err != nil {
+		return err
+	}
+
+	tmp := w.l.hintPath(w.current.id) + ".tmp"
+	if err := writeSynced(tmp, w.hints); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.l.hintPath(w.current.id)); err != nil {
+		return err
+	}
+
+	w.done = append(w.done, w.current)
+	w.current = nil
+	w.hints = w.hints[:0]
+	return nil
+}
+
+// writeSynced writes data to a new file at path and fsyncs it
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// finish seals the last output segment and returns all outputs
+func (w *mergeWriter) finish() ([]*segment, error) {
+	if err := w.seal(); err != nil {
+		return nil, err
+	}
+	return w.done, nil
+}
+
+// abort removes any output written so far
+func (w *mergeWriter) abort() {
+	if w.current != nil {
+		w.done = append(w.done, w.current)
+		w.current = nil
+	}
+
+	for _, seg := range w.done {
+		seg.file.Close()
+		os.Remove(w.l.dataPath(seg.id))
+		os.Remove(w.l.hintPath(seg.id))
+	}
+	w.done = nil
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLogOptions() LogStorageOptions {
+	opts := DefaultLogStorageOptions()
+	opts.MaxSegmentSize = 1024
+	opts.MergeInterval = 0
+	return opts
+}
+
+func TestLogStorageBasic(t *testing.T) {
+	store, err := NewLogStorage(t.TempDir(), testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Set("a", Value{Data: []byte("3")}))
+
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("3"), val.Data)
+
+	require.NoError(t, store.Delete("b"))
+	_, err = store.Get("b")
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.False(t, store.Has("b"))
+
+	require.NoError(t, store.Set("c", Value{Data: []byte("x"), Expiration: time.Now().Add(-time.Second).UnixNano()}))
+	_, err = store.Get("c")
+	assert.Equal(t, ErrKeyExpired, err)
+
+	assert.ElementsMatch(t, []string{"a"}, store.Keys())
+}
+
+func TestLogStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(strconv.Itoa(i), Value{Data: []byte("value-" + strconv.Itoa(i))}))
+	}
+	for i := 0; i < 100; i += 2 {
+		require.NoError(t, store.Delete(strconv.Itoa(i)))
+	}
+	require.NoError(t, store.Close())
+
+	store, err = NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Len(t, store.Keys(), 50)
+	val, err := store.Get("51")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value-51"), val.Data)
+	assert.False(t, store.Has("50"))
+}
+
+func TestLogStorageMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			require.NoError(t, store.Set(strconv.Itoa(i), Value{Data: []byte(strconv.Itoa(round))}))
+		}
+	}
+	require.NoError(t, store.Delete("0"))
+
+	before, err := store.segmentIDs()
+	require.NoError(t, err)
+	require.NoError(t, store.Merge())
+	after, err := store.segmentIDs()
+	require.NoError(t, err)
+	assert.Less(t, len(after), len(before))
+
+	// Writes made after the merge must win over the merged copies on reload
+	require.NoError(t, store.Set("1", Value{Data: []byte("latest")}))
+	require.NoError(t, store.Close())
+
+	store, err = NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Len(t, store.Keys(), 49)
+	val, err := store.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("latest"), val.Data)
+	val, err = store.Get("2")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4"), val.Data)
+	assert.False(t, store.Has("0"))
+}
+
+func TestLogStorageTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	path := store.dataPath(store.active.id)
+	require.NoError(t, store.Close())
+
+	// Chop the last record in half
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	store, err = NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.True(t, store.Has("a"))
+	assert.False(t, store.Has("b"))
+}
+
+func TestLogStorageCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	sealed := store.dataPath(store.active.id)
+	require.NoError(t, store.rotate(store.active.id+1))
+	require.NoError(t, store.Set("c", Value{Data: []byte("3")}))
+	require.NoError(t, store.Close())
+
+	// Flip a byte of the last record of the sealed segment
+	data, err := os.ReadFile(sealed)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(sealed, data, 0644))
+
+	store, err = NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	// The sealed segment is reported, not truncated
+	info, err := os.Stat(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+	assert.True(t, store.Has("a"))
+	assert.True(t, store.Has("c"))
+
+	var issues []ScrubIssue
+	_, err = store.Verify(func(issue ScrubIssue) { issues = append(issues, issue) })
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Empty(t, issues[0].Key)
+}
+
+func TestLogStorageMergeSkipsUnreadableRecords(t *testing.T) {
+	// The first segment holds d, a and b, the second deletes d and holds c
+	setup := func(dir string) (*LogStorage, string) {
+		store, err := NewLogStorage(dir, testLogOptions())
+		require.NoError(t, err)
+		require.NoError(t, store.Set("d", Value{Data: []byte("4")}))
+		require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+		require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+		sealed := store.dataPath(store.active.id)
+		require.NoError(t, store.rotate(store.active.id+1))
+		require.NoError(t, store.Delete("d"))
+		require.NoError(t, store.Set("c", Value{Data: []byte("3")}))
+
+		// Flip a byte of the record of b
+		f, err := os.OpenFile(sealed, os.O_RDWR, 0)
+		require.NoError(t, err)
+		info, err := f.Stat()
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{0xff}, info.Size()-1)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		return store, sealed
+	}
+
+	// The merge skips b and keeps its segment until b is written again
+	store, sealed := setup(t.TempDir())
+	require.NoError(t, store.Merge())
+	_, err := store.Get("b")
+	assert.Equal(t, ErrCorruptRecord, err)
+	var issues []ScrubIssue
+	_, err = store.Verify(func(issue ScrubIssue) { issues = append(issues, issue) })
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "b", issues[0].Key)
+	_, err = os.Stat(sealed)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Merge())
+	_, err = os.Stat(sealed)
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, store.Close())
+
+	// Keys deleted in the segments removed stay deleted when the kept
+	// segment is replayed
+	dir := t.TempDir()
+	store, sealed = setup(dir)
+	require.NoError(t, store.Merge())
+	require.NoError(t, store.Close())
+
+	store, err = NewLogStorage(dir, testLogOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	assert.ElementsMatch(t, []string{"a", "c"}, store.Keys())
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val.Data)
+
+	// A segment found damaged on load is kept by every merge
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Merge())
+	_, err = os.Stat(sealed)
+	require.NoError(t, err)
+	issues = nil
+	_, err = store.Verify(func(issue ScrubIssue) { issues = append(issues, issue) })
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Empty(t, issues[0].Key)
+}
@@ -0,0 +1,127 @@
+package storage
+
+import "sort"
+
+// lsmIterator walks LSM entries in ascending key order
+type lsmIterator interface {
+	valid() bool
+	key() string
+	entry() lsmEntry
+	next()
+	err() error
+}
+
+// sliceIterator walks a sorted, pre-materialized list of entries
+type sliceIterator struct {
+	keys    []string
+	entries []lsmEntry
+	pos     int
+}
+
+func (it *sliceIterator) valid() bool     { return it.pos < len(it.keys) }
+func (it *sliceIterator) key() string     { return it.keys[it.pos] }
+func (it *sliceIterator) entry() lsmEntry { return it.entries[it.pos] }
+func (it *sliceIterator) next()           { it.pos++ }
+func (it *sliceIterator) err() error      { return nil }
+
+// levelIterator walks the non-overlapping, sorted tables of a level > 0
+// as a single sequence
+type levelIterator struct {
+	tables []*sstable
+	pos    int
+	cur    *tableIterator
+}
+
+// newLevelIterator returns an iterator positioned at the first key >= start
+func newLevelIterator(tables []*sstable, start string) *levelIterator {
+	pos := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= start })
+	it := &levelIterator{tables: tables, pos: pos}
+	if pos < len(tables) {
+		it.cur = tables[pos].iterator(start)
+		it.skipEmpty()
+	}
+	return it
+}
+
+// skipEmpty moves on to the next table whenever the current one is exhausted
+func (it *levelIterator) skipEmpty() {
+	for it.cur != nil && !it.cur.valid() && it.cur.err() == nil {
+		it.pos++
+		if it.pos >= len(it.tables) {
+			it.cur = nil
+			return
+		}
+		it.cur = it.tables[it.pos].iterator("")
+	}
+}
+
+func (it *levelIterator) valid() bool     { return it.cur != nil && it.cur.valid() }
+func (it *levelIterator) key() string     { return it.cur.key() }
+func (it *levelIterator) entry() lsmEntry { return it.cur.entry() }
+
+func (it *levelIterator) next() {
+	it.cur.next()
+	it.skipEmpty()
+}
+
+func (it *levelIterator) err() error {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.err()
+}
+
+// mergeIterator merges several iterators into one sorted sequence. When
+// more than one iterator holds the same key, the entry from the earliest
+// iterator wins, so iterators must be passed newest first.
+type mergeIterator struct {
+	iters   []lsmIterator
+	curKey  string
+	current lsmEntry
+	ok      bool
+	e       error
+}
+
+// newMergeIterator returns a merge iterator positioned at the smallest key
+func newMergeIterator(iters []lsmIterator) *mergeIterator {
+	m := &mergeIterator{iters: iters}
+	m.next()
+	return m
+}
+
+func (m *mergeIterator) valid() bool     { return m.ok }
+func (m *mergeIterator) key() string     { return m.curKey }
+func (m *mergeIterator) entry() lsmEntry { return m.current }
+func (m *mergeIterator) err() error      { return m.e }
+
+func (m *mergeIterator) next() {
+	m.ok = false
+
+	best := -1
+	for i, it := range m.iters {
+		if err := it.err(); err != nil {
+			m.e = err
+			return
+		}
+		if !it.valid() {
+			continue
+		}
+		if best < 0 || it.key() < m.iters[best].key() {
+			best = i
+		}
+	}
+	if best < 0 {
+		return
+	}
+
+	m.curKey = m.iters[best].key()
+	m.current = m.iters[best].entry()
+	m.ok = true
+
+	// Skip older versions of the same key
+	for _, it := range m.iters {
+		if it.valid() && it.key() == m.curKey {
+			it.next()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	memtableMaxHeight = 12
+
+	// memtableEntryOverhead approximates the per-entry bookkeeping cost
+	memtableEntryOverhead = 64
+)
+
+// lsmEntry is a value or deletion marker inside the LSM tree
+type lsmEntry struct {
+	value     Value
+	tombstone bool
+}
+
+// skipNode is a single skiplist node
+type skipNode struct {
+	key   string
+	entry lsmEntry
+	next  []*skipNode
+}
+
+// memtable is an in-memory sorted buffer of recent writes backed by a
+// skiplist. It is mutated under the LSMStorage write lock and becomes
+// read-only once it is frozen for flushing.
+type memtable struct {
+	head   *skipNode
+	height int
+	size   int64
+	count  int
+	rnd    *rand.Rand
+	wals   []uint64 // WAL files holding this memtable's writes
+}
+
+// newMemtable creates an empty memtable
+func newMemtable() *memtable {
+	return &memtable{
+		head:   &skipNode{next: make([]*skipNode, memtableMaxHeight)},
+		height: 1,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (m *memtable) randomHeight() int {
+	h := 1
+	for h < memtableMaxHeight && m.rnd.Intn(4) == 0 {
+		h++
+	}
+	return h
+}
+
+// seek returns the first node with a key >= key, recording the
+// predecessor at each level in prev when it is non-nil
+func (m *memtable) seek(key string, prev []*skipNode) *skipNode {
+	x := m.head
+	for level := m.height - 1; level >= 0; level-- {
+		for next := x.next[level]; next != nil && next.key < key; next = x.next[level] {
+			x = next
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0]
+}
+
+// put inserts or replaces the entry for key
+func (m *memtable) put(key string, entry lsmEntry) {
+	prev := make([]*skipNode, memtableMaxHeight)
+	node := m.seek(key, prev)
+	if node != nil && node.key == key {
+		m.size += int64(len(entry.value.Data) - len(node.entry.value.Data))
+		node.entry = entry
+		return
+	}
+
+	h := m.randomHeight()
+	if h > m.height {
+		for i := m.height; i < h; i++ {
+			prev[i] = m.head
+		}
+		m.height = h
+	}
+
+	node = &skipNode{key: key, entry: entry, next: make([]*skipNode, h)}
+	for i := 0; i < h; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+
+	m.size += int64(len(key) + len(entry.value.Data) + memtableEntryOverhead)
+	m.count++
+}
+
+// get returns the entry for key if the memtable holds one
+func (m *memtable) get(key string) (lsmEntry, bool) {
+	node := m.seek(key, nil)
+	if node == nil || node.key != key {
+		return lsmEntry{}, false
+	}
+	return node.entry, true
+}
+
+// iterator returns an iterator positioned at the first key >= start. The
+// memtable must not be modified while the iterator is in use.
+func (m *memtable) iterator(start string) lsmIterator {
+	return &memtableIterator{node: m.seek(start, nil)}
+}
+
+// snapshot copies the entries in [start, end) so they can be iterated
+// after the lock protecting a mutable memtable is released
+func (m *memtable) snapshot(start, end string) lsmIterator {
+	it := &sliceIterator{}
+	for node := m.seek(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		it.keys = append(it.keys, node.key)
+		it.entries = append(it.entries, node.entry)
+	}
+	return it
+}
+
+// memtableIterator walks a frozen memtable
+type memtableIterator struct {
+	node *skipNode
+}
+
+func (it *memtableIterator) valid() bool     { return it.node != nil }
+func (it *memtableIterator) key() string     { return it.node.key }
+func (it *memtableIterator) entry() lsmEntry { return it.node.entry }
+func (it *memtableIterator) next()           { it.node = it.node.next[0] }
+func (it *memtableIterator) err() error      { return nil }
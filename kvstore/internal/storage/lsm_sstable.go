@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	sstableMagic      uint64 = 0x6b7673746f726531
+	sstableFooterSize        = 40
+)
+
+// SSTable layout:
+//
+//	data block 0 | crc
+//	...
+//	data block n | crc
+//	index block  | crc
+//	bloom filter | crc
+//	footer: indexOffset(8) indexSize(8) bloomOffset(8) bloomSize(8) magic(8)
+//
+// Data block entries are keyLen(uvarint) key flags(1) expiration(varint)
+// valueLen(uvarint) value. Index entries are lastKeyLen(uvarint) lastKey
+// offset(uvarint) size(uvarint), one per data block.
+
+// blockHandle locates a data block and the last key it contains
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	size    uint64
+}
+
+// sstable is an immutable sorted table file. Its index and bloom filter
+// are held in memory while data blocks are read from disk on demand.
+type sstable struct {
+	num      uint64
+	path     string
+	file     *os.File
+	index    []blockHandle
+	bloom    bloomFilter
+	smallest string
+	largest  string
+	size     int64
+	refs     int32
+	obsolete int32
+}
+
+// openSSTable opens and validates an SSTable file
+func openSSTable(path string, num uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := loadSSTable(f, path, num)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func loadSSTable(f *os.File, path string, num uint64) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, ErrCorruptRecord
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(footer[32:40]) != sstableMagic {
+		return nil, ErrCorruptRecord
+	}
+
+	t := &sstable{num: num, path: path, file: f, size: info.Size()}
+
+	indexData, err := t.readChunk(binary.BigEndian.Uint64(footer[0:8]), binary.BigEndian.Uint64(footer[8:16]))
+	if err != nil {
+		return nil, err
+	}
+	for len(indexData) > 0 {
+		var h blockHandle
+		var n int
+		if h.lastKey, n = readUvarintBytes(indexData); n <= 0 {
+			return nil, ErrCorruptRecord
+		}
+		indexData = indexData[n:]
+		if h.offset, n = binary.Uvarint(indexData); n <= 0 {
+			return nil, ErrCorruptRecord
+		}
+		indexData = indexData[n:]
+		if h.size, n = binary.Uvarint(indexData); n <= 0 {
+			return nil, ErrCorruptRecord
+		}
+		indexData = indexData[n:]
+		t.index = append(t.index, h)
+	}
+
+	bloom, err := t.readChunk(binary.BigEndian.Uint64(footer[16:24]), binary.BigEndian.Uint64(footer[24:32]))
+	if err != nil {
+		return nil, err
+	}
+	t.bloom = bloom
+
+	if len(t.index) > 0 {
+		t.largest = t.index[len(t.index)-1].lastKey
+		block, err := t.readBlock(0)
+		if err != nil {
+			return nil, err
+		}
+		if t.smallest, _, _, err = decodeBlockEntry(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// readChunk reads size bytes at offset followed by their CRC32
+func (t *sstable) readChunk(offset, size uint64) ([]byte, error) {
+	if offset+size+4 > uint64(t.size) {
+		return nil, ErrCorruptRecord
+	}
+
+	buf := make([]byte, size+4)
+	if _, err := t.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf[:size]) != binary.BigEndian.Uint32(buf[size:]) {
+		return nil, ErrCorruptRecord
+	}
+	return buf[:size], nil
+}
+
+// readBlock reads and verifies the i-th data block
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	return t.readChunk(t.index[i].offset, t.index[i].size)
+}
+
+// verifyBlock reads and decodes the i-th data block and returns how many
+// entries it holds
+func (t *sstable) verifyBlock(i int) (int, error) {
+	block, err := t.readBlock(i)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(block) > 0 {
+		_, _, size, err := decodeBlockEntry(block)
+		if err != nil {
+			return n, err
+		}
+		block = block[size:]
+		n++
+	}
+	return n, nil
+}
+
+// get looks key up in the table
+func (t *sstable) get(key string) (lsmEntry, bool, error) {
+	if key < t.smallest || key > t.largest {
+		return lsmEntry{}, false, nil
+	}
+	if !t.bloom.mayContain(bloomHash(key)) {
+		return lsmEntry{}, false, nil
+	}
+
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+	if i == len(t.index) {
+		return lsmEntry{}, false, nil
+	}
+
+	block, err := t.readBlock(i)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+
+	for len(block) > 0 {
+		k, entry, n, err := decodeBlockEntry(block)
+		if err != nil {
+			return lsmEntry{}, false, err
+		}
+		if k == key {
+			return entry, true, nil
+		}
+		if k > key {
+			break
+		}
+		block = block[n:]
+	}
+
+	return lsmEntry{}, false, nil
+}
+
+// iterator returns an iterator positioned at the first key >= start
+func (t *sstable) iterator(start string) *tableIterator {
+	it := &tableIterator{t: t}
+	it.block = sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= start })
+	it.load()
+	for it.valid() && it.k < start {
+		it.next()
+	}
+	return it
+}
+
+func (t *sstable) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// unref drops a reference, closing the table once it is unused and
+// removing its file if it has been compacted away
+func (t *sstable) unref() {
+	if atomic.AddInt32(&t.refs, -1) != 0 {
+		return
+	}
+	t.file.Close()
+	if atomic.LoadInt32(&t.obsolete) == 1 {
+		os.Remove(t.path)
+	}
+}
+
+// tableIterator walks the entries of an SSTable
+type tableIterator struct {
+	t     *sstable
+	block int
+	data  []byte
+	k     string
+	e     lsmEntry
+	ok    bool
+	fail  error
+}
+
+// load reads the current block and decodes its first entry
+func (it *tableIterator) load() {
+	it.ok = false
+	if it.block >= len(it.t.index) {
+		return
+	}
+
+	data, err := it.t.readBlock(it.block)
+	if err != nil {
+		it.fail = err
+		return
+	}
+	it.data = data
+	it.decode()
+}
+
+// decode decodes the next entry of the current block
+func (it *tableIterator) decode() {
+	k, e, n, err := decodeBlockEntry(it.data)
+	if err != nil {
+		it.ok = false
+		it.fail = err
+		return
+	}
+	it.k, it.e, it.ok = k, e, true
+	it.data = it.data[n:]
+}
+
+func (it *tableIterator) valid() bool     { return it.ok }
+func (it *tableIterator) key() string     { return it.k }
+func (it *tableIterator) entry() lsmEntry { return it.e }
+func (it *tableIterator) err() error      { return it.fail }
+
+func (it *tableIterator) next() {
+	if len(it.data) > 0 {
+		it.decode()
+		return
+	}
+	it.block++
+	it.load()
+}
+
+// sstableWriter builds an SSTable from entries added in ascending key order
+type sstableWriter struct {
+	path       string
+	file       *os.File
+	w          *bufio.Writer
+	offset     uint64
+	block      []byte
+	lastKey    string
+	index      []byte
+	hashes     []uint64
+	blockSize  int
+	bitsPerKey int
+}
+
+// newSSTableWriter creates the table file at path
+func newSSTableWriter(path string, blockSize, bitsPerKey int) (*sstableWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sstableWriter{
+		path:       path,
+		file:       f,
+		w:          bufio.NewWriter(f),
+		blockSize:  blockSize,
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
+// add appends an entry, keys must be added in ascending order
+func (w *sstableWriter) add(key string, entry lsmEntry) error {
+	w.block = appendBlockEntry(w.block, key, entry)
+	w.lastKey = key
+	if w.bitsPerKey > 0 {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// estimatedSize returns the number of bytes written so far
+func (w *sstableWriter) estimatedSize() int64 {
+	return int64(w.offset) + int64(len(w.block))
+}
+
+// writeChunk writes data followed by its CRC32 and returns its offset
+func (w *sstableWriter) writeChunk(data []byte) (uint64, error) {
+	offset := w.offset
+	if _, err := w.w.Write(data); err != nil {
+		return 0, err
+	}
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(data))
+	if _, err := w.w.Write(crc[:]); err != nil {
+		return 0, err
+	}
+
+	w.offset += uint64(len(data)) + 4
+	return offset, nil
+}
+
+func (w *sstableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	offset, err := w.writeChunk(w.block)
+	if err != nil {
+		return err
+	}
+
+	w.index = appendUvarintBytes(w.index, w.lastKey)
+	w.index = appendUvarint(w.index, offset)
+	w.index = appendUvarint(w.index, uint64(len(w.block)))
+	w.block = w.block[:0]
+	return nil
+}
+
+// finish writes the index, bloom filter and footer and syncs the file
+func (w *sstableWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
+	indexOffset, err := w.writeChunk(w.index)
+	if err != nil {
+		return err
+	}
+
+	bloom := newBloomFilter(w.hashes, w.bitsPerKey)
+	bloomOffset, err := w.writeChunk(bloom)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], indexOffset)
+	binary.BigEndian.PutUint64(footer[8:16], uint64(len(w.index)))
+	binary.BigEndian.PutUint64(footer[16:24], bloomOffset)
+	binary.BigEndian.PutUint64(footer[24:32], uint64(len(bloom)))
+	binary.BigEndian.PutUint64(footer[32:40], sstableMagic)
+	if _, err := w.w.Write(footer); err != nil {
+		return err
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// abort discards a partially written table
+func (w *sstableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+// appendBlockEntry encodes a data block entry
+func appendBlockEntry(dst []byte, key string, entry lsmEntry) []byte {
+	var flags byte
+	if entry.tombstone {
+		flags = recordFlagTombstone
+	}
+	meta := hasValueMeta(entry.value)
+	if meta {
+		flags |= recordFlagMeta
+	}
+
+	dst = appendUvarintBytes(dst, key)
+	dst = append(dst, flags)
+	dst = appendVarint(dst, entry.value.Expiration)
+	if meta {
+		dst = appendValueMeta(dst, entry.value)
+	}
+	dst = appendUvarintBytes(dst, string(entry.value.Data))
+	return dst
+}
+
+// decodeBlockEntry decodes a data block entry and returns its length
+func decodeBlockEntry(buf []byte) (string, lsmEntry, int, error) {
+	pos := 0
+
+	key, n := readUvarintBytes(buf)
+	if n <= 0 || n >= len(buf) {
+		return "", lsmEntry{}, 0, ErrCorruptRecord
+	}
+	pos += n
+
+	flags := buf[pos]
+	pos++
+
+	expiration, n := binary.Varint(buf[pos:])
+	if n <= 0 {
+		return "", lsmEntry{}, 0, ErrCorruptRecord
+	}
+	pos += n
+
+	value := Value{Expiration: expiration}
+	if flags&recordFlagMeta != 0 {
+		n, err := decodeValueMeta(buf[pos:], &value)
+		if err != nil {
+			return "", lsmEntry{}, 0, err
+		}
+		pos += n
+	}
+
+	data, n := readUvarintBytes(buf[pos:])
+	if n <= 0 {
+		return "", lsmEntry{}, 0, ErrCorruptRecord
+	}
+	pos += n
+	value.Data = []byte(data)
+
+	entry := lsmEntry{
+		value:     value,
+		tombstone: flags&recordFlagTombstone != 0,
+	}
+	return key, entry, pos, nil
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func appendVarint(dst []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+// appendUvarintBytes appends a length-prefixed string
+func appendUvarintBytes(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readUvarintBytes reads a length-prefixed string and returns the number
+// of bytes consumed, or 0 if buf is too short
+func readUvarintBytes(buf []byte) (string, int) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return "", 0
+	}
+	return string(buf[n : n+int(l)]), n + int(l)
+}
+
+// bloomFilter is a bit array followed by a byte holding the probe count
+type bloomFilter []byte
+
+// newBloomFilter builds a filter over the given key hashes
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	if bitsPerKey <= 0 {
+		return nil
+	}
+
+	// ln(2) * bits per key minimises the false positive rate
+	k := int(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	nBits := len(hashes) * bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+
+	f := make(bloomFilter, nBytes+1)
+	f[nBytes] = byte(k)
+	for _, h := range hashes {
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := 0; i < k; i++ {
+			bit := (h1 + uint32(i)*h2) % uint32(nBits)
+			f[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return f
+}
+
+// mayContain reports whether the key with the given hash may be present
+func (f bloomFilter) mayContain(h uint64) bool {
+	if len(f) < 2 {
+		return true
+	}
+
+	nBits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		bit := (h1 + uint32(i)*h2) % nBits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash hashes a key for the bloom filter
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -0,0 +1,1064 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	lsmManifestFile = "MANIFEST"
+	lsmTableExt     = ".sst"
+	lsmWALExt       = ".wal"
+)
+
+// LSMStorageOptions configures an LSMStorage
+type LSMStorageOptions struct {
+	MemtableSize        int64 // Memtable size at which it is flushed to level 0
+	BlockSize           int   // Target size of an SSTable data block
+	BloomBitsPerKey     int   // Bloom filter bits per key, 0 disables filters
+	TargetFileSize      int64 // Size at which compaction output files are split
+	L0CompactionTrigger int   // Number of level 0 tables that triggers a compaction
+	BaseLevelSize       int64 // Maximum size of level 1
+	LevelSizeMultiplier int   // Growth factor between successive levels
+	MaxLevels           int   // Number of levels including level 0
+	SyncWrites          bool  // Fsync the WAL after every write
+}
+
+// DefaultLSMStorageOptions returns the default LSM storage options
+func DefaultLSMStorageOptions() LSMStorageOptions {
+	return LSMStorageOptions{
+		MemtableSize:        4 << 20,
+		BlockSize:           4 << 10,
+		BloomBitsPerKey:     10,
+		TargetFileSize:      2 << 20,
+		L0CompactionTrigger: 4,
+		BaseLevelSize:       10 << 20,
+		LevelSizeMultiplier: 10,
+		MaxLevels:           7,
+		SyncWrites:          false,
+	}
+}
+
+// lsmManifest records which tables make up each level
+type lsmManifest struct {
+	NextFile uint64     `json:"next_file"`
+	Levels   [][]uint64 `json:"levels"`
+}
+
+// lsmVersion is an immutable set of tables. Readers hold a reference to
+// the version they started with so compaction cannot remove its files.
+type lsmVersion struct {
+	levels [][]*sstable
+	refs   int32
+}
+
+// newLSMVersion creates a version holding a reference to each of its tables
+func newLSMVersion(levels [][]*sstable) *lsmVersion {
+	v := &lsmVersion{levels: levels, refs: 1}
+	for _, level := range levels {
+		for _, t := range level {
+			t.ref()
+		}
+	}
+	return v
+}
+
+func (v *lsmVersion) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+func (v *lsmVersion) unref() {
+	if atomic.AddInt32(&v.refs, -1) != 0 {
+		return
+	}
+	for _, level := range v.levels {
+		for _, t := range level {
+			t.unref()
+		}
+	}
+}
+
+// copyLevels returns a copy of the level slices that can be modified
+func (v *lsmVersion) copyLevels() [][]*sstable {
+	levels := make([][]*sstable, len(v.levels))
+	for i, level := range v.levels {
+		levels[i] = append([]*sstable(nil), level...)
+	}
+	return levels
+}
+
+// lsmWAL is the write-ahead log backing a memtable
+type lsmWAL struct {
+	file *os.File
+	size int64
+	sync bool
+}
+
+// createLSMWAL creates a new, empty WAL file
+func createLSMWAL(path string, sync bool) (*lsmWAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &lsmWAL{file: f, sync: sync}, nil
+}
+
+// append writes a record using the same CRC-checked format as LogStorage
+func (w *lsmWAL) append(key string, value Value, flags byte) error {
+	buf := encodeRecord(key, value, flags)
+	if _, err := w.file.Write(buf); err != nil {
+		w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(buf))
+
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+func (w *lsmWAL) close() error {
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// replayLSMWAL loads the records of a WAL into a memtable, truncating any
+// torn tail left behind by a crash
+func replayLSMWAL(path string, mem *memtable) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	good, err := scanSegment(f, info.Size(), func(key string, value Value, flags byte, offset int64, size uint32) {
+		mem.put(key, lsmEntry{value: value, tombstone: flags&recordFlagTombstone != 0})
+	})
+	if err == ErrCorruptRecord {
+		return os.Truncate(path, good)
+	}
+	return err
+}
+
+// LSMStorage implements the Storage interface using a log-structured merge
+// tree: writes go to a WAL-backed memtable that is flushed to sorted
+// SSTables, which are merged into progressively larger levels in the
+// background. Keys are kept in order so range scans are cheap, and only
+// table indexes and bloom filters are held in memory.
+type LSMStorage struct {
+	dirPath         string
+	opts            LSMStorageOptions
+	mutex           sync.RWMutex
+	cond            *sync.Cond // Signalled when the immutable memtable is flushed
+	workMutex       sync.Mutex // Serializes flushes and compactions with Clear and Close
+	mem             *memtable
+	imm             *memtable
+	wal             *lsmWAL
+	current         *lsmVersion
+	now             Clock
+	nextFile        uint64
+	compactPointers []string
+	bgErr           error
+	workCh          chan struct{}
+	closeCh         chan struct{}
+	wg              sync.WaitGroup
+	closed          bool
+}
+
+// NewLSMStorage opens or creates an LSM storage in dirPath
+func NewLSMStorage(dirPath string, opts LSMStorageOptions) (*LSMStorage, error) {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+
+	defaults := DefaultLSMStorageOptions()
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaults.MemtableSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaults.BlockSize
+	}
+	if opts.TargetFileSize <= 0 {
+		opts.TargetFileSize = defaults.TargetFileSize
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if opts.BaseLevelSize <= 0 {
+		opts.BaseLevelSize = defaults.BaseLevelSize
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if opts.MaxLevels < 2 {
+		opts.MaxLevels = defaults.MaxLevels
+	}
+
+	l := &LSMStorage{
+		dirPath: dirPath,
+		opts:    opts,
+		now:     SystemClock,
+		workCh:  make(chan struct{}, 1),
+		closeCh: make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mutex)
+
+	if err := l.recover(); err != nil {
+		if l.current != nil {
+			l.current.unref()
+		}
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.worker()
+	l.signalWork()
+
+	return l, nil
+}
+
+func (l *LSMStorage) tablePath(num uint64) string {
+	return filepath.Join(l.dirPath, fmt.Sprintf("%06d%s", num, lsmTableExt))
+}
+
+func (l *LSMStorage) walPath(num uint64) string {
+	return filepath.Join(l.dirPath, fmt.Sprintf("%06d%s", num, lsmWALExt))
+}
+
+func (l *LSMStorage) newFileNum() uint64 {
+	return atomic.AddUint64(&l.nextFile, 1) - 1
+}
+
+// recover opens the tables listed in the manifest, removes tables left
+// over from interrupted flushes or compactions and replays the WALs
+func (l *LSMStorage) recover() error {
+	var manifest lsmManifest
+	data, err := os.ReadFile(filepath.Join(l.dirPath, lsmManifestFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	levels := make([][]*sstable, l.opts.MaxLevels)
+	for len(levels) < len(manifest.Levels) {
+		levels = append(levels, nil)
+	}
+
+	live := make(map[uint64]bool)
+	for lvl, nums := range manifest.Levels {
+		for _, num := range nums {
+			t, err := openSSTable(l.tablePath(num), num)
+			if err != nil {
+				l.current = newLSMVersion(levels)
+				return fmt.Errorf("open table %d: %w", num, err)
+			}
+			levels[lvl] = append(levels[lvl], t)
+			live[num] = true
+		}
+	}
+	l.current = newLSMVersion(levels)
+	l.compactPointers = make([]string, len(levels))
+	l.nextFile = manifest.NextFile
+
+	files, err := os.ReadDir(l.dirPath)
+	if err != nil {
+		return err
+	}
+
+	var wals []uint64
+	for _, file := range files {
+		name := file.Name()
+		ext := filepath.Ext(name)
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if file.IsDir() || err != nil {
+			continue
+		}
+		if num >= l.nextFile {
+			l.nextFile = num + 1
+		}
+
+		switch ext {
+		case lsmTableExt:
+			if !live[num] {
+				os.Remove(filepath.Join(l.dirPath, name))
+			}
+		case lsmWALExt:
+			wals = append(wals, num)
+		}
+	}
+
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+	l.mem = newMemtable()
+	for _, num := range wals {
+		if err := replayLSMWAL(l.walPath(num), l.mem); err != nil {
+			return fmt.Errorf("replay wal %d: %w", num, err)
+		}
+		l.mem.wals = append(l.mem.wals, num)
+	}
+
+	num := l.newFileNum()
+	wal, err := createLSMWAL(l.walPath(num), l.opts.SyncWrites)
+	if err != nil {
+		return err
+	}
+	l.wal = wal
+	l.mem.wals = append(l.mem.wals, num)
+
+	return nil
+}
+
+// saveManifest atomically replaces the manifest
+func (l *LSMStorage) saveManifest(levels [][]*sstable) error {
+	manifest := lsmManifest{
+		NextFile: atomic.LoadUint64(&l.nextFile),
+		Levels:   make([][]uint64, len(levels)),
+	}
+	for i, level := range levels {
+		manifest.Levels[i] = make([]uint64, 0, len(level))
+		for _, t := range level {
+			manifest.Levels[i] = append(manifest.Levels[i], t.num)
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dirPath, lsmManifestFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(l.dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// install persists levels as the new current version and marks tables that
+// are no longer referenced as obsolete. Must be called with the write lock held.
+func (l *LSMStorage) install(levels [][]*sstable) error {
+	if err := l.saveManifest(levels); err != nil {
+		return err
+	}
+
+	keep := make(map[*sstable]bool)
+	for _, level := range levels {
+		for _, t := range level {
+			keep[t] = true
+		}
+	}
+
+	old := l.current
+	for _, level := range old.levels {
+		for _, t := range level {
+			if !keep[t] {
+				atomic.StoreInt32(&t.obsolete, 1)
+			}
+		}
+	}
+
+	l.current = newLSMVersion(levels)
+	old.unref()
+	return nil
+}
+
+// signalWork wakes the background worker
+func (l *LSMStorage) signalWork() {
+	select {
+	case l.workCh <- struct{}{}:
+	default:
+	}
+}
+
+// resolve turns an LSM entry into a Get result
+func resolveLSMEntry(entry lsmEntry, now int64) (Value, error) {
+	if entry.tombstone {
+		return Value{}, ErrKeyNotFound
+	}
+	if entry.value.Expired(now) {
+		return Value{}, ErrKeyExpired
+	}
+	return entry.value, nil
+}
+
+// Get retrieves a value for the given key
+func (l *LSMStorage) Get(key string) (Value, error) {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return Value{}, ErrStorageClosed
+	}
+	now := l.now()
+	if entry, ok := l.mem.get(key); ok {
+		l.mutex.RUnlock()
+		return resolveLSMEntry(entry, now)
+	}
+	if l.imm != nil {
+		if entry, ok := l.imm.get(key); ok {
+			l.mutex.RUnlock()
+			return resolveLSMEntry(entry, now)
+		}
+	}
+	v := l.current
+	v.ref()
+	l.mutex.RUnlock()
+	defer v.unref()
+
+	// Level 0 tables overlap, newest first
+	for _, t := range v.levels[0] {
+		entry, ok, err := t.get(key)
+		if err != nil {
+			return Value{}, err
+		}
+		if ok {
+			return resolveLSMEntry(entry, now)
+		}
+	}
+
+	for _, level := range v.levels[1:] {
+		i := sort.Search(len(level), func(i int) bool { return level[i].largest >= key })
+		if i == len(level) {
+			continue
+		}
+		entry, ok, err := level[i].get(key)
+		if err != nil {
+			return Value{}, err
+		}
+		if ok {
+			return resolveLSMEntry(entry, now)
+		}
+	}
+
+	return Value{}, ErrKeyNotFound
+}
+
+// Set stores a value for the given key
+func (l *LSMStorage) Set(key string, value Value) error {
+	return l.write(key, value, 0)
+}
+
+// Delete removes a key from the storage
+func (l *LSMStorage) Delete(key string) error {
+	return l.write(key, Value{}, recordFlagTombstone)
+}
+
+// write logs a record to the WAL and applies it to the memtable
+func (l *LSMStorage) write(key string, value Value, flags byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.makeRoom(); err != nil {
+		return err
+	}
+
+	if err := l.wal.append(key, value, flags); err != nil {
+		return err
+	}
+
+	l.mem.put(key, lsmEntry{value: value, tombstone: flags&recordFlagTombstone != 0})
+	return nil
+}
+
+// makeRoom freezes a full memtable for flushing, stalling the writer while
+// a previous memtable is still being flushed. Must be called with the
+// write lock held.
+func (l *LSMStorage) makeRoom() error {
+	for {
+		if l.closed {
+			return ErrStorageClosed
+		}
+		if l.bgErr != nil {
+			return l.bgErr
+		}
+		if l.mem.size < l.opts.MemtableSize {
+			return nil
+		}
+		if l.imm != nil {
+			l.cond.Wait()
+			continue
+		}
+
+		num := l.newFileNum()
+		wal, err := createLSMWAL(l.walPath(num), l.opts.SyncWrites)
+		if err != nil {
+			return err
+		}
+		if err := l.wal.close(); err != nil {
+			wal.close()
+			os.Remove(l.walPath(num))
+			return err
+		}
+
+		l.imm = l.mem
+		l.mem = newMemtable()
+		l.mem.wals = []uint64{num}
+		l.wal = wal
+		l.signalWork()
+		return nil
+	}
+}
+
+// Has checks if a key exists in the storage
+func (l *LSMStorage) Has(key string) bool {
+	_, err := l.Get(key)
+	return err == nil
+}
+
+// SetClock sets the clock expirations are checked against
+func (l *LSMStorage) SetClock(clock Clock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.now = clock
+}
+
+// Keys returns all keys in the storage in ascending order
+func (l *LSMStorage) Keys() []string {
+	var keys []string
+	l.Scan("", "", func(key string, value Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Iterate calls fn for each live key with prefix after startAfter in
+// ascending order, streaming from a range scan
+func (l *LSMStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	start := prefix
+	if startAfter != "" && startAfter >= start {
+		// The smallest key sorting after startAfter
+		start = startAfter + "\x00"
+	}
+	end := prefixEnd(prefix)
+	if end != "" && start >= end {
+		return nil
+	}
+	return l.Scan(start, end, fn)
+}
+
+// prefixEnd returns the smallest key sorting after every key with prefix,
+// or "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Scan calls fn for each live key in [start, end) in ascending order,
+// stopping early when fn returns false. An empty end means no upper bound.
+func (l *LSMStorage) Scan(start, end string, fn func(key string, value Value) bool) error {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return ErrStorageClosed
+	}
+	iters := []lsmIterator{l.mem.snapshot(start, end)}
+	if l.imm != nil {
+		iters = append(iters, l.imm.iterator(start))
+	}
+	v := l.current
+	v.ref()
+	now := l.now()
+	l.mutex.RUnlock()
+	defer v.unref()
+
+	for _, t := range v.levels[0] {
+		iters = append(iters, t.iterator(start))
+	}
+	for _, level := range v.levels[1:] {
+		if len(level) > 0 {
+			iters = append(iters, newLevelIterator(level, start))
+		}
+	}
+
+	it := newMergeIterator(iters)
+	for ; it.valid(); it.next() {
+		if end != "" && it.key() >= end {
+			break
+		}
+
+		entry := it.entry()
+		if entry.tombstone || (entry.value.Expiration > 0 && entry.value.Expiration < now) {
+			continue
+		}
+		if !fn(it.key(), entry.value) {
+			break
+		}
+	}
+
+	return it.err()
+}
+
+// Verify reads every block of every table and reports those that fail
+// their checksum. The keys of a corrupt block cannot be told, so it is
+// reported by location only.
+func (l *LSMStorage) Verify(fn func(issue ScrubIssue)) (int, error) {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		return 0, ErrStorageClosed
+	}
+	v := l.current
+	v.ref()
+	l.mutex.RUnlock()
+	defer v.unref()
+
+	checked := 0
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			for i, handle := range t.index {
+				n, err := t.verifyBlock(i)
+				checked += n
+				if err != nil {
+					fn(ScrubIssue{
+						Location: fmt.Sprintf("level %d table %s block %d (keys up to %q)", level, filepath.Base(t.path), i, handle.lastKey),
+						Error:    err.Error(),
+					})
+				}
+			}
+		}
+	}
+	return checked, nil
+}
+
+// Clear removes all keys from the storage
+func (l *LSMStorage) Clear() error {
+	l.workMutex.Lock()
+	defer l.workMutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrStorageClosed
+	}
+
+	num := l.newFileNum()
+	wal, err := createLSMWAL(l.walPath(num), l.opts.SyncWrites)
+	if err != nil {
+		return err
+	}
+
+	if err := l.install(make([][]*sstable, len(l.current.levels))); err != nil {
+		wal.close()
+		os.Remove(l.walPath(num))
+		return err
+	}
+
+	obsolete := l.mem.wals
+	if l.imm != nil {
+		obsolete = append(obsolete, l.imm.wals...)
+	}
+
+	l.wal.close()
+	l.wal = wal
+	l.mem = newMemtable()
+	l.mem.wals = []uint64{num}
+	l.imm = nil
+	l.cond.Broadcast()
+
+	for _, n := range obsolete {
+		os.Remove(l.walPath(n))
+	}
+	return nil
+}
+
+// Close closes the storage
+func (l *LSMStorage) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cond.Broadcast()
+	l.mutex.Unlock()
+
+	// Let an in-flight flush or compaction finish before releasing tables
+	close(l.closeCh)
+	l.wg.Wait()
+
+	l.workMutex.Lock()
+	defer l.workMutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.wal.close()
+	l.current.unref()
+	return err
+}
+
+// worker runs flushes and compactions until the storage is closed
+func (l *LSMStorage) worker() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case <-l.closeCh:
+			return
+		case <-l.workCh:
+		}
+
+		for {
+			did, err := l.backgroundWork()
+			if err != nil {
+				l.mutex.Lock()
+				l.bgErr = err
+				l.cond.Broadcast()
+				l.mutex.Unlock()
+				break
+			}
+			if !did {
+				break
+			}
+
+			select {
+			case <-l.closeCh:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// backgroundWork performs one flush or compaction step and reports
+// whether there was anything to do
+func (l *LSMStorage) backgroundWork() (bool, error) {
+	l.workMutex.Lock()
+	defer l.workMutex.Unlock()
+
+	l.mutex.RLock()
+	imm, closed := l.imm, l.closed
+	l.mutex.RUnlock()
+
+	if closed {
+		return false, nil
+	}
+	if imm != nil {
+		return true, l.flush(imm)
+	}
+	return l.compact()
+}
+
+// flush writes the immutable memtable to a new level 0 table
+func (l *LSMStorage) flush(imm *memtable) error {
+	var table *sstable
+	if imm.count > 0 {
+		num := l.newFileNum()
+		w, err := newSSTableWriter(l.tablePath(num), l.opts.BlockSize, l.opts.BloomBitsPerKey)
+		if err != nil {
+			return err
+		}
+
+		for it := imm.iterator(""); it.valid(); it.next() {
+			if err := w.add(it.key(), it.entry()); err != nil {
+				w.abort()
+				return err
+			}
+		}
+		if err := w.finish(); err != nil {
+			w.abort()
+			return err
+		}
+
+		if table, err = openSSTable(l.tablePath(num), num); err != nil {
+			os.Remove(l.tablePath(num))
+			return err
+		}
+	}
+
+	l.mutex.Lock()
+	levels := l.current.copyLevels()
+	if table != nil {
+		levels[0] = append([]*sstable{table}, levels[0]...)
+	}
+	if err := l.install(levels); err != nil {
+		l.mutex.Unlock()
+		if table != nil {
+			table.file.Close()
+			os.Remove(table.path)
+		}
+		return err
+	}
+	l.imm = nil
+	l.cond.Broadcast()
+	l.mutex.Unlock()
+
+	for _, num := range imm.wals {
+		os.Remove(l.walPath(num))
+	}
+	return nil
+}
+
+// maxBytesForLevel returns the size above which a level is compacted
+func (l *LSMStorage) maxBytesForLevel(level int) int64 {
+	size := l.opts.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= int64(l.opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// pickCompaction chooses the level most in need of compaction and the
+// input tables from it, returning -1 if no level needs compacting
+func (l *LSMStorage) pickCompaction(v *lsmVersion) (int, []*sstable) {
+	best, bestScore := -1, 1.0
+
+	if score := float64(len(v.levels[0])) / float64(l.opts.L0CompactionTrigger); score >= bestScore {
+		best, bestScore = 0, score
+	}
+
+	for level := 1; level < len(v.levels)-1; level++ {
+		var size int64
+		for _, t := range v.levels[level] {
+			size += t.size
+		}
+		if score := float64(size) / float64(l.maxBytesForLevel(level)); score >= bestScore {
+			best, bestScore = level, score
+		}
+	}
+
+	if best < 0 {
+		return -1, nil
+	}
+
+	// Level 0 tables overlap each other so they are compacted together
+	if best == 0 {
+		return 0, append([]*sstable(nil), v.levels[0]...)
+	}
+
+	// Other levels rotate through their key space one table at a time
+	tables := v.levels[best]
+	for _, t := range tables {
+		if t.smallest > l.compactPointers[best] {
+			return best, []*sstable{t}
+		}
+	}
+	return best, []*sstable{tables[0]}
+}
+
+// overlapping returns the tables of a sorted level that intersect [smallest, largest]
+func overlapping(level []*sstable, smallest, largest string) []*sstable {
+	var tables []*sstable
+	for _, t := range level {
+		if t.largest >= smallest && t.smallest <= largest {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// isBaseLevel reports whether no level below output can hold key, in
+// which case deletion markers for it can be dropped
+func isBaseLevel(v *lsmVersion, output int, key string) bool {
+	for level := output + 1; level < len(v.levels); level++ {
+		tables := v.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+		if i < len(tables) && tables[i].smallest <= key {
+			return false
+		}
+	}
+	return true
+}
+
+// compact runs a single compaction if any level needs one
+func (l *LSMStorage) compact() (bool, error) {
+	l.mutex.RLock()
+	v := l.current
+	v.ref()
+	now := l.now()
+	l.mutex.RUnlock()
+	defer v.unref()
+
+	level, inputs := l.pickCompaction(v)
+	if inputs == nil {
+		return false, nil
+	}
+	output := level + 1
+
+	smallest, largest := inputs[0].smallest, inputs[0].largest
+	for _, t := range inputs[1:] {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+	overlaps := overlapping(v.levels[output], smallest, largest)
+
+	var outputs []*sstable
+	if len(inputs) == 1 && len(overlaps) == 0 {
+		// Nothing to merge with, move the table down as is
+		outputs = inputs
+	} else {
+		var err error
+		if outputs, err = l.mergeTables(v, inputs, overlaps, output, now); err != nil {
+			return false, err
+		}
+	}
+
+	remove := make(map[*sstable]bool)
+	for _, t := range append(inputs, overlaps...) {
+		remove[t] = true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	levels := l.current.copyLevels()
+	for i := range levels {
+		kept := levels[i][:0]
+		for _, t := range levels[i] {
+			if !remove[t] {
+				kept = append(kept, t)
+			}
+		}
+		levels[i] = kept
+	}
+	levels[output] = append(levels[output], outputs...)
+	sort.Slice(levels[output], func(i, j int) bool {
+		return levels[output][i].smallest < levels[output][j].smallest
+	})
+
+	if err := l.install(levels); err != nil {
+		for _, t := range outputs {
+			if !remove[t] {
+				t.file.Close()
+				os.Remove(t.path)
+			}
+		}
+		return false, err
+	}
+
+	l.compactPointers[level] = largest
+	return true, nil
+}
+
+// mergeTables merges the inputs and overlapping tables into new tables
+// for the output level, dropping shadowed versions and, where no deeper
+// level may hold the key, deletion markers and expired values
+func (l *LSMStorage) mergeTables(v *lsmVersion, inputs, overlaps []*sstable, output int, now int64) ([]*sstable, error) {
+	var iters []lsmIterator
+	for _, t := range inputs {
+		iters = append(iters, t.iterator(""))
+	}
+	iters = append(iters, newLevelIterator(overlaps, ""))
+
+	var outputs []*sstable
+	var w *sstableWriter
+	var num uint64
+
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.file.Close()
+			os.Remove(t.path)
+		}
+	}
+
+	finish := func() error {
+		if err := w.finish(); err != nil {
+			return err
+		}
+		w = nil
+		t, err := openSSTable(l.tablePath(num), num)
+		if err != nil {
+			os.Remove(l.tablePath(num))
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+
+	it := newMergeIterator(iters)
+	for ; it.valid(); it.next() {
+		key, entry := it.key(), it.entry()
+
+		// An expired value still shadows older versions below it
+		if !entry.tombstone && entry.value.Expiration > 0 && entry.value.Expiration < now {
+			entry = lsmEntry{tombstone: true}
+		}
+		if entry.tombstone && isBaseLevel(v, output, key) {
+			continue
+		}
+
+		if w == nil {
+			var err error
+			num = l.newFileNum()
+			if w, err = newSSTableWriter(l.tablePath(num), l.opts.BlockSize, l.opts.BloomBitsPerKey); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+		if err := w.add(key, entry); err != nil {
+			abort()
+			return nil, err
+		}
+		if w.estimatedSize() >= l.opts.TargetFileSize {
+			if err := finish(); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		abort()
+		return nil, err
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			abort()
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
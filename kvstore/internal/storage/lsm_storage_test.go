@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLSMOptions() LSMStorageOptions {
+	opts := DefaultLSMStorageOptions()
+	opts.MemtableSize = 4 << 10
+	opts.BlockSize = 256
+	opts.TargetFileSize = 8 << 10
+	opts.BaseLevelSize = 32 << 10
+	opts.L0CompactionTrigger = 2
+	return opts
+}
+
+// waitForCompaction waits until the background worker has nothing left to do
+func waitForCompaction(t *testing.T, l *LSMStorage) {
+	require.Eventually(t, func() bool {
+		l.mutex.RLock()
+		defer l.mutex.RUnlock()
+		level, _ := l.pickCompaction(l.current)
+		return l.imm == nil && level < 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLSMStorageBasic(t *testing.T) {
+	store, err := NewLSMStorage(t.TempDir(), testLSMOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("c", Value{Data: []byte("3")}))
+	require.NoError(t, store.Delete("b"))
+	require.NoError(t, store.Set("d", Value{Data: []byte("4"), Expiration: time.Now().Add(-time.Second).UnixNano()}))
+
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), val.Data)
+
+	_, err = store.Get("b")
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = store.Get("d")
+	assert.Equal(t, ErrKeyExpired, err)
+
+	assert.Equal(t, []string{"a", "c"}, store.Keys())
+}
+
+func TestLSMStorageFlushAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLSMStorage(dir, testLSMOptions())
+	require.NoError(t, err)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			require.NoError(t, store.Set(key, Value{Data: []byte(fmt.Sprintf("%s-%d", key, round))}))
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		require.NoError(t, store.Delete(fmt.Sprintf("key-%04d", i)))
+	}
+	waitForCompaction(t, store)
+
+	store.mutex.RLock()
+	deeper := 0
+	for _, level := range store.current.levels[1:] {
+		deeper += len(level)
+	}
+	store.mutex.RUnlock()
+	assert.Greater(t, deeper, 0, "expected tables below level 0")
+
+	check := func(store *LSMStorage) {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			val, err := store.Get(key)
+			if i%3 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err, key)
+				continue
+			}
+			require.NoError(t, err, key)
+			assert.Equal(t, fmt.Sprintf("%s-2", key), string(val.Data))
+		}
+		assert.Len(t, store.Keys(), 666)
+	}
+	check(store)
+	require.NoError(t, store.Close())
+
+	store, err = NewLSMStorage(dir, testLSMOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	check(store)
+}
+
+func TestLSMStorageScan(t *testing.T) {
+	store, err := NewLSMStorage(t.TempDir(), testLSMOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	for i := 0; i < 500; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%04d", i), Value{Data: []byte("x")}))
+	}
+	waitForCompaction(t, store)
+	require.NoError(t, store.Delete("key-0101"))
+
+	var keys []string
+	require.NoError(t, store.Scan("key-0100", "key-0105", func(key string, value Value) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"key-0100", "key-0102", "key-0103", "key-0104"}, keys)
+
+	keys = nil
+	require.NoError(t, store.Scan("key-0498", "", func(key string, value Value) bool {
+		keys = append(keys, key)
+		return len(keys) < 1
+	}))
+	assert.Equal(t, []string{"key-0498"}, keys)
+}
+
+func TestLSMStorageClear(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewLSMStorage(dir, testLSMOptions())
+	require.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%04d", i), Value{Data: []byte("x")}))
+	}
+	require.NoError(t, store.Clear())
+	require.NoError(t, store.Set("after", Value{Data: []byte("y")}))
+	assert.Equal(t, []string{"after"}, store.Keys())
+	require.NoError(t, store.Close())
+
+	store, err = NewLSMStorage(dir, testLSMOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []string{"after"}, store.Keys())
+}
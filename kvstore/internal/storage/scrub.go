@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Verifier is implemented by backends that can check their records
+// against the checksums stored with them
+type Verifier interface {
+	// Verify reads back every record, calls fn for each one that is
+	// missing or corrupt and returns how many records were checked
+	Verify(fn func(issue ScrubIssue)) (checked int, err error)
+}
+
+// ScrubIssue is a corrupt record found by a scrub
+type ScrubIssue struct {
+	Key         string `json:"key,omitempty"`      // Key of the record, empty if it cannot be told
+	Location    string `json:"location,omitempty"` // Where the record is stored
+	Error       string `json:"error"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// ScrubReport describes the outcome of a scrub
+type ScrubReport struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Checked  int           `json:"checked"`
+	Issues   []ScrubIssue  `json:"issues"`
+	Repaired int           `json:"repaired"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// RepairFunc rewrites the corrupt record of key with a healthy copy,
+// typically fetched from another replica. It must only write a copy of the
+// value the local state holds, never an older or newer one.
+type RepairFunc func(key string) error
+
+// ScrubOptions configures a Scrubber
+type ScrubOptions struct {
+	Interval time.Duration            // Time between background scrubs
+	Repair   RepairFunc               // Rewrites corrupt records, nil to only report
+	OnReport func(report ScrubReport) // Called with the report of every scrub
+}
+
+// DefaultScrubOptions returns the default scrub options
+func DefaultScrubOptions() ScrubOptions {
+	return ScrubOptions{
+		Interval: 24 * time.Hour,
+	}
+}
+
+// Scrubber periodically verifies the records of a backend and has corrupt
+// ones rewritten with a healthy copy
+type Scrubber struct {
+	target      Verifier
+	opts        ScrubOptions
+	runMutex    sync.Mutex // Serializes scrubs
+	reportMutex sync.RWMutex
+	last        *ScrubReport
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	stopOnce    sync.Once
+}
+
+// NewScrubber creates a scrubber that verifies target and repairs it with
+// the repair function of opts
+func NewScrubber(target Verifier, opts ScrubOptions) *Scrubber {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultScrubOptions().Interval
+	}
+
+	return &Scrubber{
+		target: target,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start runs scrubs in the background until Stop is called
+func (s *Scrubber) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.Run()
+			}
+		}
+	}()
+}
+
+// Stop stops the background scrubs and waits for the current one to finish
+func (s *Scrubber) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+}
+
+// Run scrubs the backend once, repairing what it can, and returns the report
+func (s *Scrubber) Run() ScrubReport {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	report := ScrubReport{Started: time.Now(), Issues: []ScrubIssue{}}
+	checked, err := s.target.Verify(func(issue ScrubIssue) {
+		report.Issues = append(report.Issues, issue)
+	})
+	report.Checked = checked
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		if issue.Key == "" || s.opts.Repair == nil {
+			continue
+		}
+		if err := s.opts.Repair(issue.Key); err != nil {
+			issue.RepairError = err.Error()
+			continue
+		}
+		issue.Repaired = true
+		report.Repaired++
+	}
+	report.Duration = time.Since(report.Started)
+
+	s.reportMutex.Lock()
+	s.last = &report
+	s.reportMutex.Unlock()
+
+	if s.opts.OnReport != nil {
+		s.opts.OnReport(report)
+	}
+	return report
+}
+
+// LastReport returns the report of the latest scrub. ok is false if no
+// scrub has run yet.
+func (s *Scrubber) LastReport() (report ScrubReport, ok bool) {
+	s.reportMutex.RLock()
+	defer s.reportMutex.RUnlock()
+
+	if s.last == nil {
+		return ScrubReport{}, false
+	}
+	return *s.last, true
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptByte flips the last byte of the range at offset of size in a file
+func corruptByte(t *testing.T, path string, offset, size int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset+size-1)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset+size-1)
+	require.NoError(t, err)
+}
+
+func TestDiskStorageChecksum(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewDiskStorage(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("2")}))
+	require.NoError(t, store.Close())
+
+	// Rewrite a's value with still valid JSON, only the checksum notices
+	path := filepath.Join(dir, keyFileName("a"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), `"MQ=="`, `"OQ=="`, 1)), 0644))
+
+	_, err = readRecord(path)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+
+	store, err = NewDiskStorage(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []string{keyFileName("a")}, store.RecoveryReport().Quarantined)
+	assert.False(t, store.Has("a"))
+
+	var issues []ScrubIssue
+	checked, err := store.Verify(func(issue ScrubIssue) { issues = append(issues, issue) })
+	require.NoError(t, err)
+	assert.Equal(t, 2, checked)
+	require.Len(t, issues, 1)
+	assert.Equal(t, "a", issues[0].Key)
+
+	// Once written again the key is no longer reported
+	require.NoError(t, store.Set("a", Value{Data: []byte("1")}))
+	issues = nil
+	_, err = store.Verify(func(issue ScrubIssue) { issues = append(issues, issue) })
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestScrubberRepairsLogStorage(t *testing.T) {
+	store, err := NewLogStorage(t.TempDir(), DefaultLogStorageOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("a", Value{Data: []byte("hello"), Revision: 3}))
+	require.NoError(t, store.Set("b", Value{Data: []byte("world"), Revision: 4}))
+	require.NoError(t, store.Set("gone", Value{Data: []byte("stale"), Revision: 5}))
+
+	for _, key := range []string{"a", "gone"} {
+		entry := store.keydir[key]
+		corruptByte(t, store.dataPath(entry.fileID), entry.offset, int64(entry.size))
+	}
+	_, err = store.Get("a")
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+
+	// A healthy replica has a copy of a only
+	healthy := map[string]Value{"a": {Data: []byte("hello"), Revision: 3}}
+	var reports []ScrubReport
+	scrubber := NewScrubber(store, ScrubOptions{
+		Repair: func(key string) error {
+			value, ok := healthy[key]
+			if !ok {
+				return ErrKeyNotFound
+			}
+			return store.Set(key, value)
+		},
+		OnReport: func(report ScrubReport) { reports = append(reports, report) },
+	})
+
+	_, ok := scrubber.LastReport()
+	assert.False(t, ok)
+
+	report := scrubber.Run()
+	assert.Empty(t, report.Error)
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 1, report.Repaired)
+	require.Len(t, report.Issues, 2)
+	assert.Equal(t, "a", report.Issues[0].Key)
+	assert.True(t, report.Issues[0].Repaired)
+	assert.Len(t, reports, 1)
+
+	val, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), val.Data)
+	assert.Equal(t, uint64(3), val.Revision)
+
+	// A key without a healthy copy is left for the operator, not deleted
+	assert.Equal(t, "gone", report.Issues[1].Key)
+	assert.False(t, report.Issues[1].Repaired)
+	assert.NotEmpty(t, report.Issues[1].RepairError)
+	assert.True(t, store.Has("gone"))
+
+	report = scrubber.Run()
+	require.Len(t, report.Issues, 1)
+	last, ok := scrubber.LastReport()
+	require.True(t, ok)
+	assert.Equal(t, 3, last.Checked)
+}
+
+func TestScrubberReportsWithoutRepair(t *testing.T) {
+	store, err := NewLogStorage(t.TempDir(), DefaultLogStorageOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("a", Value{Data: []byte("hello")}))
+	entry := store.keydir["a"]
+	corruptByte(t, store.dataPath(entry.fileID), entry.offset, int64(entry.size))
+
+	report := NewScrubber(store, ScrubOptions{}).Run()
+	require.Len(t, report.Issues, 1)
+	assert.False(t, report.Issues[0].Repaired)
+	assert.Equal(t, 0, report.Repaired)
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"sync/atomic"
+)
+
+// DefaultShardCount is the number of shards used when none is given
+const DefaultShardCount = 32
+
+// ShardedMemoryStorage implements the Storage interface with a number of
+// independently locked MemoryStorage shards, so that concurrent clients
+// working on different keys do not contend on a single lock
+type ShardedMemoryStorage struct {
+	shards []*MemoryStorage
+	mask   uint32
+	next   uint32 // Shard the next sampling round starts at
+}
+
+// NewShardedMemoryStorage creates a sharded in-memory storage. The shard
+// count is rounded up to a power of two.
+func NewShardedMemoryStorage(shards int) *ShardedMemoryStorage {
+	return NewShardedMemoryStorageWithOptions(shards, MemoryStorageOptions{})
+}
+
+// NewShardedMemoryStorageWithOptions creates a sharded in-memory storage.
+// The memory budget is split evenly between the shards and each shard
+// evicts on its own, which approximates the eviction order of a single
+// MemoryStorage.
+func NewShardedMemoryStorageWithOptions(shards int, opts MemoryStorageOptions) *ShardedMemoryStorage {
+	if shards <= 0 {
+		shards = DefaultShardCount
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	shardOpts := opts
+	if opts.MaxMemory > 0 {
+		shardOpts.MaxMemory = opts.MaxMemory / int64(n)
+		if shardOpts.MaxMemory == 0 {
+			shardOpts.MaxMemory = 1
+		}
+	}
+
+	s := &ShardedMemoryStorage{
+		shards: make([]*MemoryStorage, n),
+		mask:   uint32(n - 1),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewMemoryStorageWithOptions(shardOpts)
+	}
+	return s
+}
+
+// shardIndex returns the shard a key belongs to. FNV-1a is used rather than
+// a seeded hash so that every replica places keys in the same shard.
+func (s *ShardedMemoryStorage) shardIndex(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h & s.mask
+}
+
+// shard returns the shard a key belongs to
+func (s *ShardedMemoryStorage) shard(key string) *MemoryStorage {
+	return s.shards[s.shardIndex(key)]
+}
+
+// SetClock sets the clock expirations are checked against
+func (s *ShardedMemoryStorage) SetClock(clock Clock) {
+	for _, shard := range s.shards {
+		shard.SetClock(clock)
+	}
+}
+
+// Get retrieves a value for the given key
+func (s *ShardedMemoryStorage) Get(key string) (Value, error) {
+	return s.shard(key).Get(key)
+}
+
+// Set stores a value for the given key
+func (s *ShardedMemoryStorage) Set(key string, value Value) error {
+	return s.shard(key).Set(key, value)
+}
+
+// Delete removes a key from the storage
+func (s *ShardedMemoryStorage) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+// Has checks if a key exists in the storage
+func (s *ShardedMemoryStorage) Has(key string) bool {
+	return s.shard(key).Has(key)
+}
+
+// Keys returns all keys in the storage
+func (s *ShardedMemoryStorage) Keys() []string {
+	var keys []string
+	for _, shard := range s.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	return keys
+}
+
+// Iterate calls fn for each live key with prefix after startAfter in
+// ascending order
+func (s *ShardedMemoryStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	var keys []string
+	for _, shard := range s.shards {
+		keys = append(keys, shard.matchingKeys(prefix, startAfter)...)
+	}
+	return iterateSorted(keys, s.Get, fn)
+}
+
+// Clear removes all keys from the storage
+func (s *ShardedMemoryStorage) Clear() error {
+	for _, shard := range s.shards {
+		if err := shard.Clear(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the storage
+func (s *ShardedMemoryStorage) Close() error {
+	s.Clear()
+	return nil
+}
+
+// DueKeys pops up to limit keys whose expiration is before now off the
+// shards' TTL indexes and returns them
+func (s *ShardedMemoryStorage) DueKeys(now int64, limit int) []string {
+	var due []string
+	for _, shard := range s.shards {
+		if len(due) >= limit {
+			break
+		}
+		due = append(due, shard.DueKeys(now, limit-len(due))...)
+	}
+	return due
+}
+
+// Requeue puts keys popped by DueKeys back on their shards' TTL indexes
+func (s *ShardedMemoryStorage) Requeue(keys []string) {
+	for _, key := range keys {
+		s.shard(key).Requeue([]string{key})
+	}
+}
+
+// SampleKeys checks up to n keys with an expiration and returns the expired
+// ones. Each call starts at the next shard, so that all shards get sampled.
+func (s *ShardedMemoryStorage) SampleKeys(now int64, n int) (int, []string) {
+	start := atomic.AddUint32(&s.next, 1)
+	sampled := 0
+	var expired []string
+	for i := 0; i < len(s.shards) && sampled < n; i++ {
+		shard := s.shards[(start+uint32(i))&s.mask]
+		count, keys := shard.SampleKeys(now, n-sampled)
+		sampled += count
+		expired = append(expired, keys...)
+	}
+	return sampled, expired
+}
+
+// UsedMemory returns the number of bytes accounted for the stored entries
+func (s *ShardedMemoryStorage) UsedMemory() int64 {
+	var used int64
+	for _, shard := range s.shards {
+		used += shard.UsedMemory()
+	}
+	return used
+}
+
+// EvictionRanks returns the eviction rank of every key
+func (s *ShardedMemoryStorage) EvictionRanks() map[string]EvictionRank {
+	var ranks map[string]EvictionRank
+	for _, shard := range s.shards {
+		for key, rank := range shard.EvictionRanks() {
+			if ranks == nil {
+				ranks = make(map[string]EvictionRank)
+			}
+			ranks[key] = rank
+		}
+	}
+	return ranks
+}
+
+// SetEvictable sets which keys may be evicted from every shard
+func (s *ShardedMemoryStorage) SetEvictable(fn func(key string) bool) {
+	for _, shard := range s.shards {
+		shard.SetEvictable(fn)
+	}
+}
+
+// SetEvictionHandler sets a function called with every key a write to any
+// shard evicts
+func (s *ShardedMemoryStorage) SetEvictionHandler(fn func(key string, value Value)) {
+	for _, shard := range s.shards {
+		shard.SetEvictionHandler(fn)
+	}
+}
+
+// SetEvictionRanks replaces the eviction ranks of the given keys
+func (s *ShardedMemoryStorage) SetEvictionRanks(ranks map[string]EvictionRank) {
+	perShard := make([]map[string]EvictionRank, len(s.shards))
+	for key, rank := range ranks {
+		i := s.shardIndex(key)
+		if perShard[i] == nil {
+			perShard[i] = make(map[string]EvictionRank)
+		}
+		perShard[i][key] = rank
+	}
+	for i, shard := range s.shards {
+		if perShard[i] != nil {
+			shard.SetEvictionRanks(perShard[i])
+		}
+	}
+}
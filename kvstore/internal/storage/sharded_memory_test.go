@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedMemoryStorage(t *testing.T) {
+	store := NewShardedMemoryStorage(5)
+	assert.Len(t, store.shards, 8)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(strconv.Itoa(i), Value{Data: []byte(strconv.Itoa(i))}))
+	}
+	require.NoError(t, store.Delete("7"))
+	past := time.Now().Add(-time.Second).UnixNano()
+	require.NoError(t, store.Set("expired", Value{Data: []byte("x"), Expiration: past}))
+
+	val, err := store.Get("42")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("42"), val.Data)
+	_, err = store.Get("7")
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = store.Get("expired")
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.Len(t, store.Keys(), 99)
+
+	expirer := NewExpirer(store, DefaultExpiryOptions(), reapLocally(t, store))
+	assert.Equal(t, 1, expirer.RunCycle(time.Now()))
+
+	require.NoError(t, store.Clear())
+	assert.Empty(t, store.Keys())
+}
+
+func TestShardedMemoryStorageEvictionRanks(t *testing.T) {
+	opts := MemoryStorageOptions{MaxMemory: budgetFor(64, 2, 1), EvictionPolicy: AllKeysLRU}
+	a := NewShardedMemoryStorageWithOptions(4, opts)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, a.Set(strconv.Itoa(i%97), Value{Data: []byte("x")}))
+	}
+	assert.LessOrEqual(t, a.UsedMemory(), opts.MaxMemory)
+
+	b := NewShardedMemoryStorageWithOptions(4, opts)
+	for _, key := range a.Keys() {
+		require.NoError(t, b.Set(key, Value{Data: []byte("x")}))
+	}
+	b.SetEvictionRanks(a.EvictionRanks())
+	assert.Equal(t, a.EvictionRanks(), b.EvictionRanks())
+}
+
+// benchmarkParallel runs a read-heavy mix of 90% gets and 10% sets from
+// concurrent goroutines against store
+func benchmarkParallel(b *testing.B, store Storage) {
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		store.Set(strconv.Itoa(i), Value{Data: []byte("value")})
+	}
+
+	var seed uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint64(&seed, 7919)
+		for pb.Next() {
+			i++
+			key := strconv.Itoa(int(i % keys))
+			if i%10 == 0 {
+				store.Set(key, Value{Data: []byte("value")})
+			} else {
+				store.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryStorageParallel(b *testing.B) {
+	benchmarkParallel(b, NewMemoryStorage())
+}
+
+func BenchmarkShardedMemoryStorageParallel(b *testing.B) {
+	benchmarkParallel(b, NewShardedMemoryStorage(DefaultShardCount))
+}
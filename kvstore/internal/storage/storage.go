@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"container/heap"
 	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,12 +15,65 @@ var (
 	
 	// ErrKeyExpired is returned when a key has expired
 	ErrKeyExpired = errors.New("key expired")
+	
+	// ErrStorageClosed is returned when a storage is used after Close
+	ErrStorageClosed = errors.New("storage closed")
+	
+	// ErrOutOfMemory is returned when a write does not fit the memory budget
+	ErrOutOfMemory = errors.New("memory limit reached")
+	
+	// ErrWrongType is returned when an operation is used on a key holding
+	// a value of another type
+	ErrWrongType = errors.New("WRONGTYPE operation against a key holding the wrong kind of value")
 )
 
-// Value represents a value stored in the key-value store
+// Types of the data structures a value can hold. Plain values have no type.
+const (
+	TypeList = "list"
+	TypeHash = "hash"
+	TypeSet  = "set"
+	TypeZSet = "zset"
+
+	// TypeChunked values list the chunks a large value is stored in
+	TypeChunked = "chunked"
+)
+
+// Value represents a value stored in the key-value store. Fields added
+// after the first release are omitted from JSON when empty, so records
+// encoded before they existed decode and checksum the same.
 type Value struct {
 	Data        []byte
-	Expiration  int64 // Unix timestamp in nanoseconds, 0 means no expiration
+	Expiration  int64             // Unix timestamp in nanoseconds, 0 means no expiration
+	Revision    uint64            `json:",omitempty"` // Raft log index of the write that stored the value, 0 if unknown
+	Encoding    string            `json:",omitempty"` // Codec Data is compressed with, empty if stored as is
+	KeyID       uint32            `json:",omitempty"` // Keyring key Data is encrypted with, 0 if stored in plaintext
+	ContentType string            `json:",omitempty"` // Media type given by the writer, empty if none
+	Created     int64             `json:",omitempty"` // Unix nanoseconds the key was created at, 0 if unknown
+	Modified    int64             `json:",omitempty"` // Unix nanoseconds the value was written at, 0 if unknown
+	Meta        map[string]string `json:",omitempty"` // User metadata by lower-case name
+	Type        string            `json:",omitempty"` // Data structure Data encodes, empty for plain bytes
+}
+
+// Expired reports whether the value has expired at now
+func (v Value) Expired(now int64) bool {
+	return v.Expiration > 0 && v.Expiration < now
+}
+
+// Clock returns the current time in Unix nanoseconds. Backends check
+// expirations against it, which lets a replicated state machine substitute
+// a clock that advances identically on every replica.
+type Clock func() int64
+
+// SystemClock reads the local wall clock
+func SystemClock() int64 {
+	return time.Now().UnixNano()
+}
+
+// ClockSetter is implemented by backends whose expiration checks can be
+// driven by an external clock
+type ClockSetter interface {
+	// SetClock sets the clock expirations are checked against
+	SetClock(clock Clock)
 }
 
 // Storage defines the interface for storage backends
@@ -37,6 +93,11 @@ type Storage interface {
 	// Keys returns all keys in the storage
 	Keys() []string
 	
+	// Iterate calls fn for each live key that starts with prefix and sorts
+	// after startAfter, in ascending key order, stopping early when fn
+	// returns false. Empty prefix and startAfter place no restriction.
+	Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error
+	
 	// Clear removes all keys from the storage
 	Clear() error
 	
@@ -44,20 +105,70 @@ type Storage interface {
 	Close() error
 }
 
+// OrderedStorage is implemented by backends that keep keys sorted and can
+// serve range scans without listing every key
+type OrderedStorage interface {
+	Storage
+	
+	// Scan calls fn for each live key in [start, end) in ascending order,
+	// stopping early when fn returns false. An empty end means no upper bound.
+	Scan(start, end string, fn func(key string, value Value) bool) error
+}
+
+// MemoryStorageOptions configures a MemoryStorage
+type MemoryStorageOptions struct {
+	MaxMemory      int64           // Byte budget for keys and values, 0 means unlimited
+	EvictionPolicy EvictionPolicy  // What to do when a write would exceed MaxMemory
+	OnEvict        func(count int) // Called with the number of keys a write evicted
+}
+
 // MemoryStorage implements the Storage interface using in-memory map
 type MemoryStorage struct {
-	data  map[string]Value
-	mutex sync.RWMutex
+	data      map[string]Value
+	ttl       ttlIndex            // Keys with an expiration, soonest first
+	volatile  map[string]struct{} // Keys with an expiration, for sampling
+	now       Clock
+	opts      MemoryStorageOptions
+	used      int64                         // Bytes accounted for the stored entries
+	seq       int64                         // Number of writes, orders the eviction index
+	evict     *evictionIndex                // Eviction order, nil without a budget
+	evictable func(key string) bool         // Keys that may be evicted, all if nil
+	onEvicted func(key string, value Value) // Called with every evicted key
+	mutex     sync.RWMutex
 }
 
 // NewMemoryStorage creates a new in-memory storage
 func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		data: make(map[string]Value),
+	return NewMemoryStorageWithOptions(MemoryStorageOptions{})
+}
+
+// NewMemoryStorageWithOptions creates a new in-memory storage. With a
+// memory budget, writes that would exceed it evict keys according to the
+// eviction policy. Eviction only depends on the sequence of writes, never
+// on reads, so replicas applying the same log evict the same keys.
+func NewMemoryStorageWithOptions(opts MemoryStorageOptions) *MemoryStorage {
+	m := &MemoryStorage{
+		data:     make(map[string]Value),
+		volatile: make(map[string]struct{}),
+		now:      SystemClock,
+		opts:     opts,
 	}
+	if opts.MaxMemory > 0 && opts.EvictionPolicy != NoEviction {
+		m.evict = newEvictionIndex(opts.EvictionPolicy, nil)
+	}
+	return m
+}
+
+// SetClock sets the clock expirations are checked against
+func (m *MemoryStorage) SetClock(clock Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	m.now = clock
 }
 
-// Get retrieves a value for the given key
+// Get retrieves a value for the given key. Expired keys are left in place
+// for the expirer, so that reads never change what is stored.
 func (m *MemoryStorage) Get(key string) (Value, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -68,11 +179,7 @@ func (m *MemoryStorage) Get(key string) (Value, error) {
 	}
 	
 	// Check for expiration
-	if val.Expiration > 0 && val.Expiration < time.Now().UnixNano() {
-		// Key has expired, delete it
-		m.mutex.RUnlock()
-		m.Delete(key)
-		m.mutex.RLock()
+	if val.Expired(m.now()) {
 		return Value{}, ErrKeyExpired
 	}
 	
@@ -84,16 +191,95 @@ func (m *MemoryStorage) Set(key string, value Value) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	
+	if err := m.reserve(key, value); err != nil {
+		return err
+	}
+	
 	m.data[key] = value
+	if value.Expiration > 0 {
+		m.volatile[key] = struct{}{}
+		m.ttl.push(key, value.Expiration)
+		m.compactTTL()
+	} else {
+		delete(m.volatile, key)
+	}
+	
+	m.seq++
+	if m.evict != nil {
+		m.evict.touch(key, value, m.seq)
+	}
+	return nil
+}
+
+// reserve accounts for storing value under key, evicting other keys if the
+// memory budget requires it. Must be called with the write lock held.
+func (m *MemoryStorage) reserve(key string, value Value) error {
+	var old int64
+	if prev, ok := m.data[key]; ok {
+		old = entrySize(key, prev)
+	}
+	size := entrySize(key, value)
+	
+	if m.opts.MaxMemory <= 0 || size <= old || m.used-old+size <= m.opts.MaxMemory {
+		m.used += size - old
+		return nil
+	}
+	if m.evict == nil || size > m.opts.MaxMemory {
+		return ErrOutOfMemory
+	}
+	
+	// The key being written is not a candidate, its old entry is replaced
+	// anyway. It goes back into the index with its rank afterwards.
+	self, tracked := m.evict.byKey[key]
+	if tracked {
+		m.evict.remove(key)
+		defer m.evict.add(self)
+	}
+	
+	evicted := 0
+	defer func() { m.notifyEvicted(evicted) }()
+	for m.used-old+size > m.opts.MaxMemory {
+		victim, ok := m.evict.victim()
+		if !ok {
+			return ErrOutOfMemory
+		}
+		if m.onEvicted != nil {
+			m.onEvicted(victim, m.data[victim])
+		}
+		m.remove(victim)
+		evicted++
+	}
+	
+	m.used += size - old
 	return nil
 }
 
+// remove deletes key and its accounting. Must be called with the write
+// lock held.
+func (m *MemoryStorage) remove(key string) {
+	if val, ok := m.data[key]; ok {
+		m.used -= entrySize(key, val)
+	}
+	delete(m.data, key)
+	delete(m.volatile, key)
+	if m.evict != nil {
+		m.evict.remove(key)
+	}
+}
+
+// notifyEvicted reports evicted keys to the OnEvict callback
+func (m *MemoryStorage) notifyEvicted(count int) {
+	if count > 0 && m.opts.OnEvict != nil {
+		m.opts.OnEvict(count)
+	}
+}
+
 // Delete removes a key from the storage
 func (m *MemoryStorage) Delete(key string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	
-	delete(m.data, key)
+	m.remove(key)
 	return nil
 }
 
@@ -108,11 +294,7 @@ func (m *MemoryStorage) Has(key string) bool {
 	}
 	
 	// Check for expiration
-	if val.Expiration > 0 && val.Expiration < time.Now().UnixNano() {
-		return false
-	}
-	
-	return true
+	return !val.Expired(m.now())
 }
 
 // Keys returns all keys in the storage
@@ -121,11 +303,11 @@ func (m *MemoryStorage) Keys() []string {
 	defer m.mutex.RUnlock()
 	
 	keys := make([]string, 0, len(m.data))
-	now := time.Now().UnixNano()
+	now := m.now()
 	
 	for k, v := range m.data {
 		// Skip expired keys
-		if v.Expiration > 0 && v.Expiration < now {
+		if v.Expired(now) {
 			continue
 		}
 		keys = append(keys, k)
@@ -134,17 +316,206 @@ func (m *MemoryStorage) Keys() []string {
 	return keys
 }
 
+// Iterate calls fn for each live key with prefix after startAfter in
+// ascending order. Only the matching keys are collected and sorted, values
+// are read as the iteration reaches them.
+func (m *MemoryStorage) Iterate(prefix, startAfter string, fn func(key string, value Value) bool) error {
+	return iterateSorted(m.matchingKeys(prefix, startAfter), m.Get, fn)
+}
+
+// matchingKeys returns the unsorted live keys with prefix after startAfter
+func (m *MemoryStorage) matchingKeys(prefix, startAfter string) []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	
+	var keys []string
+	now := m.now()
+	for k, v := range m.data {
+		if keyInRange(k, prefix, startAfter) && !v.Expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// keyInRange reports whether key has prefix and sorts after startAfter
+func keyInRange(key, prefix, startAfter string) bool {
+	return strings.HasPrefix(key, prefix) && (startAfter == "" || key > startAfter)
+}
+
+// iterateSorted sorts keys and calls fn with each of them and its value as
+// returned by get. Keys removed since they were collected are skipped.
+func iterateSorted(keys []string, get func(key string) (Value, error), fn func(key string, value Value) bool) error {
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := get(key)
+		if err == ErrKeyNotFound || err == ErrKeyExpired {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // Clear removes all keys from the storage
 func (m *MemoryStorage) Clear() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	
 	m.data = make(map[string]Value)
+	m.volatile = make(map[string]struct{})
+	m.ttl = nil
+	m.used = 0
+	m.seq = 0
+	if m.evict != nil {
+		m.evict = newEvictionIndex(m.opts.EvictionPolicy, m.evictable)
+	}
 	return nil
 }
 
+// UsedMemory returns the number of bytes accounted for the stored entries
+func (m *MemoryStorage) UsedMemory() int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	
+	return m.used
+}
+
+// EvictionRanks returns the eviction rank of every key
+func (m *MemoryStorage) EvictionRanks() map[string]EvictionRank {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	
+	if m.evict == nil {
+		return nil
+	}
+	return m.evict.ranks()
+}
+
+// SetEvictionRanks replaces the eviction ranks of the given keys, used when
+// restoring a snapshot
+func (m *MemoryStorage) SetEvictionRanks(ranks map[string]EvictionRank) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	for _, rank := range ranks {
+		if rank.Seq > m.seq {
+			m.seq = rank.Seq
+		}
+	}
+	if m.evict != nil {
+		m.evict.setRanks(ranks)
+	}
+}
+
+// SetEvictable sets which keys may be evicted, all of them if fn is nil.
+// Keys already stored that fn rejects stop being candidates.
+func (m *MemoryStorage) SetEvictable(fn func(key string) bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	m.evictable = fn
+	if m.evict == nil {
+		return
+	}
+	m.evict.evictable = fn
+	for key := range m.evict.byKey {
+		if fn != nil && !fn(key) {
+			m.evict.remove(key)
+		}
+	}
+}
+
+// SetEvictionHandler sets a function called with every key a write evicts
+// and the value it held
+func (m *MemoryStorage) SetEvictionHandler(fn func(key string, value Value)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	m.onEvicted = fn
+}
+
+// DueKeys pops up to limit keys whose expiration is before now off the
+// TTL index and returns them. The keys themselves are left in place.
+func (m *MemoryStorage) DueKeys(now int64, limit int) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	var due []string
+	for len(due) < limit {
+		item, ok := m.ttl.popDue(now)
+		if !ok {
+			break
+		}
+		
+		// Skip index entries left behind by overwrites and deletes
+		val, ok := m.data[item.key]
+		if !ok || val.Expiration != item.expiration {
+			continue
+		}
+		due = append(due, item.key)
+	}
+	
+	return due
+}
+
+// Requeue puts keys popped by DueKeys back on the TTL index. Keys deleted
+// or made persistent since are left out.
+func (m *MemoryStorage) Requeue(keys []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	for _, key := range keys {
+		if val, ok := m.data[key]; ok && val.Expiration > 0 {
+			m.ttl.push(key, val.Expiration)
+		}
+	}
+}
+
+// SampleKeys checks up to n keys with an expiration and returns how many
+// were checked and which of them are expired. Map iteration order provides
+// the random choice.
+func (m *MemoryStorage) SampleKeys(now int64, n int) (int, []string) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	
+	sampled := 0
+	var expired []string
+	for key := range m.volatile {
+		if sampled >= n {
+			break
+		}
+		sampled++
+		
+		if m.data[key].Expired(now) {
+			expired = append(expired, key)
+		}
+	}
+	
+	return sampled, expired
+}
+
+// compactTTL rebuilds the TTL index once stale entries dominate it. Must be
+// called with the write lock held.
+func (m *MemoryStorage) compactTTL() {
+	if len(m.ttl) <= 2*len(m.volatile)+1024 {
+		return
+	}
+	
+	m.ttl = m.ttl[:0]
+	for key := range m.volatile {
+		m.ttl = append(m.ttl, ttlItem{key: key, expiration: m.data[key].Expiration})
+	}
+	heap.Init(&m.ttl)
+}
+
 // Close closes the storage
 func (m *MemoryStorage) Close() error {
 	m.Clear()
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// recordFlagMeta marks log records and table entries whose value section
+// starts with encoded value metadata. Records written before metadata
+// existed do not carry the flag and decode with zero metadata.
+const recordFlagMeta byte = 2
+
+// hasValueMeta reports whether value carries metadata besides its data and
+// expiration
+func hasValueMeta(value Value) bool {
+	return value.Revision != 0 || value.Encoding != "" || value.KeyID != 0 ||
+		value.ContentType != "" || value.Created != 0 || value.Modified != 0 || len(value.Meta) > 0 || value.Type != ""
+}
+
+// metadataSize returns the bytes taken by the content type and user
+// metadata of value
+func metadataSize(value Value) int64 {
+	size := len(value.ContentType)
+	for name, v := range value.Meta {
+		size += len(name) + len(v)
+	}
+	return int64(size)
+}
+
+// appendString appends a length-prefixed string
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readString reads a string written by appendString and returns the rest
+// of buf
+func readString(buf []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return "", nil, ErrCorruptRecord
+	}
+	return string(buf[n : n+int(l)]), buf[n+int(l):], nil
+}
+
+// appendValueMeta appends the length-prefixed metadata of value. Fields are
+// written in a fixed order and new ones are only ever added at the end, so
+// older metadata decodes with the missing fields left zero.
+func appendValueMeta(dst []byte, value Value) []byte {
+	meta := appendUvarint(nil, value.Revision)
+	meta = appendString(meta, value.Encoding)
+	meta = appendUvarint(meta, uint64(value.KeyID))
+	meta = appendString(meta, value.ContentType)
+	meta = appendUvarint(meta, uint64(value.Created))
+	meta = appendUvarint(meta, uint64(value.Modified))
+
+	// User metadata is written in name order so equal values encode the same
+	names := make([]string, 0, len(value.Meta))
+	for name := range value.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	meta = appendUvarint(meta, uint64(len(names)))
+	for _, name := range names {
+		meta = appendString(meta, name)
+		meta = appendString(meta, value.Meta[name])
+	}
+	meta = appendString(meta, value.Type)
+	dst = appendUvarint(dst, uint64(len(meta)))
+	return append(dst, meta...)
+}
+
+// decodeValueMeta reads metadata written by appendValueMeta into value and
+// returns the number of bytes consumed
+func decodeValueMeta(buf []byte, value *Value) (int, error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return 0, ErrCorruptRecord
+	}
+	meta := buf[n : n+int(l)]
+
+	if len(meta) > 0 {
+		revision, m := binary.Uvarint(meta)
+		if m <= 0 {
+			return 0, ErrCorruptRecord
+		}
+		value.Revision = revision
+		meta = meta[m:]
+	}
+
+	if len(meta) > 0 {
+		encoding, rest, err := readString(meta)
+		if err != nil {
+			return 0, err
+		}
+		value.Encoding = encoding
+		meta = rest
+	}
+
+	if len(meta) > 0 {
+		id, m := binary.Uvarint(meta)
+		if m <= 0 || id > math.MaxUint32 {
+			return 0, ErrCorruptRecord
+		}
+		value.KeyID = uint32(id)
+		meta = meta[m:]
+	}
+
+	if len(meta) > 0 {
+		contentType, rest, err := readString(meta)
+		if err != nil {
+			return 0, err
+		}
+		value.ContentType = contentType
+		meta = rest
+	}
+
+	for _, field := range []*int64{&value.Created, &value.Modified} {
+		if len(meta) == 0 {
+			break
+		}
+		t, m := binary.Uvarint(meta)
+		if m <= 0 || t > math.MaxInt64 {
+			return 0, ErrCorruptRecord
+		}
+		*field = int64(t)
+		meta = meta[m:]
+	}
+
+	if len(meta) > 0 {
+		count, m := binary.Uvarint(meta)
+		if m <= 0 || count > uint64(len(meta)) {
+			return 0, ErrCorruptRecord
+		}
+		meta = meta[m:]
+		if count > 0 {
+			value.Meta = make(map[string]string, count)
+		}
+		for i := uint64(0); i < count; i++ {
+			name, rest, err := readString(meta)
+			if err != nil {
+				return 0, err
+			}
+			v, rest, err := readString(rest)
+			if err != nil {
+				return 0, err
+			}
+			value.Meta[name] = v
+			meta = rest
+		}
+	}
+
+	if len(meta) > 0 {
+		typ, _, err := readString(meta)
+		if err != nil {
+			return 0, err
+		}
+		value.Type = typ
+	}
+
+	return n + int(l), nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueMetaPersists(t *testing.T) {
+	open := map[string]func(dir string) (Storage, error){
+		"disk": func(dir string) (Storage, error) { return NewDiskStorage(dir) },
+		"log":  func(dir string) (Storage, error) { return NewLogStorage(dir, DefaultLogStorageOptions()) },
+		"lsm":  func(dir string) (Storage, error) { return NewLSMStorage(dir, testLSMOptions()) },
+	}
+
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := openStore(dir)
+			require.NoError(t, err)
+			require.NoError(t, store.Set("with", Value{Data: []byte("1"), Revision: 42}))
+			require.NoError(t, store.Set("without", Value{Data: []byte("2")}))
+			require.NoError(t, store.Set("encoded", Value{Data: []byte("3"), Encoding: "flate"}))
+			require.NoError(t, store.Set("encrypted", Value{Data: []byte("4"), Revision: 7, KeyID: 3}))
+			described := Value{Data: []byte("5"), Revision: 9, ContentType: "text/plain", Created: 100, Modified: 200,
+				Meta: map[string]string{"owner": "billing", "empty": ""}, Type: TypeList}
+			require.NoError(t, store.Set("described", described))
+			require.NoError(t, store.Close())
+
+			store, err = openStore(dir)
+			require.NoError(t, err)
+			defer store.Close()
+
+			val, err := store.Get("with")
+			require.NoError(t, err)
+			assert.Equal(t, Value{Data: []byte("1"), Revision: 42}, val)
+
+			val, err = store.Get("without")
+			require.NoError(t, err)
+			assert.Equal(t, Value{Data: []byte("2")}, val)
+
+			val, err = store.Get("encoded")
+			require.NoError(t, err)
+			assert.Equal(t, Value{Data: []byte("3"), Encoding: "flate"}, val)
+
+			val, err = store.Get("encrypted")
+			require.NoError(t, err)
+			assert.Equal(t, Value{Data: []byte("4"), Revision: 7, KeyID: 3}, val)
+
+			val, err = store.Get("described")
+			require.NoError(t, err)
+			assert.Equal(t, described, val)
+		})
+	}
+}
+
+func TestDecodeValueMetaCorrupt(t *testing.T) {
+	var value Value
+	_, err := decodeValueMeta([]byte{5, 1}, &value)
+	assert.Equal(t, ErrCorruptRecord, err)
+}